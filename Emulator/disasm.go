@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"riscv/disasm"
+)
+
+// kutemu disasm [-start addr] [-spike] file
+//
+// Prints a listing in the layout of objdump -d, ELF files are detected by their magic
+// and everything else is a flat image loaded at -start.
+func disasmMain(args []string) int {
+	flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+	start := flags.Uint64("start", 0x80000000, "Address a flat image is loaded at")
+	spike := flags.Bool("spike", false, "Use spike syntax instead of objdump syntax")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s disasm [flags] file\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+	body, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "disasm: %s\n", err)
+		return 1
+	}
+
+	d := &disasm.Disassembler{}
+	if *spike {
+		d.Syntax = disasm.SYNTAX_SPIKE
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	if !bytes.HasPrefix(body, []byte(elf.ELFMAG)) {
+		fmt.Fprintf(w, "\n%s:     file format binary\n\n\n", filepath.Base(path))
+		fmt.Fprintf(w, "Disassembly of section .data:\n\n")
+		d.Symbols = []disasm.Symbol{{Addr: uint32(*start), Name: ".data"}}
+		listing(w, d, body, uint32(*start))
+		return 0
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "disasm: %s\n", err)
+		return 1
+	}
+	if f.Class != elf.ELFCLASS32 || f.Machine != elf.EM_RISCV {
+		fmt.Fprintf(os.Stderr, "disasm: %s is not a 32 bit RISC-V ELF\n", path)
+		return 1
+	}
+	d.Symbols = disasm.ELFSymbols(f)
+	fmt.Fprintf(w, "\n%s:     file format elf32-littleriscv\n\n", filepath.Base(path))
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_EXECINSTR == 0 || s.Type != elf.SHT_PROGBITS {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "disasm: %s: %s\n", s.Name, err)
+			return 1
+		}
+		fmt.Fprintf(w, "\nDisassembly of section %s:\n\n", s.Name)
+		listing(w, d, data, uint32(s.Addr))
+	}
+	return 0
+}
+
+// One line per instruction, with a label line wherever a symbol starts
+func listing(w io.Writer, d *disasm.Disassembler, data []byte, addr uint32) {
+	labels := make(map[uint32]string)
+	for _, s := range d.Symbols {
+		if _, ok := labels[s.Addr]; !ok {
+			labels[s.Addr] = s.Name
+		}
+	}
+	for off := 0; off+4 <= len(data); off += 4 {
+		pc := addr + uint32(off)
+		if name, ok := labels[pc]; ok {
+			if off != 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%08x <%s>:\n", pc, name)
+		}
+		word := binary.LittleEndian.Uint32(data[off:])
+		fmt.Fprintf(w, "%8x:\t%08x          \t%s\n", pc, word, d.Word(word, pc))
+	}
+}
@@ -0,0 +1,328 @@
+// Package disasm turns RV32IMA instructions back into assembly.
+// Pseudo instructions are used where GNU objdump uses them, so listings can be diffed against it.
+package disasm
+
+import (
+	"fmt"
+	"riscv/instructions"
+	"sort"
+	"strings"
+)
+
+type Syntax int
+
+const (
+	// GNU objdump: "addi\ta0,a0,1", jump targets as absolute addresses
+	SYNTAX_OBJDUMP Syntax = iota
+	// Spike: "addi    a0, a0, 1", jump targets relative to pc
+	SYNTAX_SPIKE
+)
+
+const UNIMP = 0xc0001073
+
+type Symbol struct {
+	Addr uint32
+	Name string
+}
+
+// Disassembler formats instructions, the zero value uses objdump syntax without symbols
+type Disassembler struct {
+	Syntax Syntax
+	// Sorted by address, used to name jump and branch targets
+	Symbols []Symbol
+}
+
+// Decode is instructions.DecodeBytes returning an error instead of panicking on unknown instructions
+func Decode(word uint32) (inst instructions.Inst, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			inst = nil
+			err = fmt.Errorf("unknown instruction 0x%08x", word)
+		}
+	}()
+	inst = instructions.DecodeBytes([4]byte{byte(word), byte(word >> 8), byte(word >> 16), byte(word >> 24)})
+	// Operation panics on encodings the decoder accepts but the cpu does not implement
+	_ = inst.Operation()
+	return inst, nil
+}
+
+// Word decodes and disassembles the instruction at pc
+func (d *Disassembler) Word(word uint32, pc uint32) string {
+	if word == UNIMP {
+		return "unimp"
+	}
+	inst, err := Decode(word)
+	if err != nil {
+		return d.format(".insn", fmt.Sprintf("4, 0x%08x", word))
+	}
+	return d.Inst(inst, pc)
+}
+
+// Inst disassembles an instruction at pc, it must have decoded successfully
+func (d *Disassembler) Inst(inst instructions.Inst, pc uint32) string {
+	switch i := inst.(type) {
+	case instructions.RI:
+		return d.r(i)
+	case instructions.II:
+		return d.i(i)
+	case instructions.SI:
+		return d.format(i.Operation(), reg(i.RS2), fmt.Sprintf("%d(%s)", signExtend(uint32(i.SIM), 12), reg(i.RS1)))
+	case instructions.BI:
+		return d.b(i, pc)
+	case instructions.JI:
+		target := d.target(pc, signExtend(i.JIM, 21))
+		switch i.RD {
+		case 0:
+			return d.format("j", target)
+		case 1:
+			return d.format("jal", target)
+		}
+		return d.format("jal", reg(i.RD), target)
+	case instructions.UI:
+		return d.format(i.Operation(), reg(i.RD), fmt.Sprintf("0x%x", i.UIM1))
+	case instructions.FI:
+		return d.fence(i)
+	}
+	return d.format("unknown")
+}
+
+func (d *Disassembler) r(i instructions.RI) string {
+	op := i.Operation()
+	if i.Opcode == instructions.OP_TOPLEVEL_ATOMIC_RI {
+		// Bit 1 of funct7 is aq, bit 0 is rl
+		if i.F7&0b10 != 0 {
+			op += ".aq"
+		}
+		if i.F7&0b01 != 0 {
+			if i.F7&0b10 != 0 {
+				op += "rl"
+			} else {
+				op += ".rl"
+			}
+		}
+		addr := "(" + reg(i.RS1) + ")"
+		if strings.HasPrefix(op, "lr.") {
+			return d.format(op, reg(i.RD), addr)
+		}
+		return d.format(op, reg(i.RD), reg(i.RS2), addr)
+	}
+	switch {
+	case op == "sub" && i.RS1 == 0:
+		return d.format("neg", reg(i.RD), reg(i.RS2))
+	case op == "sltu" && i.RS1 == 0:
+		return d.format("snez", reg(i.RD), reg(i.RS2))
+	case op == "slt" && i.RS2 == 0:
+		return d.format("sltz", reg(i.RD), reg(i.RS1))
+	case op == "slt" && i.RS1 == 0:
+		return d.format("sgtz", reg(i.RD), reg(i.RS2))
+	}
+	return d.format(op, reg(i.RD), reg(i.RS1), reg(i.RS2))
+}
+
+func (d *Disassembler) i(i instructions.II) string {
+	op := i.Operation()
+	imm := signExtend(uint32(i.IIM), 12)
+	switch i.Opcode {
+	case instructions.OP_TOPLEVEL_ARITH:
+		switch {
+		case op == "addi" && i.RD == 0 && i.RS1 == 0 && imm == 0:
+			return d.format("nop")
+		case op == "addi" && i.RS1 == 0:
+			return d.format("li", reg(i.RD), fmt.Sprint(imm))
+		case op == "addi" && imm == 0:
+			return d.format("mv", reg(i.RD), reg(i.RS1))
+		case op == "xori" && imm == -1:
+			return d.format("not", reg(i.RD), reg(i.RS1))
+		case op == "sltiu" && imm == 1:
+			return d.format("seqz", reg(i.RD), reg(i.RS1))
+		case op == "andi" && imm == 255:
+			return d.format("zext.b", reg(i.RD), reg(i.RS1))
+		case op == "slli" || op == "srli" || op == "srai":
+			return d.format(op, reg(i.RD), reg(i.RS1), d.shamt(i.IIM&0x1f))
+		}
+		return d.format(op, reg(i.RD), reg(i.RS1), fmt.Sprint(imm))
+	case instructions.OP_TOPLEVEL_LOAD:
+		return d.format(op, reg(i.RD), fmt.Sprintf("%d(%s)", imm, reg(i.RS1)))
+	case instructions.OP_TOPLEVEL_JUMP_2:
+		addr := fmt.Sprintf("%d(%s)", imm, reg(i.RS1))
+		switch {
+		case i.RD == 0 && i.RS1 == 1 && imm == 0:
+			return d.format("ret")
+		case i.RD == 0 && imm == 0:
+			return d.format("jr", reg(i.RS1))
+		case i.RD == 0:
+			return d.format("jr", addr)
+		case i.RD == 1 && imm == 0:
+			return d.format("jalr", reg(i.RS1))
+		case i.RD == 1:
+			return d.format("jalr", addr)
+		}
+		return d.format("jalr", reg(i.RD), addr)
+	}
+	return d.system(i, op)
+}
+
+func (d *Disassembler) system(i instructions.II, op string) string {
+	csr := uint32(i.IIM)
+	// Immediate variants keep a 5 bit immediate in rs1
+	uimm := fmt.Sprint(i.RS1)
+	switch op {
+	case "ecall", "ebreak", "mret", "sret", "wfi":
+		return d.format(op)
+	case "sfence.vma":
+		rs2 := byte(i.IIM & 0x1f)
+		switch {
+		case i.RS1 == 0 && rs2 == 0:
+			return d.format(op)
+		case rs2 == 0:
+			return d.format(op, reg(i.RS1))
+		}
+		return d.format(op, reg(i.RS1), reg(rs2))
+	case "csrrs":
+		if i.RS1 == 0 {
+			if name, ok := counters[csr]; ok {
+				return d.format(name, reg(i.RD))
+			}
+			return d.format("csrr", reg(i.RD), csrName(csr))
+		}
+		if i.RD == 0 {
+			return d.format("csrs", csrName(csr), reg(i.RS1))
+		}
+	case "csrrw", "csrrc":
+		if i.RD == 0 {
+			return d.format("csr"+op[4:], csrName(csr), reg(i.RS1))
+		}
+	case "csrrwi", "csrrsi", "csrrci":
+		if i.RD == 0 {
+			return d.format("csr"+op[4:], csrName(csr), uimm)
+		}
+		return d.format(op, reg(i.RD), csrName(csr), uimm)
+	}
+	return d.format(op, reg(i.RD), csrName(csr), reg(i.RS1))
+}
+
+// Counters read with csrrs rd, csr, zero
+var counters = map[uint32]string{
+	instructions.CYCLE:   "rdcycle",
+	instructions.TIME:    "rdtime",
+	instructions.INSTRET: "rdinstret",
+	instructions.CYCLEH:  "rdcycleh",
+	instructions.TIMEH:   "rdtimeh",
+	0xC82:                "rdinstreth",
+}
+
+func (d *Disassembler) b(i instructions.BI, pc uint32) string {
+	op := i.Operation()
+	target := d.target(pc, signExtend(uint32(i.BIM), 13))
+	switch {
+	case op == "beq" && i.RS2 == 0:
+		return d.format("beqz", reg(i.RS1), target)
+	case op == "bne" && i.RS2 == 0:
+		return d.format("bnez", reg(i.RS1), target)
+	case op == "blt" && i.RS2 == 0:
+		return d.format("bltz", reg(i.RS1), target)
+	case op == "bge" && i.RS2 == 0:
+		return d.format("bgez", reg(i.RS1), target)
+	case op == "blt" && i.RS1 == 0:
+		return d.format("bgtz", reg(i.RS2), target)
+	case op == "bge" && i.RS1 == 0:
+		return d.format("blez", reg(i.RS2), target)
+	}
+	return d.format(op, reg(i.RS1), reg(i.RS2), target)
+}
+
+func (d *Disassembler) fence(i instructions.FI) string {
+	op := i.Operation()
+	if op == "fence.i" {
+		return d.format(op)
+	}
+	// fm 8 with rw,rw is fence.tso
+	if i.FM == 0b1000 && i.Pred == 0b0011 && i.Succ == 0b0011 {
+		return d.format("fence.tso")
+	}
+	if i.Pred == 0xf && i.Succ == 0xf {
+		return d.format(op)
+	}
+	return d.format(op, fenceSet(i.Pred), fenceSet(i.Succ))
+}
+
+func fenceSet(bits byte) string {
+	s := ""
+	for n, c := range "iorw" {
+		if bits&(0b1000>>n) != 0 {
+			s += string(c)
+		}
+	}
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+func (d *Disassembler) shamt(v uint16) string {
+	if d.Syntax == SYNTAX_SPIKE {
+		return fmt.Sprint(v)
+	}
+	return fmt.Sprintf("0x%x", v)
+}
+
+// Jump and branch target, absolute with the enclosing symbol for objdump, relative for spike
+func (d *Disassembler) target(pc uint32, offset int32) string {
+	if d.Syntax == SYNTAX_SPIKE {
+		if offset < 0 {
+			return fmt.Sprintf("pc - %d", -offset)
+		}
+		return fmt.Sprintf("pc + %d", offset)
+	}
+	addr := pc + uint32(offset)
+	if name := d.Symbolize(addr); name != "" {
+		return fmt.Sprintf("%x <%s>", addr, name)
+	}
+	return fmt.Sprintf("%x", addr)
+}
+
+// Lookup returns the closest symbol at or below addr
+func (d *Disassembler) Lookup(addr uint32) (Symbol, bool) {
+	n := sort.Search(len(d.Symbols), func(i int) bool { return d.Symbols[i].Addr > addr })
+	if n == 0 {
+		return Symbol{}, false
+	}
+	return d.Symbols[n-1], true
+}
+
+// Symbolize names addr as symbol or symbol+0xoffset, using the closest symbol at or below it
+func (d *Disassembler) Symbolize(addr uint32) string {
+	s, ok := d.Lookup(addr)
+	if !ok {
+		return ""
+	}
+	if s.Addr == addr {
+		return s.Name
+	}
+	return fmt.Sprintf("%s+0x%x", s.Name, addr-s.Addr)
+}
+
+func (d *Disassembler) format(op string, args ...string) string {
+	if len(args) == 0 {
+		return op
+	}
+	if d.Syntax == SYNTAX_SPIKE {
+		return fmt.Sprintf("%-7s %s", op, strings.Join(args, ", "))
+	}
+	return op + "\t" + strings.Join(args, ",")
+}
+
+func reg(r byte) string {
+	return instructions.RegisterNames[r]
+}
+
+func csrName(csr uint32) string {
+	if name, ok := instructions.CSRNames[csr]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", csr)
+}
+
+func signExtend(v uint32, bits int) int32 {
+	return int32(v<<(32-bits)) >> (32 - bits)
+}
@@ -0,0 +1,56 @@
+package disasm
+
+import "testing"
+
+func TestObjdump(t *testing.T) {
+	d := &Disassembler{Symbols: []Symbol{{Addr: 0x80000000, Name: "_start"}}}
+	tests := []struct {
+		word uint32
+		pc   uint32
+		want string
+	}{
+		{0x00000013, 0x80000000, "nop"},
+		{0x00500513, 0x80000000, "li\ta0,5"},
+		{0x00050593, 0x80000000, "mv\ta1,a0"},
+		{0xff010113, 0x80000000, "addi\tsp,sp,-16"},
+		{0x41f5d593, 0x80000000, "srai\ta1,a1,0x1f"},
+		{0x00812503, 0x80000000, "lw\ta0,8(sp)"},
+		{0x00112623, 0x80000000, "sw\tra,12(sp)"},
+		{0x800012b7, 0x80000000, "lui\tt0,0x80001"},
+		{0xfe059ae3, 0x80000018, "bnez\ta1,8000000c <_start+0xc>"},
+		{0xff5ff06f, 0x80000010, "j\t80000004 <_start+0x4>"},
+		{0x00008067, 0x80000000, "ret"},
+		{0x300025f3, 0x80000000, "csrr\ta1,mstatus"},
+		{0x30529073, 0x80000000, "csrw\tmtvec,t0"},
+		{0x30046073, 0x80000000, "csrsi\tmstatus,8"},
+		{0xc0102573, 0x80000000, "rdtime\ta0"},
+		{0x30200073, 0x80000000, "mret"},
+		{0x0ff0000f, 0x80000000, "fence"},
+		{0x0eb6252f, 0x80000000, "amoswap.w.aqrl\ta0,a1,(a2)"},
+		{0xc0001073, 0x80000000, "unimp"},
+		{0xffffffff, 0x80000000, ".insn\t4, 0xffffffff"},
+	}
+	for _, tt := range tests {
+		if got := d.Word(tt.word, tt.pc); got != tt.want {
+			t.Errorf("0x%08x: Expected %q, Got %q", tt.word, tt.want, got)
+		}
+	}
+}
+
+func TestSpike(t *testing.T) {
+	d := &Disassembler{Syntax: SYNTAX_SPIKE}
+	tests := []struct {
+		word uint32
+		want string
+	}{
+		{0x00500513, "li      a0, 5"},
+		{0xfe059ae3, "bnez    a1, pc - 12"},
+		{0x00c000ef, "jal     pc + 12"},
+		{0x00251513, "slli    a0, a0, 2"},
+	}
+	for _, tt := range tests {
+		if got := d.Word(tt.word, 0x80000000); got != tt.want {
+			t.Errorf("0x%08x: Expected %q, Got %q", tt.word, tt.want, got)
+		}
+	}
+}
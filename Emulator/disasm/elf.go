@@ -0,0 +1,28 @@
+package disasm
+
+import (
+	"debug/elf"
+	"sort"
+)
+
+// ELFSymbols returns the function and label symbols of f sorted by address, like the ones objdump prints
+func ELFSymbols(f *elf.File) []Symbol {
+	syms, _ := f.Symbols()
+	var out []Symbol
+	for _, s := range syms {
+		t := elf.ST_TYPE(s.Info)
+		if s.Name == "" || s.Section == elf.SHN_UNDEF || s.Section >= elf.SHN_LORESERVE {
+			continue
+		}
+		if t != elf.STT_FUNC && t != elf.STT_NOTYPE {
+			continue
+		}
+		// Mapping symbols like $x mark instruction ranges, objdump hides them
+		if s.Name[0] == '$' {
+			continue
+		}
+		out = append(out, Symbol{Addr: uint32(s.Value), Name: s.Name})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out
+}
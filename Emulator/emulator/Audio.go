@@ -0,0 +1,134 @@
+package emulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+)
+
+// What the audio device plays goes to the speakers through SDL, unless headless or muted, and to a WAV file.
+// Both get 16 bit stereo at AUDIO_HOST_RATE, the guest rate is converted by repeating or dropping frames.
+
+const AUDIO_HOST_RATE = 44100
+
+// Bytes of a WAV header, the sizes in it are filled in by Close
+const WAV_HEADER_SIZE = 44
+
+type audioWriter interface {
+	// Samples are left and right interleaved
+	writeSamples(samples []int16) error
+	Close() error
+}
+
+type Sound struct {
+	writers []audioWriter
+	// Host frames owed for the guest frames so far, in guest rate units
+	phase uint64
+}
+
+func NewSound(writers ...audioWriter) *Sound {
+	return &Sound{writers: writers}
+}
+
+// play converts frames of the guest to the host rate and gives them to the writers
+func (s *Sound) play(rate uint32, channels uint32, samples []int16) {
+	out := make([]int16, 0, 2*(uint64(len(samples))*AUDIO_HOST_RATE/uint64(rate)/uint64(channels)+1))
+	for i := 0; i+int(channels) <= len(samples); i += int(channels) {
+		left, right := samples[i], samples[i+int(channels)-1]
+		s.phase += AUDIO_HOST_RATE
+		for ; s.phase >= uint64(rate); s.phase -= uint64(rate) {
+			out = append(out, left, right)
+		}
+	}
+	for _, w := range s.writers {
+		_ = w.writeSamples(out)
+	}
+}
+
+func (s *Sound) Close() error {
+	var err error
+	for _, w := range s.writers {
+		if werr := w.Close(); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// WAV with 16 bit stereo PCM
+type wavWriter struct {
+	f *os.File
+	w *bufio.Writer
+	// Bytes of samples written
+	size uint32
+}
+
+func newWAVWriter(path string) (*wavWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &wavWriter{f: f, w: bufio.NewWriter(f)}
+	w.header()
+	return w, nil
+}
+
+func (w *wavWriter) header() {
+	_, _ = w.w.WriteString("RIFF")
+	_ = binary.Write(w.w, binary.LittleEndian, uint32(WAV_HEADER_SIZE-8)+w.size)
+	_, _ = w.w.WriteString("WAVEfmt ")
+	// PCM, 2 channels, rate, bytes a second, bytes a frame and bits a sample
+	for _, v := range []any{uint32(16), uint16(1), uint16(2), uint32(AUDIO_HOST_RATE), uint32(AUDIO_HOST_RATE * 4), uint16(4), uint16(16)} {
+		_ = binary.Write(w.w, binary.LittleEndian, v)
+	}
+	_, _ = w.w.WriteString("data")
+	_ = binary.Write(w.w, binary.LittleEndian, w.size)
+}
+
+func (w *wavWriter) writeSamples(samples []int16) error {
+	w.size += uint32(2 * len(samples))
+	return binary.Write(w.w, binary.LittleEndian, samples)
+}
+
+// Close fills in the sizes
+func (w *wavWriter) Close() error {
+	err := w.w.Flush()
+	if err == nil {
+		_, err = w.f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		w.w.Reset(w.f)
+		w.header()
+		err = w.w.Flush()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openSound opens the WAV file and the speakers the config asks for, nil when there is nothing to play to
+func (e *Emulator) openSound() *Sound {
+	var writers []audioWriter
+	if e.config.Audio != "" {
+		w, err := newWAVWriter(e.config.Audio)
+		if err != nil {
+			log.Fatalf("Failed to create audio file: %s\n", err)
+		}
+		writers = append(writers, w)
+	}
+	if !e.config.Headless && !e.config.Mute {
+		w, err := openPlayback()
+		if err != nil {
+			log.Printf("No audio playback: %s\n", err)
+		} else {
+			writers = append(writers, w)
+		}
+	}
+	if len(writers) == 0 {
+		return nil
+	}
+	return NewSound(writers...)
+}
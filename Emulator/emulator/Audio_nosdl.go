@@ -0,0 +1,9 @@
+//go:build nosdl
+
+package emulator
+
+import "errors"
+
+func openPlayback() (audioWriter, error) {
+	return nil, errors.New("built without SDL")
+}
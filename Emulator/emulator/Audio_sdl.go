@@ -0,0 +1,48 @@
+//go:build !nosdl
+
+package emulator
+
+import (
+	"encoding/binary"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// Bytes queued ahead of the speakers, a quarter second. More are dropped instead of playing late.
+const AUDIO_MAX_QUEUE = AUDIO_HOST_RATE / 4 * 4
+
+type sdlAudio struct {
+	device sdl.AudioDeviceID
+}
+
+// openPlayback plays on the default audio device of the host
+func openPlayback() (audioWriter, error) {
+	if err := sdl.InitSubSystem(sdl.INIT_AUDIO); err != nil {
+		return nil, err
+	}
+	spec := &sdl.AudioSpec{Freq: AUDIO_HOST_RATE, Format: sdl.AUDIO_S16LSB, Channels: 2, Samples: 1024}
+	device, err := sdl.OpenAudioDevice("", false, spec, nil, 0)
+	if err != nil {
+		sdl.QuitSubSystem(sdl.INIT_AUDIO)
+		return nil, err
+	}
+	sdl.PauseAudioDevice(device, false)
+	return &sdlAudio{device: device}, nil
+}
+
+func (a *sdlAudio) writeSamples(samples []int16) error {
+	if sdl.GetQueuedAudioSize(a.device) > AUDIO_MAX_QUEUE {
+		return nil
+	}
+	data := make([]byte, 0, 2*len(samples))
+	for _, s := range samples {
+		data = binary.LittleEndian.AppendUint16(data, uint16(s))
+	}
+	return sdl.QueueAudio(a.device, data)
+}
+
+func (a *sdlAudio) Close() error {
+	sdl.CloseAudioDevice(a.device)
+	sdl.QuitSubSystem(sdl.INIT_AUDIO)
+	return nil
+}
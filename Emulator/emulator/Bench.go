@@ -0,0 +1,57 @@
+package emulator
+
+import (
+	"fmt"
+	"io"
+	"riscv/instructions"
+	"time"
+)
+
+// Benchmark of the emulator itself. The guest runs for a number of instructions or till it stops, then
+// the speed is reported with the time spent in device registers and the traps and interrupts taken.
+type Bench struct {
+	// Instructions to run, 0 means till the guest stops
+	count   uint64
+	instret uint64
+	start   time.Time
+	stats   instructions.Stats
+}
+
+func NewBench(count uint64) *Bench {
+	return &Bench{count: count}
+}
+
+// begin starts the clock, time spent loading the guest is not counted
+func (b *Bench) begin(instret uint64) {
+	b.instret = instret
+	b.start = time.Now()
+}
+
+// done tells if the instructions asked for ran
+func (b *Bench) done(instret uint64) bool {
+	return b.count > 0 && instret-b.instret >= b.count
+}
+
+// report takes the instructions executed by all harts
+func (b *Bench) report(w io.Writer, instret uint64, blocks bool) {
+	elapsed := time.Since(b.start)
+	n := instret - b.instret
+	mode := "interpreter"
+	if blocks {
+		mode = "blocks"
+	}
+	fmt.Fprintf(w, "bench: %d instructions in %s with the %s, %.2f MIPS\n",
+		n, elapsed.Round(time.Millisecond), mode, float64(n)/elapsed.Seconds()/1e6)
+	mmio := b.stats.MMIOTime
+	fmt.Fprintf(w, "bench: core loop %s (%.1f%%), mmio %s (%.1f%%) in %d accesses\n",
+		(elapsed - mmio).Round(time.Millisecond), percent(elapsed-mmio, elapsed),
+		mmio.Round(time.Millisecond), percent(mmio, elapsed), b.stats.MMIO)
+	fmt.Fprintf(w, "bench: %d traps, %d interrupts\n", b.stats.Traps, b.stats.Interrupts)
+}
+
+func percent(part, whole time.Duration) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(whole)
+}
@@ -0,0 +1,70 @@
+package emulator
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchDone(t *testing.T) {
+	// 0 runs till the guest stops
+	b := NewBench(0)
+	b.begin(100)
+	if b.done(100) || b.done(1<<40) {
+		t.Errorf("Expected a count of 0 never to be done")
+	}
+	b = NewBench(10)
+	b.begin(100)
+	if b.done(109) {
+		t.Errorf("Expected 9 instructions not to be done")
+	}
+	if !b.done(110) {
+		t.Errorf("Expected 10 instructions to be done")
+	}
+}
+
+func TestBenchMMIO(t *testing.T) {
+	e := newTestEmulator(Config{Headless: true}, libraryProgram)
+	// The device is slow, most of the run is spent in it
+	err := e.AddMMIO(0x40000000, 0x1000, func(offset uint32, size uint32) uint32 {
+		time.Sleep(time.Millisecond)
+		return 0
+	}, func(offset uint32, size uint32, value uint32) {
+		time.Sleep(time.Millisecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.bench = NewBench(0)
+	e.cpu.Memory.Stats = &e.bench.stats
+	e.bench.begin(e.instret())
+	if stop := e.Step(1000); stop.Reason != STOP_POWER_OFF {
+		t.Fatalf("Expected the guest to run till it powers off, Got %v", stop.Reason)
+	}
+	elapsed := time.Since(e.bench.start)
+	stats := e.bench.stats
+	// sw and lw to the region, sw to the test device
+	if stats.MMIO != 3 {
+		t.Errorf("Expected 3 accesses, Got %d", stats.MMIO)
+	}
+	if stats.MMIOTime < 2*time.Millisecond || stats.MMIOTime > elapsed {
+		t.Errorf("Expected mmio time between 2ms and %s, Got %s", elapsed, stats.MMIOTime)
+	}
+
+	var b strings.Builder
+	e.bench.report(&b, e.instret(), false)
+	m := regexp.MustCompile(`core loop \S+ \(([0-9.]+)%\), mmio \S+ \(([0-9.]+)%\)`).FindStringSubmatch(b.String())
+	if m == nil {
+		t.Fatalf("Expected the core loop and mmio shares, Got %q", b.String())
+	}
+	for _, share := range m[1:] {
+		if p, _ := strconv.ParseFloat(share, 64); p < 0 || p > 100 {
+			t.Errorf("Expected shares between 0%% and 100%%, Got %q", b.String())
+		}
+	}
+	if !strings.Contains(b.String(), "bench: 38 instructions") {
+		t.Errorf("Expected 38 instructions, Got %q", b.String())
+	}
+}
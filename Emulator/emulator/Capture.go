@@ -0,0 +1,352 @@
+package emulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"riscv/instructions"
+	"slices"
+	"strings"
+)
+
+// Screenshots and videos of the display, taken by the run loop so they need no window
+
+// Written when the guest or the monitor asks for a screenshot and no file was given
+const DEFAULT_SCREENSHOT = "kutemu-%d.png"
+
+// Instructions between two frames of a video
+const VIDEO_INTERVAL = 1000000
+const VIDEO_FPS = 30
+
+// pixels copies what the display shows, row by row as 0xAARRGGBB. Safe to call from any goroutine.
+func (e *Emulator) pixels() []uint32 {
+	return screenPixels(e.cpu.Memory.Display)
+}
+
+// screenPixels copies the screen. The frontends call it from their goroutines with the display they took at
+// start, reset keeps it.
+func screenPixels(display *instructions.Display) []uint32 {
+	display.Mutex.Lock()
+	defer display.Mutex.Unlock()
+	pixels := make([]uint32, SCREEN_WIDTH*SCREEN_HEIGHT)
+	for i := range pixels {
+		pixels[i] = display.Screen[uint32(i)]
+	}
+	return pixels
+}
+
+// Frame returns what the display shows. Pixels are opaque, the alpha byte the guest writes is not used by the
+// window either.
+func (e *Emulator) Frame() *image.RGBA {
+	screen := e.pixels()
+	img := image.NewRGBA(image.Rect(0, 0, SCREEN_WIDTH, SCREEN_HEIGHT))
+	for y := 0; y < SCREEN_HEIGHT; y++ {
+		for x := 0; x < SCREEN_WIDTH; x++ {
+			p := screen[y*SCREEN_WIDTH+x]
+			img.SetRGBA(x, y, color.RGBA{R: byte(p >> 16), G: byte(p >> 8), B: byte(p), A: 0xff})
+		}
+	}
+	return img
+}
+
+// Screenshot writes what the display shows to path as PNG
+func (e *Emulator) Screenshot(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, e.Frame())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// screenshotPath is the configured screenshot file, named after the instruction count when it has a "%d"
+func (e *Emulator) screenshotPath() string {
+	path := e.config.Screenshot
+	if path == "" {
+		path = DEFAULT_SCREENSHOT
+	}
+	if strings.Contains(path, "%d") {
+		path = fmt.Sprintf(path, e.instret())
+	}
+	return path
+}
+
+func (e *Emulator) screenshot() {
+	path := e.screenshotPath()
+	if err := e.Screenshot(path); err != nil {
+		log.Printf("Failed to save screenshot: %s\n", err)
+		return
+	}
+	log.Printf("Saved screenshot to %s\n", path)
+}
+
+// Capture takes the screenshots and video frames asked for on the command line
+type Capture struct {
+	// Instruction counts screenshots are taken at, the next one first
+	at []uint64
+	// Nil when no video is written
+	video    frameWriter
+	interval uint64
+	next     uint64
+}
+
+type frameWriter interface {
+	writeFrame(img *image.RGBA) error
+	Close() error
+}
+
+func NewCapture(config Config) (*Capture, error) {
+	c := &Capture{at: slices.Sorted(slices.Values(config.ScreenshotAt))}
+	if config.Video == "" {
+		return c, nil
+	}
+	c.interval = config.VideoInterval
+	if c.interval == 0 {
+		c.interval = VIDEO_INTERVAL
+	}
+	fps := config.VideoFPS
+	if fps == 0 {
+		fps = VIDEO_FPS
+	}
+	var err error
+	switch {
+	case strings.Contains(config.Video, "%d"):
+		c.video = &pngSequence{pattern: config.Video}
+	case strings.EqualFold(filepath.Ext(config.Video), ".y4m"):
+		c.video, err = newY4MWriter(config.Video, fps)
+	case strings.EqualFold(filepath.Ext(config.Video), ".avi"):
+		c.video, err = newAVIWriter(config.Video, fps)
+	default:
+		err = fmt.Errorf("%s: video file must end in .y4m or .avi, or have a %%d for PNG frames", config.Video)
+	}
+	return c, err
+}
+
+// tick takes what is due once the instructions ran
+func (c *Capture) tick(e *Emulator) {
+	instret := e.instret()
+	for len(c.at) > 0 && instret >= c.at[0] {
+		c.at = c.at[1:]
+		e.screenshot()
+	}
+	if c.video != nil && instret >= c.next {
+		// Blocks may run past the frame, the next one is still due at the same interval
+		c.next = instret - instret%c.interval + c.interval
+		if err := c.video.writeFrame(e.Frame()); err != nil {
+			log.Printf("Failed to write video frame: %s\n", err)
+			c.video.Close()
+			c.video = nil
+		}
+	}
+}
+
+func (c *Capture) Close() {
+	if c.video == nil {
+		return
+	}
+	if err := c.video.Close(); err != nil {
+		log.Printf("Failed to write video: %s\n", err)
+	}
+}
+
+// One PNG file per frame, numbered from 0
+type pngSequence struct {
+	pattern string
+	frames  int
+}
+
+func (p *pngSequence) writeFrame(img *image.RGBA) error {
+	f, err := os.Create(fmt.Sprintf(p.pattern, p.frames))
+	if err != nil {
+		return err
+	}
+	p.frames++
+	err = png.Encode(f, img)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (p *pngSequence) Close() error {
+	return nil
+}
+
+// YUV4MPEG2, uncompressed 4:2:0 frames any video tool reads.
+// See https://wiki.multimedia.cx/index.php/YUV4MPEG2
+type y4mWriter struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func newY4MWriter(path string, fps int) (*y4mWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "YUV4MPEG2 W%d H%d F%d:1 Ip A1:1 C420jpeg\n", SCREEN_WIDTH, SCREEN_HEIGHT, fps)
+	return &y4mWriter{f: f, w: w}, nil
+}
+
+func (y *y4mWriter) writeFrame(img *image.RGBA) error {
+	y.w.WriteString("FRAME\n")
+	luma, cb, cr := toYCbCr420(img)
+	y.w.Write(luma)
+	y.w.Write(cb)
+	_, err := y.w.Write(cr)
+	return err
+}
+
+func (y *y4mWriter) Close() error {
+	err := y.w.Flush()
+	if cerr := y.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// toYCbCr420 converts to full range BT.601, chroma averaged over 2x2 pixels
+func toYCbCr420(img *image.RGBA) (luma, cb, cr []byte) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	luma = make([]byte, w*h)
+	cb = make([]byte, w/2*h/2)
+	cr = make([]byte, w/2*h/2)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.RGBAAt(x, y)
+			luma[y*w+x], _, _ = color.RGBToYCbCr(p.R, p.G, p.B)
+		}
+	}
+	for y := 0; y < h/2; y++ {
+		for x := 0; x < w/2; x++ {
+			var sumCb, sumCr int
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				p := img.RGBAAt(2*x+d[0], 2*y+d[1])
+				_, b, r := color.RGBToYCbCr(p.R, p.G, p.B)
+				sumCb += int(b)
+				sumCr += int(r)
+			}
+			cb[y*w/2+x] = byte((sumCb + 2) / 4)
+			cr[y*w/2+x] = byte((sumCr + 2) / 4)
+		}
+	}
+	return luma, cb, cr
+}
+
+// AVI with uncompressed 24 bit frames. The sizes and the frame count in the headers are filled in by Close.
+// See https://learn.microsoft.com/en-us/windows/win32/directshow/avi-riff-file-reference
+type aviWriter struct {
+	f *os.File
+	w *bufio.Writer
+	// Offset of each frame chunk from the movi list type, for the index
+	offsets []uint32
+	// Bytes written so far, the writer is buffered so it can't be asked
+	size uint32
+	fps  int
+}
+
+// Bytes before the first frame, and sizes of the chunks in there
+const (
+	AVI_HEADER_SIZE     = 224
+	AVI_FRAME_BYTES     = SCREEN_WIDTH * SCREEN_HEIGHT * 3
+	AVI_STREAM_HDR_SIZE = 56
+	AVI_FORMAT_SIZE     = 40
+)
+
+func newAVIWriter(path string, fps int) (*aviWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &aviWriter{f: f, w: bufio.NewWriter(f), fps: fps}
+	a.header(0, 0)
+	return a, nil
+}
+
+func (a *aviWriter) write(v ...any) {
+	for _, x := range v {
+		switch x := x.(type) {
+		case string:
+			a.w.WriteString(x)
+			a.size += uint32(len(x))
+		case []byte:
+			a.w.Write(x)
+			a.size += uint32(len(x))
+		default:
+			_ = binary.Write(a.w, binary.LittleEndian, x)
+			a.size += uint32(binary.Size(x))
+		}
+	}
+}
+
+// header writes everything up to the first frame, with frames frames in moviSize bytes of movi list
+func (a *aviWriter) header(frames uint32, moviSize uint32) {
+	riffSize := uint32(AVI_HEADER_SIZE - 8 + moviSize + 8 + 16*frames)
+	a.write("RIFF", riffSize, "AVI ")
+	a.write("LIST", uint32(4+8+56+8+4+8+AVI_STREAM_HDR_SIZE+8+AVI_FORMAT_SIZE), "hdrl")
+	// Main header
+	a.write("avih", uint32(56),
+		uint32(1000000/a.fps), uint32(AVI_FRAME_BYTES*a.fps), uint32(0),
+		uint32(0x10), // AVIF_HASINDEX
+		frames, uint32(0), uint32(1), uint32(AVI_FRAME_BYTES),
+		uint32(SCREEN_WIDTH), uint32(SCREEN_HEIGHT), [4]uint32{})
+	a.write("LIST", uint32(4+8+AVI_STREAM_HDR_SIZE+8+AVI_FORMAT_SIZE), "strl")
+	// Stream header
+	a.write("strh", uint32(AVI_STREAM_HDR_SIZE), "vids", "DIB ",
+		uint32(0), uint16(0), uint16(0), uint32(0),
+		uint32(1), uint32(a.fps), uint32(0), frames, uint32(AVI_FRAME_BYTES), ^uint32(0), uint32(0),
+		[4]uint16{0, 0, SCREEN_WIDTH, SCREEN_HEIGHT})
+	// Stream format, a bottom up BITMAPINFOHEADER
+	a.write("strf", uint32(AVI_FORMAT_SIZE),
+		uint32(AVI_FORMAT_SIZE), int32(SCREEN_WIDTH), int32(SCREEN_HEIGHT), uint16(1), uint16(24),
+		uint32(0), uint32(AVI_FRAME_BYTES), int32(0), int32(0), uint32(0), uint32(0))
+	a.write("LIST", 4+moviSize, "movi")
+}
+
+func (a *aviWriter) writeFrame(img *image.RGBA) error {
+	frame := make([]byte, 0, AVI_FRAME_BYTES)
+	for y := SCREEN_HEIGHT - 1; y >= 0; y-- {
+		for x := 0; x < SCREEN_WIDTH; x++ {
+			p := img.RGBAAt(x, y)
+			frame = append(frame, p.B, p.G, p.R)
+		}
+	}
+	// Offsets are from the movi list type
+	a.offsets = append(a.offsets, a.size-(AVI_HEADER_SIZE-4))
+	a.write("00db", uint32(AVI_FRAME_BYTES), frame)
+	return nil
+}
+
+// Close writes the index and fills in the header
+func (a *aviWriter) Close() error {
+	frames := uint32(len(a.offsets))
+	moviSize := a.size - AVI_HEADER_SIZE
+	a.write("idx1", 16*frames)
+	for _, offset := range a.offsets {
+		a.write("00db", uint32(0x10), offset, uint32(AVI_FRAME_BYTES)) // AVIIF_KEYFRAME
+	}
+	err := a.w.Flush()
+	if err == nil {
+		_, err = a.f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		a.w.Reset(a.f)
+		a.header(frames, moviSize)
+		err = a.w.Flush()
+	}
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
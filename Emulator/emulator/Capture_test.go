@@ -0,0 +1,195 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testFrame is white with a red top left pixel and a blue bottom right one
+func testFrame() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, SCREEN_WIDTH, SCREEN_HEIGHT))
+	for y := 0; y < SCREEN_HEIGHT; y++ {
+		for x := 0; x < SCREEN_WIDTH; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+		}
+	}
+	img.SetRGBA(0, 0, color.RGBA{R: 0xff, A: 0xff})
+	img.SetRGBA(SCREEN_WIDTH-1, SCREEN_HEIGHT-1, color.RGBA{B: 0xff, A: 0xff})
+	return img
+}
+
+// writeVideo writes frames test frames to a video file named name and returns the file
+func writeVideo(t *testing.T, name string, frames int) []byte {
+	path := filepath.Join(t.TempDir(), name)
+	c, err := NewCapture(Config{Video: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < frames; i++ {
+		if err := c.video.writeFrame(testFrame()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.video.Close(); err != nil {
+		t.Fatal(err)
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestCaptureY4M(t *testing.T) {
+	const frames = 3
+	body := writeVideo(t, "test.y4m", frames)
+	header := fmt.Sprintf("YUV4MPEG2 W%d H%d F%d:1 Ip A1:1 C420jpeg\n", SCREEN_WIDTH, SCREEN_HEIGHT, VIDEO_FPS)
+	if !bytes.HasPrefix(body, []byte(header)) {
+		t.Fatalf("Expected the header %q, Got %q", header, body[:min(len(body), len(header))])
+	}
+	// Full resolution luma, chroma planes of half the width and height
+	lumaSize, chromaSize := SCREEN_WIDTH*SCREEN_HEIGHT, SCREEN_WIDTH/2*SCREEN_HEIGHT/2
+	frameSize := len("FRAME\n") + lumaSize + 2*chromaSize
+	if len(body) != len(header)+frames*frameSize {
+		t.Fatalf("Expected %d frames of %d bytes, Got %d bytes", frames, frameSize, len(body)-len(header))
+	}
+	for i := 0; i < frames; i++ {
+		frame := body[len(header)+i*frameSize:]
+		if !bytes.HasPrefix(frame, []byte("FRAME\n")) {
+			t.Fatalf("Expected frame %d to start with FRAME", i)
+		}
+		luma := frame[len("FRAME\n"):]
+		cb, cr := luma[lumaSize:], luma[lumaSize+chromaSize:]
+		red, _, _ := color.RGBToYCbCr(0xff, 0, 0)
+		if luma[0] != red || luma[1] != 0xff {
+			t.Errorf("Expected luma %d and 255, Got %d and %d", red, luma[0], luma[1])
+		}
+		// One red pixel of four in the top left block
+		_, redCb, redCr := color.RGBToYCbCr(0xff, 0, 0)
+		if want := byte((int(redCb) + 3*128 + 2) / 4); cb[0] != want {
+			t.Errorf("Expected cb %d, Got %d", want, cb[0])
+		}
+		if want := byte((int(redCr) + 3*128 + 2) / 4); cr[0] != want {
+			t.Errorf("Expected cr %d, Got %d", want, cr[0])
+		}
+		if cb[1] != 128 || cr[1] != 128 {
+			t.Errorf("Expected neutral chroma for white, Got %d %d", cb[1], cr[1])
+		}
+	}
+}
+
+func TestCaptureAVI(t *testing.T) {
+	const frames = 3
+	body := writeVideo(t, "test.avi", frames)
+	u32 := func(at int) uint32 { return binary.LittleEndian.Uint32(body[at:]) }
+	chunk := func(at int, fourcc string) {
+		if string(body[at:at+4]) != fourcc {
+			t.Fatalf("Expected %q at %d, Got %q", fourcc, at, body[at:at+4])
+		}
+	}
+
+	chunk(0, "RIFF")
+	chunk(8, "AVI ")
+	if u32(4) != uint32(len(body)-8) {
+		t.Errorf("Expected the RIFF size %d, Got %d", len(body)-8, u32(4))
+	}
+	// Frame counts in the main and the stream header
+	chunk(24, "avih")
+	if u32(32+16) != frames {
+		t.Errorf("Expected %d frames in the main header, Got %d", frames, u32(32+16))
+	}
+	if u32(32+32) != SCREEN_WIDTH || u32(32+36) != SCREEN_HEIGHT {
+		t.Errorf("Expected %dx%d, Got %dx%d", SCREEN_WIDTH, SCREEN_HEIGHT, u32(32+32), u32(32+36))
+	}
+	chunk(100, "strh")
+	chunk(108, "vids")
+	if u32(108+32) != frames {
+		t.Errorf("Expected %d frames in the stream header, Got %d", frames, u32(108+32))
+	}
+
+	movi := AVI_HEADER_SIZE - 12
+	chunk(movi, "LIST")
+	chunk(movi+8, "movi")
+	frameChunk := 8 + AVI_FRAME_BYTES
+	if u32(movi+4) != uint32(4+frames*frameChunk) {
+		t.Errorf("Expected the movi list size %d, Got %d", 4+frames*frameChunk, u32(movi+4))
+	}
+	for i := 0; i < frames; i++ {
+		at := AVI_HEADER_SIZE + i*frameChunk
+		chunk(at, "00db")
+		if u32(at+4) != AVI_FRAME_BYTES {
+			t.Errorf("Expected frame %d of %d bytes, Got %d", i, AVI_FRAME_BYTES, u32(at+4))
+		}
+		// Bottom up BGR, the blue pixel comes first and the red one last
+		pixels := body[at+8 : at+8+AVI_FRAME_BYTES]
+		if !bytes.Equal(pixels[AVI_FRAME_BYTES-3*SCREEN_WIDTH:][:3], []byte{0, 0, 0xff}) {
+			t.Errorf("Expected the red pixel first on the last row, Got %x", pixels[AVI_FRAME_BYTES-3*SCREEN_WIDTH:][:3])
+		}
+		if !bytes.Equal(pixels[3*(SCREEN_WIDTH-1):][:3], []byte{0xff, 0, 0}) {
+			t.Errorf("Expected the blue pixel last on the first row, Got %x", pixels[3*(SCREEN_WIDTH-1):][:3])
+		}
+	}
+
+	idx := AVI_HEADER_SIZE + frames*frameChunk
+	chunk(idx, "idx1")
+	if u32(idx+4) != 16*frames || len(body) != idx+8+16*frames {
+		t.Fatalf("Expected an index of %d entries ending the file, Got size %d", frames, u32(idx+4))
+	}
+	for i := 0; i < frames; i++ {
+		entry := idx + 8 + 16*i
+		chunk(entry, "00db")
+		// Offsets are from the movi list type
+		if offset := int(u32(entry + 8)); movi+8+offset != AVI_HEADER_SIZE+i*frameChunk {
+			t.Errorf("Expected index entry %d to point at its frame, Got offset %d", i, offset)
+		}
+		if u32(entry+12) != AVI_FRAME_BYTES {
+			t.Errorf("Expected index entry %d of %d bytes, Got %d", i, AVI_FRAME_BYTES, u32(entry+12))
+		}
+	}
+}
+
+func TestCaptureGuestScreenshot(t *testing.T) {
+	dir := t.TempDir()
+	e := newTestEmulator(Config{Headless: true, Screenshot: filepath.Join(dir, "shot-%d.png")}, []uint32{
+		0x1d3852b7, // lui t0, 0x1d385
+		0x00ff0337, // lui t1, 0xff0
+		0x0062a023, // sw t1, 0(t0)
+		0x1d3953b7, // lui t2, 0x1d395
+		0xa0038393, // addi t2, t2, -0x600
+		0x00100e13, // li t3, 1
+		0x01c3a023, // sw t3, 0(t2)
+		0x0000006f, // j .
+	})
+	e.Step(6)
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.png")); len(matches) != 0 {
+		t.Fatalf("Expected no screenshot before the write, Got %v", matches)
+	}
+	e.Step(1)
+	f, err := os.Open(filepath.Join(dir, "shot-7.png"))
+	if err != nil {
+		t.Fatalf("Expected a screenshot once the control register is written: %s", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != SCREEN_WIDTH || img.Bounds().Dy() != SCREEN_HEIGHT {
+		t.Errorf("Expected %dx%d, Got %v", SCREEN_WIDTH, SCREEN_HEIGHT, img.Bounds())
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r != 0xffff || g != 0 || b != 0 {
+		t.Errorf("Expected the red pixel the guest drew, Got %x %x %x", r, g, b)
+	}
+	// Only once
+	e.Step(10)
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.png")); len(matches) != 1 {
+		t.Errorf("Expected one screenshot, Got %v", matches)
+	}
+}
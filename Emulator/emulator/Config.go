@@ -0,0 +1,105 @@
+package emulator
+
+import "time"
+
+// Config describes the machine the emulator builds
+type Config struct {
+	// Flat binary loaded into DRAM. Loaded at VIRT_OPENSBI_START when SBI is set, VIRT_DRAM otherwise.
+	Image string
+	// Use the built-in SBI firmware and start the image in S-mode
+	SBI bool
+	// Size of DRAM starting at VIRT_DRAM, 0 means VIRT_DRAM_SIZE
+	MemorySize uint32
+	// Number of harts, 0 means 1
+	Harts int
+	// Kernel command line passed in /chosen
+	Bootargs string
+	// Write the generated device tree to this file
+	DumpDTB string
+	// Address of the gdb server, a TCP port on localhost like ":1234" or a unix socket like "unix:/tmp/gdb"
+	Gdb string
+	// Wait for gdb before running the first instruction
+	GdbWait bool
+	// Address of the monitor console, in the same forms as Gdb
+	Monitor string
+	// Time the RTC starts from. Zero uses the host time, a fixed one makes runs reproducible.
+	RTCStart time.Time
+	// Write a commit log of the executed instructions to this file, "-" is stdout
+	Trace string
+	// Which instructions end up in the trace
+	TraceFilter TraceFilter
+	// Also write the disassembly line spike -l writes before each commit line
+	TraceDisasm bool
+	// Compare every instruction with this reference commit log and stop at the first difference
+	Lockstep string
+	// Instructions shown before a difference, 0 means LOCKSTEP_CONTEXT
+	LockstepContext int
+	// File snapshots are saved to and restored from, empty means DEFAULT_SNAPSHOT
+	Snapshot string
+	// Resume from this snapshot instead of booting the image
+	Restore string
+	// Save a snapshot the first time the guest reaches this PC, 0 means never
+	SnapshotPC uint32
+	// Record time and UART input to this file
+	Record string
+	// Replay time and UART input from this recording
+	Replay string
+	// Write a pprof profile of the guest to this file
+	Profile string
+	// Write folded stacks for flame graphs to this file
+	ProfileFolded string
+	// Print this many functions with the most instructions when the run ends
+	ProfileTop int
+	// ELF file of the image, functions are named with its symbols
+	ProfileSymbols string
+	// Count every this many instructions, 0 means every instruction
+	ProfileInterval uint64
+	// Report the speed of the emulator when the run ends
+	Bench bool
+	// Stop the run after this many instructions, 0 means no limit
+	BenchCount uint64
+	// Run one instruction at a time instead of translating basic blocks
+	Interpret bool
+	// Write an lcov tracefile of the guest code executed to this file
+	Coverage string
+	// ELF file of the image with debug info, maps the code to source lines
+	CoverageELF string
+	// Run without the SDL window
+	Headless bool
+	// Serve the display, keyboard and pointer over VNC on this address, like the gdb one
+	Vnc string
+	// Draw the display in the terminal, the UART console goes on a status line under it
+	Terminal bool
+	// Times a second the terminal is redrawn, 0 means TERMINAL_FPS
+	TerminalFPS int
+	// Serve the browser frontend over HTTP on this address, like the gdb one
+	Web string
+	// File screenshots of the display are written to, "%d" is replaced with the instruction count. Empty means
+	// DEFAULT_SCREENSHOT.
+	Screenshot string
+	// Take a screenshot when this many instructions ran
+	ScreenshotAt []uint64
+	// Write frames of the display to this file: .y4m, .avi, or PNG files when it has a "%d" for the frame number
+	Video string
+	// Instructions between two frames, 0 means VIDEO_INTERVAL
+	VideoInterval uint64
+	// Frame rate written in the video header, 0 means VIDEO_FPS
+	VideoFPS int
+	// Write what the audio device plays to this WAV file
+	Audio string
+	// Don't play the audio device on the speakers, it is never played headless
+	Mute bool
+	// Keep checkpoints so gdb can step and continue backwards
+	Reverse bool
+	// Instructions between checkpoints, 0 means REVERSE_INTERVAL
+	ReverseInterval uint64
+}
+
+func (c *Config) setDefaults() {
+	if c.MemorySize == 0 {
+		c.MemorySize = VIRT_DRAM_SIZE
+	}
+	if c.Harts == 0 {
+		c.Harts = 1
+	}
+}
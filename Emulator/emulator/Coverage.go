@@ -0,0 +1,274 @@
+package emulator
+
+import (
+	"cmp"
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"riscv/disasm"
+	"riscv/instructions"
+	"slices"
+)
+
+// Guest code coverage. Every instruction executed is counted, and for branches how often they were
+// taken and not taken. When the run ends the counts are mapped to source lines with the DWARF line
+// table of the ELF file and written as an lcov tracefile, for genhtml, Codecov and the like:
+//   - a line counts as often as its most executed instruction
+//   - every branch instruction on a line is a block with two branches, taken and not taken
+//   - functions are the ELF symbols, counted on their first instruction
+
+type branchCount struct {
+	// Where the branch goes when it is taken
+	target   uint32
+	taken    uint64
+	notTaken uint64
+}
+
+type sourceLine struct {
+	file string
+	line int
+}
+
+type Coverage struct {
+	counts map[uint32]uint64
+	// Every branch instruction of the ELF file
+	branches map[uint32]*branchCount
+	// Source line of every instruction the line table covers
+	lines     map[uint32]sourceLine
+	functions []disasm.Symbol
+}
+
+// NewCoverage reads the line table and symbols of the ELF file the image was made from
+func NewCoverage(path string) (*Coverage, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := f.DWARF()
+	if err != nil {
+		return nil, fmt.Errorf("%s: no debug info, build with -g: %w", path, err)
+	}
+	c := &Coverage{
+		counts:    make(map[uint32]uint64),
+		branches:  make(map[uint32]*branchCount),
+		lines:     make(map[uint32]sourceLine),
+		functions: disasm.ELFSymbols(f),
+	}
+	if err := c.readLines(d); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(c.lines) == 0 {
+		return nil, fmt.Errorf("%s: line table is empty", path)
+	}
+	if err := c.findBranches(f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// findBranches looks for the branch instructions in the code of the ELF file, so the ones which never
+// ran are reported too
+func (c *Coverage) findBranches(f *elf.File) error {
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_PROGBITS || s.Flags&elf.SHF_EXECINSTR == 0 {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return err
+		}
+		for off := 0; off+4 <= len(data); off += 4 {
+			c.addBranch(uint32(s.Addr)+uint32(off), [4]byte(data[off:off+4]))
+		}
+	}
+	return nil
+}
+
+// addBranch adds the instruction at pc if it is a branch on a line
+func (c *Coverage) addBranch(pc uint32, b [4]byte) {
+	if _, ok := c.lines[pc]; !ok || b[0]&0x7f != instructions.OP_TOPLEVEL_BI {
+		return
+	}
+	// Reserved funct3 values are no branches
+	if i := instructions.DecodeBytes(b).(instructions.BI); i.F3 != 2 && i.F3 != 3 {
+		c.branches[pc] = &branchCount{target: pc + uint32(int16(i.BIM<<4)>>4)}
+	}
+}
+
+// readLines maps the instructions of every row of the line table to its line. A row covers the
+// addresses up to the next row of its sequence.
+func (c *Coverage) readLines(d *dwarf.Data) error {
+	r := d.Reader()
+	for {
+		unit, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if unit == nil {
+			return nil
+		}
+		if unit.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+		lr, err := d.LineReader(unit)
+		if err != nil {
+			return err
+		}
+		r.SkipChildren()
+		if lr == nil {
+			continue
+		}
+		var row, prev dwarf.LineEntry
+		started := false
+		for {
+			if err := lr.Next(&row); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return err
+			}
+			if started && prev.File != nil && prev.Line > 0 {
+				for pc := uint32(prev.Address); pc < uint32(row.Address); pc += 4 {
+					c.lines[pc] = sourceLine{prev.File.Name, prev.Line}
+				}
+			}
+			prev, started = row, !row.EndSequence
+		}
+	}
+}
+
+// executed counts the instruction which ran at pc. A branch to the next instruction counts as taken, a
+// branch which trapped as neither.
+func (c *Coverage) executed(pc uint32, cpu *instructions.Cpu) {
+	c.counts[pc]++
+	if b := c.branches[pc]; b != nil {
+		switch cpu.PC {
+		case b.target:
+			b.taken++
+		case pc + 4:
+			b.notTaken++
+		}
+	}
+}
+
+type lineCoverage struct {
+	count uint64
+	// Branch instructions of the line by address
+	branches []uint32
+}
+
+type functionCoverage struct {
+	name  string
+	line  int
+	count uint64
+}
+
+type fileCoverage struct {
+	lines     map[int]*lineCoverage
+	functions []functionCoverage
+}
+
+// Close writes the lcov tracefile
+func (c *Coverage) Close(path string) {
+	if err := writeFile(path, c.writeLcov); err != nil {
+		fmt.Fprintf(os.Stderr, "coverage: %s\n", err)
+	}
+}
+
+func (c *Coverage) writeLcov(w io.Writer) error {
+	files := make(map[string]*fileCoverage)
+	file := func(name string) *fileCoverage {
+		f := files[name]
+		if f == nil {
+			f = &fileCoverage{lines: make(map[int]*lineCoverage)}
+			files[name] = f
+		}
+		return f
+	}
+	for pc, src := range c.lines {
+		lines := file(src.file).lines
+		l := lines[src.line]
+		if l == nil {
+			l = &lineCoverage{}
+			lines[src.line] = l
+		}
+		l.count = max(l.count, c.counts[pc])
+		if c.branches[pc] != nil {
+			l.branches = append(l.branches, pc)
+		}
+	}
+	for _, s := range c.functions {
+		if src, ok := c.lines[s.Addr]; ok {
+			f := file(src.file)
+			f.functions = append(f.functions, functionCoverage{s.Name, src.line, c.counts[s.Addr]})
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	fmt.Fprintln(w, "TN:")
+	for _, name := range names {
+		f := files[name]
+		fmt.Fprintf(w, "SF:%s\n", name)
+		slices.SortStableFunc(f.functions, func(a, b functionCoverage) int { return cmp.Compare(a.line, b.line) })
+		hit := 0
+		for _, fn := range f.functions {
+			fmt.Fprintf(w, "FN:%d,%s\n", fn.line, fn.name)
+		}
+		for _, fn := range f.functions {
+			fmt.Fprintf(w, "FNDA:%d,%s\n", fn.count, fn.name)
+			if fn.count > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(w, "FNF:%d\nFNH:%d\n", len(f.functions), hit)
+
+		numbers := make([]int, 0, len(f.lines))
+		for n := range f.lines {
+			numbers = append(numbers, n)
+		}
+		slices.Sort(numbers)
+		found := 0
+		hit = 0
+		for _, n := range numbers {
+			l := f.lines[n]
+			slices.Sort(l.branches)
+			for block, pc := range l.branches {
+				b := c.branches[pc]
+				// - is a branch which was never reached
+				taken, notTaken := "-", "-"
+				if c.counts[pc] > 0 {
+					taken, notTaken = fmt.Sprint(b.taken), fmt.Sprint(b.notTaken)
+				}
+				fmt.Fprintf(w, "BRDA:%d,%d,0,%s\nBRDA:%d,%d,1,%s\n", n, block, taken, n, block, notTaken)
+				found += 2
+				if b.taken > 0 {
+					hit++
+				}
+				if b.notTaken > 0 {
+					hit++
+				}
+			}
+		}
+		fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", found, hit)
+
+		hit = 0
+		for _, n := range numbers {
+			count := f.lines[n].count
+			fmt.Fprintf(w, "DA:%d,%d\n", n, count)
+			if count > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(numbers), hit)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package emulator
+
+import (
+	"riscv/disasm"
+	"strings"
+	"testing"
+)
+
+// main loops three times and calls f, g never runs
+var coverageProgram = []uint32{
+	0x00000513, // main: li a0, 0
+	0x00150513, // loop: addi a0, a0, 1
+	0x00300593, // li a1, 3
+	0xfeb51ce3, // bne a0, a1, loop
+	0x00000263, // beq zero, zero, .+4
+	0x008000ef, // jal ra, f
+	0x0000006f, // j .
+	0x00008067, // f: ret
+	0x00a51463, // g: bne a0, a0, .+8
+	0x00008067, // ret
+	0x00008067, // ret
+}
+
+// Source line of every instruction
+var coverageLines = []sourceLine{
+	{"main.c", 1}, {"main.c", 2}, {"main.c", 2}, {"main.c", 3}, {"main.c", 4}, {"main.c", 5}, {"main.c", 6},
+	{"f.c", 10}, {"f.c", 20}, {"f.c", 21}, {"f.c", 21},
+}
+
+// Till the first time j . runs
+const coverageSteps = 14
+
+const coverageLcov = `TN:
+SF:f.c
+FN:10,f
+FN:20,g
+FNDA:1,f
+FNDA:0,g
+FNF:2
+FNH:1
+BRDA:20,0,0,-
+BRDA:20,0,1,-
+BRF:2
+BRH:0
+DA:10,1
+DA:20,0
+DA:21,0
+LF:3
+LH:1
+end_of_record
+SF:main.c
+FN:1,main
+FNDA:1,main
+FNF:1
+FNH:1
+BRDA:3,0,0,2
+BRDA:3,0,1,1
+BRDA:4,0,0,1
+BRDA:4,0,1,0
+BRF:4
+BRH:3
+DA:1,1
+DA:2,3
+DA:3,3
+DA:4,1
+DA:5,1
+DA:6,1
+LF:6
+LH:6
+end_of_record
+`
+
+func TestCoverageLcov(t *testing.T) {
+	c := &Coverage{
+		counts:    make(map[uint32]uint64),
+		branches:  make(map[uint32]*branchCount),
+		lines:     make(map[uint32]sourceLine),
+		functions: []disasm.Symbol{{Addr: VIRT_DRAM, Name: "main"}, {Addr: VIRT_DRAM + 0x1c, Name: "f"}, {Addr: VIRT_DRAM + 0x20, Name: "g"}},
+	}
+	for i, src := range coverageLines {
+		c.lines[VIRT_DRAM+uint32(4*i)] = src
+	}
+	for i, word := range coverageProgram {
+		c.addBranch(VIRT_DRAM+uint32(4*i), [4]byte{byte(word), byte(word >> 8), byte(word >> 16), byte(word >> 24)})
+	}
+	if len(c.branches) != 3 {
+		t.Errorf("Expected 3 branches, Got %d", len(c.branches))
+	}
+	e := newTestEmulator(Config{Headless: true}, coverageProgram)
+	e.coverage = c
+	e.Step(coverageSteps)
+
+	// The beq goes to the next instruction, which is taken
+	if b := c.branches[VIRT_DRAM+0x10]; b.taken != 1 || b.notTaken != 0 {
+		t.Errorf("Expected the beq to the next instruction to be taken once, Got %+v", *b)
+	}
+	var b strings.Builder
+	if err := c.writeLcov(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != coverageLcov {
+		t.Errorf("Expected\n%s\nGot\n%s", coverageLcov, b.String())
+	}
+}
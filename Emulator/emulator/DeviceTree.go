@@ -0,0 +1,172 @@
+package emulator
+
+import (
+	"fmt"
+	"riscv/fdt"
+	"riscv/instructions"
+)
+
+// Phandles of the interrupt controllers
+const PHANDLE_PLIC = 1
+const PHANDLE_TEST = 2
+
+// Each hart has its own local interrupt controller, after the fixed ones
+func phandleCpuIntc(hart int) uint32 {
+	return uint32(16 + hart)
+}
+
+// What Linux expects in riscv,isa. Privilege modes are not part of it.
+const ISA = "rv32ima_zicsr_zifencei"
+
+// Frequency of mtime, it counts milliseconds
+const TIMEBASE_FREQUENCY = 1000
+
+// Same as QEMU virt
+const UART_CLOCK_FREQUENCY = 0x384000
+
+// generateDeviceTree describes the machine built by newMachine
+func generateDeviceTree(config Config) []byte {
+	b := fdt.NewBuilder()
+	b.BeginNode("")
+	b.PropertyU32("#address-cells", 2)
+	b.PropertyU32("#size-cells", 2)
+	b.PropertyString("compatible", "kutemu,virt", "riscv-virtio")
+	b.PropertyString("model", "KUTEmu virt")
+
+	uartPath := fmt.Sprintf("/soc/serial@%x", instructions.VIRT_UART0)
+	b.BeginNode("aliases")
+	b.PropertyString("serial0", uartPath)
+	b.EndNode()
+
+	b.BeginNode("chosen")
+	if config.Bootargs != "" {
+		b.PropertyString("bootargs", config.Bootargs)
+	}
+	b.PropertyString("stdout-path", uartPath)
+	b.EndNode()
+
+	b.BeginNode(fmt.Sprintf("memory@%x", VIRT_DRAM))
+	b.PropertyString("device_type", "memory")
+	b.PropertyU64("reg", VIRT_DRAM, uint64(config.MemorySize))
+	b.EndNode()
+
+	b.BeginNode("cpus")
+	b.PropertyU32("#address-cells", 1)
+	b.PropertyU32("#size-cells", 0)
+	b.PropertyU32("timebase-frequency", TIMEBASE_FREQUENCY)
+	for hart := 0; hart < config.Harts; hart++ {
+		b.BeginNode(fmt.Sprintf("cpu@%d", hart))
+		b.PropertyString("device_type", "cpu")
+		b.PropertyU32("reg", uint32(hart))
+		b.PropertyString("status", "okay")
+		b.PropertyString("compatible", "riscv")
+		b.PropertyString("riscv,isa", ISA)
+		b.PropertyString("riscv,isa-base", "rv32i")
+		b.PropertyString("riscv,isa-extensions", "i", "m", "a", "zicsr", "zifencei")
+		b.BeginNode("interrupt-controller")
+		b.PropertyU32("#interrupt-cells", 1)
+		b.PropertyEmpty("interrupt-controller")
+		b.PropertyString("compatible", "riscv,cpu-intc")
+		b.PropertyU32("phandle", phandleCpuIntc(hart))
+		b.EndNode()
+		b.EndNode()
+	}
+	b.EndNode()
+
+	b.BeginNode("soc")
+	b.PropertyU32("#address-cells", 2)
+	b.PropertyU32("#size-cells", 2)
+	b.PropertyString("compatible", "simple-bus")
+	b.PropertyEmpty("ranges")
+
+	// Software and timer interrupts of every hart
+	var clintIrqs []uint32
+	for hart := 0; hart < config.Harts; hart++ {
+		clintIrqs = append(clintIrqs, phandleCpuIntc(hart), 3, phandleCpuIntc(hart), 7)
+	}
+	b.BeginNode(fmt.Sprintf("clint@%x", instructions.BASE_CLINT))
+	b.PropertyString("compatible", "sifive,clint0", "riscv,clint0")
+	b.PropertyU64("reg", instructions.BASE_CLINT, instructions.CLINT_END-instructions.BASE_CLINT+1)
+	b.PropertyU32("interrupts-extended", clintIrqs...)
+	b.EndNode()
+
+	// M-mode and S-mode external interrupts of every hart, in context order
+	var plicIrqs []uint32
+	for hart := 0; hart < config.Harts; hart++ {
+		plicIrqs = append(plicIrqs, phandleCpuIntc(hart), 11, phandleCpuIntc(hart), 9)
+	}
+	b.BeginNode(fmt.Sprintf("plic@%x", instructions.PLIC_BASE))
+	b.PropertyString("compatible", "sifive,plic-1.0.0", "riscv,plic0")
+	b.PropertyU64("reg", uint64(instructions.PLIC_BASE), uint64(instructions.PLIC_SIZE))
+	b.PropertyU32("#address-cells", 0)
+	b.PropertyU32("#interrupt-cells", 1)
+	b.PropertyEmpty("interrupt-controller")
+	b.PropertyU32("riscv,ndev", VIRT_PLIC_NDEV)
+	b.PropertyU32("interrupts-extended", plicIrqs...)
+	b.PropertyU32("phandle", PHANDLE_PLIC)
+	b.EndNode()
+
+	b.BeginNode(fmt.Sprintf("serial@%x", instructions.VIRT_UART0))
+	b.PropertyString("compatible", "ns16550a")
+	b.PropertyU64("reg", instructions.VIRT_UART0, 0x100)
+	b.PropertyU32("clock-frequency", UART_CLOCK_FREQUENCY)
+	b.PropertyU32("interrupt-parent", PHANDLE_PLIC)
+	b.PropertyU32("interrupts", instructions.UART0_IRQ)
+	b.EndNode()
+
+	b.BeginNode(fmt.Sprintf("test@%x", instructions.VIRT_TEST))
+	b.PropertyString("compatible", "sifive,test1", "sifive,test0", "syscon")
+	b.PropertyU64("reg", instructions.VIRT_TEST, instructions.VIRT_TEST_SIZE)
+	b.PropertyU32("phandle", PHANDLE_TEST)
+	b.EndNode()
+
+	b.BeginNode("poweroff")
+	b.PropertyString("compatible", "syscon-poweroff")
+	b.PropertyU32("regmap", PHANDLE_TEST)
+	b.PropertyU32("offset", 0)
+	b.PropertyU32("value", instructions.FINISHER_PASS)
+	b.EndNode()
+
+	b.BeginNode("reboot")
+	b.PropertyString("compatible", "syscon-reboot")
+	b.PropertyU32("regmap", PHANDLE_TEST)
+	b.PropertyU32("offset", 0)
+	b.PropertyU32("value", instructions.FINISHER_RESET)
+	b.EndNode()
+
+	b.BeginNode(fmt.Sprintf("rtc@%x", instructions.VIRT_RTC))
+	b.PropertyString("compatible", "google,goldfish-rtc")
+	b.PropertyU64("reg", instructions.VIRT_RTC, instructions.VIRT_RTC_SIZE)
+	b.PropertyU32("interrupt-parent", PHANDLE_PLIC)
+	b.PropertyU32("interrupts", instructions.RTC_IRQ)
+	b.EndNode()
+
+	b.BeginNode(fmt.Sprintf("keypad@%x", instructions.VIRT_EVENTS))
+	b.PropertyString("compatible", "google,goldfish-events-keypad")
+	b.PropertyU64("reg", instructions.VIRT_EVENTS, instructions.VIRT_EVENTS_SIZE)
+	b.PropertyU32("interrupt-parent", PHANDLE_PLIC)
+	b.PropertyU32("interrupts", instructions.EVENTS_IRQ)
+	b.EndNode()
+
+	b.BeginNode(fmt.Sprintf("audio@%x", instructions.VIRT_AUDIO))
+	b.PropertyString("compatible", "kutemu,audio")
+	b.PropertyU64("reg", instructions.VIRT_AUDIO, instructions.VIRT_AUDIO_SIZE)
+	b.PropertyU32("interrupt-parent", PHANDLE_PLIC)
+	b.PropertyU32("interrupts", instructions.AUDIO_IRQ)
+	b.EndNode()
+
+	// Pixels are words, addressed by pixel index rather than byte offset,
+	// so this is not a simple-framebuffer
+	b.BeginNode(fmt.Sprintf("framebuffer@%x", instructions.VIRT_DISPLAY))
+	b.PropertyString("compatible", "kutemu,display")
+	b.PropertyU64("reg", instructions.VIRT_DISPLAY, instructions.VIRT_DISPLAY_SIZE)
+	b.PropertyU32("width", SCREEN_WIDTH)
+	b.PropertyU32("height", SCREEN_HEIGHT)
+	b.PropertyString("format", "a8r8g8b8")
+	b.EndNode()
+
+	b.EndNode()
+
+	b.EndNode()
+	return b.Finish(0)
+}
@@ -0,0 +1,174 @@
+package emulator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"riscv/fdt"
+	"riscv/instructions"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type dtNode struct {
+	props    map[string][]byte
+	children map[string]*dtNode
+}
+
+// parseDeviceTree reads the structure block of a blob into nodes
+func parseDeviceTree(t *testing.T, blob []byte) *dtNode {
+	be := binary.BigEndian
+	if be.Uint32(blob) != fdt.FDT_MAGIC || int(be.Uint32(blob[4:])) != len(blob) {
+		t.Fatalf("Expected a device tree of %d bytes", len(blob))
+	}
+	off, strs := be.Uint32(blob[8:]), be.Uint32(blob[12:])
+	word := func() uint32 {
+		v := be.Uint32(blob[off:])
+		off += 4
+		return v
+	}
+	cstring := func(at uint32) string {
+		end := at
+		for blob[end] != 0 {
+			end++
+		}
+		return string(blob[at:end])
+	}
+	var stack []*dtNode
+	var root *dtNode
+	for {
+		switch token := word(); token {
+		case fdt.FDT_BEGIN_NODE:
+			name := cstring(off)
+			off = (off + uint32(len(name)) + 1 + 3) &^ 3
+			node := &dtNode{props: make(map[string][]byte), children: make(map[string]*dtNode)}
+			if len(stack) == 0 {
+				root = node
+			} else {
+				stack[len(stack)-1].children[name] = node
+			}
+			stack = append(stack, node)
+		case fdt.FDT_END_NODE:
+			stack = stack[:len(stack)-1]
+		case fdt.FDT_PROP:
+			size, nameOff := word(), word()
+			stack[len(stack)-1].props[cstring(strs+nameOff)] = blob[off : off+size]
+			off = (off + size + 3) &^ 3
+		case fdt.FDT_END:
+			if len(stack) != 0 {
+				t.Fatalf("Expected every node to end")
+			}
+			return root
+		default:
+			t.Fatalf("Expected a token, Got %x at %d", token, off-4)
+		}
+	}
+}
+
+func (n *dtNode) node(t *testing.T, path string) *dtNode {
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		child, ok := n.children[name]
+		if !ok {
+			t.Fatalf("Expected node %s", path)
+		}
+		n = child
+	}
+	return n
+}
+
+func (n *dtNode) u32s(name string) []uint32 {
+	var v []uint32
+	for i := 0; i+4 <= len(n.props[name]); i += 4 {
+		v = append(v, binary.BigEndian.Uint32(n.props[name][i:]))
+	}
+	return v
+}
+
+func TestDeviceTree(t *testing.T) {
+	const harts = 3
+	root := parseDeviceTree(t, generateDeviceTree(Config{Harts: harts, MemorySize: VIRT_DRAM_SIZE}))
+
+	cpus := root.node(t, "/cpus")
+	if got := cpus.u32s("timebase-frequency"); !slices.Equal(got, []uint32{TIMEBASE_FREQUENCY}) {
+		t.Errorf("Expected timebase-frequency %d, Got %v", TIMEBASE_FREQUENCY, got)
+	}
+	if len(cpus.children) != harts {
+		t.Errorf("Expected %d cpus, Got %d", harts, len(cpus.children))
+	}
+	var clint, plic []uint32
+	for hart := 0; hart < harts; hart++ {
+		intc := root.node(t, fmt.Sprintf("/cpus/cpu@%d/interrupt-controller", hart))
+		if _, ok := intc.props["interrupt-controller"]; !ok {
+			t.Errorf("Expected hart %d to have an interrupt controller", hart)
+		}
+		phandle := intc.u32s("phandle")
+		if len(phandle) != 1 {
+			t.Fatalf("Expected a phandle on the interrupt controller of hart %d", hart)
+		}
+		clint = append(clint, phandle[0], 3, phandle[0], 7)
+		plic = append(plic, phandle[0], 11, phandle[0], 9)
+	}
+	if got := root.node(t, fmt.Sprintf("/soc/clint@%x", instructions.BASE_CLINT)).u32s("interrupts-extended"); !slices.Equal(got, clint) {
+		t.Errorf("Expected the clint to reach the software and timer interrupts of every hart %v, Got %v", clint, got)
+	}
+	plicNode := root.node(t, fmt.Sprintf("/soc/plic@%x", instructions.PLIC_BASE))
+	if got := plicNode.u32s("interrupts-extended"); !slices.Equal(got, plic) {
+		t.Errorf("Expected a M-mode and a S-mode context for every hart %v, Got %v", plic, got)
+	}
+	if got := plicNode.u32s("phandle"); !slices.Equal(got, []uint32{PHANDLE_PLIC}) {
+		t.Errorf("Expected the plic phandle %d, Got %v", PHANDLE_PLIC, got)
+	}
+
+	for _, device := range []struct {
+		name string
+		base uint32
+		irq  uint32
+	}{
+		{"serial", instructions.VIRT_UART0, instructions.UART0_IRQ},
+		{"rtc", instructions.VIRT_RTC, instructions.RTC_IRQ},
+		{"keypad", instructions.VIRT_EVENTS, instructions.EVENTS_IRQ},
+		{"audio", instructions.VIRT_AUDIO, instructions.AUDIO_IRQ},
+	} {
+		node := root.node(t, fmt.Sprintf("/soc/%s@%x", device.name, device.base))
+		if got := node.u32s("reg"); len(got) != 4 || got[1] != device.base {
+			t.Errorf("Expected %s at %x, Got %v", device.name, device.base, got)
+		}
+		if got := node.u32s("interrupts"); !slices.Equal(got, []uint32{device.irq}) {
+			t.Errorf("Expected %s on interrupt %d, Got %v", device.name, device.irq, got)
+		}
+		if got := node.u32s("interrupt-parent"); !slices.Equal(got, []uint32{PHANDLE_PLIC}) {
+			t.Errorf("Expected %s to interrupt through the plic, Got %v", device.name, got)
+		}
+	}
+
+	// The test device has no interrupt, power off and reboot write to it
+	test := root.node(t, fmt.Sprintf("/soc/test@%x", instructions.VIRT_TEST))
+	if got := test.u32s("reg"); len(got) != 4 || got[1] != instructions.VIRT_TEST {
+		t.Errorf("Expected the test device at %x, Got %v", instructions.VIRT_TEST, got)
+	}
+	for name, value := range map[string]uint32{"poweroff": instructions.FINISHER_PASS, "reboot": instructions.FINISHER_RESET} {
+		node := root.node(t, "/soc/"+name)
+		if !slices.Equal(node.u32s("regmap"), test.u32s("phandle")) || !slices.Equal(node.u32s("value"), []uint32{value}) {
+			t.Errorf("Expected %s to write %x to the test device", name, value)
+		}
+	}
+}
+
+func TestDeviceTreeInRAM(t *testing.T) {
+	for _, size := range []uint32{VIRT_DRAM_SIZE, 64 * 1024 * 1024, DTB - VIRT_DRAM + 16} {
+		config := Config{SBI: true, MemorySize: size}
+		e := NewEmulator(config)
+		_ = e.Load()
+		dtb := generateDeviceTree(e.config)
+		addr := e.Register(11)
+		if addr%8 != 0 || uint64(addr)+uint64(len(dtb)) > uint64(VIRT_DRAM)+uint64(size) {
+			t.Errorf("Expected the device tree inside %d bytes of RAM, Got it at %x", size, addr)
+		}
+		if got := e.cpu.Memory.ReadWord(addr); got != 0xedfe0dd0 {
+			t.Errorf("Expected the device tree magic at %x, Got %08x", addr, got)
+		}
+	}
+	if got := dtbAddress(Config{MemorySize: VIRT_DRAM_SIZE}, 0x1000); got != DTB {
+		t.Errorf("Expected the device tree at %x, Got %x", DTB, got)
+	}
+}
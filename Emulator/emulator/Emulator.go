@@ -3,201 +3,771 @@ package emulator
 import (
 	"fmt"
 	"log"
-	"maps"
 	"os"
+	"os/signal"
 	"riscv/instructions"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/veandco/go-sdl2/sdl"
 )
 
 type Emulator struct {
-	cpu      *instructions.Cpu
-	window   *sdl.Window
-	renderer *sdl.Renderer
-	texture  *sdl.Texture
+	config Config
+	// Harts of the machine, cpu is the one running its quantum
+	harts []*instructions.Cpu
+	cpu   *instructions.Cpu
+	// Instret of cpu when its quantum began
+	quantum uint64
+	// Times the devices ran for a hart waiting in wfi, Step counts them like instructions
+	idled uint64
+	sdlWindow
 	running  bool
+	debugger *Debugger
+	monitor  *Monitor
+	web      *Web
+	terminal *Terminal
+	sound    *Sound
+	tracer   *Tracer
+	lockstep *Lockstep
+	profiler *Profiler
+	coverage *Coverage
+	// Run translated blocks instead of one instruction at a time, and the block which ran last
+	blocks bool
+	block  *instructions.Block
+	bench  *Bench
+	// Screenshots and video frames taken at instruction counts
+	capture *Capture
+	// Added through the library API, they stay across resets
+	execHooks   []ExecHook
+	memoryHooks []func(addr uint32, size uint32, value uint32, write bool)
+	mmio        []*instructions.MMIO
+	// Instructions executed when the library loop last moved mtime
+	timeInstret uint64
+	// Snapshot asked for by the SDL window, done by the run loop between instructions
+	snapshotRequest atomic.Int32
+	// Where the guest is, for the goroutines of the frontends. The run loop publishes it when one asks.
+	progress       atomic.Pointer[progress]
+	progressWanted atomic.Bool
+	// Snapshot at SnapshotPC is taken only the first time it is reached
+	snapshotTaken bool
+	// Time and UART input when recording, replaying or running backwards
+	journal *Journal
+	reverse *Reverse
+	// Set while reverse execution executes instructions again, the tools don't see them
+	rewinding bool
+	// sha256 of the loaded image
+	image [32]byte
+	// Set on SIGINT while recording, profiling, measuring coverage, benchmarking or capturing video, so the files get written properly
+	interrupted atomic.Bool
+	// Host time in milliseconds kept by UpdateTime, the run loop gives it to the CLINT
+	wallClock atomic.Uint64
 }
 
 const VIRT_DRAM = 0x80000000
+const VIRT_DRAM_SIZE = 128 * 1024 * 1024
 const VIRT_OPENSBI_START = 0x80200000
 const VIRT_VIRTIO = 0x10001000
 const DTB = 0x87e00000
+const VIRT_PLIC_NDEV = 95
+
+// Instructions a hart runs before the next one gets its turn
+const HART_QUANTUM = 1000
+
+// Host time given up each time a hart waiting in wfi finds no interrupt pending
+const WFI_SLEEP = 200 * time.Microsecond
+
+// Instruction passed to the devices when the hart waits in wfi
+var wfi = &instructions.Decoded{Name: "wfi", Op: instructions.OP_WFI, Word: 0x10500073}
+
+// Process exit code when guest crashes instead of powering off.
+// Guest fail codes from the test device are always odd, so it can't be confused with them.
+const EXIT_CRASH = 2
+
+// Process exit code when the debugger killed the guest or the monitor quit
+const EXIT_KILLED = 4
+
+// Process exit code when lockstep found a difference with the reference, or replay with the recording
+const EXIT_DIVERGED = 6
+
+// Process exit code when stopped with Ctrl-C, like a shell reports it
+const EXIT_INTERRUPTED = 130
 const SCREEN_WIDTH = 320
 const SCREEN_HEIGHT = 200
 
-func NewEmulator() *Emulator {
-	uart := instructions.NewUART()
-	clint := &instructions.Clint{}
-	plic := &instructions.Plic{
-		Priority:  1,
-		Pending:   make([]uint32, 0),
-		Enable:    0,
-		Threshold: 1,
-		Claim:     0,
-		Complete:  0,
+func NewEmulator(config Config) *Emulator {
+	config.setDefaults()
+	harts := newMachine(config)
+	e := &Emulator{
+		config:  config,
+		harts:   harts,
+		cpu:     harts[0],
+		running: true,
 	}
+	e.publish()
+	return e
+}
+
+// Creates the harts with all their devices in their power on state
+func newMachine(config Config) []*instructions.Cpu {
+	uart := instructions.NewUART()
+	clint := instructions.NewClint(config.Harts)
+	// An M-mode and a S-mode context for every hart
+	plic := instructions.NewPlic(VIRT_PLIC_NDEV, 2*uint32(config.Harts))
 	screen := make(map[uint32]uint32)
 	disp := &instructions.Display{
 		Screen: screen,
 		Mutex:  sync.Mutex{},
 	}
-	memory := &instructions.Memory{Map: make(map[uint32]byte), Uart: uart, Plic: plic, Clint: clint, Display: disp}
-	csr := &instructions.CSR{
-		Registers: make([]uint32, 4096),
-	}
-	cpu := &instructions.Cpu{
-		PC:          0x80000000,
-		Registers:   [32]uint32{},
-		Memory:      memory,
-		CSR:         csr,
-		CurrentMode: 3,
+	syscon := &instructions.Syscon{}
+	rtc := instructions.NewGoldfishRTC(config.RTCStart, plic)
+	events := instructions.NewGoldfishEvents(plic, SCREEN_WIDTH, SCREEN_HEIGHT)
+	audio := instructions.NewAudio(plic)
+	memory := &instructions.Memory{Map: make(map[uint32]byte), Uart: uart, Plic: plic, Clint: clint, Display: disp, Syscon: syscon, Rtc: rtc, Events: events, Audio: audio}
+	audio.Memory = memory
+	// Every hart starts at the image with a0 = hartid, the guest tells them apart
+	harts := make([]*instructions.Cpu, config.Harts)
+	for i := range harts {
+		csr := &instructions.CSR{
+			Registers: make([]uint32, 4096),
+		}
+		harts[i] = &instructions.Cpu{
+			PC:          0x80000000,
+			Registers:   [32]uint32{},
+			Memory:      memory,
+			CSR:         csr,
+			CurrentMode: 3,
+			HartID:      uint32(i),
+		}
+		harts[i].Registers[10] = uint32(i)
 	}
-	memory.SetCpu(cpu)
-	cpu.Memory = memory
-	return &Emulator{
-		cpu:      cpu,
-		window:   nil,
-		renderer: nil,
-		texture:  nil,
-		running:  true,
+	memory.SetHarts(harts)
+
+	// Firmware hands over to the kernel in S-mode with a0 = hartid, a1 = device tree
+	if config.SBI {
+		sbi := instructions.NewSbi(harts)
+		for _, hart := range harts {
+			hart.Sbi = sbi
+			hart.CurrentMode = 1
+		}
+		cpu := harts[0]
+		cpu.PC = VIRT_OPENSBI_START
+		cpu.Registers[11] = dtbAddress(config, len(generateDeviceTree(config)))
 	}
+	return harts
 }
 
 func (e *Emulator) UpdateTime() {
 	for {
 		time.Sleep(1 * time.Millisecond)
-		e.cpu.Memory.Clint.Mtime = uint64(time.Now().UnixMilli())
+		e.wallClock.Store(uint64(time.Now().UnixMilli()))
 	}
 }
 
-func (e *Emulator) Run() {
-	//f, _ := os.Create("e.log")
-	//defer f.Close()
-
+// Load puts the guest image and the device tree into memory. The device tree is loaded even when the image
+// can't be read.
+func (e *Emulator) Load() error {
 	//body, _ := os.ReadFile("./../C/OS/fw_dynamic.bin")
-	path := os.Getenv("OBJ_PATH")
-	//path = "/home/josv/Projects/RiscV/Tests/os.img"
-	path = "/home/josv/Projects/RiscV/Tests/doom-riscv.bin"
-	body, _ := os.ReadFile(path)
-	_ = e.cpu.Memory.LoadBytes(body, VIRT_DRAM)
+	path := e.config.Image
+	if path == "" {
+		path = os.Getenv("OBJ_PATH")
+	}
+	if path == "" {
+		//path = "/home/josv/Projects/RiscV/Tests/os.img"
+		path = "/home/josv/Projects/RiscV/Tests/doom-riscv.bin"
+	}
+	body, err := os.ReadFile(path)
+	e.image = imageHash(body)
+	location := uint32(VIRT_DRAM)
+	if e.config.SBI {
+		location = VIRT_OPENSBI_START
+	}
+	_ = e.cpu.Memory.LoadBytes(body, location)
 
-	memory := e.cpu.Memory
-	cpu := e.cpu
+	dtb := generateDeviceTree(e.config)
+	_ = e.cpu.Memory.LoadBytes(dtb, dtbAddress(e.config, len(dtb)))
+	return err
+}
+
+// The device tree goes at DTB, or at the top of RAM when the blob doesn't fit below the end of RAM there
+func dtbAddress(config Config, size int) uint32 {
+	end := uint64(VIRT_DRAM) + uint64(config.MemorySize)
+	if uint64(DTB)+uint64(size) <= end {
+		return DTB
+	}
+	// The blob has to be 8 byte aligned
+	return uint32(end-uint64(size)) &^ 7
+}
 
-	//body, _ = os.ReadFile("two.dtb")
-	//_ = memory.LoadBytes(body, DTB)
+// Loads the guest image into memory, a missing image shows up as the guest crashing
+func (e *Emulator) load() {
+	_ = e.Load()
+}
 
-	var b [4]byte
-	go func() {
-		e.initialize()
-		for {
-			e.drawScreen()
+// Puts the machine back in its power on state, keeping what is shown on the screen till guest redraws it
+func (e *Emulator) reset() {
+	display := e.cpu.Memory.Display
+	// Instret counts for the whole run, recordings and traces refer to it
+	harts := newMachine(e.config)
+	for i, hart := range harts {
+		hart.Instret = e.harts[i].Instret
+	}
+	e.harts = harts
+	e.cpu = harts[0]
+	e.quantum = e.cpu.Instret
+	e.block = nil
+	e.cpu.Memory.Display = display
+	e.attach()
+	e.load()
+}
+
+// Hooks the tools into the cpu
+func (e *Emulator) attach() {
+	e.hookMemory()
+	e.cpu.Memory.MMIO = e.mmio
+	// Takes the UART output from stdout, before the browser adds to it
+	if e.terminal != nil {
+		e.terminal.attach(e.cpu.Memory.Uart)
+	}
+	// Before the journal, so what is typed in the browser is recorded
+	if e.web != nil {
+		e.web.attach(e.cpu.Memory.Uart)
+	}
+	if e.journal != nil {
+		e.journal.attach(e)
+	}
+	if e.bench != nil {
+		e.cpu.Memory.Stats = &e.bench.stats
+	}
+	if e.sound != nil {
+		e.cpu.Memory.Audio.Output = func(rate uint32, channels uint32, samples []int16) {
+			// Heard the first time
+			if !e.rewinding {
+				e.sound.play(rate, channels, samples)
+			}
 		}
-	}()
+	}
+	if e.reverse != nil {
+		// Checkpoints after the first one keep the pages written since the one before
+		if e.cpu.Memory.Dirty == nil {
+			e.cpu.Memory.Dirty = make(map[uint32]bool)
+		}
+		// The guest already printed it the first time
+		output := e.cpu.Memory.Uart.Output
+		e.cpu.Memory.Uart.Output = func(b byte) {
+			if !e.rewinding {
+				output(b)
+			}
+		}
+	}
+}
 
-	// Update time goroutines
-	go e.UpdateTime()
+// hookMemory gives the harts the memory hooks of the tools and the library
+func (e *Emulator) hookMemory() {
+	var hooks []func(addr uint32, size uint32, value uint32, write bool)
+	hooks = append(hooks, e.memoryHooks...)
+	if e.debugger != nil {
+		hooks = append(hooks, e.debugger.memoryAccess)
+	}
+	if e.tracer != nil {
+		hooks = append(hooks, e.tracer.memoryAccess)
+	}
+	if e.lockstep != nil {
+		hooks = append(hooks, e.lockstep.memoryAccess)
+	}
+	var hook func(addr uint32, size uint32, value uint32, write bool)
+	switch len(hooks) {
+	case 0:
+	case 1:
+		hook = hooks[0]
+	default:
+		hook = func(addr uint32, size uint32, value uint32, write bool) {
+			for _, hook := range hooks {
+				hook(addr, size, value, write)
+			}
+		}
+	}
+	for _, hart := range e.harts {
+		hart.MemoryHook = hook
+	}
+}
 
-	for {
-		b[0] = memory.ReadByte(cpu.PC)
-		b[1] = memory.ReadByte(cpu.PC + 1)
-		b[2] = memory.ReadByte(cpu.PC + 2)
-		b[3] = memory.ReadByte(cpu.PC + 3)
-
-		// fail on empty instructions
-		if b[0] == 0 && b[1] == 0 && b[2] == 0 && b[3] == 0 {
-			fmt.Printf("\nFail: Empty instruction. PC: %x\n", cpu.PC)
-			cpu.PC += 4
+// Run executes the guest till it powers off and returns the exit code for the process
+func (e *Emulator) Run() int {
+	if e.config.Trace != "" {
+		tracer, err := NewTracer(e.config.Trace, e.config.TraceFilter, e.config.TraceDisasm)
+		if err != nil {
+			log.Fatalf("Failed to open trace: %s\n", err)
+		}
+		defer tracer.Close()
+		e.tracer = tracer
+	}
+	if e.config.Lockstep != "" {
+		lockstep, err := NewLockstep(e.config.Lockstep, e.config.LockstepContext)
+		if err != nil {
+			log.Fatalf("Failed to open reference log: %s\n", err)
+		}
+		defer lockstep.Close()
+		e.lockstep = lockstep
+	}
+	if e.config.Profile != "" || e.config.ProfileFolded != "" || e.config.ProfileTop > 0 {
+		profiler, err := NewProfiler(e.config.ProfileSymbols, e.config.ProfileInterval)
+		if err != nil {
+			log.Fatalf("Failed to read profile symbols: %s\n", err)
+		}
+		defer profiler.Close(e.config)
+		e.profiler = profiler
+		e.catchInterrupt()
+	}
+	if e.config.Coverage != "" {
+		coverage, err := NewCoverage(e.config.CoverageELF)
+		if err != nil {
+			log.Fatalf("Failed to read coverage debug info: %s\n", err)
+		}
+		defer coverage.Close(e.config.Coverage)
+		e.coverage = coverage
+		e.catchInterrupt()
+	}
+	if e.config.Bench {
+		e.bench = NewBench(e.config.BenchCount)
+		defer func() { e.bench.report(os.Stderr, e.instret(), e.blocks) }()
+		e.catchInterrupt()
+	}
+	if e.config.Gdb != "" {
+		debugger, err := NewDebugger(e, e.config.Gdb, e.config.GdbWait)
+		if err != nil {
+			log.Fatalf("Failed to start gdb server: %s\n", err)
+		}
+		defer debugger.Close()
+		e.debugger = debugger
+	}
+	if e.config.Monitor != "" {
+		monitor, err := NewMonitor(e, e.config.Monitor)
+		if err != nil {
+			log.Fatalf("Failed to start monitor: %s\n", err)
+		}
+		defer monitor.Close()
+		e.monitor = monitor
+	}
+	if e.config.Web != "" {
+		web, err := NewWeb(e, e.config.Web)
+		if err != nil {
+			log.Fatalf("Failed to start web server: %s\n", err)
+		}
+		defer web.Close()
+		e.web = web
+	}
+	if e.config.Terminal {
+		e.terminal = NewTerminal(e, e.config.TerminalFPS)
+		// The terminal has to be put back
+		defer e.terminal.Close()
+		e.catchInterrupt()
+	}
+	e.load()
+	header := recordingHeader{
+		SBI:        e.config.SBI,
+		MemorySize: e.config.MemorySize,
+		Image:      e.image,
+		Mtime:      uint64(time.Now().UnixMilli()),
+	}
+	switch {
+	case e.config.Replay != "":
+		replay, err := NewReplay(e.config.Replay)
+		if err != nil {
+			log.Fatalf("Failed to open recording: %s\n", err)
+		}
+		if err := replay.Check(e.config, e.image); err != nil {
+			log.Fatalf("Can't replay %s: %s\n", e.config.Replay, err)
+		}
+		// Resets build the RTC from the config, it has to start at the same time
+		e.config.RTCStart = time.Unix(0, replay.Header.RTCStart)
+		e.cpu.Memory.Rtc.Start = e.config.RTCStart
+		e.journal = replay
+	case e.config.Record != "" || e.config.Reverse:
+		if e.config.RTCStart.IsZero() {
+			e.config.RTCStart = time.Now()
+		}
+		e.cpu.Memory.Rtc.Start = e.config.RTCStart
+		header.RTCStart = e.config.RTCStart.UnixNano()
+		if e.config.Record == "" {
+			e.journal = NewLiveJournal(header)
 			break
 		}
-		inst := instructions.DecodeBytes(b)
+		recording, err := NewRecording(e.config.Record, header)
+		if err != nil {
+			log.Fatalf("Failed to create recording: %s\n", err)
+		}
+		defer func() {
+			if err := recording.Close(e.cpu.Instret); err != nil {
+				log.Printf("Failed to write recording: %s\n", err)
+			}
+		}()
+		e.journal = recording
+		e.catchInterrupt()
+	}
+	if e.config.Reverse {
+		e.reverse = NewReverse(e.config.ReverseInterval)
+	}
+	if sound := e.openSound(); sound != nil {
+		defer func() {
+			if err := sound.Close(); err != nil {
+				log.Printf("Failed to write audio: %s\n", err)
+			}
+		}()
+		e.sound = sound
+		e.catchInterrupt()
+	}
+	e.attach()
 
-		//fmt.Println(fmt.Sprintf("Executing Bytes: %x, Opcode: %s, Operation: #%v PC: %x ", instructions.TransformLittleToBig(b), inst.Operation(), inst, cpu.PC))
-		//mstatus := instructions.ToMStatusReg(cpu.CSR.GetValue(instructions.MSTATUS, cpu.CurrentMode, &cpu))
-		//fmt.Println(fmt.Sprintf("before mstatus: %x", mstatus))
+	if e.config.Restore != "" {
+		if err := e.restoreSnapshot(e.config.Restore); err != nil {
+			log.Fatalf("Failed to restore snapshot: %s\n", err)
+		}
+	}
+	if e.config.DumpDTB != "" {
+		if err := os.WriteFile(e.config.DumpDTB, generateDeviceTree(e.config), 0644); err != nil {
+			log.Printf("Failed to dump device tree: %s\n", err)
+		}
+	}
 
-		// f.WriteString(fmt.Sprintf("0x%x\n", cpu.PC))
-		_ = cpu.ExecInst(inst)
+	// After the journal, it decides if input goes in
+	if e.config.Vnc != "" {
+		vnc, err := NewVnc(e, e.config.Vnc)
+		if err != nil {
+			log.Fatalf("Failed to start vnc server: %s\n", err)
+		}
+		defer vnc.Close()
+	}
+	if !e.config.Headless {
+		if err := e.startWindow(); err != nil {
+			log.Printf("No window, running headless: %s\n", err)
+		}
+	}
 
-		//mstatus = instructions.ToMStatusReg(cpu.CSR.GetValue(instructions.MSTATUS, cpu.CurrentMode, &cpu))
-		//fmt.Println(fmt.Sprintf("after mstatus: %x", mstatus))
+	if len(e.config.ScreenshotAt) > 0 || e.config.Video != "" {
+		capture, err := NewCapture(e.config)
+		if err != nil {
+			log.Fatalf("Failed to open video: %s\n", err)
+		}
+		defer capture.Close()
+		e.capture = capture
+		e.catchInterrupt()
+	}
+
+	// Last, the messages of a failed start stay readable
+	if e.terminal != nil {
+		e.terminal.start()
+	}
+	e.blocks = e.useBlocks()
+	if e.bench != nil {
+		e.bench.begin(e.instret())
+	}
 
-		if e.cpu.Memory.Uart.DataExistsToRead() && cpu.CSR.Registers[instructions.MIE] > 0 {
-			// trigger a plic interrupt
-			e.cpu.Memory.Plic.TriggerInterrupt(10, cpu)
+	// Update time goroutines. The journal moves time itself, at known instructions.
+	clock := e.journal == nil
+	if clock {
+		// Set before the first instruction, a timer programmed from 0 would fire right away
+		e.wallClock.Store(uint64(time.Now().UnixMilli()))
+		go e.UpdateTime()
+	}
+
+	for {
+		if clock {
+			e.cpu.Memory.Clint.Mtime = e.wallClock.Load()
+		}
+		if code, ok := e.step(); !ok {
+			return code
 		}
-		_ = cpu.HandleInterrupts(inst.Operation())
+	}
+}
 
-		//mstatus = instructions.ToMStatusReg(cpu.CSR.GetValue(instructions.MSTATUS, cpu.CurrentMode, &cpu))
-		//fmt.Println(fmt.Sprintf("post interrupt mstatus: %x", mstatus))
-		// Handle interrupts / exceptions
+// step runs the next instruction, or block with e.blocks set, and everything which comes with it. It returns
+// false with the exit code when the run is over.
+func (e *Emulator) step() (int, bool) {
+	if code, ok := e.prepare(); !ok {
+		return code, false
+	}
+	if req := e.snapshotRequest.Swap(SNAPSHOT_NONE); req != SNAPSHOT_NONE {
+		e.snapshot(req)
+	}
+	if e.progressWanted.Load() && e.progressWanted.Swap(false) {
+		e.publish()
+	}
+	if e.config.SnapshotPC != 0 && e.cpu.PC == e.config.SnapshotPC && !e.snapshotTaken {
+		e.snapshotTaken = true
+		e.snapshot(SNAPSHOT_SAVE)
+	}
+	if e.monitor != nil && !e.monitor.beforeExec(e.cpu) {
+		return EXIT_KILLED, false
+	}
+	if e.debugger != nil && !e.debugger.beforeExec(e.cpu) {
+		return EXIT_KILLED, false
+	}
+	if e.web != nil {
+		e.web.beforeExec()
+	}
+	execute := e.execute
+	if e.blocks {
+		execute = e.executeBlock
+	}
+	if e.cpu.Waiting {
+		execute = e.idle
+	}
+	code, ok := execute()
+	// Also when the guest powers off right after asking
+	if display := e.cpu.Memory.Display; display.ScreenshotRequested {
+		display.ScreenshotRequested = false
+		e.screenshot()
+	}
+	if !ok {
+		return code, false
 	}
+	if e.capture != nil {
+		e.capture.tick(e)
+	}
+	e.schedule()
+	return 0, true
 }
 
-func (e *Emulator) initialize() {
-	// Initialize SDL
-	if err := sdl.Init(sdl.INIT_VIDEO); err != nil {
-		log.Fatalf("Failed to initialize SDL: %s\n", err)
+// schedule gives the next running hart its turn once the current one ran its quantum, stopped or waits in
+// wfi. Harts take turns in hart ID order, so runs are the same every time. When every hart waits the current
+// one stays, so the devices are run by idle till an interrupt wakes one.
+func (e *Emulator) schedule() {
+	if len(e.harts) == 1 || (!e.cpu.Stopped && !e.cpu.Waiting && e.cpu.Instret-e.quantum < HART_QUANTUM) {
+		return
+	}
+	next := e.cpu
+	for i := 1; i <= len(e.harts); i++ {
+		hart := e.harts[(int(e.cpu.HartID)+i)%len(e.harts)]
+		if !hart.Stopped && !hart.Idle() {
+			next = hart
+			break
+		}
+	}
+	if next == e.cpu && e.cpu.Stopped {
+		// Only waiting harts are left
+		for _, hart := range e.harts {
+			if !hart.Stopped {
+				next = hart
+				break
+			}
+		}
+	}
+	if next == e.cpu && e.cpu.Instret-e.quantum < HART_QUANTUM {
+		return
 	}
+	e.cpu = next
+	e.quantum = e.cpu.Instret
+	e.block = nil
+}
+
+// progress is where the guest was when the run loop last published it
+type progress struct {
+	PC      uint32
+	Instret uint64
+}
 
-	// Create a window
-	window, err := sdl.CreateWindow("RiscV32", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED, 320, 200, sdl.WINDOW_SHOWN)
-	if err != nil {
-		log.Fatalf("Failed to create window: %s\n", err)
+// publish lets the frontends see where the guest is now, only the run loop calls it
+func (e *Emulator) publish() {
+	e.progress.Store(&progress{PC: e.cpu.PC, Instret: e.instret()})
+}
+
+// lastProgress is where the guest was at the last publish, and asks the run loop for a newer one. The
+// goroutines of the frontends read it instead of e.cpu, which a reset or the next hart replaces.
+func (e *Emulator) lastProgress() progress {
+	e.progressWanted.Store(true)
+	return *e.progress.Load()
+}
+
+// instret is the number of instructions all harts executed
+func (e *Emulator) instret() uint64 {
+	var n uint64
+	for _, hart := range e.harts {
+		n += hart.Instret
 	}
-	e.window = window
+	return n
+}
 
-	// Create a renderer
-	renderer, err := sdl.CreateRenderer(e.window, -1, sdl.RENDERER_ACCELERATED)
-	if err != nil {
-		log.Fatalf("Failed to create renderer: %s\n", err)
+// catchInterrupt makes Ctrl-C stop the run loop instead of the process, so the deferred writes happen
+func (e *Emulator) catchInterrupt() {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		e.interrupted.Store(true)
+	}()
+}
+
+// prepare does what comes before the next instruction: time moves and a checkpoint may be taken.
+// It returns false with the exit code when the run is over.
+func (e *Emulator) prepare() (int, bool) {
+	if e.interrupted.Load() {
+		return EXIT_INTERRUPTED, false
 	}
-	e.renderer = renderer
+	if e.journal != nil && !e.journal.tick(e.cpu) {
+		if e.journal.Diverged != "" {
+			fmt.Fprintf(os.Stderr, "replay: diverged at instruction %d: %s\n", e.cpu.Instret, e.journal.Diverged)
+			return EXIT_DIVERGED, false
+		}
+		fmt.Fprintf(os.Stderr, "replay: recording ended at instruction %d\n", e.cpu.Instret)
+		return 0, false
+	}
+	if e.reverse != nil {
+		e.reverse.tick(e)
+	}
+	if e.bench != nil && e.bench.done(e.instret()) {
+		return 0, false
+	}
+	return 0, true
+}
+
+// execute runs the instruction at PC and then the devices. It returns false with the exit code when
+// the machine stopped.
+func (e *Emulator) execute() (int, bool) {
+	memory := e.cpu.Memory
+	cpu := e.cpu
 
-	// Create a texture to manipulate pixels
-	texture, err := e.renderer.CreateTexture(sdl.PIXELFORMAT_ARGB8888, sdl.TEXTUREACCESS_STREAMING, SCREEN_WIDTH, SCREEN_HEIGHT)
-	if err != nil {
-		log.Fatalf("Failed to create texture: %s\n", err)
+	d := memory.Fetch(cpu.PC)
+	// fail on empty instructions
+	if d.Inst == nil {
+		fmt.Printf("\nFail: Empty instruction. PC: %x\n", cpu.PC)
+		cpu.PC += 4
+		return EXIT_CRASH, false
+	}
+	inst := d.Inst
+	tools := !e.rewinding
+	if tools {
+		for _, hook := range e.execHooks {
+			hook(int(cpu.HartID), cpu.PC, d.Word)
+		}
+	}
+	if tools && e.tracer != nil {
+		e.tracer.before(cpu, d.Word, inst)
 	}
-	e.texture = texture
-	e.running = true
+	if tools && e.lockstep != nil {
+		e.lockstep.before(cpu, d.Word, inst)
+	}
+	pc := cpu.PC
+	_ = cpu.Exec(d)
+	if tools && e.profiler != nil {
+		e.profiler.executed(pc, inst, cpu)
+	}
+	if tools && e.coverage != nil {
+		e.coverage.executed(pc, cpu)
+	}
+	if tools && e.tracer != nil {
+		e.tracer.after(cpu)
+	}
+	if tools && e.lockstep != nil {
+		if ok, done := e.lockstep.after(cpu); !ok {
+			if done {
+				return 0, false
+			}
+			return EXIT_DIVERGED, false
+		}
+	}
+	if tools && e.debugger != nil && !e.debugger.afterExec() {
+		return EXIT_KILLED, false
+	}
+
+	return e.devices(d)
 }
 
-func (e *Emulator) drawScreen() {
-	// Lock the texture to directly modify its pixels
-	pixels, pitch, err := e.texture.Lock(nil)
-	if err != nil {
-		log.Fatalf("Failed to lock texture: %s\n", err)
+// executeBlock runs the block at PC and then the devices, like execute does for one instruction
+func (e *Emulator) executeBlock() (int, bool) {
+	memory := e.cpu.Memory
+	var b *instructions.Block
+	if e.block != nil {
+		b = memory.Next(e.block, e.cpu.PC)
+	} else {
+		b = memory.Block(e.cpu.PC)
+	}
+	e.block = b
+	if b == nil {
+		return e.execute()
 	}
-	e.cpu.Memory.Display.Mutex.Lock()
-	Screen := maps.Clone(e.cpu.Memory.Display.Screen)
-	e.cpu.Memory.Display.Mutex.Unlock()
-	// Set random colors for each pixel
-	for y := uint32(0); y < SCREEN_HEIGHT; y++ {
-		for x := uint32(0); x < SCREEN_WIDTH; x++ {
-			offset := y*uint32(pitch) + x*4 // Calculate the offset in the pixel buffer
-			// Generate random ARGB values
-			a := byte((Screen[y*SCREEN_WIDTH+x] & 0xFF000000) >> 24)
-			r := byte((Screen[y*SCREEN_WIDTH+x] & 0x00FF0000) >> 16)
-			g := byte((Screen[y*SCREEN_WIDTH+x] & 0x0000FF00) >> 8)
-			b := byte(Screen[y*SCREEN_WIDTH+x] & 0x000000FF)
-			pixels[offset] = b
-			pixels[offset+1] = g
-			pixels[offset+2] = r
-			pixels[offset+3] = a
+	return e.devices(e.cpu.RunBlock(b))
+}
+
+// devices runs the devices after the last instruction and takes the interrupts they raised. It returns
+// false with the exit code when the machine stopped.
+func (e *Emulator) devices(last *instructions.Decoded) (int, bool) {
+	memory := e.cpu.Memory
+	cpu := e.cpu
+
+	// Guest asked for power off or reboot through the test device
+	if memory.Syscon.Requested {
+		if memory.Syscon.Reset {
+			e.reset()
+			return 0, true
 		}
+		return memory.Syscon.ExitCode, false
+	}
+
+	// UART keeps its line high as long as there is data to read
+	memory.Plic.SetLevel(instructions.UART0_IRQ, memory.Uart.DataExistsToRead())
+	memory.Rtc.Tick()
+	memory.Events.Tick()
+	memory.Audio.Tick(memory.Clint.Mtime)
+	if cpu.Sbi != nil {
+		cpu.Sbi.Tick()
+	} else {
+		memory.Clint.Tick()
+	}
+	next := cpu.PC
+	_ = cpu.HandleInterrupts(last.Name)
+	if !e.rewinding && e.profiler != nil && cpu.PC != next {
+		e.profiler.trap(next, cpu.PC)
+	}
+
+	//mstatus = instructions.ToMStatusReg(cpu.CSR.GetValue(instructions.MSTATUS, cpu.CurrentMode, &cpu))
+	//fmt.Println(fmt.Sprintf("post interrupt mstatus: %x", mstatus))
+	// Handle interrupts / exceptions
+	return 0, true
+}
+
+// idle runs the devices for a hart waiting in wfi, without executing anything. The host gets the CPU for
+// WFI_SLEEP as long as no interrupt is pending.
+func (e *Emulator) idle() (int, bool) {
+	cpu := e.cpu
+	// A journal moves time at instruction counts, so the hart goes on. So does a hart no interrupt can wake.
+	if e.journal != nil || cpu.CSR.Registers[instructions.MIE] == 0 {
+		cpu.Waiting = false
 	}
+	if !cpu.Idle() {
+		return 0, true
+	}
+	time.Sleep(WFI_SLEEP)
+	e.idled++
+	return e.devices(wfi)
+}
 
-	// Unlock the texture
-	e.texture.Unlock()
+// useBlocks tells if the guest can run block by block, which is only possible when nothing has to look
+// at every instruction
+func (e *Emulator) useBlocks() bool {
+	return !e.config.Interpret && e.config.SnapshotPC == 0 && e.tracer == nil && e.lockstep == nil &&
+		e.profiler == nil && e.coverage == nil && e.debugger == nil && e.monitor == nil && e.journal == nil &&
+		len(e.execHooks) == 0
+}
 
-	// Clear the renderer and copy the texture to it
-	e.renderer.Clear()
-	e.renderer.Copy(e.texture, nil, nil)
-	e.renderer.Present()
-	// 60 FPS
-	sdl.Delay(30)
-	//e.cpu.Memory.Display.Screen[0] = 1 << 16
+func (e *Emulator) snapshot(req int32) {
+	path := e.snapshotPath()
+	switch req {
+	case SNAPSHOT_SAVE:
+		if err := e.saveSnapshot(path); err != nil {
+			log.Printf("Failed to save snapshot: %s\n", err)
+			return
+		}
+		log.Printf("Saved snapshot to %s at pc 0x%x\n", path, e.cpu.PC)
+	case SNAPSHOT_RESTORE:
+		// Jumping to another point would make the run different from its journal
+		if e.journal != nil {
+			log.Printf("Snapshots can't be restored while recording, replaying or running backwards\n")
+			return
+		}
+		if err := e.restoreSnapshot(path); err != nil {
+			log.Printf("Failed to restore snapshot: %s\n", err)
+			return
+		}
+		log.Printf("Restored snapshot from %s at pc 0x%x\n", path, e.cpu.PC)
+	}
 }
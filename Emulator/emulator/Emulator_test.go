@@ -0,0 +1,105 @@
+package emulator
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestEmulator builds the machine of config with program in DRAM, where the harts start
+func newTestEmulator(config Config, program []uint32) *Emulator {
+	e := NewEmulator(config)
+	b := make([]byte, 4*len(program))
+	for i, w := range program {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+	e.WriteMemory(VIRT_DRAM, b)
+	return e
+}
+
+// Hart 0 waits in wfi for a software interrupt, hart 1 sends it through the CLINT
+var wfiIpi = []uint32{
+	0x00051c63, // bnez a0, hart1
+	0x00800293, // li t0, 8
+	0x30429073, // csrw mie, t0
+	0x10500073, // wfi
+	0x00100493, // li s1, 1
+	0x0000006f, // done0: j done0
+	0x00100293, // hart1: li t0, 1
+	0x02000337, // lui t1, 0x2000
+	0x00532023, // sw t0, 0(t1)
+	0x0000006f, // done1: j done1
+}
+
+func TestWfiOtherHartRuns(t *testing.T) {
+	e := newTestEmulator(Config{Harts: 2, Headless: true}, wfiIpi)
+	e.OnExec(func(hart int, pc uint32, word uint32) {
+		if hart == 1 && word == 0x00532023 && !e.Hart(0).Waiting {
+			t.Errorf("Expected hart 0 to wait in wfi when hart 1 sends the IPI")
+		}
+	})
+	stop := e.RunUntil(func(e *Emulator) bool { return e.Hart(0).Registers[9] == 1 || e.Instret() > 10*HART_QUANTUM })
+	if stop.Reason != STOP_CONDITION || e.Hart(0).Registers[9] != 1 {
+		t.Fatalf("Expected hart 0 to wake up, Got %v at %x", stop.Reason, stop.PC)
+	}
+	if e.Hart(0).Waiting || e.Hart(1).Instret < 3 {
+		t.Errorf("Expected hart 1 to run while hart 0 waited, Got %d instructions", e.Hart(1).Instret)
+	}
+}
+
+func TestWfiAllHartsWait(t *testing.T) {
+	// Both harts wait, the timer of hart 1 wakes it
+	e := newTestEmulator(Config{Harts: 2, Headless: true}, []uint32{
+		0x08000293, // li t0, 0x80
+		0x30429073, // csrw mie, t0
+		0x10500073, // wfi
+		0x00100493, // li s1, 1
+		0x0000006f, // j .
+	})
+	e.cpu.Memory.Clint.Mtimecmp[0] = ^uint64(0)
+	stop := e.RunUntil(func(e *Emulator) bool {
+		if e.Hart(0).Waiting && e.Hart(1).Waiting {
+			e.cpu.Memory.Clint.Mtimecmp[1] = 0
+		}
+		return e.Hart(1).Registers[9] == 1
+	})
+	if stop.Reason != STOP_CONDITION || !e.Hart(0).Waiting {
+		t.Errorf("Expected hart 1 to wake up and hart 0 to go on waiting, Got %v", stop.Reason)
+	}
+}
+
+// Powers off once mtime moved by 3
+var clockProgram = []uint32{
+	0x0200c2b7, // lui t0, 0x200c
+	0xff82a583, // lw a1, -8(t0)
+	0xff82a603, // loop: lw a2, -8(t0)
+	0x40b606b3, // sub a3, a2, a1
+	0x00300713, // li a4, 3
+	0xfee6eae3, // bltu a3, a4, loop
+	0x00100337, // lui t1, 0x100
+	0x000053b7, // lui t2, 0x5
+	0x55538393, // addi t2, t2, 0x555
+	0x00732023, // sw t2, 0(t1)
+	0x0000006f, // j .
+}
+
+func TestRunClock(t *testing.T) {
+	b := make([]byte, 4*len(clockProgram))
+	for i, w := range clockProgram {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+	path := filepath.Join(t.TempDir(), "clock.bin")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEmulator(Config{Headless: true, Image: path})
+	start := time.Now()
+	if code := e.Run(); code != 0 {
+		t.Fatalf("Expected the guest to power off, Got exit code %d", code)
+	}
+	if time.Since(start) < 2*time.Millisecond {
+		t.Errorf("Expected mtime to follow the host clock, took %s", time.Since(start))
+	}
+}
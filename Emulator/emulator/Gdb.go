@@ -0,0 +1,793 @@
+package emulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"riscv/instructions"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// GDB remote serial protocol stub.
+// See https://sourceware.org/gdb/current/onlinedocs/gdb.html/Remote-Protocol.html
+// Attach with: riscv32-none-elf-gdb hello.bin -ex "target remote :1234"
+
+const GDB_SIGINT = 2
+const GDB_SIGTRAP = 5
+
+// Register numbers gdb uses for RISC-V
+const GDB_REG_PC = 32
+const GDB_REG_FIRST_CSR = 65
+const GDB_REG_PRIV = GDB_REG_FIRST_CSR + 4096
+
+// Z packet types
+const GDB_SW_BREAKPOINT = 0
+const GDB_HW_BREAKPOINT = 1
+const GDB_WRITE_WATCHPOINT = 2
+const GDB_READ_WATCHPOINT = 3
+const GDB_ACCESS_WATCHPOINT = 4
+
+const EBREAK = 0x00100073
+
+// Interrupt request sent by gdb outside of any packet
+const GDB_INTERRUPT = 0x03
+
+// Largest packet gdb may send and we reply with, told to gdb in qSupported
+const GDB_PACKET_SIZE = 0x4000
+
+type watchpoint struct {
+	kind   int
+	addr   uint32
+	length uint32
+}
+
+// One event from the client. A closed event means the client went away.
+type gdbPacket struct {
+	conn      net.Conn
+	data      string
+	interrupt bool
+	closed    bool
+}
+
+type Debugger struct {
+	e        *Emulator
+	listener net.Listener
+	packets  chan gdbPacket
+	// Packets which arrived while the guest was running, handled on next stop
+	queued []gdbPacket
+	conn   net.Conn
+	noAck  atomic.Bool
+	// Original bytes under software breakpoints, which are ebreak instructions in memory
+	breakpoints map[uint32][4]byte
+	// Breakpoints are taken out of memory while the machine is saved or executed again
+	lifted        bool
+	hwBreakpoints map[uint32]bool
+	watchpoints   []watchpoint
+	// Stop reply for a watchpoint hit by the instruction being executed
+	watchHit string
+	stepping bool
+	// Breakpoints at the PC we resume from are not hit again
+	resuming bool
+	// Stop before the first instruction and wait for a client
+	waitFirst bool
+	killed    bool
+	lastStop  string
+}
+
+// NewDebugger listens on address, either a TCP port on localhost like ":1234" or a unix socket like "unix:/tmp/gdb"
+func NewDebugger(e *Emulator, address string, wait bool) (*Debugger, error) {
+	listener, err := listen(address)
+	if err != nil {
+		return nil, err
+	}
+	d := &Debugger{
+		e:             e,
+		listener:      listener,
+		packets:       make(chan gdbPacket, 16),
+		breakpoints:   make(map[uint32][4]byte),
+		hwBreakpoints: make(map[uint32]bool),
+		waitFirst:     wait,
+		lastStop:      fmt.Sprintf("S%02x", GDB_SIGTRAP),
+	}
+	go d.accept()
+	return d, nil
+}
+
+// listen opens a TCP port on localhost like ":1234", or a unix socket like "unix:/tmp/gdb"
+func listen(address string) (net.Listener, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network = "unix"
+		address = path
+		_ = os.Remove(path)
+	} else {
+		address = strings.TrimPrefix(address, "tcp:")
+		if !strings.Contains(address, ":") {
+			address = ":" + address
+		}
+		// Never listen on other interfaces unless asked to
+		if strings.HasPrefix(address, ":") {
+			address = "127.0.0.1" + address
+		}
+	}
+	return net.Listen(network, address)
+}
+
+func (d *Debugger) accept() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		d.read(conn)
+	}
+}
+
+// Reads packets from a client till it disconnects. Only one client is served at a time.
+func (d *Debugger) read(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	defer func() {
+		_ = conn.Close()
+		d.packets <- gdbPacket{conn: conn, closed: true}
+	}()
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case GDB_INTERRUPT:
+			d.packets <- gdbPacket{conn: conn, interrupt: true}
+		case '$':
+			data, err := r.ReadString('#')
+			if err != nil {
+				return
+			}
+			data = data[:len(data)-1]
+			sum := make([]byte, 2)
+			if _, err := r.Read(sum[:1]); err != nil {
+				return
+			}
+			if _, err := r.Read(sum[1:]); err != nil {
+				return
+			}
+			want, _ := strconv.ParseUint(string(sum), 16, 8)
+			if byte(want) != checksum(data) {
+				_, _ = conn.Write([]byte("-"))
+				continue
+			}
+			// Acks stop after QStartNoAckMode is answered, which happens before the next packet is sent
+			if !d.noAck.Load() {
+				_, _ = conn.Write([]byte("+"))
+			}
+			d.packets <- gdbPacket{conn: conn, data: unescape(data)}
+		}
+		// Acks from the client are ignored, nothing is retransmitted over a reliable stream
+	}
+}
+
+func checksum(data string) byte {
+	sum := byte(0)
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// Binary data has '#', '$', '}' and '*' escaped as '}' followed by the byte xor 0x20
+func unescape(data string) string {
+	if !strings.Contains(data, "}") {
+		return data
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			b.WriteByte(data[i] ^ 0x20)
+			continue
+		}
+		b.WriteByte(data[i])
+	}
+	return b.String()
+}
+
+func (d *Debugger) send(data string) {
+	if d.conn == nil {
+		return
+	}
+	_, _ = fmt.Fprintf(d.conn, "$%s#%02x", data, checksum(data))
+}
+
+// beforeExec is called before the instruction at PC is fetched. It blocks while the guest is stopped
+// and returns false once gdb killed the guest.
+func (d *Debugger) beforeExec(cpu *instructions.Cpu) bool {
+	reply, notify := d.checkStop(cpu)
+	if reply == "" {
+		return true
+	}
+	if !d.stop(reply, notify) {
+		return false
+	}
+	// Instruction at PC runs right away, without hitting the breakpoint again
+	d.resuming = false
+	return true
+}
+
+func (d *Debugger) checkStop(cpu *instructions.Cpu) (string, bool) {
+	if d.waitFirst {
+		d.waitFirst = false
+		return fmt.Sprintf("S%02x", GDB_SIGTRAP), false
+	}
+	for len(d.packets) > 0 {
+		p := <-d.packets
+		switch {
+		case p.interrupt:
+			return fmt.Sprintf("S%02x", GDB_SIGINT), true
+		case p.closed:
+			d.disconnect(p.conn)
+		default:
+			d.queued = append(d.queued, p)
+		}
+	}
+	if d.resuming {
+		d.resuming = false
+		return "", false
+	}
+	if d.hwBreakpoints[cpu.PC] {
+		return fmt.Sprintf("T%02xhwbreak:;", GDB_SIGTRAP), true
+	}
+	// Inserted breakpoints and ebreak in guest code
+	if d.peekWord(cpu.PC) == EBREAK {
+		return fmt.Sprintf("T%02xswbreak:;", GDB_SIGTRAP), true
+	}
+	return "", false
+}
+
+// afterExec is called once the instruction is executed
+func (d *Debugger) afterExec() bool {
+	if d.watchHit != "" {
+		reply := d.watchHit
+		d.watchHit = ""
+		d.stepping = false
+		return d.stop(reply, true)
+	}
+	if d.stepping {
+		d.stepping = false
+		return d.stop(fmt.Sprintf("S%02x", GDB_SIGTRAP), true)
+	}
+	return true
+}
+
+// memoryAccess checks the watchpoints, it is the memory hook of the cpu
+func (d *Debugger) memoryAccess(addr uint32, size uint32, value uint32, write bool) {
+	for _, w := range d.watchpoints {
+		if addr >= w.addr+w.length || w.addr >= addr+size {
+			continue
+		}
+		switch {
+		case w.kind == GDB_WRITE_WATCHPOINT && write:
+			d.watchHit = fmt.Sprintf("T%02xwatch:%x;", GDB_SIGTRAP, addr)
+		case w.kind == GDB_READ_WATCHPOINT && !write:
+			d.watchHit = fmt.Sprintf("T%02xrwatch:%x;", GDB_SIGTRAP, addr)
+		case w.kind == GDB_ACCESS_WATCHPOINT:
+			d.watchHit = fmt.Sprintf("T%02xawatch:%x;", GDB_SIGTRAP, addr)
+		}
+	}
+}
+
+// Reports the stop to the client and serves it till the guest is resumed
+func (d *Debugger) stop(reply string, notify bool) bool {
+	d.lastStop = reply
+	if notify {
+		d.send(reply)
+	}
+	for !d.killed {
+		var p gdbPacket
+		if len(d.queued) > 0 {
+			p = d.queued[0]
+			d.queued = d.queued[1:]
+		} else {
+			p = <-d.packets
+		}
+		switch {
+		// Already stopped
+		case p.interrupt:
+		case p.closed:
+			// A client going away lets the guest run again
+			if d.disconnect(p.conn) {
+				return true
+			}
+		default:
+			d.conn = p.conn
+			if d.handle(p.data) {
+				if d.killed {
+					return false
+				}
+				d.resuming = true
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Drops everything the client had set. Returns true if it was the current client.
+func (d *Debugger) disconnect(conn net.Conn) bool {
+	if conn != d.conn {
+		return false
+	}
+	d.conn = nil
+	d.noAck.Store(false)
+	d.removeAll()
+	return true
+}
+
+func (d *Debugger) removeAll() {
+	for addr := range d.breakpoints {
+		d.removeBreakpoint(GDB_SW_BREAKPOINT, addr, 4)
+	}
+	clear(d.hwBreakpoints)
+	d.watchpoints = nil
+	d.stepping = false
+}
+
+// Handles one packet, returns true when the guest should resume
+func (d *Debugger) handle(data string) bool {
+	cpu := d.e.cpu
+	if data == "" {
+		d.send("")
+		return false
+	}
+	switch data[0] {
+	case '?':
+		d.send(d.lastStop)
+	case 'g':
+		var b strings.Builder
+		for i := 0; i <= GDB_REG_PC; i++ {
+			v, _ := d.readRegister(i)
+			b.WriteString(encodeWord(v))
+		}
+		d.send(b.String())
+	case 'G':
+		for i := 0; i <= GDB_REG_PC && len(data) >= 1+8*(i+1); i++ {
+			v, err := decodeWord(data[1+8*i : 1+8*(i+1)])
+			if err != nil {
+				d.send("E01")
+				return false
+			}
+			d.writeRegister(i, v)
+		}
+		d.e.changed()
+		d.send("OK")
+	case 'p':
+		n, err := strconv.ParseUint(data[1:], 16, 32)
+		if err != nil {
+			d.send("E01")
+			return false
+		}
+		v, ok := d.readRegister(int(n))
+		if !ok {
+			d.send("E01")
+			return false
+		}
+		d.send(encodeWord(v))
+	case 'P':
+		reg, value, _ := strings.Cut(data[1:], "=")
+		n, err := strconv.ParseUint(reg, 16, 32)
+		if err != nil {
+			d.send("E01")
+			return false
+		}
+		v, err := decodeWord(value)
+		if err != nil || !d.writeRegister(int(n), v) {
+			d.send("E01")
+			return false
+		}
+		d.e.changed()
+		d.send("OK")
+	case 'm':
+		addr, length, err := parseAddrLength(data[1:])
+		// Two hex digits a byte, with $, # and the checksum around them
+		if err != nil || length > (GDB_PACKET_SIZE-4)/2 {
+			d.send("E01")
+			return false
+		}
+		buf := make([]byte, length)
+		for i := range buf {
+			buf[i] = d.peekByte(addr + uint32(i))
+		}
+		d.send(hex.EncodeToString(buf))
+	case 'M', 'X':
+		header, payload, _ := strings.Cut(data[1:], ":")
+		addr, length, err := parseAddrLength(header)
+		if err != nil {
+			d.send("E01")
+			return false
+		}
+		buf := []byte(payload)
+		if data[0] == 'M' {
+			buf, err = hex.DecodeString(payload)
+		}
+		if err != nil || uint32(len(buf)) < length {
+			d.send("E01")
+			return false
+		}
+		for i := uint32(0); i < length; i++ {
+			d.pokeByte(buf[i], addr+i)
+		}
+		d.e.changed()
+		d.send("OK")
+	case 'c', 's':
+		if len(data) > 1 {
+			addr, err := strconv.ParseUint(data[1:], 16, 32)
+			if err != nil {
+				d.send("E01")
+				return false
+			}
+			cpu.PC = uint32(addr)
+			d.e.changed()
+		}
+		d.stepping = data[0] == 's'
+		return true
+	case 'b':
+		d.handleReverse(data)
+	case 'v':
+		return d.handleV(data)
+	case 'Z', 'z':
+		d.handleZ(data)
+	case 'q', 'Q':
+		d.handleQuery(data)
+	case 'H':
+		d.send("OK")
+	case 'T':
+		d.send("OK")
+	case 'D':
+		d.removeAll()
+		d.send("OK")
+		return true
+	case 'k':
+		d.removeAll()
+		d.killed = true
+		return true
+	default:
+		d.send("")
+	}
+	return false
+}
+
+func (d *Debugger) handleV(data string) bool {
+	switch {
+	case data == "vCont?":
+		d.send("vCont;c;C;s;S")
+	case strings.HasPrefix(data, "vCont;"):
+		// Single hart, so the first action applies
+		action := strings.Split(data[len("vCont;"):], ";")[0]
+		action, _, _ = strings.Cut(action, ":")
+		switch action[0] {
+		case 'c', 'C':
+			d.stepping = false
+			return true
+		case 's', 'S':
+			d.stepping = true
+			return true
+		}
+		d.send("E01")
+	case strings.HasPrefix(data, "vKill"):
+		d.removeAll()
+		d.killed = true
+		d.send("OK")
+		return true
+	default:
+		d.send("")
+	}
+	return false
+}
+
+// bs and bc go back one instruction, or to the last breakpoint or watchpoint hit. The guest stays stopped.
+func (d *Debugger) handleReverse(data string) {
+	if d.e.reverse == nil {
+		d.send("E01")
+		return
+	}
+	d.stepping = false
+	switch data {
+	case "bs":
+		d.lastStop = d.e.reverseStep()
+	case "bc":
+		d.lastStop = d.e.reverseContinue()
+	default:
+		d.send("")
+		return
+	}
+	d.send(d.lastStop)
+}
+
+func (d *Debugger) handleZ(data string) {
+	fields := strings.Split(data[1:], ",")
+	if len(fields) < 3 {
+		d.send("E01")
+		return
+	}
+	kind, err1 := strconv.Atoi(fields[0])
+	addr, err2 := strconv.ParseUint(fields[1], 16, 32)
+	length, err3 := strconv.ParseUint(strings.Split(fields[2], ";")[0], 16, 32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		d.send("E01")
+		return
+	}
+	insert := data[0] == 'Z'
+	switch kind {
+	case GDB_SW_BREAKPOINT, GDB_HW_BREAKPOINT, GDB_WRITE_WATCHPOINT, GDB_READ_WATCHPOINT, GDB_ACCESS_WATCHPOINT:
+		if insert {
+			d.insertBreakpoint(kind, uint32(addr), uint32(length))
+		} else {
+			d.removeBreakpoint(kind, uint32(addr), uint32(length))
+		}
+		d.send("OK")
+	default:
+		d.send("")
+	}
+}
+
+func (d *Debugger) insertBreakpoint(kind int, addr uint32, length uint32) {
+	switch kind {
+	case GDB_SW_BREAKPOINT:
+		if _, ok := d.breakpoints[addr]; ok {
+			return
+		}
+		var orig [4]byte
+		for i := range orig {
+			orig[i] = d.e.cpu.Memory.PeekByte(addr + uint32(i))
+		}
+		d.breakpoints[addr] = orig
+		for i := uint32(0); i < 4; i++ {
+			d.e.cpu.Memory.PokeByte(byte(uint32(EBREAK)>>(8*i)), addr+i)
+		}
+	case GDB_HW_BREAKPOINT:
+		d.hwBreakpoints[addr] = true
+	default:
+		d.watchpoints = append(d.watchpoints, watchpoint{kind: kind, addr: addr, length: length})
+	}
+}
+
+func (d *Debugger) removeBreakpoint(kind int, addr uint32, length uint32) {
+	switch kind {
+	case GDB_SW_BREAKPOINT:
+		orig, ok := d.breakpoints[addr]
+		if !ok {
+			return
+		}
+		delete(d.breakpoints, addr)
+		for i := uint32(0); i < 4; i++ {
+			d.e.cpu.Memory.PokeByte(orig[i], addr+i)
+		}
+	case GDB_HW_BREAKPOINT:
+		delete(d.hwBreakpoints, addr)
+	default:
+		d.watchpoints = slices.DeleteFunc(d.watchpoints, func(w watchpoint) bool {
+			return w == watchpoint{kind: kind, addr: addr, length: length}
+		})
+	}
+}
+
+func (d *Debugger) handleQuery(data string) {
+	switch {
+	case strings.HasPrefix(data, "qSupported"):
+		features := fmt.Sprintf("PacketSize=%x;", GDB_PACKET_SIZE) + "qXfer:features:read+;swbreak+;hwbreak+;vContSupported+;QStartNoAckMode+"
+		if d.e.reverse != nil {
+			features += ";ReverseStep+;ReverseContinue+"
+		}
+		d.send(features)
+	case data == "QStartNoAckMode":
+		d.send("OK")
+		d.noAck.Store(true)
+	case strings.HasPrefix(data, "qXfer:features:read:target.xml:"):
+		offset, length, err := parseAddrLength(data[len("qXfer:features:read:target.xml:"):])
+		if err != nil {
+			d.send("E01")
+			return
+		}
+		xml := targetXML()
+		if offset >= uint32(len(xml)) {
+			d.send("l")
+			return
+		}
+		end := min(uint32(len(xml)), offset+length)
+		if end == uint32(len(xml)) {
+			d.send("l" + xml[offset:end])
+		} else {
+			d.send("m" + xml[offset:end])
+		}
+	case data == "qAttached":
+		d.send("1")
+	// A single thread, the hart
+	case data == "qC":
+		d.send("QC1")
+	case data == "qfThreadInfo":
+		d.send("m1")
+	case data == "qsThreadInfo":
+		d.send("l")
+	default:
+		d.send("")
+	}
+}
+
+// Stop reply for a breakpoint at pc, empty if there is none. Unlike checkStop it doesn't look at memory,
+// so it works with the breakpoints lifted.
+func (d *Debugger) breakpointAt(pc uint32) string {
+	if d.hwBreakpoints[pc] {
+		return fmt.Sprintf("T%02xhwbreak:;", GDB_SIGTRAP)
+	}
+	if _, ok := d.breakpoints[pc]; ok {
+		return fmt.Sprintf("T%02xswbreak:;", GDB_SIGTRAP)
+	}
+	return ""
+}
+
+// liftBreakpoints puts the original memory back under the software breakpoints
+func (d *Debugger) liftBreakpoints() {
+	if d.lifted {
+		return
+	}
+	d.lifted = true
+	for addr, orig := range d.breakpoints {
+		for i := uint32(0); i < 4; i++ {
+			d.e.cpu.Memory.PokeByte(orig[i], addr+i)
+		}
+	}
+}
+
+// placeBreakpoints writes the software breakpoints back, memory may have been restored in between
+func (d *Debugger) placeBreakpoints() {
+	if !d.lifted {
+		return
+	}
+	d.lifted = false
+	for addr := range d.breakpoints {
+		var orig [4]byte
+		for i := range orig {
+			orig[i] = d.e.cpu.Memory.PeekByte(addr + uint32(i))
+		}
+		d.breakpoints[addr] = orig
+		for i := uint32(0); i < 4; i++ {
+			d.e.cpu.Memory.PokeByte(byte(uint32(EBREAK)>>(8*i)), addr+i)
+		}
+	}
+}
+
+// Breakpoints are hidden from the client, it sees the original memory
+func (d *Debugger) peekByte(addr uint32) byte {
+	for bp, orig := range d.breakpoints {
+		if addr >= bp && addr < bp+4 {
+			return orig[addr-bp]
+		}
+	}
+	return d.e.cpu.Memory.PeekByte(addr)
+}
+
+func (d *Debugger) pokeByte(b byte, addr uint32) {
+	for bp, orig := range d.breakpoints {
+		if addr >= bp && addr < bp+4 {
+			orig[addr-bp] = b
+			d.breakpoints[bp] = orig
+			return
+		}
+	}
+	d.e.cpu.Memory.PokeByte(b, addr)
+}
+
+func (d *Debugger) peekWord(addr uint32) uint32 {
+	m := d.e.cpu.Memory
+	return uint32(m.PeekByte(addr)) | uint32(m.PeekByte(addr+1))<<8 | uint32(m.PeekByte(addr+2))<<16 | uint32(m.PeekByte(addr+3))<<24
+}
+
+func (d *Debugger) readRegister(n int) (uint32, bool) {
+	cpu := d.e.cpu
+	switch {
+	case n < 32:
+		return cpu.Registers[n], true
+	case n == GDB_REG_PC:
+		return cpu.PC, true
+	case n == GDB_REG_PRIV:
+		return cpu.CurrentMode, true
+	case n >= GDB_REG_FIRST_CSR && n < GDB_REG_FIRST_CSR+4096 && instructions.IsCSRValid(uint32(n-GDB_REG_FIRST_CSR)):
+		return cpu.CSR.GetValue(uint32(n-GDB_REG_FIRST_CSR), 3, cpu), true
+	}
+	return 0, false
+}
+
+func (d *Debugger) writeRegister(n int, v uint32) bool {
+	cpu := d.e.cpu
+	switch {
+	case n == 0:
+	case n < 32:
+		cpu.Registers[n] = v
+	case n == GDB_REG_PC:
+		cpu.PC = v
+	case n == GDB_REG_PRIV:
+		cpu.CurrentMode = v & 3
+	case n >= GDB_REG_FIRST_CSR && n < GDB_REG_FIRST_CSR+4096 && instructions.IsCSRValid(uint32(n-GDB_REG_FIRST_CSR)):
+		cpu.CSR.SetValue(uint32(n-GDB_REG_FIRST_CSR), v, 3, cpu)
+	default:
+		return false
+	}
+	return true
+}
+
+// Registers are sent in target byte order
+func encodeWord(v uint32) string {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return hex.EncodeToString(b)
+}
+
+func decodeWord(s string) (uint32, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return 0, fmt.Errorf("invalid register value %q", s)
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func parseAddrLength(s string) (uint32, uint32, error) {
+	a, l, _ := strings.Cut(s, ",")
+	addr, err := strconv.ParseUint(a, 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	length, err := strconv.ParseUint(l, 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(addr), uint32(length), nil
+}
+
+// Describes the registers, so gdb knows about CSRs and the privilege mode
+func targetXML() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+<architecture>riscv:rv32</architecture>
+<feature name="org.gnu.gdb.riscv.cpu">
+`)
+	for i, name := range instructions.RegisterNames {
+		regType := "int"
+		switch name {
+		case "sp", "gp", "tp", "s0":
+			regType = "data_ptr"
+		case "ra":
+			regType = "code_ptr"
+		}
+		fmt.Fprintf(&b, "<reg name=\"%s\" bitsize=\"32\" type=\"%s\" regnum=\"%d\"/>\n", name, regType, i)
+	}
+	fmt.Fprintf(&b, "<reg name=\"pc\" bitsize=\"32\" type=\"code_ptr\" regnum=\"%d\"/>\n", GDB_REG_PC)
+	b.WriteString("</feature>\n<feature name=\"org.gnu.gdb.riscv.csr\">\n")
+	var csrs []uint32
+	for csr := range instructions.CSRNames {
+		if instructions.IsCSRValid(csr) {
+			csrs = append(csrs, csr)
+		}
+	}
+	slices.Sort(csrs)
+	for _, csr := range csrs {
+		fmt.Fprintf(&b, "<reg name=\"%s\" bitsize=\"32\" regnum=\"%d\" group=\"csr\"/>\n", instructions.CSRNames[csr], GDB_REG_FIRST_CSR+int(csr))
+	}
+	b.WriteString("</feature>\n<feature name=\"org.gnu.gdb.riscv.virtual\">\n")
+	fmt.Fprintf(&b, "<reg name=\"priv\" bitsize=\"32\" regnum=\"%d\" group=\"general\"/>\n", GDB_REG_PRIV)
+	b.WriteString("</feature>\n</target>\n")
+	return b.String()
+}
+
+func (d *Debugger) Close() {
+	if err := d.listener.Close(); err != nil {
+		log.Printf("Failed to close gdb listener: %s\n", err)
+	}
+}
@@ -0,0 +1,217 @@
+package emulator
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Counts in a0 and stores it to 0x80001000
+var gdbProgram = []uint32{
+	0x00150513, // loop: addi a0, a0, 1
+	0x800012b7, // lui t0, 0x80001
+	0x00a2a023, // sw a0, 0(t0)
+	0xff5ff06f, // j loop
+}
+
+type gdbClient struct {
+	t     *testing.T
+	e     *Emulator
+	conn  net.Conn
+	r     *bufio.Reader
+	noAck bool
+	// What the run loop returned once gdb killed the guest
+	done chan Stop
+}
+
+// newGdbClient runs gdbProgram stopped before the first instruction, with a client on the other end of a pipe
+func newGdbClient(t *testing.T) *gdbClient {
+	return connectGdb(t, newTestEmulator(Config{Headless: true}, gdbProgram))
+}
+
+func connectGdb(t *testing.T, e *Emulator) *gdbClient {
+	server, client := net.Pipe()
+	d := &Debugger{
+		e:             e,
+		packets:       make(chan gdbPacket, 16),
+		breakpoints:   make(map[uint32][4]byte),
+		hwBreakpoints: make(map[uint32]bool),
+		waitFirst:     true,
+		lastStop:      fmt.Sprintf("S%02x", GDB_SIGTRAP),
+	}
+	e.debugger = d
+	e.attach()
+	go d.read(server)
+	c := &gdbClient{t: t, e: e, conn: client, r: bufio.NewReader(client), done: make(chan Stop, 1)}
+	go func() { c.done <- e.RunUntil(func(e *Emulator) bool { return false }) }()
+	t.Cleanup(func() { client.Close() })
+	return c
+}
+
+// write sends a packet as it is, with its checksum
+func (c *gdbClient) write(data string) {
+	if _, err := fmt.Fprintf(c.conn, "$%s#%02x", data, checksum(data)); err != nil {
+		c.t.Fatal(err)
+	}
+	if !c.noAck {
+		c.expectAck('+')
+	}
+}
+
+func (c *gdbClient) expectAck(want byte) {
+	if b, err := c.r.ReadByte(); err != nil || b != want {
+		c.t.Fatalf("Expected %c, Got %c %v", want, b, err)
+	}
+}
+
+// reply reads a packet and checks its checksum
+func (c *gdbClient) reply() string {
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	data = data[:len(data)-1]
+	sum := make([]byte, 2)
+	if _, err := c.r.Read(sum[:1]); err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.r.Read(sum[1:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if want, _ := strconv.ParseUint(string(sum), 16, 8); byte(want) != checksum(data) {
+		c.t.Errorf("Expected checksum %02x of %q, Got %s", checksum(data), data, sum)
+	}
+	return data
+}
+
+func (c *gdbClient) call(data string) string {
+	c.write(data)
+	return c.reply()
+}
+
+func (c *gdbClient) expect(data string, want string) {
+	if got := c.call(data); got != want {
+		c.t.Errorf("Expected %q for %q, Got %q", want, data, got)
+	}
+}
+
+func (c *gdbClient) kill() {
+	c.write("k")
+	<-c.done
+}
+
+func TestGdbChecksum(t *testing.T) {
+	if got := checksum("OK"); got != 0x9a {
+		t.Errorf("Expected checksum 9a, Got %02x", got)
+	}
+	c := newGdbClient(t)
+	// A bad checksum is nacked and not handled
+	fmt.Fprintf(c.conn, "$?#00")
+	c.expectAck('-')
+	c.expect("?", "S05")
+	c.expect("p20", "00000080")
+	c.kill()
+}
+
+func TestGdbNoAck(t *testing.T) {
+	c := newGdbClient(t)
+	c.expect("qSupported:swbreak+", "PacketSize=4000;qXfer:features:read+;swbreak+;hwbreak+;vContSupported+;QStartNoAckMode+")
+	c.expect("QStartNoAckMode", "OK")
+	c.noAck = true
+	c.expect("?", "S05")
+	c.kill()
+}
+
+func TestGdbEscapedWrite(t *testing.T) {
+	c := newGdbClient(t)
+	// '#', '$', '}' and '*' are sent as '}' and the byte xor 0x20
+	c.expect("X80002000,5:}\x03}\x04}]}\x0aA", "OK")
+	c.expect("m80002000,5", "23247d2a41")
+	c.expect("M80002000,2:beef", "OK")
+	c.expect("m80002000,2", "beef")
+	c.expect("X80002000,4:ab", "E01")
+	// Replies have to fit in a packet
+	c.expect(fmt.Sprintf("m80002000,%x", (GDB_PACKET_SIZE-4)/2+1), "E01")
+	c.expect("m80002000,ffffffff", "E01")
+	if got := c.call(fmt.Sprintf("m80002000,%x", (GDB_PACKET_SIZE-4)/2)); len(got) != GDB_PACKET_SIZE-4 {
+		t.Errorf("Expected the largest read to fit the packet, Got %d digits", len(got))
+	}
+	c.kill()
+}
+
+func TestGdbTargetXML(t *testing.T) {
+	c := newGdbClient(t)
+	var xml strings.Builder
+	for chunks := 0; ; chunks++ {
+		if chunks > len(targetXML())/0x100+1 {
+			t.Fatalf("Expected the last chunk")
+		}
+		reply := c.call(fmt.Sprintf("qXfer:features:read:target.xml:%x,100", xml.Len()))
+		if reply == "" || (reply[0] != 'm' && reply[0] != 'l') {
+			t.Fatalf("Expected a chunk, Got %q", reply)
+		}
+		if reply[0] == 'm' && len(reply) != 0x101 {
+			t.Errorf("Expected chunks of 100 bytes, Got %d", len(reply)-1)
+		}
+		xml.WriteString(reply[1:])
+		if reply[0] == 'l' {
+			break
+		}
+	}
+	if xml.String() != targetXML() {
+		t.Errorf("Expected the chunks to make up target.xml")
+	}
+	c.expect(fmt.Sprintf("qXfer:features:read:target.xml:%x,100", len(targetXML())), "l")
+	c.kill()
+}
+
+func TestGdbVCont(t *testing.T) {
+	c := newGdbClient(t)
+	c.expect("vCont?", "vCont;c;C;s;S")
+	c.expect("vCont;s:1;c", "S05")
+	c.expect("p20", "04000080")
+	c.expect("vCont;S05", "S05")
+	c.expect("p20", "08000080")
+	c.expect("vCont;x", "E01")
+	c.kill()
+}
+
+func TestGdbBreakpoint(t *testing.T) {
+	c := newGdbClient(t)
+	c.expect("Z0,80000008,4", "OK")
+	// The client sees the original instruction
+	c.expect("m80000008,4", "23a0a200")
+	c.expect("c", "T05swbreak:;")
+	c.expect("p20", "08000080")
+	c.expect("p0a", "01000000")
+	// Hit again on the next round
+	c.expect("c", "T05swbreak:;")
+	c.expect("p0a", "02000000")
+	c.expect("z0,80000008,4", "OK")
+	c.expect("Z1,8000000c,4", "OK")
+	c.expect("c", "T05hwbreak:;")
+	c.expect("p20", "0c000080")
+	c.expect("z1,8000000c,4", "OK")
+	c.expect("Z9,80000000,4", "")
+	c.kill()
+}
+
+func TestGdbWatchpoint(t *testing.T) {
+	c := newGdbClient(t)
+	c.expect("Z2,80001000,4", "OK")
+	c.expect("c", "T05watch:80001000;")
+	// Stopped after the store
+	c.expect("p20", "0c000080")
+	c.expect("m80001000,4", "01000000")
+	c.expect("z2,80001000,4", "OK")
+	c.expect("Z0,80000000,4", "OK")
+	c.expect("c", "T05swbreak:;")
+	c.expect("p0a", "01000000")
+	c.kill()
+}
@@ -0,0 +1,215 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"riscv/instructions"
+	"time"
+)
+
+// KUTEmu as a library. Build the machine with NewEmulator, put the guest in with Load or WriteMemory and drive it
+// with Step and RunUntil. Nothing is opened, no window, server or file; the tools of the config are only started
+// by Run.
+//
+//	e := emulator.NewEmulator(emulator.Config{Image: "test.bin"})
+//	if err := e.Load(); err != nil {
+//		return err
+//	}
+//	stop := e.RunUntil(func(e *emulator.Emulator) bool { return e.PC() == 0x80000040 })
+
+// Why Step or RunUntil returned
+type StopReason int
+
+const (
+	// The instructions asked for ran
+	STOP_STEPPED StopReason = iota
+	// The condition of RunUntil became true
+	STOP_CONDITION
+	// The guest powered off through the test device, or ended a test with ecall
+	STOP_POWER_OFF
+	// The guest ran into something which can't be executed
+	STOP_CRASH
+)
+
+var stopReasonNames = [...]string{"stepped", "condition", "power off", "crash"}
+
+func (r StopReason) String() string {
+	if int(r) < len(stopReasonNames) {
+		return stopReasonNames[r]
+	}
+	return fmt.Sprintf("StopReason(%d)", int(r))
+}
+
+type Stop struct {
+	Reason StopReason
+	// Exit code Run would return
+	Code int
+	// Hart which ran last and its PC
+	Hart int
+	PC   uint32
+	// What went wrong, for STOP_CRASH
+	Err error
+}
+
+// Called before every instruction with the hart running it, its PC and the instruction word
+type ExecHook func(hart int, pc uint32, word uint32)
+
+// mtime follows the host clock, moved every this many instructions by the library loop
+const LIBRARY_TIME_INTERVAL = 1000
+
+var errEmptyInstruction = errors.New("empty instruction")
+
+// Step runs n instructions, counted over all harts, one at a time. While every hart waits in wfi a step is
+// one wait of WFI_SLEEP for an interrupt, so Step returns even when none comes.
+func (e *Emulator) Step(n uint64) Stop {
+	blocks := e.blocks
+	e.blocks = false
+	defer func() { e.blocks = blocks }()
+	target := e.instret() + e.idled + n
+	return e.drive(func() bool { return e.instret()+e.idled >= target }, STOP_STEPPED)
+}
+
+// RunUntil runs till cond returns true or the machine stops. cond is checked before every instruction, or
+// before every translated block when no exec hook or tool needs to see every instruction.
+func (e *Emulator) RunUntil(cond func(e *Emulator) bool) Stop {
+	e.blocks = e.useBlocks()
+	return e.drive(func() bool { return cond(e) }, STOP_CONDITION)
+}
+
+// drive runs the machine till done. Guest crashes which panic in the instruction code are returned as a stop.
+func (e *Emulator) drive(done func() bool, reason StopReason) (stop Stop) {
+	defer func() {
+		if r := recover(); r != nil {
+			stop = e.stopped(STOP_CRASH, EXIT_CRASH)
+			stop.Err = fmt.Errorf("%v", r)
+		}
+	}()
+	if syscon := e.cpu.Memory.Syscon; syscon.Requested && !syscon.Reset {
+		return e.stopped(STOP_POWER_OFF, syscon.ExitCode)
+	}
+	e.timeInstret = e.instret()
+	e.moveTime()
+	for !done() {
+		// A waiting hart executes nothing, time has to move for its timer to wake it
+		if e.cpu.Waiting || e.instret()-e.timeInstret >= LIBRARY_TIME_INTERVAL {
+			e.timeInstret = e.instret()
+			e.moveTime()
+		}
+		code, ok := e.step()
+		if ok {
+			continue
+		}
+		if e.cpu.Memory.Syscon.Requested {
+			return e.stopped(STOP_POWER_OFF, code)
+		}
+		stop := e.stopped(STOP_CRASH, code)
+		stop.Err = errEmptyInstruction
+		return stop
+	}
+	return e.stopped(reason, 0)
+}
+
+func (e *Emulator) moveTime() {
+	if e.journal == nil {
+		e.cpu.Memory.Clint.Mtime = uint64(time.Now().UnixMilli())
+	}
+}
+
+func (e *Emulator) stopped(reason StopReason, code int) Stop {
+	return Stop{Reason: reason, Code: code, Hart: int(e.cpu.HartID), PC: e.cpu.PC}
+}
+
+// Instret is the number of instructions all harts executed
+func (e *Emulator) Instret() uint64 {
+	return e.instret()
+}
+
+// Harts is the number of harts of the machine
+func (e *Emulator) Harts() int {
+	return len(e.harts)
+}
+
+// Hart gives direct access to a hart, for what the methods here don't cover
+func (e *Emulator) Hart(id int) *instructions.Cpu {
+	return e.harts[id]
+}
+
+// PC, registers and CSRs are the ones of the hart which runs next, with a single hart that is the only one
+
+func (e *Emulator) PC() uint32 {
+	return e.cpu.PC
+}
+
+func (e *Emulator) SetPC(pc uint32) {
+	e.cpu.PC = pc
+}
+
+// Register reads x0 to x31
+func (e *Emulator) Register(n int) uint32 {
+	return e.cpu.Registers[n]
+}
+
+// SetRegister writes x1 to x31, writes to x0 are ignored
+func (e *Emulator) SetRegister(n int, v uint32) {
+	if n != 0 {
+		e.cpu.Registers[n] = v
+	}
+}
+
+// CSR reads a CSR like M-mode would, CSRs which are not implemented read as 0
+func (e *Emulator) CSR(n uint32) uint32 {
+	if !instructions.IsCSRValid(n) {
+		return 0
+	}
+	return e.cpu.CSR.GetValue(n, 3, e.cpu)
+}
+
+// SetCSR writes a CSR like M-mode would, CSRs which are not implemented are ignored
+func (e *Emulator) SetCSR(n uint32, v uint32) {
+	if instructions.IsCSRValid(n) {
+		e.cpu.CSR.SetValue(n, v, 3, e.cpu)
+	}
+}
+
+// ReadMemory fills b from RAM at addr, devices are not touched
+func (e *Emulator) ReadMemory(addr uint32, b []byte) {
+	for i := range b {
+		b[i] = e.cpu.Memory.PeekByte(addr + uint32(i))
+	}
+}
+
+// WriteMemory writes b to RAM at addr, devices are not touched
+func (e *Emulator) WriteMemory(addr uint32, b []byte) {
+	for i, v := range b {
+		e.cpu.Memory.PokeByte(v, addr+uint32(i))
+	}
+}
+
+// AddMMIO serves guest accesses to size bytes at base with read and write, instead of RAM or a built-in
+// device. Either callback may be nil. Regions can't overlap.
+func (e *Emulator) AddMMIO(base uint32, size uint32, read func(offset uint32, size uint32) uint32, write func(offset uint32, size uint32, value uint32)) error {
+	if size == 0 || base+size-1 < base {
+		return fmt.Errorf("mmio region at %x of %d bytes doesn't fit", base, size)
+	}
+	for _, r := range e.mmio {
+		if base < r.Base+r.Size && r.Base < base+size {
+			return fmt.Errorf("mmio region at %x overlaps the one at %x", base, r.Base)
+		}
+	}
+	e.mmio = append(e.mmio, &instructions.MMIO{Base: base, Size: size, Read: read, Write: write})
+	e.cpu.Memory.MMIO = e.mmio
+	// Code may have been translated from there
+	e.cpu.Memory.FlushCode()
+	return nil
+}
+
+// OnExec calls hook before every instruction. The machine runs one instruction at a time from then on.
+func (e *Emulator) OnExec(hook ExecHook) {
+	e.execHooks = append(e.execHooks, hook)
+}
+
+// OnMemory calls hook for every load and store done by an instruction, with the value loaded or stored
+func (e *Emulator) OnMemory(hook func(addr uint32, size uint32, value uint32, write bool)) {
+	e.memoryHooks = append(e.memoryHooks, hook)
+	e.hookMemory()
+}
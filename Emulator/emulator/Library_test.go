@@ -0,0 +1,118 @@
+package emulator
+
+import "testing"
+
+// Counts a0 to 10, stores it to the MMIO region at 0x40000000 and loads a1 from it, then fails with code 2
+var libraryProgram = []uint32{
+	0x00000513, // li a0, 0
+	0x00150513, // loop: addi a0, a0, 1
+	0x00a00293, // li t0, 10
+	0xfe551ce3, // bne a0, t0, loop
+	0x40000337, // lui t1, 0x40000
+	0x00a32023, // sw a0, 0(t1)
+	0x00432583, // lw a1, 4(t1)
+	0x001003b7, // lui t2, 0x100
+	0x000232b7, // lui t0, 0x23
+	0x33328293, // addi t0, t0, 0x333
+	0x0053a023, // sw t0, 0(t2)
+	0x0000006f, // j .
+}
+
+func TestLibraryStep(t *testing.T) {
+	e := newTestEmulator(Config{Headless: true}, libraryProgram)
+	stop := e.Step(31)
+	if stop.Reason != STOP_STEPPED || e.Instret() != 31 {
+		t.Fatalf("Expected 31 steps, Got %v after %d", stop.Reason, e.Instret())
+	}
+	if e.PC() != VIRT_DRAM+0x10 || e.Register(10) != 10 {
+		t.Errorf("Expected the loop done with a0 10, Got pc %x a0 %d", e.PC(), e.Register(10))
+	}
+	e.SetRegister(0, 1)
+	if e.Register(0) != 0 {
+		t.Errorf("Expected x0 to stay 0")
+	}
+}
+
+func TestLibraryRunUntil(t *testing.T) {
+	e := newTestEmulator(Config{Headless: true}, libraryProgram)
+	stop := e.RunUntil(func(e *Emulator) bool { return e.Register(10) == 5 })
+	if stop.Reason != STOP_CONDITION || stop.Hart != 0 || e.Register(10) != 5 {
+		t.Errorf("Expected to stop at a0 5, Got %v with a0 %d", stop.Reason, e.Register(10))
+	}
+}
+
+func TestLibraryMMIOAndPowerOff(t *testing.T) {
+	e := newTestEmulator(Config{Headless: true}, libraryProgram)
+	var written, read []uint32
+	err := e.AddMMIO(0x40000000, 0x1000, func(offset uint32, size uint32) uint32 {
+		read = append(read, offset, size)
+		return 42
+	}, func(offset uint32, size uint32, value uint32) {
+		written = append(written, offset, size, value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddMMIO(0x40000800, 0x1000, nil, nil); err == nil {
+		t.Errorf("Expected overlapping regions to be refused")
+	}
+	var executed []uint32
+	e.OnExec(func(hart int, pc uint32, word uint32) {
+		executed = append(executed, pc)
+		if word != libraryProgram[(pc-VIRT_DRAM)/4] {
+			t.Errorf("Expected word %08x at %x, Got %08x", libraryProgram[(pc-VIRT_DRAM)/4], pc, word)
+		}
+	})
+
+	stop := e.RunUntil(func(e *Emulator) bool { return false })
+	if stop.Reason != STOP_POWER_OFF || stop.Code != 5 {
+		t.Errorf("Expected power off with code 5, Got %v %d", stop.Reason, stop.Code)
+	}
+	if len(written) != 3 || written[0] != 0 || written[1] != 4 || written[2] != 10 {
+		t.Errorf("Expected a0 stored at offset 0, Got %v", written)
+	}
+	if len(read) != 2 || read[0] != 4 || e.Register(11) != 42 {
+		t.Errorf("Expected a1 loaded from offset 4, Got %v and a1 %d", read, e.Register(11))
+	}
+	if len(executed) != 38 || executed[37] != VIRT_DRAM+0x28 {
+		t.Errorf("Expected 38 instructions up to the power off, Got %d", len(executed))
+	}
+	// It stays off
+	if stop := e.Step(1); stop.Reason != STOP_POWER_OFF || e.Instret() != 38 {
+		t.Errorf("Expected no more steps after power off, Got %v", stop.Reason)
+	}
+}
+
+func TestLibraryStepWfi(t *testing.T) {
+	e := newTestEmulator(Config{Headless: true}, []uint32{
+		0x08000293, // li t0, 0x80
+		0x30429073, // csrw mie, t0
+		0x10500073, // wfi
+		0x0000006f, // j .
+	})
+	e.Step(3)
+	// No timer is set, the steps are waits
+	if stop := e.Step(5); stop.Reason != STOP_STEPPED || e.Instret() != 3 || !e.Hart(0).Waiting {
+		t.Fatalf("Expected Step to return while the hart waits, Got %v after %d", stop.Reason, e.Instret())
+	}
+	e.cpu.Memory.Clint.Mtimecmp[0] = 0
+	if stop := e.Step(1); stop.Reason != STOP_STEPPED || e.PC() != VIRT_DRAM+0xc {
+		t.Errorf("Expected the timer to wake the hart, Got pc %x", e.PC())
+	}
+}
+
+func TestLibraryEcallExit(t *testing.T) {
+	for _, test := range []struct {
+		a0   uint32
+		code int
+	}{{0, 0}, {42, 0}, {1, 7}} {
+		e := newTestEmulator(Config{Headless: true}, []uint32{
+			0x00300193, // li gp, 3
+			0x00000073, // ecall
+		})
+		e.SetRegister(10, test.a0)
+		if stop := e.RunUntil(func(e *Emulator) bool { return false }); stop.Reason != STOP_POWER_OFF || stop.Code != test.code {
+			t.Errorf("Expected exit code %d for a0 %d, Got %v %d", test.code, test.a0, stop.Reason, stop.Code)
+		}
+	}
+}
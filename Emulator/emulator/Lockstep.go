@@ -0,0 +1,357 @@
+package emulator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"riscv/disasm"
+	"riscv/instructions"
+	"strconv"
+	"strings"
+)
+
+// Lockstep checks every executed instruction against a commit log recorded by a reference simulator
+// and stops at the first difference.
+//
+// Two formats are read:
+//
+//	core   0: 3 0x80000000 (0x00500513) x10 0x00000005          spike --log-commits, also written by -trace
+//	0, 0x80000000, 0x500513, "li a0,5", a0 -> 0x5                 qemu -plugin libexeclog.so,reg=*
+//
+// Qemu's execlog has no privilege mode, CSR writes or store values, so those are not checked with it.
+// Interrupts must arrive at the same instruction in both runs, which needs a deterministic timer in both.
+
+const LOCKSTEP_CONTEXT = 10
+
+type Lockstep struct {
+	r    *bufio.Scanner
+	file io.Closer
+	line int
+	recorder
+	// Last instructions executed, oldest first
+	history []string
+	context int
+	disasm  *disasm.Disassembler
+	// Where the divergence report goes
+	out io.Writer
+	// Instructions that matched
+	Matched uint64
+}
+
+// reference is one instruction of the reference log
+type reference struct {
+	commit
+	line int
+	text string
+	// Fields the format does not have are not compared
+	hasMode    bool
+	hasValues  bool
+	hasAllRegs bool
+}
+
+func NewLockstep(path string, context int) (*Lockstep, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if context <= 0 {
+		context = LOCKSTEP_CONTEXT
+	}
+	r := bufio.NewScanner(f)
+	r.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &Lockstep{
+		r:       r,
+		file:    f,
+		context: context,
+		disasm:  &disasm.Disassembler{Syntax: disasm.SYNTAX_SPIKE},
+		out:     os.Stderr,
+	}, nil
+}
+
+func (l *Lockstep) Close() error {
+	return l.file.Close()
+}
+
+func (l *Lockstep) before(cpu *instructions.Cpu, word uint32, inst instructions.Inst) {
+	l.begin(cpu, word, inst)
+}
+
+// next reads the next instruction of the reference log, false at its end
+func (l *Lockstep) next() (reference, bool, error) {
+	for l.r.Scan() {
+		l.line++
+		text := strings.TrimSpace(l.r.Text())
+		ref, ok, err := parseReference(text)
+		if err != nil {
+			return ref, false, fmt.Errorf("line %d: %s", l.line, err)
+		}
+		if ok {
+			ref.line = l.line
+			ref.text = text
+			return ref, true, nil
+		}
+	}
+	return reference{}, false, l.r.Err()
+}
+
+// after compares the executed instruction with the reference. It returns false when the run must stop,
+// with done set when the reference log ended without a difference.
+func (l *Lockstep) after(cpu *instructions.Cpu) (ok bool, done bool) {
+	inst := l.inst
+	c := l.end(cpu)
+	line := fmt.Sprintf("%s    %s", c.String(), l.disasm.Inst(inst, c.pc))
+
+	// Spike logs nothing for an instruction that traps
+	if op := inst.Operation(); op == "ecall" || op == "ebreak" {
+		l.remember(line)
+		return true, false
+	}
+
+	ref, found, err := l.next()
+	if err != nil {
+		fmt.Fprintf(l.out, "lockstep: reading reference: %s\n", err)
+		return false, false
+	}
+	if !found {
+		fmt.Fprintf(l.out, "lockstep: reference log ended, %d instructions matched\n", l.Matched)
+		return false, true
+	}
+	if msg := compare(cpu, &c, &ref); msg != "" {
+		l.report(cpu, msg, line, ref)
+		return false, false
+	}
+	l.remember(line)
+	l.Matched++
+	return true, false
+}
+
+func (l *Lockstep) remember(line string) {
+	if len(l.history) == l.context {
+		l.history = l.history[1:]
+	}
+	l.history = append(l.history, line)
+}
+
+func (l *Lockstep) report(cpu *instructions.Cpu, msg string, line string, ref reference) {
+	w := l.out
+	fmt.Fprintf(w, "lockstep: diverged at instruction %d, reference line %d: %s\n", l.Matched, ref.line, msg)
+	fmt.Fprintf(w, "last %d instructions:\n", len(l.history))
+	for _, h := range l.history {
+		fmt.Fprintf(w, "  %s\n", h)
+	}
+	fmt.Fprintf(w, "kutemu:    %s\n", line)
+	fmt.Fprintf(w, "reference: %s\n", ref.text)
+}
+
+// compare returns what differs between the executed instruction and the reference, empty if nothing
+func compare(cpu *instructions.Cpu, c *commit, ref *reference) string {
+	if c.pc != ref.pc {
+		return fmt.Sprintf("pc is 0x%08x, reference has 0x%08x", c.pc, ref.pc)
+	}
+	if c.word != ref.word {
+		return fmt.Sprintf("instruction is 0x%08x, reference has 0x%08x", c.word, ref.word)
+	}
+	if ref.hasMode && c.mode != ref.mode {
+		return fmt.Sprintf("privilege mode is %d, reference has %d", c.mode, ref.mode)
+	}
+	for _, r := range ref.regs {
+		if cpu.Registers[r.reg] != r.value {
+			return fmt.Sprintf("x%d (%s) is 0x%08x, reference has 0x%08x",
+				r.reg, instructions.RegisterNames[r.reg], cpu.Registers[r.reg], r.value)
+		}
+	}
+	if ref.hasAllRegs {
+		for _, r := range c.regs {
+			if !wrote(ref.regs, r.reg) {
+				return fmt.Sprintf("x%d (%s) was written with 0x%08x, reference did not write it",
+					r.reg, instructions.RegisterNames[r.reg], r.value)
+			}
+		}
+	}
+	for _, w := range ref.csrs {
+		if !instructions.IsCSRValid(w.csr) {
+			return fmt.Sprintf("reference wrote csr 0x%x, which is not implemented", w.csr)
+		}
+		if v := csrValue(cpu, w.csr); v != w.value {
+			return fmt.Sprintf("csr %s is 0x%08x, reference has 0x%08x", csrLabel(w.csr), v, w.value)
+		}
+	}
+	stores, refStores := writes(c.accesses), writes(ref.accesses)
+	if len(stores) != len(refStores) {
+		return fmt.Sprintf("%d memory writes, reference has %d", len(stores), len(refStores))
+	}
+	for n, s := range stores {
+		r := refStores[n]
+		if s.addr != r.addr {
+			return fmt.Sprintf("memory write to 0x%08x, reference wrote 0x%08x", s.addr, r.addr)
+		}
+		if ref.hasValues && (s.size != r.size || s.value != r.value) {
+			return fmt.Sprintf("memory write of 0x%0*x to 0x%08x, reference wrote 0x%0*x",
+				2*s.size, s.value, s.addr, 2*r.size, r.value)
+		}
+	}
+	return ""
+}
+
+func wrote(regs []regWrite, reg byte) bool {
+	for _, r := range regs {
+		if r.reg == reg {
+			return true
+		}
+	}
+	return false
+}
+
+func writes(accesses []memoryAccess) []memoryAccess {
+	var out []memoryAccess
+	for _, a := range accesses {
+		if a.write {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func csrLabel(csr uint32) string {
+	if name, ok := instructions.CSRNames[csr]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", csr)
+}
+
+// parseReference parses one line of a reference log, ok is false for lines that are not an instruction
+func parseReference(text string) (ref reference, ok bool, err error) {
+	if strings.HasPrefix(text, "core") {
+		return parseSpike(text)
+	}
+	if strings.Contains(text, "\"") {
+		return parseExeclog(text)
+	}
+	return ref, false, nil
+}
+
+// core   0: 3 0x80000000 (0x00500513) x10 0x00000005 mem 0x80001000 0x05
+// Lines without a privilege mode are disassembly or trap messages and are skipped.
+func parseSpike(text string) (ref reference, ok bool, err error) {
+	colon := strings.Index(text, ":")
+	if colon < 0 {
+		return ref, false, nil
+	}
+	f := strings.Fields(text[colon+1:])
+	if len(f) < 3 || len(f[0]) != 1 || f[0][0] < '0' || f[0][0] > '3' || !strings.HasPrefix(f[2], "(") {
+		return ref, false, nil
+	}
+	ref.hasMode, ref.hasValues, ref.hasAllRegs = true, true, true
+	ref.mode = uint32(f[0][0] - '0')
+	if ref.pc, err = parseHex(f[1]); err != nil {
+		return ref, false, err
+	}
+	if ref.word, err = parseHex(strings.Trim(f[2], "()")); err != nil {
+		return ref, false, err
+	}
+	for i := 3; i < len(f); i++ {
+		tok := f[i]
+		switch {
+		case tok == "mem":
+			if i+1 >= len(f) {
+				return ref, false, fmt.Errorf("mem without address")
+			}
+			a := memoryAccess{}
+			if a.addr, err = parseHex(f[i+1]); err != nil {
+				return ref, false, err
+			}
+			i++
+			// A value after the address makes it a store, its digits give the size
+			if i+1 < len(f) && strings.HasPrefix(f[i+1], "0x") {
+				a.write = true
+				a.size = uint32(len(f[i+1])-2) / 2
+				if a.value, err = parseHex(f[i+1]); err != nil {
+					return ref, false, err
+				}
+				i++
+			}
+			ref.accesses = append(ref.accesses, a)
+		case i+1 < len(f) && len(tok) > 1 && tok[0] == 'x':
+			n, err := strconv.Atoi(tok[1:])
+			if err != nil || n < 0 || n > 31 {
+				return ref, false, fmt.Errorf("bad register %q", tok)
+			}
+			v, err := parseHex(f[i+1])
+			if err != nil {
+				return ref, false, err
+			}
+			ref.regs = append(ref.regs, regWrite{reg: byte(n), value: v})
+			i++
+		case i+1 < len(f) && len(tok) > 1 && tok[0] == 'c' && strings.Contains(tok, "_"):
+			n, err := strconv.ParseUint(tok[1:strings.Index(tok, "_")], 10, 32)
+			if err != nil {
+				return ref, false, fmt.Errorf("bad csr %q", tok)
+			}
+			v, err := parseHex(f[i+1])
+			if err != nil {
+				return ref, false, err
+			}
+			ref.csrs = append(ref.csrs, csrWrite{csr: uint32(n), value: v})
+			i++
+		case i+1 < len(f) && len(tok) > 1 && (tok[0] == 'f' || tok[0] == 'v'):
+			// Float and vector registers are not implemented
+			i++
+		}
+	}
+	return ref, true, nil
+}
+
+// 0, 0x80000000, 0x500513, "li a0,5", store, 0x80001000, a0 -> 0x5
+func parseExeclog(text string) (ref reference, ok bool, err error) {
+	first := strings.Index(text, "\"")
+	last := strings.LastIndex(text, "\"")
+	head := strings.Split(text[:first], ",")
+	if len(head) < 3 {
+		return ref, false, nil
+	}
+	if ref.pc, err = parseHex(strings.TrimSpace(head[1])); err != nil {
+		return ref, false, err
+	}
+	if ref.word, err = parseHex(strings.TrimSpace(head[2])); err != nil {
+		return ref, false, err
+	}
+	tail := strings.Split(text[last+1:], ",")
+	for i := 0; i < len(tail); i++ {
+		tok := strings.TrimSpace(tail[i])
+		switch {
+		case tok == "load" || tok == "store":
+			if i+1 >= len(tail) {
+				return ref, false, fmt.Errorf("%s without address", tok)
+			}
+			a := memoryAccess{write: tok == "store"}
+			if a.addr, err = parseHex(strings.TrimSpace(tail[i+1])); err != nil {
+				return ref, false, err
+			}
+			ref.accesses = append(ref.accesses, a)
+			i++
+		case strings.Contains(tok, "->"):
+			parts := strings.SplitN(tok, "->", 2)
+			name := strings.TrimSpace(parts[0])
+			v, err := parseHex(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return ref, false, err
+			}
+			for n, r := range instructions.RegisterNames {
+				if r == name || fmt.Sprintf("x%d", n) == name {
+					ref.regs = append(ref.regs, regWrite{reg: byte(n), value: v})
+				}
+			}
+		}
+	}
+	return ref, true, nil
+}
+
+// Values of 64 bit simulators are truncated to 32 bits
+func parseHex(s string) (uint32, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return uint32(v), nil
+}
@@ -0,0 +1,133 @@
+package emulator
+
+import (
+	"bufio"
+	"reflect"
+	"riscv/disasm"
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		ok   bool
+		want reference
+	}{
+		{"core   0: 3 0x80000000 (0x00500513) x10 0x00000005", true, reference{
+			commit:  commit{mode: 3, pc: 0x80000000, word: 0x00500513, regs: []regWrite{{10, 5}}},
+			hasMode: true, hasValues: true, hasAllRegs: true,
+		}},
+		{"core   0: 1 0x80000008 (0x00a2a023) mem 0x80001000 0x00000005", true, reference{
+			commit:  commit{mode: 1, pc: 0x80000008, word: 0x00a2a023, accesses: []memoryAccess{{0x80001000, 4, 5, true}}},
+			hasMode: true, hasValues: true, hasAllRegs: true,
+		}},
+		{"core   0: 0 0x8000000c (0x00a29223) mem 0x80001004 0x0005", true, reference{
+			commit:  commit{pc: 0x8000000c, word: 0x00a29223, accesses: []memoryAccess{{0x80001004, 2, 5, true}}},
+			hasMode: true, hasValues: true, hasAllRegs: true,
+		}},
+		{"core   0: 3 0x80000014 (0x0002a583) x11 0x00000005 mem 0x80001000", true, reference{
+			commit:  commit{mode: 3, pc: 0x80000014, word: 0x0002a583, regs: []regWrite{{11, 5}}, accesses: []memoryAccess{{addr: 0x80001000}}},
+			hasMode: true, hasValues: true, hasAllRegs: true,
+		}},
+		{"core   0: 3 0x8000001c (0x34051073) c832_mscratch 0x00000005", true, reference{
+			commit:  commit{mode: 3, pc: 0x8000001c, word: 0x34051073, csrs: []csrWrite{{0x340, 5}}},
+			hasMode: true, hasValues: true, hasAllRegs: true,
+		}},
+		// 64 bit spike
+		{"core   0: 3 0x0000000080000000 (0x00500513) x10 0xffffffffffffffff", true, reference{
+			commit:  commit{mode: 3, pc: 0x80000000, word: 0x00500513, regs: []regWrite{{10, 0xffffffff}}},
+			hasMode: true, hasValues: true, hasAllRegs: true,
+		}},
+		// Disassembly and trap messages
+		{"core   0: 0x80000000 (0x00500513) li      a0, 5", false, reference{}},
+		{"core   0: 0x80000014 (0x0002a583) lw      a1, 0(t0)", false, reference{}},
+		{"core   0: exception trap_illegal_instruction, epc 0x80000004", false, reference{}},
+		{"core   0:           tval 0x00000000", false, reference{}},
+		{"", false, reference{}},
+		{"0, 0x80000000, 0x500513, \"li a0,5\", a0 -> 0x5", true, reference{
+			commit: commit{pc: 0x80000000, word: 0x500513, regs: []regWrite{{10, 5}}},
+		}},
+		{"0, 0x80000008, 0xa2a023, \"sw a0,0(t0)\", store, 0x80001000", true, reference{
+			commit: commit{pc: 0x80000008, word: 0xa2a023, accesses: []memoryAccess{{addr: 0x80001000, write: true}}},
+		}},
+		{"0, 0x80000014, 0x2a583, \"lw a1,0(t0)\", load, 0x80001000, a1 -> 0x5", true, reference{
+			commit: commit{pc: 0x80000014, word: 0x2a583, regs: []regWrite{{11, 5}}, accesses: []memoryAccess{{addr: 0x80001000}}},
+		}},
+		{"0, 0x80000018, 0x62c603, \"lbu x12,6(x5)\", load, 0x80001006, x12 -> 0x5", true, reference{
+			commit: commit{pc: 0x80000018, word: 0x62c603, regs: []regWrite{{12, 5}}, accesses: []memoryAccess{{addr: 0x80001006}}},
+		}},
+		{"Instruction \"li\"", false, reference{}},
+	} {
+		got, ok, err := parseReference(test.text)
+		if err != nil {
+			t.Errorf("Expected %q to parse, Got %s", test.text, err)
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("Expected ok %v for %q, Got %v", test.ok, test.text, ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Expected %+v for %q, Got %+v", test.want, test.text, got)
+		}
+	}
+}
+
+func TestParseReferenceErrors(t *testing.T) {
+	for _, text := range []string{
+		"core   0: 3 0x8000000z (0x00500513)",
+		"core   0: 3 0x80000000 (0x00500513) x32 0x00000001",
+		"core   0: 3 0x80000000 (0x00500513) x10 five",
+		"core   0: 3 0x80000008 (0x00a2a023) mem",
+		"0, 0x80000000, 0x500513, \"li a0,5\", a0 -> five",
+		"0, 0x80000008, 0xa2a023, \"sw a0,0(t0)\", store",
+	} {
+		if _, _, err := parseReference(text); err == nil {
+			t.Errorf("Expected %q to be refused", text)
+		}
+	}
+}
+
+func TestLockstepDivergence(t *testing.T) {
+	// The reference has a0 one too high in the fourth round
+	const diverged = 12
+	lines := trace(t, gdbProgram, 16, TraceFilter{})
+	lines[diverged] = strings.Replace(lines[diverged], "x10 0x00000004", "x10 0x00000005", 1)
+
+	var out strings.Builder
+	l := &Lockstep{
+		r:       bufio.NewScanner(strings.NewReader(strings.Join(lines, "\n"))),
+		context: LOCKSTEP_CONTEXT,
+		disasm:  &disasm.Disassembler{Syntax: disasm.SYNTAX_SPIKE},
+		out:     &out,
+	}
+	e := newTestEmulator(Config{Headless: true}, gdbProgram)
+	e.lockstep = l
+	e.hookMemory()
+	e.Step(16)
+	if l.Matched != diverged || e.Instret() != diverged+1 {
+		t.Fatalf("Expected to stop after %d matches, Got %d matches after %d instructions", diverged, l.Matched, e.Instret())
+	}
+
+	report := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := "lockstep: diverged at instruction 12, reference line 13: x10 (a0) is 0x00000004, reference has 0x00000005"
+	if len(report) != 2+LOCKSTEP_CONTEXT+2 || report[0] != want {
+		t.Fatalf("Expected a report starting with\n%s\nGot\n%s", want, out.String())
+	}
+	if report[1] != "last 10 instructions:" {
+		t.Errorf("Expected the context header, Got %q", report[1])
+	}
+	// The instructions before the difference, oldest first, with their disassembly
+	for i, h := range report[2 : 2+LOCKSTEP_CONTEXT] {
+		if want := "  " + lines[diverged-LOCKSTEP_CONTEXT+i] + "    "; !strings.HasPrefix(h, want) {
+			t.Errorf("Expected context line %q, Got %q", want, h)
+		}
+	}
+	if got := report[len(report)-2]; got != "kutemu:    "+trace(t, gdbProgram, 16, TraceFilter{})[diverged]+"    addi    a0, a0, 1" {
+		t.Errorf("Expected the executed instruction, Got %q", got)
+	}
+	if got := report[len(report)-1]; got != "reference: "+lines[diverged] {
+		t.Errorf("Expected the reference line, Got %q", got)
+	}
+}
@@ -0,0 +1,483 @@
+package emulator
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"riscv/instructions"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Monitor is a console in the spirit of the QEMU monitor, for inspecting and controlling the guest.
+// Connect with: nc localhost 4444, or socat - UNIX-CONNECT:/tmp/monitor
+// Commands are run by the run loop between two instructions, so they always see a consistent machine.
+
+const MONITOR_PROMPT = "(kutemu) "
+
+// Bytes shown by x when no count is given
+const MONITOR_DUMP = 64
+
+const MONITOR_HELP = `info registers        general purpose registers, pc and privilege mode
+info csrs             implemented CSRs
+info devices          memory map of the devices
+info irq              pending and enabled interrupts
+info break            breakpoints
+status                running or paused, and where
+stop                  pause the guest
+cont                  resume the guest
+step [N]              run N instructions, 1 by default, and pause
+x ADDR [COUNT]        dump COUNT bytes of memory at ADDR
+translate VADDR       walk the sv32 page tables in satp, the cpu itself doesn't translate addresses
+irq SOURCE [LEVEL]    raise PLIC source, or drive its line to LEVEL 0 or 1
+break ADDR            pause when pc reaches ADDR
+delete ADDR           remove the breakpoint at ADDR
+savevm [FILE]         save a snapshot
+loadvm [FILE]         restore a snapshot
+screendump [FILE]     save the display as PNG
+quit                  stop the emulator
+`
+
+// One line from a client. A closed command means the client went away.
+type monitorCommand struct {
+	conn   net.Conn
+	line   string
+	closed bool
+}
+
+type Monitor struct {
+	e        *Emulator
+	listener net.Listener
+	commands chan monitorCommand
+	// Client replies and notifications go to
+	conn        net.Conn
+	paused      bool
+	breakpoints map[uint32]bool
+	// Pause once this many instructions were executed, 0 means never
+	stepTo uint64
+	quit   bool
+}
+
+func NewMonitor(e *Emulator, address string) (*Monitor, error) {
+	listener, err := listen(address)
+	if err != nil {
+		return nil, err
+	}
+	m := &Monitor{
+		e:           e,
+		listener:    listener,
+		commands:    make(chan monitorCommand, 16),
+		breakpoints: make(map[uint32]bool),
+	}
+	go m.accept()
+	return m, nil
+}
+
+func (m *Monitor) accept() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		m.read(conn)
+	}
+}
+
+// Reads commands from a client till it disconnects. Only one client is served at a time.
+func (m *Monitor) read(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		m.commands <- monitorCommand{conn: conn, closed: true}
+	}()
+	fmt.Fprintf(conn, "KUTEmu monitor, type help for the commands\n%s", MONITOR_PROMPT)
+	r := bufio.NewScanner(conn)
+	for r.Scan() {
+		m.commands <- monitorCommand{conn: conn, line: strings.TrimSpace(r.Text())}
+	}
+}
+
+func (m *Monitor) printf(format string, args ...any) {
+	if m.conn != nil {
+		fmt.Fprintf(m.conn, format, args...)
+	}
+}
+
+// beforeExec runs the commands which arrived and blocks while the guest is paused.
+// It returns false once the monitor asked to quit.
+func (m *Monitor) beforeExec(cpu *instructions.Cpu) bool {
+	for len(m.commands) > 0 {
+		m.run(<-m.commands)
+	}
+	if !m.paused && m.breakpoints[cpu.PC] {
+		m.pause("breakpoint")
+	}
+	if m.stepTo != 0 && cpu.Instret >= m.stepTo {
+		m.stepTo = 0
+		m.pause("stepped")
+	}
+	for m.paused && !m.quit {
+		m.run(<-m.commands)
+	}
+	return !m.quit
+}
+
+func (m *Monitor) pause(reason string) {
+	m.paused = true
+	m.printf("\n%s, paused at pc 0x%08x\n%s", reason, m.e.cpu.PC, MONITOR_PROMPT)
+}
+
+func (m *Monitor) run(c monitorCommand) {
+	if c.closed {
+		if c.conn == m.conn {
+			m.conn = nil
+		}
+		return
+	}
+	m.conn = c.conn
+	if c.line != "" {
+		m.handle(strings.Fields(c.line))
+	}
+	if !m.quit {
+		m.printf("%s", MONITOR_PROMPT)
+	}
+}
+
+func (m *Monitor) handle(args []string) {
+	e := m.e
+	cpu := e.cpu
+	switch args[0] {
+	case "help", "?":
+		m.printf("%s", MONITOR_HELP)
+	case "info", "i":
+		if len(args) < 2 {
+			m.printf("info what? registers, csrs, devices, irq or break\n")
+			return
+		}
+		m.info(args[1])
+	case "status":
+		if m.paused {
+			m.printf("paused at pc 0x%08x, %d instructions executed\n", cpu.PC, cpu.Instret)
+		} else {
+			m.printf("running, %d instructions executed\n", cpu.Instret)
+		}
+	case "stop":
+		if !m.paused {
+			m.paused = true
+			m.printf("paused at pc 0x%08x\n", cpu.PC)
+		}
+	case "cont", "c":
+		m.paused = false
+		m.stepTo = 0
+	case "step", "s":
+		n := uint64(1)
+		if len(args) > 1 {
+			v, err := strconv.ParseUint(args[1], 0, 64)
+			if err != nil || v == 0 {
+				m.printf("step: invalid count %q\n", args[1])
+				return
+			}
+			n = v
+		}
+		m.stepTo = cpu.Instret + n
+		m.paused = false
+	case "x":
+		m.dump(args[1:])
+	case "translate":
+		if len(args) < 2 {
+			m.printf("translate: missing address\n")
+			return
+		}
+		vaddr, err := parseAddress(args[1])
+		if err != nil {
+			m.printf("translate: %s\n", err)
+			return
+		}
+		m.printf("%s\n", translate(cpu, vaddr))
+	case "irq":
+		m.irq(args[1:])
+	case "break", "b":
+		if len(args) < 2 {
+			m.info("break")
+			return
+		}
+		addr, err := parseAddress(args[1])
+		if err != nil {
+			m.printf("break: %s\n", err)
+			return
+		}
+		m.breakpoints[addr] = true
+	case "delete", "d":
+		if len(args) < 2 {
+			clear(m.breakpoints)
+			return
+		}
+		addr, err := parseAddress(args[1])
+		if err != nil || !m.breakpoints[addr] {
+			m.printf("delete: no breakpoint at %s\n", args[1])
+			return
+		}
+		delete(m.breakpoints, addr)
+	case "savevm":
+		path := e.snapshotPath()
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if err := e.saveSnapshot(path); err != nil {
+			m.printf("savevm: %s\n", err)
+			return
+		}
+		m.printf("saved snapshot to %s\n", path)
+	case "loadvm":
+		path := e.snapshotPath()
+		if len(args) > 1 {
+			path = args[1]
+		}
+		// Jumping to another point would make the run different from its journal
+		if e.journal != nil {
+			m.printf("loadvm: snapshots can't be restored while recording, replaying or running backwards\n")
+			return
+		}
+		if err := e.restoreSnapshot(path); err != nil {
+			m.printf("loadvm: %s\n", err)
+			return
+		}
+		m.printf("restored snapshot from %s, pc 0x%08x\n", path, e.cpu.PC)
+	case "screendump":
+		path := e.screenshotPath()
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if err := e.Screenshot(path); err != nil {
+			m.printf("screendump: %s\n", err)
+			return
+		}
+		m.printf("saved screenshot to %s\n", path)
+	case "quit", "q":
+		m.quit = true
+		m.paused = false
+	default:
+		m.printf("unknown command %q, type help for the commands\n", args[0])
+	}
+}
+
+func (m *Monitor) info(what string) {
+	cpu := m.e.cpu
+	switch what {
+	case "registers", "r":
+		m.printf("pc       %08x  mode %d  instret %d\n", cpu.PC, cpu.CurrentMode, cpu.Instret)
+		for i := 0; i < 32; i++ {
+			m.printf("x%-2d %-4s %08x", i, instructions.RegisterNames[i], cpu.Registers[i])
+			if i%4 == 3 {
+				m.printf("\n")
+			} else {
+				m.printf("  ")
+			}
+		}
+	case "csrs":
+		var csrs []uint32
+		for csr := range instructions.CSRNames {
+			if instructions.IsCSRValid(csr) {
+				csrs = append(csrs, csr)
+			}
+		}
+		slices.Sort(csrs)
+		for _, csr := range csrs {
+			m.printf("%03x %-10s %08x\n", csr, instructions.CSRNames[csr], cpu.CSR.GetValue(csr, 3, cpu))
+		}
+	case "devices":
+		m.printf("%08x-%08x test (syscon)\n", instructions.VIRT_TEST, instructions.VIRT_TEST+instructions.VIRT_TEST_SIZE-1)
+		m.printf("%08x-%08x rtc (goldfish), irq %d\n", instructions.VIRT_RTC, instructions.VIRT_RTC+instructions.VIRT_RTC_SIZE-1, instructions.RTC_IRQ)
+		m.printf("%08x-%08x keypad (goldfish events), irq %d\n", instructions.VIRT_EVENTS, instructions.VIRT_EVENTS+instructions.VIRT_EVENTS_SIZE-1, instructions.EVENTS_IRQ)
+		m.printf("%08x-%08x audio, irq %d\n", instructions.VIRT_AUDIO, instructions.VIRT_AUDIO+instructions.VIRT_AUDIO_SIZE-1, instructions.AUDIO_IRQ)
+		m.printf("%08x-%08x clint, mtime %d mtimecmp %d\n", instructions.BASE_CLINT, instructions.CLINT_END, cpu.Memory.Clint.Mtime, cpu.Memory.Clint.Mtimecmp[cpu.HartID])
+		m.printf("%08x-%08x plic, %d sources\n", instructions.PLIC_BASE, instructions.PLIC_BASE+instructions.PLIC_SIZE-1, cpu.Memory.Plic.NumSources)
+		m.printf("%08x-%08x uart (ns16550a), irq %d\n", instructions.VIRT_UART0, instructions.VIRT_UART0+0xff, instructions.UART0_IRQ)
+		m.printf("%08x-%08x framebuffer, %dx%d\n", instructions.VIRT_DISPLAY, instructions.VIRT_DISPLAY+instructions.VIRT_DISPLAY_SIZE-1, SCREEN_WIDTH, SCREEN_HEIGHT)
+		m.printf("%08x-%08x display control, write %d for a screenshot\n", instructions.VIRT_DISPLAY_CTRL, instructions.VIRT_DISPLAY_CTRL+3, instructions.DISPLAY_CTRL_SCREENSHOT)
+		m.printf("%08x-%08x ram\n", VIRT_DRAM, VIRT_DRAM+m.e.config.MemorySize-1)
+	case "irq":
+		csr := cpu.CSR.Registers
+		m.printf("mip %08x %s\n", csr[instructions.MIP], interruptBits(csr[instructions.MIP]))
+		m.printf("mie %08x %s\n", csr[instructions.MIE], interruptBits(csr[instructions.MIE]))
+		m.printf("mideleg %08x\n", csr[instructions.MIDELEG])
+		plic := cpu.Memory.Plic
+		m.printf("plic pending %v claimed %v level %v\n",
+			plicSources(plic, plic.Pending), plicSources(plic, plic.Claimed), plicSources(plic, plic.Level))
+		for n, ctx := range plic.Contexts {
+			mode := "m"
+			if n%2 == 1 {
+				mode = "s"
+			}
+			m.printf("plic context %d (hart %d %s-mode) threshold %d enabled %v\n",
+				n, n/2, mode, ctx.Threshold, plicSources(plic, ctx.Enable))
+		}
+	case "break":
+		addrs := slices.Sorted(maps.Keys(m.breakpoints))
+		if len(addrs) == 0 {
+			m.printf("no breakpoints\n")
+		}
+		for _, addr := range addrs {
+			m.printf("0x%08x\n", addr)
+		}
+	default:
+		m.printf("info: unknown %q\n", what)
+	}
+}
+
+// Interrupt bits of mip and mie by name
+func interruptBits(v uint32) string {
+	names := []string{1: "ssip", 3: "msip", 5: "stip", 7: "mtip", 9: "seip", 11: "meip"}
+	var set []string
+	for bit, name := range names {
+		if name != "" && v&(1<<bit) != 0 {
+			set = append(set, name)
+		}
+	}
+	return "[" + strings.Join(set, " ") + "]"
+}
+
+func plicSources(plic *instructions.Plic, bits []uint32) []uint32 {
+	var ids []uint32
+	for id := uint32(1); id <= plic.NumSources; id++ {
+		if bits[id/32]&(1<<(id%32)) != 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// x ADDR [COUNT], 16 bytes per line like hexdump -C
+func (m *Monitor) dump(args []string) {
+	if len(args) < 1 {
+		m.printf("x: missing address\n")
+		return
+	}
+	addr, err := parseAddress(args[0])
+	if err != nil {
+		m.printf("x: %s\n", err)
+		return
+	}
+	count := uint64(MONITOR_DUMP)
+	if len(args) > 1 {
+		if count, err = strconv.ParseUint(args[1], 0, 32); err != nil {
+			m.printf("x: invalid count %q\n", args[1])
+			return
+		}
+	}
+	mem := m.e.cpu.Memory
+	for line := uint64(0); line < count; line += 16 {
+		var hexes, text strings.Builder
+		for i := line; i < min(line+16, count); i++ {
+			b := mem.PeekByte(addr + uint32(i))
+			fmt.Fprintf(&hexes, "%02x ", b)
+			if b >= 0x20 && b < 0x7f {
+				text.WriteByte(b)
+			} else {
+				text.WriteByte('.')
+			}
+		}
+		m.printf("%08x  %-48s |%s|\n", addr+uint32(line), hexes.String(), text.String())
+	}
+}
+
+// irq SOURCE triggers an edge, irq SOURCE LEVEL drives the line like a level triggered device
+func (m *Monitor) irq(args []string) {
+	plic := m.e.cpu.Memory.Plic
+	if len(args) < 1 {
+		m.printf("irq: missing source\n")
+		return
+	}
+	id, err := strconv.ParseUint(args[0], 0, 32)
+	if err != nil || id == 0 || uint32(id) > plic.NumSources {
+		m.printf("irq: source must be between 1 and %d\n", plic.NumSources)
+		return
+	}
+	if len(args) == 1 {
+		plic.TriggerInterrupt(uint32(id))
+		return
+	}
+	switch args[1] {
+	case "0":
+		plic.SetLevel(uint32(id), false)
+	case "1":
+		plic.SetLevel(uint32(id), true)
+	default:
+		m.printf("irq: level must be 0 or 1\n")
+	}
+}
+
+// Sv32 PTE bits
+const (
+	PTE_V = 1 << iota
+	PTE_R
+	PTE_W
+	PTE_X
+	PTE_U
+	PTE_G
+	PTE_A
+	PTE_D
+)
+
+// translate walks the sv32 page tables satp points to and describes the result
+func translate(cpu *instructions.Cpu, vaddr uint32) string {
+	satp := cpu.CSR.Registers[instructions.SRW]
+	if satp>>31 == 0 {
+		return fmt.Sprintf("0x%08x -> 0x%08x, satp is bare", vaddr, vaddr)
+	}
+	mem := cpu.Memory
+	table := (satp & 0x3fffff) << 12
+	for level := 1; level >= 0; level-- {
+		vpn := (vaddr >> (12 + 10*level)) & 0x3ff
+		at := table + vpn*4
+		pte := uint32(mem.PeekByte(at)) | uint32(mem.PeekByte(at+1))<<8 | uint32(mem.PeekByte(at+2))<<16 | uint32(mem.PeekByte(at+3))<<24
+		if pte&PTE_V == 0 || (pte&PTE_R == 0 && pte&PTE_W != 0) {
+			return fmt.Sprintf("0x%08x: page fault, level %d pte at 0x%08x is 0x%08x", vaddr, level, at, pte)
+		}
+		ppn := pte >> 10
+		if pte&(PTE_R|PTE_X) == 0 {
+			table = ppn << 12
+			continue
+		}
+		var paddr uint32
+		if level == 1 {
+			// A megapage must be aligned to 4 MiB
+			if ppn&0x3ff != 0 {
+				return fmt.Sprintf("0x%08x: page fault, misaligned megapage pte at 0x%08x is 0x%08x", vaddr, at, pte)
+			}
+			paddr = ppn<<12 | vaddr&0x3fffff
+		} else {
+			paddr = ppn<<12 | vaddr&0xfff
+		}
+		return fmt.Sprintf("0x%08x -> 0x%08x, level %d pte at 0x%08x is 0x%08x %s", vaddr, paddr, level, at, pte, pteFlags(pte))
+	}
+	return fmt.Sprintf("0x%08x: page fault, no leaf pte", vaddr)
+}
+
+// rwxugad, - for the bits which are clear
+func pteFlags(pte uint32) string {
+	names := "rwxugad"
+	out := []byte("-------")
+	for i := range names {
+		if pte&(PTE_R<<i) != 0 {
+			out[i] = names[i]
+		}
+	}
+	return string(out)
+}
+
+func parseAddress(s string) (uint32, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q", s)
+	}
+	return uint32(v), nil
+}
+
+func (m *Monitor) Close() {
+	if err := m.listener.Close(); err != nil {
+		log.Printf("Failed to close monitor listener: %s\n", err)
+	}
+}
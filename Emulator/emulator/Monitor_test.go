@@ -0,0 +1,185 @@
+package emulator
+
+import (
+	"bufio"
+	"net"
+	"riscv/instructions"
+	"strings"
+	"testing"
+)
+
+type monitorClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	done chan Stop
+}
+
+// newMonitorClient runs gdbProgram paused before the first instruction, with a client on the other end of a pipe
+func newMonitorClient(t *testing.T) *monitorClient {
+	e := newTestEmulator(Config{Headless: true}, gdbProgram)
+	server, client := net.Pipe()
+	m := &Monitor{
+		e:           e,
+		commands:    make(chan monitorCommand, 16),
+		breakpoints: make(map[uint32]bool),
+		paused:      true,
+	}
+	e.monitor = m
+	go m.read(server)
+	c := &monitorClient{t: t, conn: client, r: bufio.NewReader(client), done: make(chan Stop, 1)}
+	go func() { c.done <- e.RunUntil(func(e *Emulator) bool { return false }) }()
+	t.Cleanup(func() { client.Close() })
+	if greeting := c.prompt(); greeting != "KUTEmu monitor, type help for the commands\n" {
+		t.Fatalf("Expected the greeting, Got %q", greeting)
+	}
+	return c
+}
+
+// prompt reads till the next prompt and returns what came before it
+func (c *monitorClient) prompt() string {
+	var b strings.Builder
+	for !strings.HasSuffix(b.String(), MONITOR_PROMPT) {
+		s, err := c.r.ReadString(' ')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		b.WriteString(s)
+	}
+	return strings.TrimSuffix(b.String(), MONITOR_PROMPT)
+}
+
+func (c *monitorClient) call(line string) string {
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.prompt()
+}
+
+func (c *monitorClient) expect(line string, want string) {
+	if got := c.call(line); got != want {
+		c.t.Errorf("Expected %q for %q, Got %q", want, line, got)
+	}
+}
+
+func (c *monitorClient) quit() {
+	if _, err := c.conn.Write([]byte("quit\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	if stop := <-c.done; stop.Code != EXIT_KILLED {
+		c.t.Errorf("Expected the run to end on quit, Got %v %d", stop.Reason, stop.Code)
+	}
+}
+
+func TestMonitorPauseAndStep(t *testing.T) {
+	c := newMonitorClient(t)
+	c.expect("status", "paused at pc 0x80000000, 0 instructions executed\n")
+	c.expect("stop", "")
+	c.expect("step 6", "")
+	if got := c.prompt(); got != "\nstepped, paused at pc 0x80000008\n" {
+		t.Errorf("Expected to pause after the steps, Got %q", got)
+	}
+	c.expect("status", "paused at pc 0x80000008, 6 instructions executed\n")
+	c.expect("step 0", "step: invalid count \"0\"\n")
+	c.expect("bogus", "unknown command \"bogus\", type help for the commands\n")
+	c.quit()
+}
+
+func TestMonitorRegisters(t *testing.T) {
+	c := newMonitorClient(t)
+	c.expect("step 6", "")
+	c.prompt()
+	lines := strings.Split(c.call("info registers"), "\n")
+	if len(lines) != 10 || lines[0] != "pc       80000008  mode 3  instret 6" {
+		t.Fatalf("Expected pc and 8 lines of registers, Got %q", lines)
+	}
+	for _, want := range []string{"x0  zero 00000000", "x5  t0   80001000", "x10 a0   00000002"} {
+		if !strings.Contains(strings.Join(lines, "\n"), want) {
+			t.Errorf("Expected %q in the register dump", want)
+		}
+	}
+	if want := "x8  s0   00000000  x9  s1   00000000  x10 a0   00000002  x11 a1   00000000"; lines[3] != want {
+		t.Errorf("Expected 4 registers a line\n%s\nGot\n%s", want, lines[3])
+	}
+	c.quit()
+}
+
+func TestMonitorMemoryDump(t *testing.T) {
+	c := newMonitorClient(t)
+	c.expect("step 6", "")
+	c.prompt()
+	c.expect("x 0x80001000 4", "80001000  01 00 00 00                                      |....|\n")
+	c.expect("x 80000000 20", "80000000  13 05 15 00 b7 12 00 80 23 a0 a2 00 6f f0 5f ff  |........#...o._.|\n"+
+		"80000010  00 00 00 00                                      |....|\n")
+	if got := strings.Count(c.call("x 80000000"), "\n"); got != MONITOR_DUMP/16 {
+		t.Errorf("Expected %d lines by default, Got %d", MONITOR_DUMP/16, got)
+	}
+	c.expect("x", "x: missing address\n")
+	c.expect("x zz", "x: invalid address \"zz\"\n")
+	c.quit()
+}
+
+func TestMonitorBreakpoints(t *testing.T) {
+	c := newMonitorClient(t)
+	c.expect("info break", "no breakpoints\n")
+	c.expect("break 8000000c", "")
+	c.expect("break 0x80000004", "")
+	c.expect("info break", "0x80000004\n0x8000000c\n")
+	c.expect("cont", "")
+	if got := c.prompt(); got != "\nbreakpoint, paused at pc 0x80000004\n" {
+		t.Errorf("Expected to pause at the first breakpoint, Got %q", got)
+	}
+	c.expect("delete 80000004", "")
+	c.expect("delete 80000004", "delete: no breakpoint at 80000004\n")
+	c.expect("cont", "")
+	if got := c.prompt(); got != "\nbreakpoint, paused at pc 0x8000000c\n" {
+		t.Errorf("Expected to pause at the second breakpoint, Got %q", got)
+	}
+	c.expect("status", "paused at pc 0x8000000c, 3 instructions executed\n")
+	// Hit again on the next round
+	c.expect("cont", "")
+	if got := c.prompt(); got != "\nbreakpoint, paused at pc 0x8000000c\n" {
+		t.Errorf("Expected to pause at the breakpoint again, Got %q", got)
+	}
+	c.expect("status", "paused at pc 0x8000000c, 7 instructions executed\n")
+	c.expect("delete", "")
+	c.expect("info break", "no breakpoints\n")
+	c.quit()
+}
+
+func TestMonitorTranslate(t *testing.T) {
+	c := newMonitorClient(t)
+	c.expect("translate 80001000", "0x80001000 -> 0x80001000, satp is bare\n")
+	c.expect("translate", "translate: missing address\n")
+	c.quit()
+
+	e := newTestEmulator(Config{Headless: true}, nil)
+	cpu := e.Hart(0)
+	// Root table at 0x80002000, the second level one at 0x80003000
+	ptes := map[uint32]uint32{
+		0x80002400: 0x80000<<10 | PTE_V | PTE_R | PTE_W | PTE_X,
+		0x80002004: 0x80003<<10 | PTE_V,
+		0x80003014: 0x80010<<10 | PTE_V | PTE_R | PTE_A | PTE_D,
+		0x8000200c: 0x80001<<10 | PTE_V | PTE_R,
+		0x80002010: PTE_V | PTE_W,
+	}
+	for addr, pte := range ptes {
+		cpu.Memory.WriteWord(pte, addr)
+	}
+	cpu.CSR.Registers[instructions.SRW] = 1<<31 | 0x80002
+	for _, test := range []struct {
+		vaddr uint32
+		want  string
+	}{
+		{0x40001234, "0x40001234 -> 0x80001234, level 1 pte at 0x80002400 is 0x2000000f rwx----"},
+		{0x00405678, "0x00405678 -> 0x80010678, level 0 pte at 0x80003014 is 0x200040c3 r----ad"},
+		{0x00800000, "0x00800000: page fault, level 1 pte at 0x80002008 is 0x00000000"},
+		{0x00c00000, "0x00c00000: page fault, misaligned megapage pte at 0x8000200c is 0x20000403"},
+		{0x01000000, "0x01000000: page fault, level 1 pte at 0x80002010 is 0x00000005"},
+		{0x00401000, "0x00401000: page fault, level 0 pte at 0x80003004 is 0x00000000"},
+	} {
+		if got := translate(cpu, test.vaddr); got != test.want {
+			t.Errorf("Expected %q, Got %q", test.want, got)
+		}
+	}
+}
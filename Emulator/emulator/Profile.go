@@ -0,0 +1,422 @@
+package emulator
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"riscv/disasm"
+	"riscv/instructions"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Guest profiler. Every interval-th instruction is counted with the call stack it ran in.
+// The call stack is followed the way the return address stack of a cpu predicts it, see the hints for
+// jal and jalr in the RISC-V spec: a jump writing ra or t0 is a call, a jalr through ra or t0 that doesn't
+// write them is a return. Traps are frames too, entered when pc goes where the instruction doesn't send
+// it or an interrupt is taken, and left with mret or sret.
+//
+// Written when the run ends:
+//   - a report of the functions with the most instructions, on stderr
+//   - folded stacks, one "main;draw;memcpy 1234" line per stack, for flamegraph.pl or speedscope
+//   - a pprof profile for go tool pprof
+
+// Deeper calls are not followed, so recursion without end doesn't eat the memory
+const PROFILE_MAX_DEPTH = 1024
+
+// One function call on the way to an instruction, the root is the code running before any call
+type frame struct {
+	parent *frame
+	// Call instruction in the parent, the instruction interrupted for traps
+	callsite uint32
+	entry    uint32
+	ret      uint32
+	depth    int
+	children map[uint64]*frame
+}
+
+type profileKey struct {
+	frame *frame
+	pc    uint32
+}
+
+type Profiler struct {
+	interval  uint64
+	countdown uint64
+	root      *frame
+	current   *frame
+	// Calls past PROFILE_MAX_DEPTH, the returns matching them pop nothing
+	overflow int
+	// Samples per stack and pc
+	counts  map[profileKey]uint64
+	symbols *disasm.Disassembler
+	start   time.Time
+}
+
+// NewProfiler counts every interval-th instruction and names functions with the symbols of an ELF file,
+// which may be empty
+func NewProfiler(symbols string, interval uint64) (*Profiler, error) {
+	if interval == 0 {
+		interval = 1
+	}
+	root := &frame{}
+	p := &Profiler{
+		interval:  interval,
+		countdown: interval,
+		root:      root,
+		current:   root,
+		counts:    make(map[profileKey]uint64),
+		symbols:   &disasm.Disassembler{},
+		start:     time.Now(),
+	}
+	if symbols != "" {
+		f, err := elf.Open(symbols)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		p.symbols.Symbols = disasm.ELFSymbols(f)
+	}
+	return p, nil
+}
+
+func isLink(r byte) bool {
+	return r == 1 || r == 5
+}
+
+// executed counts the instruction which ran at pc and follows the calls and returns it makes
+func (p *Profiler) executed(pc uint32, inst instructions.Inst, cpu *instructions.Cpu) {
+	p.countdown--
+	if p.countdown == 0 {
+		p.countdown = p.interval
+		p.counts[profileKey{p.current, pc}]++
+	}
+	switch i := inst.(type) {
+	case instructions.JI:
+		if isLink(i.RD) {
+			p.call(pc, cpu.PC, pc+4)
+		}
+		return
+	case instructions.BI:
+		return
+	case instructions.II:
+		switch i.Opcode {
+		case instructions.OP_TOPLEVEL_JUMP_2:
+			switch {
+			// Coroutine switch
+			case isLink(i.RD) && isLink(i.RS1) && i.RD != i.RS1:
+				p.ret(cpu.PC)
+				p.call(pc, cpu.PC, pc+4)
+			case isLink(i.RD):
+				p.call(pc, cpu.PC, pc+4)
+			case isLink(i.RS1):
+				p.ret(cpu.PC)
+			}
+			return
+		case instructions.OP_TOPLEVEL_ENVIRON:
+			if op := i.Operation(); op == "mret" || op == "sret" {
+				p.ret(cpu.PC)
+				return
+			}
+		}
+	}
+	// Everything else goes to the next instruction unless it trapped
+	if cpu.PC != pc+4 {
+		p.trap(pc, cpu.PC)
+	}
+}
+
+// trap enters a trap handler, the instruction at pc was interrupted or trapped
+func (p *Profiler) trap(pc uint32, handler uint32) {
+	p.call(pc, handler, pc)
+}
+
+func (p *Profiler) call(callsite uint32, entry uint32, ret uint32) {
+	if p.current.depth >= PROFILE_MAX_DEPTH {
+		p.overflow++
+		return
+	}
+	key := uint64(callsite)<<32 | uint64(entry)
+	child, ok := p.current.children[key]
+	if !ok {
+		child = &frame{parent: p.current, callsite: callsite, entry: entry, ret: ret, depth: p.current.depth + 1}
+		if p.current.children == nil {
+			p.current.children = make(map[uint64]*frame)
+		}
+		p.current.children[key] = child
+	}
+	p.current = child
+}
+
+func (p *Profiler) ret(to uint32) {
+	if p.overflow > 0 {
+		p.overflow--
+		return
+	}
+	// longjmp and exceptions leave several frames at once
+	for f := p.current; f != p.root; f = f.parent {
+		if f.ret == to {
+			p.current = f.parent
+			return
+		}
+	}
+	if p.current != p.root {
+		p.current = p.current.parent
+	}
+}
+
+// Function pc belongs to. Without a symbol, it is named after the entry of the frame it ran in.
+func (p *Profiler) function(pc uint32, f *frame) string {
+	if s, ok := p.symbols.Lookup(pc); ok {
+		return s.Name
+	}
+	if f != p.root {
+		return fmt.Sprintf("0x%08x", f.entry)
+	}
+	return "[unknown]"
+}
+
+type profileLocation struct {
+	pc       uint32
+	function string
+}
+
+// Stack of a sample, the instruction first and then the call sites up to the root
+func (p *Profiler) stack(key profileKey) []profileLocation {
+	stack := []profileLocation{{key.pc, p.function(key.pc, key.frame)}}
+	for f := key.frame; f != p.root; f = f.parent {
+		stack = append(stack, profileLocation{f.callsite, p.function(f.callsite, f.parent)})
+	}
+	return stack
+}
+
+// Close writes the profiles that were asked for
+func (p *Profiler) Close(config Config) {
+	if config.ProfileTop > 0 {
+		p.writeTop(os.Stderr, config.ProfileTop)
+	}
+	if config.ProfileFolded != "" {
+		if err := writeFile(config.ProfileFolded, p.writeFolded); err != nil {
+			fmt.Fprintf(os.Stderr, "profile: %s\n", err)
+		}
+	}
+	if config.Profile != "" {
+		if err := writeFile(config.Profile, p.writePprof); err != nil {
+			fmt.Fprintf(os.Stderr, "profile: %s\n", err)
+		}
+	}
+}
+
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Instructions counted by a number of samples
+func (p *Profiler) instructions(samples uint64) uint64 {
+	return samples * p.interval
+}
+
+// writeTop prints the n functions with the most instructions. Self counts the instructions of the
+// function itself, cumulative also those of the functions it called.
+func (p *Profiler) writeTop(w io.Writer, n int) {
+	self := make(map[string]uint64)
+	cum := make(map[string]uint64)
+	var total uint64
+	for key, count := range p.counts {
+		total += count
+		stack := p.stack(key)
+		self[stack[0].function] += count
+		// Recursive functions count once
+		seen := make(map[string]bool)
+		for _, l := range stack {
+			if !seen[l.function] {
+				seen[l.function] = true
+				cum[l.function] += count
+			}
+		}
+	}
+	names := make([]string, 0, len(cum))
+	for name := range cum {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		if c := cmp.Compare(self[b], self[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	percent := func(v uint64) float64 {
+		return 100 * float64(v) / float64(max(total, 1))
+	}
+	fmt.Fprintf(w, "profile: %d instructions\n", p.instructions(total))
+	fmt.Fprintf(w, "%14s %7s %14s %7s  %s\n", "self", "self%", "cum", "cum%", "function")
+	for _, name := range names[:min(n, len(names))] {
+		fmt.Fprintf(w, "%14d %6.2f%% %14d %6.2f%%  %s\n",
+			p.instructions(self[name]), percent(self[name]), p.instructions(cum[name]), percent(cum[name]), name)
+	}
+}
+
+// writeFolded writes one line per stack, root first, in the format of Brendan Gregg's stackcollapse scripts
+func (p *Profiler) writeFolded(w io.Writer) error {
+	folded := make(map[string]uint64)
+	for key, count := range p.counts {
+		stack := p.stack(key)
+		names := make([]string, 0, len(stack))
+		for i := len(stack) - 1; i >= 0; i-- {
+			names = append(names, stack[i].function)
+		}
+		folded[strings.Join(names, ";")] += count
+	}
+	lines := make([]string, 0, len(folded))
+	for stack := range folded {
+		lines = append(lines, stack)
+	}
+	slices.Sort(lines)
+	for _, stack := range lines {
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, p.instructions(folded[stack])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePprof writes a gzipped profile.proto, see
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+func (p *Profiler) writePprof(w io.Writer) error {
+	var strs []string
+	strIndex := make(map[string]uint64)
+	str := func(s string) uint64 {
+		if n, ok := strIndex[s]; ok {
+			return n
+		}
+		strIndex[s] = uint64(len(strs))
+		strs = append(strs, s)
+		return uint64(len(strs) - 1)
+	}
+	str("")
+
+	var out protobuf
+	valueType := func(field int) {
+		var v protobuf
+		v.uint(1, str("instructions"))
+		v.uint(2, str("count"))
+		out.bytes(field, v.b)
+	}
+	valueType(1)
+
+	functions := make(map[string]uint64)
+	locations := make(map[profileLocation]uint64)
+	var functionsOut, locationsOut protobuf
+	keys := make([]profileKey, 0, len(p.counts))
+	for key := range p.counts {
+		keys = append(keys, key)
+	}
+	// Same input, same file
+	stacks := make(map[profileKey][]profileLocation, len(keys))
+	for _, key := range keys {
+		stacks[key] = p.stack(key)
+	}
+	slices.SortFunc(keys, func(a, b profileKey) int {
+		return slices.CompareFunc(stacks[a], stacks[b], func(x, y profileLocation) int {
+			if c := cmp.Compare(x.pc, y.pc); c != 0 {
+				return c
+			}
+			return strings.Compare(x.function, y.function)
+		})
+	})
+	for _, key := range keys {
+		var ids []uint64
+		for _, l := range stacks[key] {
+			id, ok := locations[l]
+			if !ok {
+				fn, ok := functions[l.function]
+				if !ok {
+					fn = uint64(len(functions) + 1)
+					functions[l.function] = fn
+					var f protobuf
+					f.uint(1, fn)
+					f.uint(2, str(l.function))
+					f.uint(3, str(l.function))
+					functionsOut.bytes(5, f.b)
+				}
+				id = uint64(len(locations) + 1)
+				locations[l] = id
+				var line, loc protobuf
+				line.uint(1, fn)
+				loc.uint(1, id)
+				loc.uint(3, uint64(l.pc))
+				loc.bytes(4, line.b)
+				locationsOut.bytes(4, loc.b)
+			}
+			ids = append(ids, id)
+		}
+		var sample protobuf
+		sample.packed(1, ids)
+		sample.packed(2, []uint64{p.instructions(p.counts[key])})
+		out.bytes(2, sample.b)
+	}
+	out.b = append(out.b, locationsOut.b...)
+	out.b = append(out.b, functionsOut.b...)
+	for _, s := range strs {
+		out.bytes(6, []byte(s))
+	}
+	out.uint(9, uint64(p.start.UnixNano()))
+	out.uint(10, uint64(time.Since(p.start).Nanoseconds()))
+	valueType(11)
+	out.uint(12, p.interval)
+
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(out.b); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// Just enough protocol buffers encoding for profile.proto
+type protobuf struct {
+	b []byte
+}
+
+func (pb *protobuf) varint(v uint64) {
+	for v >= 0x80 {
+		pb.b = append(pb.b, byte(v)|0x80)
+		v >>= 7
+	}
+	pb.b = append(pb.b, byte(v))
+}
+
+func (pb *protobuf) uint(field int, v uint64) {
+	pb.varint(uint64(field) << 3)
+	pb.varint(v)
+}
+
+func (pb *protobuf) bytes(field int, b []byte) {
+	pb.varint(uint64(field)<<3 | 2)
+	pb.varint(uint64(len(b)))
+	pb.b = append(pb.b, b...)
+}
+
+func (pb *protobuf) packed(field int, vs []uint64) {
+	var inner protobuf
+	for _, v := range vs {
+		inner.varint(v)
+	}
+	pb.bytes(field, inner.b)
+}
@@ -0,0 +1,216 @@
+package emulator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"riscv/disasm"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// main calls f, then g which calls f too
+var profileProgram = []uint32{
+	0x00c000ef, // main: jal ra, f
+	0x010000ef, // jal ra, g
+	0x0000006f, // j .
+	0x00150513, // f: addi a0, a0, 1
+	0x00008067, // ret
+	0x00008413, // g: mv s0, ra
+	0xff5ff0ef, // jal ra, f
+	0x00040093, // mv ra, s0
+	0x00008067, // ret
+}
+
+// Till the first time j . runs
+const profileSteps = 11
+
+var profileFolded = []string{
+	"main 3",
+	"main;f 2",
+	"main;g 4",
+	"main;g;f 2",
+}
+
+func newTestProfiler(t *testing.T) *Profiler {
+	p, err := NewProfiler("", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.symbols.Symbols = []disasm.Symbol{{Addr: VIRT_DRAM, Name: "main"}, {Addr: VIRT_DRAM + 0xc, Name: "f"}, {Addr: VIRT_DRAM + 0x14, Name: "g"}}
+	e := newTestEmulator(Config{Headless: true}, profileProgram)
+	e.profiler = p
+	e.Step(profileSteps)
+	return p
+}
+
+func TestProfileFolded(t *testing.T) {
+	p := newTestProfiler(t)
+	var b strings.Builder
+	if err := p.writeFolded(&b); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Split(strings.TrimSpace(b.String()), "\n"); !slices.Equal(got, profileFolded) {
+		t.Errorf("Expected %q, Got %q", profileFolded, got)
+	}
+
+	// Without symbols functions are named after their entry
+	p.symbols.Symbols = nil
+	b.Reset()
+	_ = p.writeFolded(&b)
+	if !strings.Contains(b.String(), "[unknown];0x80000014;0x8000000c 2\n") {
+		t.Errorf("Expected frames named after their entry, Got %q", b.String())
+	}
+}
+
+// protoVarint reads the varint b starts with
+func protoVarint(t *testing.T, b []byte) (uint64, []byte) {
+	var v uint64
+	for shift := 0; len(b) > 0; shift += 7 {
+		c := b[0]
+		b = b[1:]
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v, b
+		}
+	}
+	t.Fatalf("Expected a varint")
+	return 0, nil
+}
+
+// protoFields splits a protocol buffers message into its fields, varints are returned as their value
+func protoFields(t *testing.T, b []byte) (fields []int, values [][]byte, varints []uint64) {
+	for len(b) > 0 {
+		var key, v uint64
+		key, b = protoVarint(t, b)
+		fields = append(fields, int(key>>3))
+		switch key & 7 {
+		case 0:
+			v, b = protoVarint(t, b)
+			values = append(values, nil)
+			varints = append(varints, v)
+		case 2:
+			v, b = protoVarint(t, b)
+			values = append(values, b[:v])
+			varints = append(varints, 0)
+			b = b[v:]
+		default:
+			t.Fatalf("Expected varint or length delimited fields, Got wire type %d", key&7)
+		}
+	}
+	return
+}
+
+func protoPacked(t *testing.T, b []byte) []uint64 {
+	var vs []uint64
+	for len(b) > 0 {
+		var v uint64
+		v, b = protoVarint(t, b)
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+func TestProfilePprof(t *testing.T) {
+	p := newTestProfiler(t)
+	var b bytes.Buffer
+	if err := p.writePprof(&b); err != nil {
+		t.Fatal(err)
+	}
+	z, err := gzip.NewReader(&b)
+	if err != nil {
+		t.Fatalf("Expected a gzipped profile, Got %s", err)
+	}
+	raw, err := io.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// profile.proto field numbers
+	var strs []string
+	var samples [][]byte
+	functions := make(map[uint64]uint64)
+	locations := make(map[uint64][2]uint64)
+	var period uint64
+	var sampleType []byte
+	fields, values, varints := protoFields(t, raw)
+	for i, field := range fields {
+		switch field {
+		case 1:
+			sampleType = values[i]
+		case 2:
+			samples = append(samples, values[i])
+		case 4:
+			f, v, n := protoFields(t, values[i])
+			var id, addr, fn uint64
+			for j := range f {
+				switch f[j] {
+				case 1:
+					id = n[j]
+				case 3:
+					addr = n[j]
+				case 4:
+					_, _, line := protoFields(t, v[j])
+					fn = line[0]
+				}
+			}
+			locations[id] = [2]uint64{addr, fn}
+		case 5:
+			_, _, n := protoFields(t, values[i])
+			functions[n[0]] = n[1]
+		case 6:
+			strs = append(strs, string(values[i]))
+		case 12:
+			period = varints[i]
+		}
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("Expected the string table to start with the empty string")
+	}
+	if _, _, n := protoFields(t, sampleType); len(n) != 2 || strs[n[0]] != "instructions" || strs[n[1]] != "count" {
+		t.Errorf("Expected the sample type instructions/count")
+	}
+	if period != 1 {
+		t.Errorf("Expected period 1, Got %d", period)
+	}
+
+	var total uint64
+	perStack := make(map[string]uint64)
+	for _, sample := range samples {
+		f, v, _ := protoFields(t, sample)
+		var names []string
+		var value uint64
+		for j := range f {
+			switch f[j] {
+			case 1:
+				for _, id := range protoPacked(t, v[j]) {
+					loc, ok := locations[id]
+					if !ok {
+						t.Fatalf("Expected location %d", id)
+					}
+					names = append([]string{strs[functions[loc[1]]]}, names...)
+				}
+			case 2:
+				value = protoPacked(t, v[j])[0]
+			}
+		}
+		total += value
+		perStack[strings.Join(names, ";")] += value
+	}
+	var folded []string
+	for stack, value := range perStack {
+		folded = append(folded, fmt.Sprintf("%s %d", stack, value))
+	}
+	slices.Sort(folded)
+	if !slices.Equal(folded, profileFolded) || total != profileSteps {
+		t.Errorf("Expected the samples %q, Got %q", profileFolded, folded)
+	}
+	// Call sites are located in the caller
+	for _, loc := range locations {
+		if loc[0] == uint64(VIRT_DRAM+0x18) && strs[functions[loc[1]]] != "g" {
+			t.Errorf("Expected the call site in g")
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package emulator
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"riscv/instructions"
+	"sync"
+	"time"
+)
+
+// Record and replay of everything that makes a run nondeterministic. Each event is stamped with the number
+// of instructions executed before it, so replay can put it back at the same point:
+//   - mtime, which otherwise follows the host clock. The RTC follows mtime in both modes.
+//   - bytes received by the UART. Seq is the number of times the UART polled for input, a poll happens
+//     more than once per instruction.
+//   - keys and pointer events sent to the goldfish events device, by VNC. Value is the type, code and value
+//     of the event, 16, 16 and 32 bits from the top.
+//
+// File: RECORDING_MAGIC, then gzip compressed little endian recordingHeader followed by events.
+const RECORDING_MAGIC = "KUTEMU-RECORDING\n"
+const RECORDING_VERSION = 2
+
+const (
+	EVENT_TIME uint8 = iota + 1
+	EVENT_UART
+	EVENT_INPUT
+	// Last event, recording stopped there
+	EVENT_END
+)
+
+type recordingHeader struct {
+	Version    uint32
+	SBI        bool
+	MemorySize uint32
+	// sha256 of the image, replaying another one can't work
+	Image    [32]byte
+	Mtime    uint64
+	RTCStart int64
+}
+
+type event struct {
+	Instret uint64
+	Seq     uint64
+	Kind    uint8
+	Value   uint64
+}
+
+func imageHash(body []byte) [32]byte {
+	return sha256.Sum256(body)
+}
+
+// The RTC runs on mtime, so it is as deterministic as mtime
+func (e *Emulator) mtimeClock() time.Time {
+	return time.UnixMilli(int64(e.cpu.Memory.Clint.Mtime))
+}
+
+// Journal is where time and UART input come from when the run has to be reproducible. Live, they come
+// from the host and are logged. Otherwise, they are replayed from events, which are either a recording
+// or what was logged live before reverse execution went back in time.
+type Journal struct {
+	Header recordingHeader
+	// events[0] is event number base, older ones were dropped
+	events []event
+	base   int
+	// Number of the next event to replay
+	pos int
+	// Inputs can come from the host once the run gets past what was already executed
+	live bool
+	// Live events are kept for re-execution, otherwise only written to the recording
+	keep bool
+	// Ticks and polls done live so far, earlier ones are replayed
+	liveTicks uint64
+	livePolls uint64
+	polls     uint64
+	mtime     uint64
+	// Input events sent from other goroutines, logged and given to the guest by the next live tick
+	inputMutex sync.Mutex
+	inputs     []instructions.InputEvent
+	// Recording live events go to
+	file io.Closer
+	w    *bufio.Writer
+	z    *gzip.Writer
+	err  error
+	// Set when the run doesn't match the recording anymore
+	Diverged string
+}
+
+// Place in the journal, to go back to with a checkpoint
+type journalMark struct {
+	pos   int
+	polls uint64
+	mtime uint64
+}
+
+// NewLiveJournal takes inputs from the host and keeps them in memory for reverse execution
+func NewLiveJournal(header recordingHeader) *Journal {
+	return &Journal{Header: header, live: true, keep: true, mtime: header.Mtime}
+}
+
+// NewRecording takes inputs from the host and writes them to path
+func NewRecording(path string, header recordingHeader) (*Journal, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{Header: header, live: true, mtime: header.Mtime, file: f, w: bufio.NewWriter(f)}
+	j.w.WriteString(RECORDING_MAGIC)
+	j.z = gzip.NewWriter(j.w)
+	j.Header.Version = RECORDING_VERSION
+	j.write(j.Header)
+	return j, j.err
+}
+
+func (j *Journal) write(v any) {
+	if j.z != nil && j.err == nil {
+		j.err = binary.Write(j.z, binary.LittleEndian, v)
+	}
+}
+
+// NewReplay reads a recording made with NewRecording
+func NewReplay(path string) (*Journal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := bufio.NewReader(f)
+	magic := make([]byte, len(RECORDING_MAGIC))
+	if _, err := io.ReadFull(b, magic); err != nil || string(magic) != RECORDING_MAGIC {
+		return nil, fmt.Errorf("%s: not a recording", path)
+	}
+	z, err := gzip.NewReader(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	j := &Journal{}
+	if err := binary.Read(z, binary.LittleEndian, &j.Header); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if j.Header.Version != RECORDING_VERSION {
+		return nil, fmt.Errorf("%s: recording version %d, only version %d is supported", path, j.Header.Version, RECORDING_VERSION)
+	}
+	j.mtime = j.Header.Mtime
+	for {
+		var ev event
+		if err := binary.Read(z, binary.LittleEndian, &ev); err != nil {
+			// Without its END event the run can't be told apart from one which went another way
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("%s: recording is cut short", path)
+			}
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		j.events = append(j.events, ev)
+		if ev.Kind == EVENT_END {
+			break
+		}
+	}
+	// Checks the gzip trailer
+	if _, err := io.Copy(io.Discard, z); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return j, nil
+}
+
+// Check makes sure the machine is the one the recording was made with
+func (j *Journal) Check(config Config, image [32]byte) error {
+	h := j.Header
+	if h.SBI != config.SBI || h.MemorySize != config.MemorySize {
+		return fmt.Errorf("recording was made with sbi %v and %d bytes of memory", h.SBI, h.MemorySize)
+	}
+	if h.Image != image {
+		return errors.New("recording was made with another image")
+	}
+	return nil
+}
+
+// Next event to replay, if there is one
+func (j *Journal) next() (event, bool) {
+	if j.pos-j.base < len(j.events) {
+		return j.events[j.pos-j.base], true
+	}
+	return event{}, false
+}
+
+func (j *Journal) log(ev event) {
+	j.write(ev)
+	if j.keep {
+		j.events = append(j.events, ev)
+		j.pos++
+	}
+}
+
+// attach makes the UART and RTC of the machine go through the journal
+func (j *Journal) attach(e *Emulator) {
+	cpu := e.cpu
+	host := cpu.Memory.Uart.Input
+	cpu.Memory.Uart.Input = func() (byte, bool) {
+		j.polls++
+		if ev, ok := j.next(); ok && ev.Kind == EVENT_UART && ev.Seq == j.polls {
+			if ev.Instret != cpu.Instret {
+				j.Diverged = fmt.Sprintf("uart byte was received at instruction %d, replay is at %d", ev.Instret, cpu.Instret)
+			}
+			j.pos++
+			return byte(ev.Value), true
+		}
+		if !j.live || j.polls <= j.livePolls {
+			return 0, false
+		}
+		j.livePolls = j.polls
+		b, ok := host()
+		if ok {
+			j.log(event{Instret: cpu.Instret, Seq: j.polls, Kind: EVENT_UART, Value: uint64(b)})
+		}
+		return b, ok
+	}
+	cpu.Memory.Clint.Mtime = j.mtime
+	cpu.Memory.Rtc.SetClock(e.mtimeClock)
+}
+
+// tick applies the events due before the next instruction, or moves mtime to the host clock when live.
+// It returns false when the run is over, because the recording ended or the run went another way.
+func (j *Journal) tick(cpu *instructions.Cpu) bool {
+	for j.Diverged == "" {
+		ev, ok := j.next()
+		if !ok {
+			break
+		}
+		if ev.Instret > cpu.Instret {
+			return true
+		}
+		switch ev.Kind {
+		case EVENT_TIME:
+			j.mtime = ev.Value
+			cpu.Memory.Clint.Mtime = j.mtime
+		case EVENT_INPUT:
+			cpu.Memory.Events.Send(uint32(ev.Value>>48), uint32(ev.Value>>32)&0xFFFF, uint32(ev.Value))
+		case EVENT_UART:
+			// Consumed by the UART when it polls, which it should have done already
+			if ev.Instret < cpu.Instret {
+				j.Diverged = fmt.Sprintf("uart byte due at instruction %d was never polled for", ev.Instret)
+				return false
+			}
+			return true
+		case EVENT_END:
+			return false
+		default:
+			j.Diverged = fmt.Sprintf("unknown event %d", ev.Kind)
+			return false
+		}
+		j.pos++
+	}
+	if j.Diverged != "" {
+		return false
+	}
+	if !j.live {
+		// Recording ended without an END event
+		return false
+	}
+	if cpu.Instret < j.liveTicks {
+		return true
+	}
+	j.liveTicks = cpu.Instret + 1
+	j.inputMutex.Lock()
+	inputs := j.inputs
+	j.inputs = nil
+	j.inputMutex.Unlock()
+	for _, in := range inputs {
+		j.log(event{Instret: cpu.Instret, Kind: EVENT_INPUT, Value: uint64(in.Type&0xFFFF)<<48 | uint64(in.Code&0xFFFF)<<32 | uint64(in.Value)})
+		cpu.Memory.Events.Send(in.Type, in.Code, in.Value)
+	}
+	now := uint64(time.Now().UnixMilli())
+	if j.mtime != now {
+		j.mtime = now
+		cpu.Memory.Clint.Mtime = now
+		j.log(event{Instret: cpu.Instret, Kind: EVENT_TIME, Value: now})
+	}
+	return true
+}
+
+// input queues an event for the events device, it reaches the guest at the next live tick. It returns false
+// when replaying a recording, which has all its input already.
+func (j *Journal) input(ev instructions.InputEvent) bool {
+	if !j.live {
+		return false
+	}
+	j.inputMutex.Lock()
+	j.inputs = append(j.inputs, ev)
+	j.inputMutex.Unlock()
+	return true
+}
+
+func (j *Journal) mark() journalMark {
+	return journalMark{pos: j.pos, polls: j.polls, mtime: j.mtime}
+}
+
+// rewind goes back to a mark, events after it are replayed till the run catches up with where it was
+func (j *Journal) rewind(m journalMark, cpu *instructions.Cpu) {
+	j.pos = m.pos
+	j.polls = m.polls
+	j.mtime = m.mtime
+	cpu.Memory.Clint.Mtime = m.mtime
+}
+
+// forget drops the events after the current point, input comes from the host again from here
+func (j *Journal) forget(cpu *instructions.Cpu) {
+	if !j.live {
+		return
+	}
+	j.events = j.events[:j.pos-j.base]
+	j.liveTicks = cpu.Instret + 1
+	j.livePolls = j.polls
+}
+
+// trim drops the events before pos, nothing can go back there anymore
+func (j *Journal) trim(pos int) {
+	if pos > j.base && pos <= j.pos {
+		j.events = append([]event(nil), j.events[pos-j.base:]...)
+		j.base = pos
+	}
+}
+
+// Close ends a recording at the given instruction
+func (j *Journal) Close(instret uint64) error {
+	if j.file == nil {
+		return nil
+	}
+	j.write(event{Instret: instret, Kind: EVENT_END})
+	if err := j.z.Close(); j.err == nil {
+		j.err = err
+	}
+	if err := j.w.Flush(); j.err == nil {
+		j.err = err
+	}
+	if err := j.file.Close(); j.err == nil {
+		j.err = err
+	}
+	return j.err
+}
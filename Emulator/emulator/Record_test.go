@@ -0,0 +1,197 @@
+package emulator
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"riscv/instructions"
+	"testing"
+	"time"
+)
+
+// Sums mtime in a2, and the bytes read from the UART in a4 with their count in a5
+var journalProgram = []uint32{
+	0x0200c2b7, // loop: lui t0, 0x200c
+	0xff82a583, // lw a1, -8(t0)
+	0x00b60633, // add a2, a2, a1
+	0x10000337, // lui t1, 0x10000
+	0x00534383, // lbu t2, 5(t1)
+	0x0013f393, // andi t2, t2, 1
+	0xfe0384e3, // beqz t2, loop
+	0x00034683, // lbu a3, 0(t1)
+	0x00d70733, // add a4, a4, a3
+	0x00178793, // addi a5, a5, 1
+	0xfd9ff06f, // j loop
+}
+
+const journalSteps = 200000
+
+// record runs journalProgram with a byte typed every few hundred polls and writes the recording to path
+func record(t *testing.T, path string) *Emulator {
+	config := Config{Headless: true}
+	e := newTestEmulator(config, journalProgram)
+	polls := 0
+	e.cpu.Memory.Uart.Input = func() (byte, bool) {
+		polls++
+		if polls%487 == 0 {
+			return byte('a' + polls%26), true
+		}
+		return 0, false
+	}
+	recording, err := NewRecording(path, recordingHeader{MemorySize: VIRT_DRAM_SIZE, Mtime: uint64(time.Now().UnixMilli())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.journal = recording
+	e.attach()
+	start := time.Now()
+	// Long enough for mtime to move
+	for e.Instret() < journalSteps || time.Since(start) < 5*time.Millisecond {
+		e.Step(journalSteps / 10)
+	}
+	if err := recording.Close(e.Instret()); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestJournalInput(t *testing.T) {
+	live := NewLiveJournal(recordingHeader{})
+	e := newTestEmulator(Config{Headless: true}, []uint32{0x0000006f}) // j .
+	e.Step(5)
+	if !live.input(instructions.InputEvent{Type: instructions.EV_KEY, Code: 0x110, Value: 1}) {
+		t.Fatalf("Expected a live journal to take input")
+	}
+	live.tick(e.cpu)
+	if !e.cpu.Memory.Events.Pending() {
+		t.Errorf("Expected the input to reach the device on the tick")
+	}
+	var ev event
+	for _, logged := range live.events {
+		if logged.Kind == EVENT_INPUT {
+			ev = logged
+		}
+	}
+	if ev.Kind != EVENT_INPUT || ev.Instret != 5 {
+		t.Fatalf("Expected the input logged at instruction 5, Got %+v", live.events)
+	}
+
+	// Replayed at the same instruction with the same event
+	replay := &Journal{events: []event{ev}}
+	if replay.input(instructions.InputEvent{}) {
+		t.Errorf("Expected a replay to refuse input")
+	}
+	e = newTestEmulator(Config{Headless: true}, []uint32{0x0000006f})
+	for e.Instret() < 5 {
+		replay.tick(e.cpu)
+		if e.cpu.Memory.Events.Pending() {
+			t.Fatalf("Expected the input at instruction 5, Got it at %d", e.Instret())
+		}
+		e.Step(1)
+	}
+	replay.tick(e.cpu)
+	want := []uint32{instructions.EV_KEY, 0x110, 1}
+	for _, w := range want {
+		if got := e.cpu.Memory.ReadWord(instructions.VIRT_EVENTS + instructions.EVENTS_READ); got != w {
+			t.Errorf("Expected event word %x, Got %x", w, got)
+		}
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.rec")
+	recorded := record(t, path)
+	if recorded.Register(15) == 0 {
+		t.Fatalf("Expected the guest to read bytes from the UART")
+	}
+
+	replay, err := NewReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	times := 0
+	for _, ev := range replay.events {
+		if ev.Kind == EVENT_TIME {
+			times++
+		}
+	}
+	if times < 2 || replay.events[len(replay.events)-1].Kind != EVENT_END {
+		t.Errorf("Expected time events and the end, Got %d time events", times)
+	}
+	config := Config{Headless: true, MemorySize: VIRT_DRAM_SIZE}
+	if err := replay.Check(config, [32]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEmulator(config, journalProgram)
+	e.cpu.Memory.Uart.Input = func() (byte, bool) {
+		t.Fatalf("Expected no input from the host while replaying")
+		return 0, false
+	}
+	e.journal = replay
+	e.attach()
+	e.Step(recorded.Instret())
+	if replay.Diverged != "" {
+		t.Fatalf("Expected the replay to follow the recording, Got %s", replay.Diverged)
+	}
+	if e.Instret() != recorded.Instret() || e.PC() != recorded.PC() {
+		t.Errorf("Expected pc %x after %d instructions, Got %x after %d", recorded.PC(), recorded.Instret(), e.PC(), e.Instret())
+	}
+	for n := 1; n < 32; n++ {
+		if e.Register(n) != recorded.Register(n) {
+			t.Errorf("Expected x%d %x, Got %x", n, recorded.Register(n), e.Register(n))
+		}
+	}
+}
+
+func TestJournalRefused(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.rec")
+	record(t, path)
+	body, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut short at the end and in the middle
+	for _, size := range []int{len(body) - 4, len(body) / 2} {
+		cut := filepath.Join(dir, "cut.rec")
+		_ = os.WriteFile(cut, body[:size], 0o644)
+		if _, err := NewReplay(cut); err == nil {
+			t.Errorf("Expected a recording cut to %d of %d bytes to be refused", size, len(body))
+		}
+	}
+
+	_ = os.WriteFile(filepath.Join(dir, "magic.rec"), []byte("KUTEMU-SNAPSHOT\n"), 0o644)
+	if _, err := NewReplay(filepath.Join(dir, "magic.rec")); err == nil {
+		t.Errorf("Expected a file without the magic to be refused")
+	}
+
+	old := filepath.Join(dir, "old.rec")
+	f, _ := os.Create(old)
+	w := bufio.NewWriter(f)
+	w.WriteString(RECORDING_MAGIC)
+	z := gzip.NewWriter(w)
+	_ = binary.Write(z, binary.LittleEndian, recordingHeader{Version: RECORDING_VERSION - 1})
+	_ = binary.Write(z, binary.LittleEndian, event{Kind: EVENT_END})
+	z.Close()
+	w.Flush()
+	f.Close()
+	if _, err := NewReplay(old); err == nil {
+		t.Errorf("Expected an older version to be refused")
+	}
+
+	replay, err := NewReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []Config{{SBI: true, MemorySize: VIRT_DRAM_SIZE}, {MemorySize: 64 * 1024 * 1024}} {
+		if replay.Check(config, [32]byte{}) == nil {
+			t.Errorf("Expected the recording not to replay with %+v", config)
+		}
+	}
+	if replay.Check(Config{MemorySize: VIRT_DRAM_SIZE}, imageHash([]byte("other"))) == nil {
+		t.Errorf("Expected the recording not to replay another image")
+	}
+}
@@ -0,0 +1,234 @@
+package emulator
+
+import (
+	"fmt"
+	"maps"
+	"riscv/instructions"
+	"sort"
+)
+
+// Reverse execution. The machine is saved every interval instructions, going back restores the last
+// checkpoint before the target and executes forward to it again. Time and UART input come from the
+// journal, so the instructions run the same way the second time.
+//
+// Only the first checkpoint has all of RAM, the others have the pages written since the checkpoint before.
+
+// Instructions between checkpoints
+const REVERSE_INTERVAL = 1000000
+
+// Checkpoints kept, older ones are dropped and can't be gone back to
+const REVERSE_CHECKPOINTS = 32
+
+type checkpoint struct {
+	instret uint64
+	state   *instructions.MachineState
+	journal journalMark
+	// Has all pages, otherwise only the pages written since the checkpoint before
+	full bool
+}
+
+type Reverse struct {
+	interval uint64
+	limit    int
+	// Oldest first
+	checkpoints []checkpoint
+	// Memory whose dirty pages are the ones written since the newest checkpoint. The next checkpoint
+	// is a full one when the machine has other memory, like after a reset.
+	memory *instructions.Memory
+}
+
+func NewReverse(interval uint64) *Reverse {
+	if interval == 0 {
+		interval = REVERSE_INTERVAL
+	}
+	return &Reverse{interval: interval, limit: REVERSE_CHECKPOINTS}
+}
+
+// tick takes a checkpoint when the run gets interval instructions past the last one
+func (r *Reverse) tick(e *Emulator) {
+	if n := len(r.checkpoints); n > 0 && e.cpu.Instret < r.checkpoints[n-1].instret+r.interval {
+		return
+	}
+	r.take(e)
+}
+
+func (r *Reverse) take(e *Emulator) {
+	m := e.cpu.Memory
+	cp := checkpoint{
+		instret: e.cpu.Instret,
+		journal: e.journal.mark(),
+		full:    len(r.checkpoints) == 0 || r.memory != m,
+	}
+	if cp.full {
+		cp.state = e.saveMachine()
+	} else {
+		cp.state = e.saveDirty()
+	}
+	clear(m.Dirty)
+	r.memory = m
+	r.checkpoints = append(r.checkpoints, cp)
+	if len(r.checkpoints) > r.limit {
+		// The oldest pages go into the next checkpoint, which becomes the full one
+		if next := &r.checkpoints[1]; !next.full {
+			state := *next.state
+			state.Pages = maps.Clone(r.checkpoints[0].state.Pages)
+			maps.Copy(state.Pages, next.state.Pages)
+			next.state, next.full = &state, true
+		}
+		r.checkpoints = append([]checkpoint(nil), r.checkpoints[1:]...)
+		e.journal.trim(r.checkpoints[0].journal.pos)
+	}
+}
+
+// restore puts the machine back to checkpoint n, with the pages of the full checkpoint before it and
+// the ones written after
+func (r *Reverse) restore(e *Emulator, n int) {
+	first := n
+	for !r.checkpoints[first].full {
+		first--
+	}
+	state := *r.checkpoints[n].state
+	state.Pages = make(map[uint32][]byte)
+	for _, cp := range r.checkpoints[first : n+1] {
+		maps.Copy(state.Pages, cp.state.Pages)
+	}
+	e.cpu.Restore(&state)
+	// Pages the newer checkpoints wrote now differ from the newest one
+	clear(e.cpu.Memory.Dirty)
+	r.dirty(e, r.checkpoints[n+1:])
+}
+
+// dirty marks the pages of checkpoints as written since the newest one
+func (r *Reverse) dirty(e *Emulator, checkpoints []checkpoint) {
+	for _, cp := range checkpoints {
+		if cp.full {
+			r.memory = nil
+		}
+		for base := range cp.state.Pages {
+			e.cpu.Memory.Dirty[base] = true
+		}
+	}
+}
+
+// Index of the last checkpoint at or before instret, -1 if there is none
+func (r *Reverse) before(instret uint64) int {
+	return sort.Search(len(r.checkpoints), func(i int) bool { return r.checkpoints[i].instret > instret }) - 1
+}
+
+// changed is called when the debugger changed the machine. What was executed after this point won't
+// happen again, so the checkpoints and input after it are dropped.
+func (e *Emulator) changed() {
+	if e.reverse == nil {
+		return
+	}
+	r := e.reverse
+	kept := sort.Search(len(r.checkpoints), func(i int) bool { return r.checkpoints[i].instret >= e.cpu.Instret })
+	r.dirty(e, r.checkpoints[kept:])
+	r.checkpoints = r.checkpoints[:kept]
+	e.journal.forget(e.cpu)
+	r.take(e)
+}
+
+// saveMachine is cpu.Save with the original memory under the breakpoints of the debugger
+func (e *Emulator) saveMachine() *instructions.MachineState {
+	return e.lifted(e.harts[0].Save)
+}
+
+// saveDirty is saveMachine with only the pages written since the last checkpoint
+func (e *Emulator) saveDirty() *instructions.MachineState {
+	return e.lifted(e.harts[0].SaveDirty)
+}
+
+func (e *Emulator) lifted(save func() *instructions.MachineState) *instructions.MachineState {
+	if e.debugger != nil {
+		e.debugger.liftBreakpoints()
+		defer e.debugger.placeBreakpoints()
+	}
+	return save()
+}
+
+// restoreMachine gives the first hart the next turn
+func (e *Emulator) restoreMachine(s *instructions.MachineState) {
+	e.harts[0].Restore(s)
+	// All pages may differ from the checkpoints
+	if e.reverse != nil {
+		e.reverse.memory = nil
+	}
+	e.cpu = e.harts[0]
+	e.quantum = e.cpu.Instret
+	if e.debugger != nil {
+		e.debugger.placeBreakpoints()
+	}
+}
+
+// rerun restores checkpoint n and executes till target without stopping. seen is called with the
+// stop reply of every breakpoint and watchpoint hit on the way, and the instruction it stops before.
+// Returns false if the machine stopped before target.
+func (e *Emulator) rerun(n int, target uint64, seen func(instret uint64, reply string)) bool {
+	d := e.debugger
+	d.liftBreakpoints()
+	e.reverse.restore(e, n)
+	e.journal.rewind(e.reverse.checkpoints[n].journal, e.cpu)
+	e.rewinding = true
+	defer func() { e.rewinding = false }()
+	for e.cpu.Instret < target {
+		instret := e.cpu.Instret
+		if reply := d.breakpointAt(e.cpu.PC); reply != "" && seen != nil {
+			seen(instret, reply)
+		}
+		if _, ok := e.execute(); !ok {
+			return false
+		}
+		if d.watchHit != "" && seen != nil {
+			seen(instret, d.watchHit)
+		}
+		d.watchHit = ""
+		if _, ok := e.prepare(); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Stop reply when going back reached the oldest checkpoint
+func replayBegin() string {
+	return fmt.Sprintf("T%02xreplaylog:begin;", GDB_SIGTRAP)
+}
+
+// reverseStep goes back one instruction and returns the stop reply for gdb
+func (e *Emulator) reverseStep() string {
+	r := e.reverse
+	defer e.debugger.placeBreakpoints()
+	if e.cpu.Instret == 0 || r.before(e.cpu.Instret-1) < 0 {
+		return replayBegin()
+	}
+	// A machine that stopped on the way stays where it stopped
+	target := e.cpu.Instret - 1
+	e.rerun(r.before(target), target, nil)
+	return fmt.Sprintf("S%02x", GDB_SIGTRAP)
+}
+
+// reverseContinue goes back to the last breakpoint or watchpoint hit before the current instruction.
+// Checkpoints are searched from the newest, each is executed up to the next one to find the last hit in it.
+func (e *Emulator) reverseContinue() string {
+	r := e.reverse
+	defer e.debugger.placeBreakpoints()
+	end := e.cpu.Instret
+	for n := r.before(end - 1); end > 0 && n >= 0; n-- {
+		cp := r.checkpoints[n]
+		var hit uint64
+		var reply string
+		if !e.rerun(n, end, func(instret uint64, stop string) { hit, reply = instret, stop }) {
+			return fmt.Sprintf("S%02x", GDB_SIGTRAP)
+		}
+		if reply != "" {
+			e.rerun(n, hit, nil)
+			return reply
+		}
+		end = cp.instret
+	}
+	if len(r.checkpoints) > 0 {
+		e.rerun(0, r.checkpoints[0].instret, nil)
+	}
+	return replayBegin()
+}
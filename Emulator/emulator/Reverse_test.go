@@ -0,0 +1,113 @@
+package emulator
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+// newReverseGdbClient is newGdbClient keeping up to limit checkpoints, one every interval instructions
+func newReverseGdbClient(t *testing.T, interval uint64, limit int) *gdbClient {
+	config := Config{Headless: true, Reverse: true, ReverseInterval: interval}
+	e := newTestEmulator(config, gdbProgram)
+	e.journal = NewLiveJournal(recordingHeader{})
+	e.reverse = NewReverse(interval)
+	e.reverse.limit = limit
+	return connectGdb(t, e)
+}
+
+func TestReverseStep(t *testing.T) {
+	c := newReverseGdbClient(t, 4, REVERSE_CHECKPOINTS)
+	// Registers and the word stored to before every step
+	var regs, mem []string
+	for i := 0; i < 10; i++ {
+		regs = append(regs, c.call("g"))
+		mem = append(mem, c.call("m80001000,4"))
+		c.expect("s", "S05")
+	}
+	for i := 9; i >= 0; i-- {
+		c.expect("bs", "S05")
+		if got := c.call("g"); got != regs[i] {
+			t.Errorf("Expected the registers before step %d\n%s\nGot\n%s", i, regs[i], got)
+		}
+		if got := c.call("m80001000,4"); got != mem[i] {
+			t.Errorf("Expected memory %s before step %d, Got %s", mem[i], i, got)
+		}
+	}
+	c.expect("bs", "T05replaylog:begin;")
+	c.expect("p20", "00000080")
+	// Runs forward again the same way
+	for i := 0; i < 6; i++ {
+		c.expect("s", "S05")
+	}
+	c.expect("g", regs[6])
+	c.expect("m80001000,4", mem[6])
+	c.kill()
+}
+
+func TestReverseContinue(t *testing.T) {
+	c := newReverseGdbClient(t, 4, REVERSE_CHECKPOINTS)
+	c.expect("Z1,80000008,4", "OK")
+	for round := 1; round <= 3; round++ {
+		c.expect("c", "T05hwbreak:;")
+	}
+	c.expect("p0a", "03000000")
+	// Back to the hits of the rounds before, before the store
+	c.expect("bc", "T05hwbreak:;")
+	c.expect("p20", "08000080")
+	c.expect("p0a", "02000000")
+	c.expect("m80001000,4", "01000000")
+	c.expect("bc", "T05hwbreak:;")
+	c.expect("p0a", "01000000")
+	c.expect("m80001000,4", "00000000")
+	c.expect("bc", "T05replaylog:begin;")
+	c.expect("p0a", "00000000")
+	// And forward to the same hits
+	c.expect("c", "T05hwbreak:;")
+	c.expect("c", "T05hwbreak:;")
+	c.expect("p0a", "02000000")
+	c.kill()
+}
+
+func TestReverseDirtyPages(t *testing.T) {
+	c := newReverseGdbClient(t, 4, REVERSE_CHECKPOINTS)
+	for i := 0; i < 14; i++ {
+		c.expect("s", "S05")
+	}
+	c.expect("bs", "S05")
+	c.kill()
+	r := c.e.reverse
+	if len(r.checkpoints) < 3 || !r.checkpoints[0].full {
+		t.Fatalf("Expected a full checkpoint and the ones after it, Got %d", len(r.checkpoints))
+	}
+	if _, ok := r.checkpoints[0].state.Pages[VIRT_DRAM]; !ok {
+		t.Errorf("Expected the full checkpoint to have the program")
+	}
+	// Only the page stored to changes
+	for _, cp := range r.checkpoints[1:] {
+		pages := slices.Collect(maps.Keys(cp.state.Pages))
+		if cp.full || !slices.Equal(pages, []uint32{0x80001000}) {
+			t.Errorf("Expected the checkpoint at %d to have only page 80001000, Got %x", cp.instret, pages)
+		}
+	}
+}
+
+func TestReverseDropsOldest(t *testing.T) {
+	c := newReverseGdbClient(t, 4, 2)
+	for i := 0; i < 14; i++ {
+		c.expect("s", "S05")
+	}
+	// The oldest checkpoint now has what the dropped ones had
+	c.expect("bs", "S05")
+	c.expect("bs", "S05")
+	c.expect("p0a", "03000000")
+	c.expect("m80001000,4", "03000000")
+	c.kill()
+	r := c.e.reverse
+	if len(r.checkpoints) != 2 || !r.checkpoints[0].full || r.checkpoints[0].instret != 8 {
+		t.Fatalf("Expected 2 checkpoints from 8, Got %d", len(r.checkpoints))
+	}
+	if _, ok := r.checkpoints[0].state.Pages[VIRT_DRAM]; !ok {
+		t.Errorf("Expected the oldest checkpoint to keep the program")
+	}
+}
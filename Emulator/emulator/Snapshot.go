@@ -0,0 +1,132 @@
+package emulator
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"riscv/instructions"
+)
+
+// Snapshot file: SNAPSHOT_MAGIC, the format version as a little endian uint32, then the gzip compressed gob
+// of a snapshot. The version is bumped whenever MachineState changes in a way gob can't read old files.
+const SNAPSHOT_MAGIC = "KUTEMU-SNAPSHOT\n"
+const SNAPSHOT_VERSION = 3
+
+// Written when the hotkey is pressed and no snapshot file was given
+const DEFAULT_SNAPSHOT = "kutemu.snapshot"
+
+type snapshot struct {
+	// Machine configuration the state belongs to
+	SBI        bool
+	MemorySize uint32
+	Harts      int
+	Machine    *instructions.MachineState
+}
+
+// What the SDL window asked the run loop to do
+const (
+	SNAPSHOT_NONE int32 = iota
+	SNAPSHOT_SAVE
+	SNAPSHOT_RESTORE
+)
+
+func (e *Emulator) snapshotPath() string {
+	if e.config.Snapshot != "" {
+		return e.config.Snapshot
+	}
+	return DEFAULT_SNAPSHOT
+}
+
+// saveSnapshot writes the machine to path. It is written to a temporary file first so a crash can't leave a
+// half written snapshot behind.
+func (e *Emulator) saveSnapshot(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = writeSnapshot(f, &snapshot{
+		SBI:        e.config.SBI,
+		MemorySize: e.config.MemorySize,
+		Harts:      e.config.Harts,
+		Machine:    e.saveMachine(),
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeSnapshot(w io.Writer, s *snapshot) error {
+	b := bufio.NewWriter(w)
+	b.WriteString(SNAPSHOT_MAGIC)
+	_ = binary.Write(b, binary.LittleEndian, uint32(SNAPSHOT_VERSION))
+	z := gzip.NewWriter(b)
+	if err := gob.NewEncoder(z).Encode(s); err != nil {
+		return err
+	}
+	if err := z.Close(); err != nil {
+		return err
+	}
+	return b.Flush()
+}
+
+// restoreSnapshot loads the machine from path. The machine must have been built with the same configuration.
+func (e *Emulator) restoreSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s, err := readSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if s.SBI != e.config.SBI {
+		return fmt.Errorf("%s: snapshot was taken with sbi %v, machine has %v", path, s.SBI, e.config.SBI)
+	}
+	if s.MemorySize != e.config.MemorySize {
+		return fmt.Errorf("%s: snapshot was taken with %d bytes of memory, machine has %d", path, s.MemorySize, e.config.MemorySize)
+	}
+	if s.Harts != e.config.Harts {
+		return fmt.Errorf("%s: snapshot was taken with %d harts, machine has %d", path, s.Harts, e.config.Harts)
+	}
+	e.restoreMachine(s.Machine)
+	return nil
+}
+
+func readSnapshot(r io.Reader) (*snapshot, error) {
+	b := bufio.NewReader(r)
+	magic := make([]byte, len(SNAPSHOT_MAGIC))
+	if _, err := io.ReadFull(b, magic); err != nil || string(magic) != SNAPSHOT_MAGIC {
+		return nil, errors.New("not a snapshot")
+	}
+	var version uint32
+	if err := binary.Read(b, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("snapshot version %d, only version %d is supported", version, SNAPSHOT_VERSION)
+	}
+	z, err := gzip.NewReader(b)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{}
+	if err := gob.NewDecoder(z).Decode(s); err != nil {
+		return nil, err
+	}
+	if s.Machine == nil {
+		return nil, errors.New("snapshot has no machine state")
+	}
+	return s, nil
+}
@@ -0,0 +1,156 @@
+package emulator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"reflect"
+	"riscv/instructions"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Counts in a0 forever
+var countingProgram = []uint32{
+	0x00150513, // loop: addi a0, a0, 1
+	0xffdff06f, // j loop
+}
+
+// newSnapshotMachine runs the harts for a while and puts every device in a state which isn't its power on one
+func newSnapshotMachine(config Config) *Emulator {
+	e := newTestEmulator(config, countingProgram)
+	clock := time.Unix(1700000000, 0)
+	e.cpu.Memory.Rtc.SetClock(func() time.Time { return clock })
+	e.Step(2*HART_QUANTUM + 100)
+	e.SetCSR(instructions.MSCRATCH, 0x1234)
+	e.Hart(e.Harts() - 1).Waiting = true
+	m := e.cpu.Memory
+	for _, w := range [][2]uint32{
+		{0x83, instructions.VIRT_UART0 + 3},
+		{7, instructions.PLIC_BASE + 4*instructions.RTC_IRQ},
+		{0x1234, instructions.BASE_CLINT + instructions.MTIMECMP_OFFSET + 8},
+		{0x00ff00ff, instructions.VIRT_DISPLAY + 40},
+		{1, instructions.VIRT_RTC + instructions.RTC_IRQ_ENABLED},
+		{0x1000, instructions.VIRT_RTC + instructions.RTC_ALARM_LOW},
+		{0x80001000, instructions.VIRT_AUDIO + instructions.AUDIO_BUFFER},
+		{instructions.EVENTS_PAGE_ABSDATA, instructions.VIRT_EVENTS + instructions.EVENTS_SET_PAGE},
+		{2<<16 | instructions.FINISHER_FAIL, instructions.VIRT_TEST},
+	} {
+		m.WriteWord(w[0], w[1])
+	}
+	m.Events.Send(instructions.EV_KEY, 30, 1)
+	m.Events.Tick()
+	return e
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	config := Config{Headless: true, Harts: 2}
+	e := newSnapshotMachine(config)
+	path := filepath.Join(t.TempDir(), "test.snapshot")
+	if err := e.saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewEmulator(config)
+	clock := time.Unix(1700000000, 0)
+	restored.cpu.Memory.Rtc.SetClock(func() time.Time { return clock })
+	if err := restored.restoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		want, got := e.Hart(i), restored.Hart(i)
+		if got.PC != want.PC || got.Registers != want.Registers || got.Instret != want.Instret || got.Waiting != want.Waiting {
+			t.Errorf("Expected hart %d at %x after %d instructions, Got %x after %d", i, want.PC, want.Instret, got.PC, got.Instret)
+		}
+		if !reflect.DeepEqual(got.CSR.Registers, want.CSR.Registers) {
+			t.Errorf("Expected the CSRs of hart %d to be restored", i)
+		}
+	}
+	if restored.CSR(instructions.MSCRATCH) != 0x1234 {
+		t.Errorf("Expected mscratch 1234, Got %x", restored.CSR(instructions.MSCRATCH))
+	}
+	code := make([]byte, 4*len(countingProgram))
+	restored.ReadMemory(VIRT_DRAM, code)
+	if binary.LittleEndian.Uint32(code[4:]) != countingProgram[1] {
+		t.Errorf("Expected the program in RAM")
+	}
+	// Every device
+	want, got := e.saveMachine(), restored.saveMachine()
+	for _, field := range []string{"Pages", "Uart", "Plic", "Clint", "Display", "Rtc", "Audio", "Events", "Syscon"} {
+		if !reflect.DeepEqual(reflect.ValueOf(*got).FieldByName(field).Interface(), reflect.ValueOf(*want).FieldByName(field).Interface()) {
+			t.Errorf("Expected %s to be restored", field)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the restored machine to save the same state")
+	}
+	// The power off asked for before the snapshot still happens
+	if stop := restored.Step(1); stop.Reason != STOP_POWER_OFF || stop.Code != 5 {
+		t.Errorf("Expected the restored machine to power off with code 5, Got %v %d", stop.Reason, stop.Code)
+	}
+}
+
+func TestSnapshotFormat(t *testing.T) {
+	e := newSnapshotMachine(Config{Headless: true})
+	var b bytes.Buffer
+	if err := writeSnapshot(&b, &snapshot{MemorySize: 1234, Harts: 1, Machine: e.saveMachine()}); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	if !strings.HasPrefix(string(data), SNAPSHOT_MAGIC) {
+		t.Fatalf("Expected the file to start with the magic")
+	}
+	rest := data[len(SNAPSHOT_MAGIC):]
+	if version := binary.LittleEndian.Uint32(rest); version != SNAPSHOT_VERSION {
+		t.Errorf("Expected version %d, Got %d", SNAPSHOT_VERSION, version)
+	}
+	z, err := gzip.NewReader(bytes.NewReader(rest[4:]))
+	if err != nil {
+		t.Fatalf("Expected gzip after the version, Got %s", err)
+	}
+	var s snapshot
+	if err := gob.NewDecoder(z).Decode(&s); err != nil {
+		t.Fatalf("Expected a gob of the snapshot, Got %s", err)
+	}
+	if s.MemorySize != 1234 || s.Machine.PC != e.PC() {
+		t.Errorf("Expected the snapshot back, Got memory %d and pc %x", s.MemorySize, s.Machine.PC)
+	}
+
+	if _, err := readSnapshot(bytes.NewReader(data)); err != nil {
+		t.Errorf("Expected the snapshot to read, Got %s", err)
+	}
+	old := bytes.Clone(data)
+	binary.LittleEndian.PutUint32(old[len(SNAPSHOT_MAGIC):], SNAPSHOT_VERSION-1)
+	if _, err := readSnapshot(bytes.NewReader(old)); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("Expected an older version to be refused, Got %v", err)
+	}
+	if _, err := readSnapshot(strings.NewReader("KUTEMU-RECORDING\n")); err == nil {
+		t.Errorf("Expected a file without the magic to be refused")
+	}
+	if _, err := readSnapshot(bytes.NewReader(data[:len(data)/2])); err == nil {
+		t.Errorf("Expected a truncated snapshot to be refused")
+	}
+}
+
+func TestSnapshotOtherMachine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.snapshot")
+	if err := newSnapshotMachine(Config{Headless: true}).saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Errorf("Expected the temporary file to be gone")
+	}
+	for _, config := range []Config{
+		{Headless: true, SBI: true},
+		{Headless: true, MemorySize: 64 * 1024 * 1024},
+		{Headless: true, Harts: 2},
+	} {
+		if err := NewEmulator(config).restoreSnapshot(path); err == nil {
+			t.Errorf("Expected the snapshot not to restore with %+v", config)
+		}
+	}
+}
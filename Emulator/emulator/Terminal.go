@@ -0,0 +1,237 @@
+package emulator
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"riscv/instructions"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Draws the display in the terminal with half block characters, two pixels per character in 24 bit colour,
+// scaled down to fit. The UART console takes the status line under it and typed keys go to the UART.
+// What the guest printed is written out when the run ends, the picture is drawn on the alternate screen.
+
+// Redraws a second when no fps is given
+const TERMINAL_FPS = 10
+
+// Used when the size of the terminal can't be asked
+const TERMINAL_COLS = 80
+const TERMINAL_ROWS = 24
+
+// Console output kept to be written out when the run ends
+const TERMINAL_SCROLLBACK = 64 * 1024
+
+type Terminal struct {
+	e        *Emulator
+	display  *instructions.Display
+	out      *bufio.Writer
+	interval time.Duration
+	restore  func()
+	started  bool
+	stop     chan struct{}
+	done     chan struct{}
+	// The console is written by the run loop and drawn by the terminal goroutine
+	mutex sync.Mutex
+	// Line the guest is printing and the one before, a carriage return starts the line again with the next byte
+	line     []byte
+	previous []byte
+	cr       bool
+	// Inside an escape sequence, 1 after ESC and 2 after ESC [
+	escape int
+	output []byte
+	// What is on the terminal, to draw only what changed
+	shown  []uint32
+	cols   int
+	rows   int
+	status string
+}
+
+func NewTerminal(e *Emulator, fps int) *Terminal {
+	if fps == 0 {
+		fps = TERMINAL_FPS
+	}
+	return &Terminal{
+		e:        e,
+		display:  e.cpu.Memory.Display,
+		out:      bufio.NewWriterSize(os.Stdout, 64*1024),
+		interval: time.Second / time.Duration(fps),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// attach takes the UART output, stdout is the picture now
+func (t *Terminal) attach(uart *instructions.UART) {
+	uart.Output = t.console
+}
+
+// start switches to the alternate screen and draws till Close
+func (t *Terminal) start() {
+	restore, err := rawInput()
+	if err != nil {
+		log.Printf("Keys are read a line at a time: %s\n", err)
+	}
+	t.restore = restore
+	t.started = true
+	t.out.WriteString("\x1b[?1049h\x1b[?25l\x1b[2J")
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-ticker.C:
+				t.draw()
+			}
+		}
+	}()
+}
+
+// Close puts the terminal back and writes out what the guest printed
+func (t *Terminal) Close() {
+	if !t.started {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	t.out.WriteString("\x1b[0m\x1b[?25h\x1b[?1049l")
+	t.mutex.Lock()
+	_, _ = t.out.Write(t.output)
+	t.mutex.Unlock()
+	_ = t.out.Flush()
+	if t.restore != nil {
+		t.restore()
+	}
+}
+
+func (t *Terminal) console(b byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.output = append(t.output, b)
+	if len(t.output) > 2*TERMINAL_SCROLLBACK {
+		t.output = slices.Clone(t.output[len(t.output)-TERMINAL_SCROLLBACK:])
+	}
+	switch {
+	case t.escape == 1:
+		t.escape = 0
+		if b == '[' {
+			t.escape = 2
+		}
+	case t.escape == 2:
+		// Parameters till the final byte
+		if b >= 0x40 && b <= 0x7e {
+			t.escape = 0
+		}
+	case b == 0x1b:
+		t.escape = 1
+	case b == '\r':
+		t.cr = true
+	case b == '\n':
+		t.previous = slices.Clone(t.line)
+		t.line = t.line[:0]
+		t.cr = false
+	case b == '\b' || b == 0x7f:
+		if len(t.line) > 0 {
+			t.line = t.line[:len(t.line)-1]
+		}
+	case b >= 0x20 && b < 0x7f:
+		if t.cr {
+			t.line = t.line[:0]
+			t.cr = false
+		}
+		t.line = append(t.line, b)
+	}
+}
+
+// statusLine shows the line the guest is printing, or the last one it printed, and the instructions executed
+func (t *Terminal) statusLine(cols int) string {
+	t.mutex.Lock()
+	line := string(t.line)
+	if len(line) == 0 {
+		line = string(t.previous)
+	}
+	t.mutex.Unlock()
+	right := fmt.Sprintf(" %d instructions ", t.e.lastProgress().Instret)
+	left := " " + line
+	if room := cols - len(right); len(left) > room {
+		// The end of the line is what is being typed
+		left = left[len(left)-max(room, 0):]
+	}
+	return left + strings.Repeat(" ", max(cols-len(left)-len(right), 0)) + right
+}
+
+func (t *Terminal) draw() {
+	cols, rows, err := terminalSize()
+	if err != nil || cols == 0 || rows < 2 {
+		cols, rows = TERMINAL_COLS, TERMINAL_ROWS
+	}
+	resized := cols != t.cols || rows != t.rows
+	if resized {
+		t.out.WriteString("\x1b[0m\x1b[2J")
+		t.cols, t.rows = cols, rows
+	}
+	if frame := screenPixels(t.display); resized || !slices.Equal(frame, t.shown) {
+		t.drawFrame(downscale(frame, cols, rows-1))
+		t.shown = frame
+	}
+	if status := t.statusLine(cols); resized || status != t.status {
+		fmt.Fprintf(t.out, "\x1b[%d;1H\x1b[0;7m%s\x1b[0m", rows, status)
+		t.status = status
+	}
+	_ = t.out.Flush()
+}
+
+// drawFrame draws two rows of pixels per line, the upper one as the foreground of ▀ and the lower one as the
+// background. Colours are only sent when they change.
+func (t *Terminal) drawFrame(pixels [][]uint32) {
+	t.out.WriteString("\x1b[H")
+	for y := 0; y+1 < len(pixels); y += 2 {
+		fg, bg := uint32(1<<24), uint32(1<<24)
+		for x := range pixels[y] {
+			if top := pixels[y][x]; top != fg {
+				fmt.Fprintf(t.out, "\x1b[38;2;%d;%d;%dm", top>>16, top>>8&0xff, top&0xff)
+				fg = top
+			}
+			if bottom := pixels[y+1][x]; bottom != bg {
+				fmt.Fprintf(t.out, "\x1b[48;2;%d;%d;%dm", bottom>>16, bottom>>8&0xff, bottom&0xff)
+				bg = bottom
+			}
+			t.out.WriteString("▀")
+		}
+		t.out.WriteString("\x1b[0m\x1b[K\r\n")
+	}
+}
+
+// downscale averages the display into as many pixels as fit cols characters wide and rows high, keeping its
+// shape. It is never scaled up.
+func downscale(frame []uint32, cols int, rows int) [][]uint32 {
+	scale := min(1, float64(cols)/SCREEN_WIDTH, float64(2*rows)/SCREEN_HEIGHT)
+	w := max(1, int(SCREEN_WIDTH*scale))
+	h := max(2, int(SCREEN_HEIGHT*scale)&^1)
+	pixels := make([][]uint32, h)
+	for y := range pixels {
+		pixels[y] = make([]uint32, w)
+		y0, y1 := y*SCREEN_HEIGHT/h, max((y+1)*SCREEN_HEIGHT/h, y*SCREEN_HEIGHT/h+1)
+		for x := range pixels[y] {
+			x0, x1 := x*SCREEN_WIDTH/w, max((x+1)*SCREEN_WIDTH/w, x*SCREEN_WIDTH/w+1)
+			var r, g, b, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for _, p := range frame[sy*SCREEN_WIDTH+x0 : sy*SCREEN_WIDTH+x1] {
+					r += p >> 16 & 0xff
+					g += p >> 8 & 0xff
+					b += p & 0xff
+					n++
+				}
+			}
+			pixels[y][x] = (r/n)<<16 | (g/n)<<8 | b/n
+		}
+	}
+	return pixels
+}
@@ -0,0 +1,35 @@
+package emulator
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawInput hands typed keys to the UART one at a time without echo. Ctrl-C still stops the emulator.
+// The returned function puts the terminal back.
+func rawInput() (func(), error) {
+	fd := int(os.Stdin.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	saved := *termios
+	termios.Lflag &^= unix.ICANON | unix.ECHO
+	termios.Iflag &^= unix.ICRNL
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return nil, err
+	}
+	return func() { _ = unix.IoctlSetTermios(fd, unix.TCSETS, &saved) }, nil
+}
+
+// terminalSize is the size of the terminal on stdout in characters
+func terminalSize() (int, int, error) {
+	ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(ws.Col), int(ws.Row), nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package emulator
+
+import "errors"
+
+// Keys are read a line at a time with echo, like without -terminal
+func rawInput() (func(), error) {
+	return nil, errors.New("raw terminal input is only supported on linux")
+}
+
+func terminalSize() (int, int, error) {
+	return 0, 0, errors.New("terminal size is only known on linux")
+}
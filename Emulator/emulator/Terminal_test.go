@@ -0,0 +1,105 @@
+package emulator
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTerminalDrawFrame(t *testing.T) {
+	var buf bytes.Buffer
+	term := &Terminal{out: bufio.NewWriter(&buf)}
+	term.drawFrame([][]uint32{
+		{0xff0000, 0xff0000, 0x00ff00},
+		{0x0000ff, 0x0000ff, 0x0000ff},
+	})
+	term.out.Flush()
+	// Colours are sent only when they change
+	want := "\x1b[H" +
+		"\x1b[38;2;255;0;0m\x1b[48;2;0;0;255m▀▀" +
+		"\x1b[38;2;0;255;0m▀" +
+		"\x1b[0m\x1b[K\r\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Expected %q, Got %q", want, got)
+	}
+}
+
+func TestTerminalDownscale(t *testing.T) {
+	// Red on the left half, blue on the right one
+	frame := make([]uint32, SCREEN_WIDTH*SCREEN_HEIGHT)
+	for i := range frame {
+		frame[i] = 0xff0000
+		if i%SCREEN_WIDTH >= SCREEN_WIDTH/2 {
+			frame[i] = 0x0000ff
+		}
+	}
+	for _, tc := range []struct {
+		cols, rows    int
+		width, height int
+	}{
+		{80, 23, 73, 46},
+		{40, 50, 40, 24},
+		{320, 100, 320, 200},
+		// Never scaled up
+		{1000, 1000, 320, 200},
+		{1, 1, 1, 2},
+	} {
+		pixels := downscale(frame, tc.cols, tc.rows)
+		if len(pixels) != tc.height || len(pixels[0]) != tc.width {
+			t.Errorf("Expected %dx%d for %d columns and %d rows, Got %dx%d", tc.width, tc.height, tc.cols, tc.rows, len(pixels[0]), len(pixels))
+			continue
+		}
+		if tc.width < 2 {
+			continue
+		}
+		if pixels[0][0] != 0xff0000 || pixels[tc.height-1][tc.width-1] != 0x0000ff {
+			t.Errorf("Expected red left and blue right at %dx%d, Got %06x and %06x", tc.width, tc.height, pixels[0][0], pixels[tc.height-1][tc.width-1])
+		}
+	}
+
+	// Pixels are averaged
+	checker := make([]uint32, SCREEN_WIDTH*SCREEN_HEIGHT)
+	for i := range checker {
+		if (i%SCREEN_WIDTH+i/SCREEN_WIDTH)%2 == 0 {
+			checker[i] = 0xffffff
+		}
+	}
+	pixels := downscale(checker, SCREEN_WIDTH/2, SCREEN_HEIGHT/4)
+	if len(pixels) != SCREEN_HEIGHT/2 || pixels[0][0] != 0x7f7f7f {
+		t.Errorf("Expected %d rows of grey, Got %d rows of %06x", SCREEN_HEIGHT/2, len(pixels), pixels[0][0])
+	}
+}
+
+func TestTerminalStatusLine(t *testing.T) {
+	term := NewTerminal(newTestEmulator(Config{Headless: true}, nil), 0)
+	write := func(s string) {
+		for _, b := range []byte(s) {
+			term.console(b)
+		}
+	}
+	right := " 0 instructions "
+
+	write("booting\r\n")
+	// The last line printed till the next one starts
+	if got, want := term.statusLine(40), " booting"+strings.Repeat(" ", 40-8-len(right))+right; got != want {
+		t.Errorf("Expected %q, Got %q", want, got)
+	}
+	// Escape sequences are dropped and backspaces erase
+	write("login: rx\bo\x1b[1mot")
+	if got, want := term.statusLine(40), " login: root"+strings.Repeat(" ", 40-12-len(right))+right; got != want {
+		t.Errorf("Expected %q, Got %q", want, got)
+	}
+	// Too long, the end is kept
+	if got, want := term.statusLine(20), "root"+right; got != want {
+		t.Errorf("Expected %q, Got %q", want, got)
+	}
+	// A carriage return starts the line again
+	write("\rpassword:")
+	if got := term.statusLine(40); !strings.HasPrefix(got, " password: ") || len(got) != 40 {
+		t.Errorf("Expected the line rewritten, Got %q", got)
+	}
+	if string(term.output) != "booting\r\nlogin: rx\bo\x1b[1mot\rpassword:" {
+		t.Errorf("Expected everything printed kept for the end, Got %q", term.output)
+	}
+}
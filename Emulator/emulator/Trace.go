@@ -0,0 +1,236 @@
+package emulator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"riscv/disasm"
+	"riscv/instructions"
+	"strings"
+)
+
+// Instruction trace in the format of spike -l --log-commits, so traces can be diffed against Spike and Qemu.
+//
+//	core   0: 0x80000000 (0x00500513) li      a0, 5
+//	core   0: 3 0x80000000 (0x00500513) x10 0x00000005
+//
+// First line is the disassembly, second one the commit log with the privilege mode, register and CSR
+// writes, loads as "mem addr" and stores as "mem addr value".
+
+type TraceFilter struct {
+	// Only trace PCs in [StartPC, EndPC), an EndPC of 0 means no limit
+	StartPC uint32
+	EndPC   uint32
+	// Bit n set traces privilege mode n, 0 traces all modes
+	Modes uint32
+	// Only trace instructions with index in [Start, Start+Count), a Count of 0 means no limit
+	Start uint64
+	Count uint64
+}
+
+type memoryAccess struct {
+	addr  uint32
+	size  uint32
+	value uint32
+	write bool
+}
+
+type regWrite struct {
+	reg   byte
+	value uint32
+}
+
+type csrWrite struct {
+	csr   uint32
+	value uint32
+}
+
+// commit is what one instruction did, one line of the commit log
+type commit struct {
+	hart     uint32
+	mode     uint32
+	pc       uint32
+	word     uint32
+	regs     []regWrite
+	csrs     []csrWrite
+	accesses []memoryAccess
+}
+
+func (c *commit) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "core %3d: %d 0x%08x (0x%08x)", c.hart, c.mode, c.pc, c.word)
+	for _, r := range c.regs {
+		fmt.Fprintf(&b, " x%d 0x%08x", r.reg, r.value)
+	}
+	for _, w := range c.csrs {
+		fmt.Fprintf(&b, " c%d_%s 0x%08x", w.csr, instructions.CSRNames[w.csr], w.value)
+	}
+	// Loads are logged before stores, like spike does
+	for _, a := range c.accesses {
+		if !a.write {
+			fmt.Fprintf(&b, " mem 0x%08x", a.addr)
+		}
+	}
+	for _, a := range c.accesses {
+		if a.write {
+			fmt.Fprintf(&b, " mem 0x%08x 0x%0*x", a.addr, 2*a.size, a.value)
+		}
+	}
+	return b.String()
+}
+
+// recorder collects what the instruction being executed does
+type recorder struct {
+	active   bool
+	hart     uint32
+	pc       uint32
+	word     uint32
+	inst     instructions.Inst
+	mode     uint32
+	accesses []memoryAccess
+}
+
+// begin is called with the fetched instruction, right before it is executed
+func (r *recorder) begin(cpu *instructions.Cpu, word uint32, inst instructions.Inst) {
+	r.active = true
+	r.hart = cpu.HartID
+	r.pc = cpu.PC
+	r.word = word
+	r.inst = inst
+	r.mode = cpu.CurrentMode
+	r.accesses = r.accesses[:0]
+}
+
+// memoryAccess records loads and stores, it is the memory hook of the cpu
+func (r *recorder) memoryAccess(addr uint32, size uint32, value uint32, write bool) {
+	if r.active {
+		r.accesses = append(r.accesses, memoryAccess{addr: addr, size: size, value: value, write: write})
+	}
+}
+
+// end returns the commit of the executed instruction
+func (r *recorder) end(cpu *instructions.Cpu) commit {
+	r.active = false
+	c := commit{hart: r.hart, mode: r.mode, pc: r.pc, word: r.word, accesses: r.accesses}
+	// Writes to x0 are not logged
+	if rd, ok := destination(r.inst); ok && rd != 0 {
+		c.regs = []regWrite{{reg: rd, value: cpu.Registers[rd]}}
+	}
+	if csr, ok := csrWritten(r.inst); ok {
+		c.csrs = []csrWrite{{csr: csr, value: csrValue(cpu, csr)}}
+	}
+	return c
+}
+
+type Tracer struct {
+	w      *bufio.Writer
+	file   io.Closer
+	filter TraceFilter
+	// Without it only the commit log is written
+	disasm *disasm.Disassembler
+	recorder
+}
+
+// NewTracer writes the trace to path, "-" is stdout
+func NewTracer(path string, filter TraceFilter, withDisasm bool) (*Tracer, error) {
+	t := &Tracer{filter: filter}
+	if withDisasm {
+		t.disasm = &disasm.Disassembler{Syntax: disasm.SYNTAX_SPIKE}
+	}
+	if path == "-" {
+		t.w = bufio.NewWriter(os.Stdout)
+		return t, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	t.file = f
+	t.w = bufio.NewWriter(f)
+	return t, nil
+}
+
+func (t *Tracer) matches(cpu *instructions.Cpu) bool {
+	f := t.filter
+	if cpu.PC < f.StartPC || (f.EndPC != 0 && cpu.PC >= f.EndPC) {
+		return false
+	}
+	if f.Modes != 0 && f.Modes&(1<<cpu.CurrentMode) == 0 {
+		return false
+	}
+	if cpu.Instret < f.Start || (f.Count != 0 && cpu.Instret >= f.Start+f.Count) {
+		return false
+	}
+	return true
+}
+
+// before is called with the fetched instruction, right before it is executed
+func (t *Tracer) before(cpu *instructions.Cpu, word uint32, inst instructions.Inst) {
+	if t.matches(cpu) {
+		t.begin(cpu, word, inst)
+	}
+}
+
+// after writes the trace of the executed instruction
+func (t *Tracer) after(cpu *instructions.Cpu) {
+	if !t.active {
+		return
+	}
+	if t.disasm != nil {
+		fmt.Fprintf(t.w, "core %3d: 0x%08x (0x%08x) %s\n", t.hart, t.pc, t.word, t.disasm.Inst(t.inst, t.pc))
+	}
+	c := t.end(cpu)
+	t.w.WriteString(c.String())
+	t.w.WriteByte('\n')
+}
+
+// Register written by the instruction, if it has one
+func destination(inst instructions.Inst) (byte, bool) {
+	switch i := inst.(type) {
+	case instructions.RI:
+		return i.RD, true
+	case instructions.II:
+		return i.RD, true
+	case instructions.JI:
+		return i.RD, true
+	case instructions.UI:
+		return i.RD, true
+	}
+	return 0, false
+}
+
+// CSR written by the instruction. csrrs and csrrc only write when rs1 is not x0.
+func csrWritten(inst instructions.Inst) (uint32, bool) {
+	i, ok := inst.(instructions.II)
+	if !ok || i.Opcode != instructions.OP_TOPLEVEL_ENVIRON {
+		return 0, false
+	}
+	csr := uint32(i.IIM)
+	switch i.Operation() {
+	case "csrrw", "csrrwi":
+		return csr, instructions.IsCSRValid(csr)
+	case "csrrs", "csrrc", "csrrsi", "csrrci":
+		return csr, i.RS1 != 0 && instructions.IsCSRValid(csr)
+	case "mret":
+		return instructions.MSTATUS, true
+	case "sret":
+		return instructions.SSTATUS, true
+	}
+	return 0, false
+}
+
+// Value of a CSR as the guest reads it in M-mode
+func csrValue(cpu *instructions.Cpu, csr uint32) uint32 {
+	return cpu.CSR.GetValue(csr, 3, cpu)
+}
+
+func (t *Tracer) Close() error {
+	if err := t.w.Flush(); err != nil {
+		return err
+	}
+	if t.file != nil {
+		return t.file.Close()
+	}
+	return nil
+}
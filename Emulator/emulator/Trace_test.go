@@ -0,0 +1,71 @@
+package emulator
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Writes registers, memory of every width and a CSR
+var traceProgram = []uint32{
+	0x00500513, // li a0, 5
+	0x800012b7, // lui t0, 0x80001
+	0x00a2a023, // sw a0, 0(t0)
+	0x00a29223, // sh a0, 4(t0)
+	0x00a28323, // sb a0, 6(t0)
+	0x0002a583, // lw a1, 0(t0)
+	0x0062c603, // lbu a2, 6(t0)
+	0x34051073, // csrw mscratch, a0
+	0x0000006f, // j .
+}
+
+var traceLines = []string{
+	"core   0: 3 0x80000000 (0x00500513) x10 0x00000005",
+	"core   0: 3 0x80000004 (0x800012b7) x5 0x80001000",
+	"core   0: 3 0x80000008 (0x00a2a023) mem 0x80001000 0x00000005",
+	"core   0: 3 0x8000000c (0x00a29223) mem 0x80001004 0x0005",
+	"core   0: 3 0x80000010 (0x00a28323) mem 0x80001006 0x05",
+	"core   0: 3 0x80000014 (0x0002a583) x11 0x00000005 mem 0x80001000",
+	"core   0: 3 0x80000018 (0x0062c603) x12 0x00000005 mem 0x80001006",
+	"core   0: 3 0x8000001c (0x34051073) c832_mscratch 0x00000005",
+	"core   0: 3 0x80000020 (0x0000006f)",
+}
+
+// trace runs steps instructions of program through the tracer and returns the lines written
+func trace(t *testing.T, program []uint32, steps uint64, filter TraceFilter) []string {
+	var b strings.Builder
+	e := newTestEmulator(Config{Headless: true}, program)
+	e.tracer = &Tracer{w: bufio.NewWriter(&b), filter: filter}
+	e.hookMemory()
+	e.Step(steps)
+	if err := e.tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+}
+
+func TestTraceCommits(t *testing.T) {
+	got := trace(t, traceProgram, uint64(len(traceProgram)), TraceFilter{})
+	if !slices.Equal(got, traceLines) {
+		t.Errorf("Expected\n%s\nGot\n%s", strings.Join(traceLines, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestTraceFilter(t *testing.T) {
+	for _, test := range []struct {
+		filter TraceFilter
+		want   []string
+	}{
+		{TraceFilter{StartPC: 0x80000008, EndPC: 0x80000010}, traceLines[2:4]},
+		{TraceFilter{StartPC: 0x80000018}, traceLines[6:]},
+		{TraceFilter{Modes: 1 << 3}, traceLines},
+		{TraceFilter{Modes: 1<<0 | 1<<1}, []string{""}},
+		{TraceFilter{Start: 2, Count: 3}, traceLines[2:5]},
+		{TraceFilter{Start: 7}, traceLines[7:]},
+	} {
+		if got := trace(t, traceProgram, uint64(len(traceProgram)), test.filter); !slices.Equal(got, test.want) {
+			t.Errorf("Expected for %+v\n%s\nGot\n%s", test.filter, strings.Join(test.want, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
@@ -0,0 +1,515 @@
+package emulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"riscv/instructions"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// VNC server showing the display, keys and the pointer go to the goldfish events device of the guest.
+// Speaks RFB 3.3, 3.7 and 3.8 without authentication, with the raw and CopyRect encodings. CopyRect is used
+// when the screen scrolled, which is most of what a console does.
+// Connect with: vncviewer localhost:5900
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst
+
+const VNC_NAME = "KUTEmu"
+
+// Updates are sent at most this many times a second
+const VNC_FPS = 30
+
+// Viewers name a few encodings and paste short text, anything longer is not from a viewer
+const VNC_MAX_ENCODINGS = 256
+const VNC_MAX_CUT_TEXT = 64 * 1024
+
+// Client to server messages
+const RFB_SET_PIXEL_FORMAT = 0
+const RFB_SET_ENCODINGS = 2
+const RFB_UPDATE_REQUEST = 3
+const RFB_KEY_EVENT = 4
+const RFB_POINTER_EVENT = 5
+const RFB_CUT_TEXT = 6
+
+// Server to client messages and the encodings
+const RFB_FRAMEBUFFER_UPDATE = 0
+const RFB_ENCODING_RAW = 0
+const RFB_ENCODING_COPYRECT = 1
+
+type Vnc struct {
+	e        *Emulator
+	display  *instructions.Display
+	listener net.Listener
+	// Input is dropped while replaying, the run has to stay what was recorded. Told once.
+	dropped atomic.Bool
+}
+
+func NewVnc(e *Emulator, address string) (*Vnc, error) {
+	listener, err := listen(address)
+	if err != nil {
+		return nil, err
+	}
+	v := &Vnc{e: e, display: e.cpu.Memory.Display, listener: listener}
+	go v.accept()
+	return v, nil
+}
+
+func (v *Vnc) Close() error {
+	return v.listener.Close()
+}
+
+// Clients are served at the same time, they all see the same screen
+func (v *Vnc) accept() {
+	for {
+		conn, err := v.listener.Accept()
+		if err != nil {
+			return
+		}
+		go v.serve(conn)
+	}
+}
+
+func (v *Vnc) serve(conn net.Conn) {
+	c := &vncClient{
+		v:       v,
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		format:  vncFormat,
+		actions: make(chan func(), 16),
+	}
+	if err := c.handshake(); err != nil {
+		log.Printf("vnc: %s\n", err)
+		_ = conn.Close()
+		return
+	}
+	go c.read()
+	c.write()
+}
+
+// input sends an event to the guest. A journal logs it with the instruction it arrives at.
+func (v *Vnc) input(typ uint32, code uint32, value uint32) {
+	if j := v.e.journal; j != nil {
+		if !j.input(instructions.InputEvent{Type: typ, Code: code, Value: value}) && !v.dropped.Swap(true) {
+			log.Printf("vnc: input is ignored while replaying\n")
+		}
+		return
+	}
+	v.e.cpu.Memory.Events.Send(typ, code, value)
+}
+
+type pixelFormat struct {
+	bpp        uint8
+	depth      uint8
+	bigEndian  uint8
+	trueColour uint8
+	redMax     uint16
+	greenMax   uint16
+	blueMax    uint16
+	redShift   uint8
+	greenShift uint8
+	blueShift  uint8
+}
+
+// The display itself, 0xAARRGGBB little endian
+var vncFormat = pixelFormat{bpp: 32, depth: 24, trueColour: 1, redMax: 255, greenMax: 255, blueMax: 255, redShift: 16, greenShift: 8}
+
+func (f pixelFormat) bytes() []byte {
+	b := []byte{f.bpp, f.depth, f.bigEndian, f.trueColour}
+	b = binary.BigEndian.AppendUint16(b, f.redMax)
+	b = binary.BigEndian.AppendUint16(b, f.greenMax)
+	b = binary.BigEndian.AppendUint16(b, f.blueMax)
+	return append(b, f.redShift, f.greenShift, f.blueShift, 0, 0, 0)
+}
+
+func parsePixelFormat(b []byte) pixelFormat {
+	return pixelFormat{
+		bpp:        b[0],
+		depth:      b[1],
+		bigEndian:  b[2],
+		trueColour: b[3],
+		redMax:     binary.BigEndian.Uint16(b[4:]),
+		greenMax:   binary.BigEndian.Uint16(b[6:]),
+		blueMax:    binary.BigEndian.Uint16(b[8:]),
+		redShift:   b[10],
+		greenShift: b[11],
+		blueShift:  b[12],
+	}
+}
+
+// appendPixel appends a display pixel in the format of the client
+func (f pixelFormat) appendPixel(b []byte, p uint32) []byte {
+	scale := func(c uint32, max uint16) uint32 {
+		return c * uint32(max) / 255
+	}
+	v := scale(p>>16&0xff, f.redMax)<<f.redShift | scale(p>>8&0xff, f.greenMax)<<f.greenShift |
+		scale(p&0xff, f.blueMax)<<f.blueShift
+	switch {
+	case f.bpp == 8:
+		return append(b, byte(v))
+	case f.bpp == 16 && f.bigEndian != 0:
+		return binary.BigEndian.AppendUint16(b, uint16(v))
+	case f.bpp == 16:
+		return binary.LittleEndian.AppendUint16(b, uint16(v))
+	case f.bigEndian != 0:
+		return binary.BigEndian.AppendUint32(b, v)
+	default:
+		return binary.LittleEndian.AppendUint32(b, v)
+	}
+}
+
+type vncClient struct {
+	v    *Vnc
+	conn net.Conn
+	r    *bufio.Reader
+	// Messages read are turned into actions run by the writer, which owns everything below
+	actions chan func()
+	format  pixelFormat
+	// Client understands CopyRect
+	copyRect bool
+	// Update requests not answered yet, and if one of them asked for the whole screen
+	requests int
+	full     bool
+	// What the client shows, nil till it got the whole screen
+	shown []uint32
+	// Pointer buttons held
+	buttons byte
+}
+
+func (c *vncClient) handshake() error {
+	if _, err := io.WriteString(c.conn, "RFB 003.008\n"); err != nil {
+		return err
+	}
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(c.r, version); err != nil {
+		return err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version), "RFB %03d.%03d\n", &major, &minor); err != nil {
+		return fmt.Errorf("bad protocol version %q", version)
+	}
+	// No authentication. 3.3 is told the security type, later versions choose it and 3.8 gets a result.
+	if minor < 7 {
+		if _, err := c.conn.Write([]byte{0, 0, 0, 1}); err != nil {
+			return err
+		}
+	} else {
+		if _, err := c.conn.Write([]byte{1, 1}); err != nil {
+			return err
+		}
+		security, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if security != 1 {
+			return fmt.Errorf("client chose security type %d", security)
+		}
+		if minor >= 8 {
+			if _, err := c.conn.Write([]byte{0, 0, 0, 0}); err != nil {
+				return err
+			}
+		}
+	}
+	// Shared flag, the screen is always shared
+	if _, err := c.r.ReadByte(); err != nil {
+		return err
+	}
+	init := binary.BigEndian.AppendUint16(nil, SCREEN_WIDTH)
+	init = binary.BigEndian.AppendUint16(init, SCREEN_HEIGHT)
+	init = append(init, vncFormat.bytes()...)
+	init = binary.BigEndian.AppendUint32(init, uint32(len(VNC_NAME)))
+	init = append(init, VNC_NAME...)
+	_, err := c.conn.Write(init)
+	return err
+}
+
+// read handles the messages of the client till it goes away
+func (c *vncClient) read() {
+	defer close(c.actions)
+	if err := c.readMessages(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		log.Printf("vnc: %s\n", err)
+	}
+}
+
+func (c *vncClient) readMessages() error {
+	buf := make([]byte, 20)
+	for {
+		kind, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case RFB_SET_PIXEL_FORMAT:
+			if _, err := io.ReadFull(c.r, buf[:19]); err != nil {
+				return err
+			}
+			format := parsePixelFormat(buf[3:])
+			if format.trueColour == 0 || (format.bpp != 8 && format.bpp != 16 && format.bpp != 32) {
+				return fmt.Errorf("unsupported pixel format, %d bits per pixel, true colour %d", format.bpp, format.trueColour)
+			}
+			c.actions <- func() {
+				c.format = format
+			}
+		case RFB_SET_ENCODINGS:
+			if _, err := io.ReadFull(c.r, buf[:3]); err != nil {
+				return err
+			}
+			count := int(binary.BigEndian.Uint16(buf[1:]))
+			if count > VNC_MAX_ENCODINGS {
+				return fmt.Errorf("too many encodings, %d", count)
+			}
+			encodings := make([]byte, 4*count)
+			if _, err := io.ReadFull(c.r, encodings); err != nil {
+				return err
+			}
+			copyRect := false
+			for i := 0; i < len(encodings); i += 4 {
+				if int32(binary.BigEndian.Uint32(encodings[i:])) == RFB_ENCODING_COPYRECT {
+					copyRect = true
+				}
+			}
+			c.actions <- func() {
+				c.copyRect = copyRect
+			}
+		case RFB_UPDATE_REQUEST:
+			// Incremental flag and a region, the region is ignored and what changed anywhere is sent
+			if _, err := io.ReadFull(c.r, buf[:9]); err != nil {
+				return err
+			}
+			incremental := buf[0] != 0
+			c.actions <- func() {
+				c.requests++
+				c.full = c.full || !incremental
+			}
+		case RFB_KEY_EVENT:
+			if _, err := io.ReadFull(c.r, buf[:7]); err != nil {
+				return err
+			}
+			if code, ok := vncKeys[binary.BigEndian.Uint32(buf[3:])]; ok {
+				c.v.input(instructions.EV_KEY, code, uint32(buf[0]))
+			}
+		case RFB_POINTER_EVENT:
+			if _, err := io.ReadFull(c.r, buf[:5]); err != nil {
+				return err
+			}
+			c.pointer(buf[0], binary.BigEndian.Uint16(buf[1:]), binary.BigEndian.Uint16(buf[3:]))
+		case RFB_CUT_TEXT:
+			if _, err := io.ReadFull(c.r, buf[:7]); err != nil {
+				return err
+			}
+			n := binary.BigEndian.Uint32(buf[3:])
+			if n > VNC_MAX_CUT_TEXT {
+				return fmt.Errorf("cut text too long, %d bytes", n)
+			}
+			if _, err := c.r.Discard(int(n)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown message type %d", kind)
+		}
+	}
+}
+
+// Buttons of the RFB button mask, left, middle and right
+var vncButtons = [3]uint32{instructions.BTN_LEFT, instructions.BTN_MIDDLE, instructions.BTN_RIGHT}
+
+func (c *vncClient) pointer(mask byte, x uint16, y uint16) {
+	c.v.input(instructions.EV_ABS, instructions.ABS_X, uint32(min(x, SCREEN_WIDTH-1)))
+	c.v.input(instructions.EV_ABS, instructions.ABS_Y, uint32(min(y, SCREEN_HEIGHT-1)))
+	for i, button := range vncButtons {
+		if bit := byte(1) << i; (mask^c.buttons)&bit != 0 {
+			c.v.input(instructions.EV_KEY, button, uint32(mask&bit)>>i)
+		}
+	}
+	c.buttons = mask
+}
+
+// write sends the updates the client asked for, checking the screen VNC_FPS times a second
+func (c *vncClient) write() {
+	defer func() {
+		_ = c.conn.Close()
+		// The reader may still be handing over actions
+		for range c.actions {
+		}
+	}()
+	ticker := time.NewTicker(time.Second / VNC_FPS)
+	defer ticker.Stop()
+	for {
+		select {
+		case action, ok := <-c.actions:
+			if !ok {
+				return
+			}
+			action()
+		case <-ticker.C:
+		}
+		if c.requests == 0 {
+			continue
+		}
+		sent, err := c.update(screenPixels(c.v.display))
+		if err != nil {
+			return
+		}
+		if sent {
+			c.requests--
+			c.full = false
+		}
+	}
+}
+
+// update sends what changed since the last update, or the whole screen. It returns false when nothing changed.
+func (c *vncClient) update(frame []uint32) (bool, error) {
+	msg := []byte{RFB_FRAMEBUFFER_UPDATE, 0, 0, 0}
+	rects := 0
+	if c.full || c.shown == nil {
+		msg = c.appendRaw(msg, frame, 0, SCREEN_HEIGHT)
+		rects++
+	} else {
+		shown := c.shown
+		top, bottom := changedRows(shown, frame)
+		if c.copyRect && top < bottom {
+			if dy := scrolled(shown, frame); dy != 0 {
+				// Only worth it when less is left to send
+				if t, b := changedRows(scroll(shown, dy), frame); b-t < bottom-top {
+					msg = appendCopyRect(msg, dy)
+					rects++
+					top, bottom = t, b
+				}
+			}
+		}
+		if top < bottom {
+			msg = c.appendRaw(msg, frame, top, bottom)
+			rects++
+		}
+	}
+	if rects == 0 {
+		return false, nil
+	}
+	binary.BigEndian.PutUint16(msg[2:], uint16(rects))
+	c.shown = frame
+	_, err := c.conn.Write(msg)
+	return true, err
+}
+
+func appendRect(msg []byte, x, y, w, h int, encoding int32) []byte {
+	for _, v := range []int{x, y, w, h} {
+		msg = binary.BigEndian.AppendUint16(msg, uint16(v))
+	}
+	return binary.BigEndian.AppendUint32(msg, uint32(encoding))
+}
+
+// appendRaw appends the full width rows top to bottom, bottom excluded
+func (c *vncClient) appendRaw(msg []byte, frame []uint32, top int, bottom int) []byte {
+	msg = appendRect(msg, 0, top, SCREEN_WIDTH, bottom-top, RFB_ENCODING_RAW)
+	for _, p := range frame[top*SCREEN_WIDTH : bottom*SCREEN_WIDTH] {
+		msg = c.format.appendPixel(msg, p)
+	}
+	return msg
+}
+
+// appendCopyRect moves the rows of the client up by dy, or down for a negative dy
+func appendCopyRect(msg []byte, dy int) []byte {
+	if dy > 0 {
+		msg = appendRect(msg, 0, 0, SCREEN_WIDTH, SCREEN_HEIGHT-dy, RFB_ENCODING_COPYRECT)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+		return binary.BigEndian.AppendUint16(msg, uint16(dy))
+	}
+	msg = appendRect(msg, 0, -dy, SCREEN_WIDTH, SCREEN_HEIGHT+dy, RFB_ENCODING_COPYRECT)
+	return binary.BigEndian.AppendUint32(msg, 0)
+}
+
+func row(frame []uint32, y int) []uint32 {
+	return frame[y*SCREEN_WIDTH : (y+1)*SCREEN_WIDTH]
+}
+
+// changedRows returns the first row which differs and the one after the last, equal when none differs
+func changedRows(old []uint32, frame []uint32) (int, int) {
+	top, bottom := 0, SCREEN_HEIGHT
+	for top < bottom && slices.Equal(row(old, top), row(frame, top)) {
+		top++
+	}
+	for bottom > top && slices.Equal(row(old, bottom-1), row(frame, bottom-1)) {
+		bottom--
+	}
+	return top, bottom
+}
+
+// scrolled finds how many rows the screen moved up, or down when negative. Only moves of less than half the
+// screen are looked for, 0 means none.
+func scrolled(old []uint32, frame []uint32) int {
+	for d := 1; d < SCREEN_HEIGHT/2; d++ {
+		for _, dy := range []int{d, -d} {
+			matches := true
+			for y := max(0, -dy); y < min(SCREEN_HEIGHT, SCREEN_HEIGHT-dy) && matches; y++ {
+				matches = slices.Equal(row(frame, y), row(old, y+dy))
+			}
+			if matches {
+				return dy
+			}
+		}
+	}
+	return 0
+}
+
+// scroll is what the client shows after the CopyRect of appendCopyRect
+func scroll(old []uint32, dy int) []uint32 {
+	moved := slices.Clone(old)
+	for y := max(0, -dy); y < min(SCREEN_HEIGHT, SCREEN_HEIGHT-dy); y++ {
+		copy(row(moved, y), row(old, y+dy))
+	}
+	return moved
+}
+
+// X11 keysyms to Linux keycodes, for a US layout. Shifted symbols are the key they are on, the client sends
+// shift by itself.
+var vncKeys = func() map[uint32]uint32 {
+	keys := map[uint32]uint32{
+		0xff1b: 1,   // Escape
+		0xff08: 14,  // BackSpace
+		0xff09: 15,  // Tab
+		0xff0d: 28,  // Return
+		0xffe3: 29,  // Control_L
+		0xffe1: 42,  // Shift_L
+		0xffe2: 54,  // Shift_R
+		0xffe9: 56,  // Alt_L
+		' ':    57,  // space
+		0xffe5: 58,  // Caps_Lock
+		0xffc8: 87,  // F11
+		0xffc9: 88,  // F12
+		0xffe4: 97,  // Control_R
+		0xffea: 100, // Alt_R
+		0xff50: 102, // Home
+		0xff52: 103, // Up
+		0xff55: 104, // Page_Up
+		0xff51: 105, // Left
+		0xff53: 106, // Right
+		0xff57: 107, // End
+		0xff54: 108, // Down
+		0xff56: 109, // Page_Down
+		0xff63: 110, // Insert
+		0xffff: 111, // Delete
+		0xffeb: 125, // Super_L
+	}
+	// F1 to F10
+	for i := uint32(0); i < 10; i++ {
+		keys[0xffbe+i] = 59 + i
+	}
+	// Rows of the keyboard by their first keycode, each key unshifted and shifted
+	rows := map[uint32]string{
+		2:  "1!2@3#4$5%6^7&8*9(0)-_=+",
+		16: "qQwWeErRtTyYuUiIoOpP[{]}",
+		30: "aAsSdDfFgGhHjJkKlL;:'\"`~",
+		43: "\\|zZxXcCvVbBnNmM,<.>/?",
+	}
+	for first, chars := range rows {
+		for i, c := range chars {
+			keys[uint32(c)] = first + uint32(i/2)
+		}
+	}
+	return keys
+}()
@@ -0,0 +1,144 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+type vncTestClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// newVncClient serves a display with a red top left pixel and a green one below it to a 3.8 client
+func newVncClient(t *testing.T) *vncTestClient {
+	e := newTestEmulator(Config{Headless: true}, nil)
+	display := e.cpu.Memory.Display
+	display.Screen[0] = 0x00ff0000
+	display.Screen[SCREEN_WIDTH] = 0x0000ff00
+	v := &Vnc{e: e, display: display}
+	server, client := net.Pipe()
+	go v.serve(server)
+	t.Cleanup(func() { client.Close() })
+	c := &vncTestClient{t: t, conn: client}
+
+	c.expect([]byte("RFB 003.008\n"))
+	c.send([]byte("RFB 003.008\n"))
+	// One security type, none
+	c.expect([]byte{1, 1})
+	c.send([]byte{1})
+	c.expect([]byte{0, 0, 0, 0})
+	c.send([]byte{1})
+	init := binary.BigEndian.AppendUint16(nil, SCREEN_WIDTH)
+	init = binary.BigEndian.AppendUint16(init, SCREEN_HEIGHT)
+	init = append(init, vncFormat.bytes()...)
+	init = binary.BigEndian.AppendUint32(init, uint32(len(VNC_NAME)))
+	c.expect(append(init, VNC_NAME...))
+	return c
+}
+
+func (c *vncTestClient) send(b []byte) {
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *vncTestClient) read(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, b); err != nil {
+		c.t.Fatal(err)
+	}
+	return b
+}
+
+func (c *vncTestClient) expect(want []byte) {
+	if got := c.read(len(want)); !bytes.Equal(got, want) {
+		c.t.Fatalf("Expected %q, Got %q", want, got)
+	}
+}
+
+// requestUpdate asks for the whole screen
+func (c *vncTestClient) requestUpdate(incremental bool) {
+	msg := []byte{RFB_UPDATE_REQUEST, 0}
+	if incremental {
+		msg[1] = 1
+	}
+	for _, v := range []uint16{0, 0, SCREEN_WIDTH, SCREEN_HEIGHT} {
+		msg = binary.BigEndian.AppendUint16(msg, v)
+	}
+	c.send(msg)
+}
+
+// closed checks the server hung up
+func (c *vncTestClient) closed() {
+	if _, err := c.conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		c.t.Errorf("Expected the server to close the connection, Got %v", err)
+	}
+}
+
+func TestVncFullUpdate(t *testing.T) {
+	c := newVncClient(t)
+	c.requestUpdate(false)
+	c.expect([]byte{RFB_FRAMEBUFFER_UPDATE, 0, 0, 1})
+	header := c.read(12)
+	want := appendRect(nil, 0, 0, SCREEN_WIDTH, SCREEN_HEIGHT, RFB_ENCODING_RAW)
+	if !bytes.Equal(header, want) {
+		t.Fatalf("Expected the rectangle %x, Got %x", want, header)
+	}
+	pixels := c.read(4 * SCREEN_WIDTH * SCREEN_HEIGHT)
+	// 32 bits little endian, red shifted by 16 and green by 8
+	for _, p := range []struct {
+		index int
+		want  []byte
+	}{
+		{0, []byte{0, 0, 0xff, 0}},
+		{1, []byte{0, 0, 0, 0}},
+		{SCREEN_WIDTH, []byte{0, 0xff, 0, 0}},
+	} {
+		if got := pixels[4*p.index:][:4]; !bytes.Equal(got, p.want) {
+			t.Errorf("Expected pixel %d to be %x, Got %x", p.index, p.want, got)
+		}
+	}
+}
+
+func TestVncPixelFormat(t *testing.T) {
+	c := newVncClient(t)
+	// 16 bits big endian, 5 6 5
+	format := pixelFormat{bpp: 16, depth: 16, bigEndian: 1, trueColour: 1, redMax: 31, greenMax: 63, blueMax: 31, redShift: 11, greenShift: 5}
+	c.send(append([]byte{RFB_SET_PIXEL_FORMAT, 0, 0, 0}, format.bytes()...))
+	c.requestUpdate(false)
+	c.expect([]byte{RFB_FRAMEBUFFER_UPDATE, 0, 0, 1})
+	c.read(12)
+	pixels := c.read(2 * SCREEN_WIDTH * SCREEN_HEIGHT)
+	if got := binary.BigEndian.Uint16(pixels); got != 0xf800 {
+		t.Errorf("Expected red to be 0xf800, Got 0x%04x", got)
+	}
+	if got := binary.BigEndian.Uint16(pixels[2*SCREEN_WIDTH:]); got != 0x07e0 {
+		t.Errorf("Expected green to be 0x07e0, Got 0x%04x", got)
+	}
+}
+
+func TestVncTooManyEncodings(t *testing.T) {
+	c := newVncClient(t)
+	c.send([]byte{RFB_SET_ENCODINGS, 0, 0xff, 0xff})
+	c.closed()
+}
+
+func TestVncCutTextTooLong(t *testing.T) {
+	c := newVncClient(t)
+	msg := append([]byte{RFB_CUT_TEXT, 0, 0, 0}, binary.BigEndian.AppendUint32(nil, VNC_MAX_CUT_TEXT+1)...)
+	c.send(msg)
+	c.closed()
+}
+
+func TestVncCutText(t *testing.T) {
+	c := newVncClient(t)
+	c.send(append([]byte{RFB_CUT_TEXT, 0, 0, 0, 0, 0, 0, 5}, "hello"...))
+	// Still served after the text
+	c.requestUpdate(false)
+	c.expect([]byte{RFB_FRAMEBUFFER_UPDATE, 0, 0, 1})
+}
@@ -0,0 +1,320 @@
+package emulator
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"riscv/instructions"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Browser frontend: a page showing the display, with a console on the UART and buttons to pause, reset and
+// save or restore a snapshot. Served over HTTP and a WebSocket, meant for localhost or an SSH tunnel to it.
+// Open http://localhost:8080 after -web :8080
+// The controls are run by the run loop between two instructions, like the monitor commands.
+
+//go:embed web/index.html
+var webPage []byte
+
+// Display updates and console output are sent at most this many times a second
+const WEB_FPS = 30
+
+// Console output kept for browsers which connect later
+const WEB_SCROLLBACK = 64 * 1024
+
+// First byte of the binary messages to the browser
+const WEB_MSG_DISPLAY = 0
+const WEB_MSG_UART = 1
+
+type Web struct {
+	e       *Emulator
+	display *instructions.Display
+	server  *http.Server
+	// Controls from the browsers, run between instructions
+	actions chan func()
+	// Owned by the run loop, the browsers see the copy
+	paused     bool
+	pausedSeen atomic.Bool
+	mutex      sync.Mutex
+	// Typed in the browsers and not read by the UART yet
+	input []byte
+	// The last WEB_SCROLLBACK bytes of console output, and the number of bytes ever written
+	output  []byte
+	written uint64
+}
+
+// Sent by the page, Data is the typed text for uart
+type webCommand struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+type webStatus struct {
+	Type    string `json:"type"`
+	Paused  bool   `json:"paused"`
+	PC      string `json:"pc"`
+	Instret uint64 `json:"instret"`
+}
+
+type webMessage struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func NewWeb(e *Emulator, address string) (*Web, error) {
+	listener, err := listen(address)
+	if err != nil {
+		return nil, err
+	}
+	w := &Web{e: e, display: e.cpu.Memory.Display, actions: make(chan func(), 16)}
+	w.server = &http.Server{Handler: w.handler()}
+	go func() {
+		if err := w.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("web: %s\n", err)
+		}
+	}()
+	return w, nil
+}
+
+// handler serves the page and the WebSocket of the browsers
+func (w *Web) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", w.page)
+	mux.HandleFunc("/ws", w.socket)
+	return mux
+}
+
+func (w *Web) Close() error {
+	return w.server.Close()
+}
+
+func (w *Web) page(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(rw, r)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = rw.Write(webPage)
+}
+
+// attach puts the browser consoles on the UART, next to stdin and stdout
+func (w *Web) attach(uart *instructions.UART) {
+	host := uart.Input
+	uart.Input = func() (byte, bool) {
+		w.mutex.Lock()
+		if len(w.input) > 0 {
+			b := w.input[0]
+			w.input = w.input[1:]
+			w.mutex.Unlock()
+			return b, true
+		}
+		w.mutex.Unlock()
+		return host()
+	}
+	output := uart.Output
+	uart.Output = func(b byte) {
+		output(b)
+		w.mutex.Lock()
+		w.output = append(w.output, b)
+		if len(w.output) > 2*WEB_SCROLLBACK {
+			w.output = slices.Clone(w.output[len(w.output)-WEB_SCROLLBACK:])
+		}
+		w.written++
+		w.mutex.Unlock()
+	}
+}
+
+// outputSince returns the console output after the first n bytes ever written, and how many were written
+func (w *Web) outputSince(n uint64) ([]byte, uint64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	start := w.written - uint64(min(len(w.output), WEB_SCROLLBACK))
+	n = max(n, start)
+	return slices.Clone(w.output[len(w.output)-int(w.written-n):]), w.written
+}
+
+// beforeExec runs the controls which arrived and blocks while paused. The browsers see where the guest is
+// after each of them.
+func (w *Web) beforeExec() {
+	for len(w.actions) > 0 {
+		(<-w.actions)()
+		w.e.publish()
+	}
+	for w.paused {
+		(<-w.actions)()
+		w.e.publish()
+	}
+}
+
+func (w *Web) setPaused(paused bool) {
+	w.paused = paused
+	w.pausedSeen.Store(paused)
+}
+
+// One browser. Replies to its controls go through notes, they are made by the run loop which must not wait for
+// the browser.
+type webClient struct {
+	ws    *wsConn
+	notes chan string
+	done  chan struct{}
+	// What the browser shows, nil before the first update, the console output it got and if it shows paused
+	shown   []uint32
+	written uint64
+	paused  bool
+}
+
+func (c *webClient) note(format string, args ...any) {
+	select {
+	case c.notes <- fmt.Sprintf(format, args...):
+	default:
+	}
+}
+
+func (w *Web) socket(rw http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(rw, r)
+	if err != nil {
+		log.Printf("web: %s\n", err)
+		return
+	}
+	c := &webClient{ws: ws, notes: make(chan string, 16), done: make(chan struct{})}
+	go w.read(c)
+	w.write(c)
+}
+
+// read runs the commands of a browser till it goes away
+func (w *Web) read(c *webClient) {
+	defer close(c.done)
+	for {
+		op, data, err := c.ws.readMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("web: %s\n", err)
+			}
+			return
+		}
+		var cmd webCommand
+		if op != WS_TEXT || json.Unmarshal(data, &cmd) != nil {
+			continue
+		}
+		w.command(c, cmd)
+	}
+}
+
+func (w *Web) command(c *webClient, cmd webCommand) {
+	e := w.e
+	switch cmd.Type {
+	case "uart":
+		w.mutex.Lock()
+		w.input = append(w.input, cmd.Data...)
+		w.mutex.Unlock()
+	case "pause":
+		w.actions <- func() { w.setPaused(true) }
+	case "resume":
+		w.actions <- func() { w.setPaused(false) }
+	case "reset":
+		w.actions <- func() {
+			// The run would go another way than its journal
+			if e.journal != nil {
+				c.note("reset: not while recording, replaying or running backwards")
+				return
+			}
+			e.reset()
+			c.note("reset")
+		}
+	case "save":
+		w.actions <- func() {
+			path := e.snapshotPath()
+			if err := e.saveSnapshot(path); err != nil {
+				c.note("save: %s", err)
+				return
+			}
+			c.note("saved snapshot to %s", path)
+		}
+	case "restore":
+		w.actions <- func() {
+			if e.journal != nil {
+				c.note("restore: snapshots can't be restored while recording, replaying or running backwards")
+				return
+			}
+			path := e.snapshotPath()
+			if err := e.restoreSnapshot(path); err != nil {
+				c.note("restore: %s", err)
+				return
+			}
+			c.note("restored snapshot from %s", path)
+		}
+	}
+}
+
+// write sends what changed on the display and the console WEB_FPS times a second, and the status every second
+func (w *Web) write(c *webClient) {
+	defer c.ws.Close()
+	ticker := time.NewTicker(time.Second / WEB_FPS)
+	defer ticker.Stop()
+	for tick := 0; ; tick++ {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if err := w.update(c, tick%WEB_FPS == 0); err != nil {
+			return
+		}
+	}
+}
+
+func (w *Web) update(c *webClient, status bool) error {
+	frame := screenPixels(w.display)
+	progress := w.e.lastProgress()
+	top, bottom := 0, SCREEN_HEIGHT
+	if c.shown != nil {
+		top, bottom = changedRows(c.shown, frame)
+	}
+	if top < bottom {
+		msg := []byte{WEB_MSG_DISPLAY}
+		msg = binary.BigEndian.AppendUint16(msg, uint16(top))
+		msg = binary.BigEndian.AppendUint16(msg, uint16(bottom))
+		for _, p := range frame[top*SCREEN_WIDTH : bottom*SCREEN_WIDTH] {
+			msg = append(msg, byte(p>>16), byte(p>>8), byte(p), 0xff)
+		}
+		if err := c.ws.writeFrame(WS_BINARY, msg); err != nil {
+			return err
+		}
+		c.shown = frame
+	}
+	if out, n := w.outputSince(c.written); len(out) > 0 {
+		if err := c.ws.writeFrame(WS_BINARY, append([]byte{WEB_MSG_UART}, out...)); err != nil {
+			return err
+		}
+		c.written = n
+	}
+	for len(c.notes) > 0 {
+		if err := w.writeJSON(c, webMessage{Type: "message", Text: <-c.notes}); err != nil {
+			return err
+		}
+		status = true
+	}
+	// Pausing and resuming show right away
+	if paused := w.pausedSeen.Load(); status || paused != c.paused {
+		c.paused = paused
+		return w.writeJSON(c, webStatus{Type: "status", Paused: paused, PC: fmt.Sprintf("%08x", progress.PC), Instret: progress.Instret})
+	}
+	return nil
+}
+
+func (w *Web) writeJSON(c *webClient, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.ws.writeFrame(WS_TEXT, data)
+}
@@ -0,0 +1,171 @@
+package emulator
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The part of WebSocket the browser frontend needs: whole messages, ping and close.
+// See https://datatracker.ietf.org/doc/html/rfc6455
+
+const WS_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Messages from the browser are commands and typed text, anything bigger is not from the page
+const WS_MAX_MESSAGE = 64 * 1024
+
+const WS_CONTINUATION = 0x0
+const WS_TEXT = 0x1
+const WS_BINARY = 0x2
+const WS_CLOSE = 0x8
+const WS_PING = 0x9
+const WS_PONG = 0xa
+
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// Messages are written by the client loop, pongs and closes by the reader
+	mutex sync.Mutex
+}
+
+// upgradeWebSocket takes over the connection of a WebSocket handshake. Only pages served from the same host may
+// connect, any site open in the browser could reach a localhost port otherwise.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "websocket expected", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, "cross origin websocket", http.StatusForbidden)
+			return nil, fmt.Errorf("websocket from origin %s refused", origin)
+		}
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + WS_GUID))
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// writeFrame sends a whole message in one frame, servers don't mask
+func (c *wsConn) writeFrame(op byte, data []byte) error {
+	header := []byte{0x80 | op}
+	switch n := len(data); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(n))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, err := c.conn.Write(append(header, data...))
+	return err
+}
+
+// readMessage returns the next text or binary message. Pings are answered, a close is answered and ends
+// the connection with io.EOF.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var op byte
+	var message []byte
+	for {
+		fin, frameOp, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOp {
+		case WS_PING:
+			if err := c.writeFrame(WS_PONG, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case WS_PONG:
+			continue
+		case WS_CLOSE:
+			_ = c.writeFrame(WS_CLOSE, nil)
+			return 0, nil, io.EOF
+		case WS_CONTINUATION:
+			if op == 0 {
+				return 0, nil, errors.New("websocket continuation without a message")
+			}
+		default:
+			op = frameOp
+		}
+		message = append(message, payload...)
+		if len(message) > WS_MAX_MESSAGE {
+			return 0, nil, errors.New("websocket message too big")
+		}
+		if fin {
+			return op, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op := header[0]&0x80 != 0, header[0]&0x0f
+	// Browsers always mask
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked websocket frame")
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > WS_MAX_MESSAGE {
+		return false, 0, nil, errors.New("websocket frame too big")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
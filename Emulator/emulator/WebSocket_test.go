@@ -0,0 +1,282 @@
+package emulator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The example of the RFC
+const wsTestKey = "dGhlIHNhbXBsZSBub25jZQ=="
+const wsTestAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+
+// clientFrame is a frame as a browser sends it, masked. length is the length field when it is not the
+// shortest one, 126 or 127.
+func clientFrame(fin bool, op byte, payload []byte, length byte) []byte {
+	b := []byte{op}
+	if fin {
+		b[0] |= 0x80
+	}
+	n := len(payload)
+	switch {
+	case length == 127 || n > 0xffff:
+		b = binary.BigEndian.AppendUint64(append(b, 0x80|127), uint64(n))
+	case length == 126 || n >= 126:
+		b = binary.BigEndian.AppendUint16(append(b, 0x80|126), uint16(n))
+	default:
+		b = append(b, 0x80|byte(n))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// serverFrame reads a frame of the server, which must not be masked
+func serverFrame(t *testing.T, r io.Reader) (bool, byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatalf("Expected an unmasked frame")
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			t.Fatal(err)
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			t.Fatal(err)
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0]&0x80 != 0, header[0] & 0x0f, payload
+}
+
+type wsResult struct {
+	op   byte
+	data []byte
+	err  error
+}
+
+// pipeWebSocket is a server connection with the browser end of a pipe. Messages the server reads arrive on
+// the channel, the pipe blocks writers till the other end reads.
+func pipeWebSocket(t *testing.T) (net.Conn, chan wsResult) {
+	server, client := net.Pipe()
+	ws := &wsConn{conn: server, r: bufio.NewReader(server)}
+	results := make(chan wsResult, 1)
+	go func() {
+		defer ws.Close()
+		for {
+			op, data, err := ws.readMessage()
+			results <- wsResult{op, data, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { client.Close() })
+	return client, results
+}
+
+// sendFrames writes frames from any goroutine
+func sendFrames(t *testing.T, conn net.Conn, frames ...[]byte) {
+	for _, f := range frames {
+		if _, err := conn.Write(f); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestWebSocketLengths(t *testing.T) {
+	client, results := pipeWebSocket(t)
+	for _, tc := range []struct {
+		n      int
+		length byte
+	}{
+		{0, 0},
+		{125, 0},
+		{126, 0},
+		{300, 0},
+		{0xffff, 0},
+		{WS_MAX_MESSAGE, 0},
+		// Longer length fields than needed are accepted
+		{5, 126},
+		{1000, 127},
+	} {
+		payload := bytes.Repeat([]byte("abcdefg"), tc.n/7+1)[:tc.n]
+		go sendFrames(t, client, clientFrame(true, WS_BINARY, payload, tc.length))
+		r := <-results
+		if r.err != nil || r.op != WS_BINARY || !bytes.Equal(r.data, payload) {
+			t.Fatalf("Expected %d bytes unmasked, Got %d bytes op %d %v", tc.n, len(r.data), r.op, r.err)
+		}
+	}
+}
+
+func TestWebSocketFragments(t *testing.T) {
+	client, results := pipeWebSocket(t)
+	go sendFrames(t, client,
+		clientFrame(false, WS_TEXT, []byte("hel"), 0),
+		// Control frames may come between the fragments
+		clientFrame(true, WS_PING, []byte("ping"), 0),
+		clientFrame(false, WS_CONTINUATION, []byte("l"), 0),
+		clientFrame(true, WS_CONTINUATION, []byte("o"), 0))
+	if fin, op, payload := serverFrame(t, client); !fin || op != WS_PONG || string(payload) != "ping" {
+		t.Errorf("Expected a pong with the ping payload, Got %v %d %q", fin, op, payload)
+	}
+	if r := <-results; r.err != nil || r.op != WS_TEXT || string(r.data) != "hello" {
+		t.Errorf("Expected text hello, Got %d %q %v", r.op, r.data, r.err)
+	}
+
+	go sendFrames(t, client, clientFrame(true, WS_CLOSE, nil, 0))
+	if _, op, _ := serverFrame(t, client); op != WS_CLOSE {
+		t.Errorf("Expected the close to be answered, Got op %d", op)
+	}
+	if r := <-results; r.err != io.EOF {
+		t.Errorf("Expected io.EOF after a close, Got %v", r.err)
+	}
+}
+
+func TestWebSocketRejects(t *testing.T) {
+	big := make([]byte, WS_MAX_MESSAGE/2+1)
+	unmasked := clientFrame(true, WS_TEXT, []byte("hi"), 0)
+	unmasked[1] &^= 0x80
+	for _, tc := range []struct {
+		name   string
+		frames [][]byte
+		want   string
+	}{
+		{"unmasked", [][]byte{unmasked}, "unmasked websocket frame"},
+		// Only the header is read
+		{"frame too big", [][]byte{clientFrame(true, WS_BINARY, make([]byte, WS_MAX_MESSAGE+1), 0)[:14]}, "websocket frame too big"},
+		{"message too big", [][]byte{clientFrame(false, WS_BINARY, big, 0), clientFrame(true, WS_CONTINUATION, big, 0)}, "websocket message too big"},
+		{"continuation", [][]byte{clientFrame(true, WS_CONTINUATION, []byte("lo"), 0)}, "websocket continuation without a message"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, results := pipeWebSocket(t)
+			go func() {
+				for _, f := range tc.frames {
+					if _, err := client.Write(f); err != nil {
+						return
+					}
+				}
+			}()
+			if r := <-results; r.err == nil || r.err.Error() != tc.want {
+				t.Errorf("Expected %q, Got %v", tc.want, r.err)
+			}
+		})
+	}
+}
+
+func TestWebSocketWriteFrame(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	ws := &wsConn{conn: server, r: bufio.NewReader(server)}
+	defer ws.Close()
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte{byte(n)}, n)
+		go func() { _ = ws.writeFrame(WS_BINARY, payload) }()
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(client, head); err != nil {
+			t.Fatal(err)
+		}
+		want := byte(n)
+		switch {
+		case n > 0xffff:
+			want = 127
+		case n >= 126:
+			want = 126
+		}
+		if head[0] != 0x80|WS_BINARY || head[1] != want {
+			t.Fatalf("Expected header %02x %02x for %d bytes, Got %x", 0x80|WS_BINARY, want, n, head)
+		}
+		_, _, payloadGot := serverFrame(t, io.MultiReader(bytes.NewReader(head), client))
+		if !bytes.Equal(payloadGot, payload) {
+			t.Errorf("Expected %d bytes, Got %d", n, len(payloadGot))
+		}
+	}
+}
+
+// dialWebSocket does the handshake of a browser on the page at url
+func dialWebSocket(t *testing.T, url string, path string, origin string) (net.Conn, *bufio.Reader, *http.Response) {
+	host := strings.TrimPrefix(url, "http://")
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n", path, host, wsTestKey)
+	if origin != "" {
+		fmt.Fprintf(conn, "Origin: %s\r\n", origin)
+	}
+	fmt.Fprintf(conn, "\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		if op, data, err := ws.readMessage(); err == nil {
+			_ = ws.writeFrame(op, data)
+		}
+	}))
+	defer server.Close()
+
+	conn, r, resp := dialWebSocket(t, server.URL, "/", server.URL)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, Got %s", resp.Status)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != wsTestAccept {
+		t.Errorf("Expected Sec-WebSocket-Accept %s, Got %s", wsTestAccept, got)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Errorf("Expected Upgrade: websocket, Got %q", resp.Header.Get("Upgrade"))
+	}
+	sendFrames(t, conn, clientFrame(true, WS_TEXT, []byte("echo"), 0))
+	if _, op, payload := serverFrame(t, r); op != WS_TEXT || string(payload) != "echo" {
+		t.Errorf("Expected the message back, Got %d %q", op, payload)
+	}
+
+	// Pages of other sites are refused
+	if _, _, resp := dialWebSocket(t, server.URL, "/", "http://example.com"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for another origin, Got %s", resp.Status)
+	}
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without an upgrade, Got %s", resp.Status)
+	}
+}
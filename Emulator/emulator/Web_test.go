@@ -0,0 +1,172 @@
+package emulator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type webTestClient struct {
+	t    *testing.T
+	w    *Web
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newWebClient serves a display with a red top left pixel to a browser, the UART goes only to the browser
+func newWebClient(t *testing.T) *webTestClient {
+	e := newTestEmulator(Config{Headless: true}, nil)
+	display := e.cpu.Memory.Display
+	display.Screen[0] = 0x00ff0000
+	uart := e.cpu.Memory.Uart
+	uart.Input = func() (byte, bool) { return 0, false }
+	uart.Output = func(b byte) {}
+	w := &Web{e: e, display: display, actions: make(chan func(), 16)}
+	w.attach(uart)
+	server := httptest.NewServer(w.handler())
+	t.Cleanup(server.Close)
+	conn, r, resp := dialWebSocket(t, server.URL, "/ws", "")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, Got %s", resp.Status)
+	}
+	return &webTestClient{t: t, w: w, conn: conn, r: r}
+}
+
+func (c *webTestClient) message() (byte, []byte) {
+	_, op, payload := serverFrame(c.t, c.r)
+	return op, payload
+}
+
+// update skips to the next binary message, statuses come every second
+func (c *webTestClient) update() []byte {
+	for {
+		if op, payload := c.message(); op == WS_BINARY {
+			return payload
+		}
+	}
+}
+
+func (c *webTestClient) command(cmd webCommand) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	sendFrames(c.t, c.conn, clientFrame(true, WS_TEXT, data, 0))
+}
+
+// status skips to the next status message
+func (c *webTestClient) status() webStatus {
+	for {
+		op, data := c.message()
+		if op != WS_TEXT {
+			continue
+		}
+		var s webStatus
+		if err := json.Unmarshal(data, &s); err != nil {
+			c.t.Fatal(err)
+		}
+		if s.Type == "status" {
+			return s
+		}
+	}
+}
+
+func TestWebPage(t *testing.T) {
+	w := &Web{}
+	server := httptest.NewServer(w.handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" || !bytes.Equal(body, webPage) {
+		t.Errorf("Expected the page, Got %s %s and %d bytes", resp.Status, resp.Header.Get("Content-Type"), len(body))
+	}
+	resp, err = http.Get(server.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, Got %s", resp.Status)
+	}
+}
+
+func TestWebUpdates(t *testing.T) {
+	c := newWebClient(t)
+	// The whole screen first, as RGBA rows
+	op, msg := c.message()
+	if op != WS_BINARY || msg[0] != WEB_MSG_DISPLAY {
+		t.Fatalf("Expected a display update, Got op %d", op)
+	}
+	top, bottom := binary.BigEndian.Uint16(msg[1:]), binary.BigEndian.Uint16(msg[3:])
+	if top != 0 || bottom != SCREEN_HEIGHT || len(msg) != 5+4*SCREEN_WIDTH*SCREEN_HEIGHT {
+		t.Fatalf("Expected rows 0 to %d, Got %d to %d in %d bytes", SCREEN_HEIGHT, top, bottom, len(msg))
+	}
+	if !bytes.Equal(msg[5:13], []byte{0xff, 0, 0, 0xff, 0, 0, 0, 0xff}) {
+		t.Errorf("Expected a red and a black pixel, Got %x", msg[5:13])
+	}
+	if s := c.status(); s.Paused || s.PC != "80000000" {
+		t.Errorf("Expected running at 80000000, Got %+v", s)
+	}
+
+	// Console output, and only the changed rows
+	c.w.e.cpu.Memory.Uart.Output('o')
+	c.w.e.cpu.Memory.Uart.Output('k')
+	// A tick may come between the two bytes
+	var console []byte
+	for len(console) < 2 {
+		msg := c.update()
+		if msg[0] != WEB_MSG_UART {
+			t.Fatalf("Expected the console output, Got %q", msg)
+		}
+		console = append(console, msg[1:]...)
+	}
+	if string(console) != "ok" {
+		t.Errorf("Expected ok on the console, Got %q", console)
+	}
+	c.w.display.Mutex.Lock()
+	c.w.display.Screen[2*SCREEN_WIDTH] = 0x0000ff00
+	c.w.display.Mutex.Unlock()
+	msg = c.update()
+	if msg[0] != WEB_MSG_DISPLAY || binary.BigEndian.Uint16(msg[1:]) != 2 ||
+		binary.BigEndian.Uint16(msg[3:]) != 3 || !bytes.Equal(msg[5:9], []byte{0, 0xff, 0, 0xff}) {
+		t.Errorf("Expected row 2 with a green pixel, Got %x", msg[:min(len(msg), 9)])
+	}
+}
+
+func TestWebCommands(t *testing.T) {
+	c := newWebClient(t)
+	c.status()
+
+	// Typed text waits for the guest to read it
+	c.command(webCommand{Type: "uart", Data: "hi"})
+	c.command(webCommand{Type: "pause"})
+	// The run loop runs the controls, it is not running here
+	(<-c.w.actions)()
+	if s := c.status(); !s.Paused {
+		t.Errorf("Expected paused, Got %+v", s)
+	}
+	uart := c.w.e.cpu.Memory.Uart
+	for _, want := range []byte("hi") {
+		if b, ok := uart.Input(); !ok || b != want {
+			t.Errorf("Expected %q typed, Got %q %v", want, b, ok)
+		}
+	}
+	if _, ok := uart.Input(); ok {
+		t.Errorf("Expected nothing more typed")
+	}
+	c.command(webCommand{Type: "resume"})
+	(<-c.w.actions)()
+	if s := c.status(); s.Paused {
+		t.Errorf("Expected running, Got %+v", s)
+	}
+}
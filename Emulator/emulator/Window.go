@@ -0,0 +1,113 @@
+//go:build !nosdl
+
+package emulator
+
+import (
+	"log"
+	"maps"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// The SDL window shows the display of the guest. Building with -tags nosdl leaves SDL out, the emulator is always
+// headless then.
+
+type sdlWindow struct {
+	window   *sdl.Window
+	renderer *sdl.Renderer
+	texture  *sdl.Texture
+}
+
+// startWindow opens the window, drawn and polled by its own goroutine
+func (e *Emulator) startWindow() error {
+	go func() {
+		e.initialize()
+		for {
+			e.handleEvents()
+			e.drawScreen()
+		}
+	}()
+	return nil
+}
+
+// F5 saves a snapshot, F9 restores it
+func (e *Emulator) handleEvents() {
+	for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
+		key, ok := event.(*sdl.KeyboardEvent)
+		if !ok || key.Type != sdl.KEYDOWN || key.Repeat != 0 {
+			continue
+		}
+		switch key.Keysym.Sym {
+		case sdl.K_F5:
+			e.snapshotRequest.Store(SNAPSHOT_SAVE)
+		case sdl.K_F9:
+			e.snapshotRequest.Store(SNAPSHOT_RESTORE)
+		}
+	}
+}
+
+func (e *Emulator) initialize() {
+	// Initialize SDL
+	if err := sdl.Init(sdl.INIT_VIDEO); err != nil {
+		log.Fatalf("Failed to initialize SDL: %s\n", err)
+	}
+
+	// Create a window
+	window, err := sdl.CreateWindow("RiscV32", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED, 320, 200, sdl.WINDOW_SHOWN)
+	if err != nil {
+		log.Fatalf("Failed to create window: %s\n", err)
+	}
+	e.window = window
+
+	// Create a renderer
+	renderer, err := sdl.CreateRenderer(e.window, -1, sdl.RENDERER_ACCELERATED)
+	if err != nil {
+		log.Fatalf("Failed to create renderer: %s\n", err)
+	}
+	e.renderer = renderer
+
+	// Create a texture to manipulate pixels
+	texture, err := e.renderer.CreateTexture(sdl.PIXELFORMAT_ARGB8888, sdl.TEXTUREACCESS_STREAMING, SCREEN_WIDTH, SCREEN_HEIGHT)
+	if err != nil {
+		log.Fatalf("Failed to create texture: %s\n", err)
+	}
+	e.texture = texture
+	e.running = true
+}
+
+func (e *Emulator) drawScreen() {
+	// Lock the texture to directly modify its pixels
+	pixels, pitch, err := e.texture.Lock(nil)
+	if err != nil {
+		log.Fatalf("Failed to lock texture: %s\n", err)
+	}
+	e.cpu.Memory.Display.Mutex.Lock()
+	Screen := maps.Clone(e.cpu.Memory.Display.Screen)
+	e.cpu.Memory.Display.Mutex.Unlock()
+	// Set random colors for each pixel
+	for y := uint32(0); y < SCREEN_HEIGHT; y++ {
+		for x := uint32(0); x < SCREEN_WIDTH; x++ {
+			offset := y*uint32(pitch) + x*4 // Calculate the offset in the pixel buffer
+			// Generate random ARGB values
+			a := byte((Screen[y*SCREEN_WIDTH+x] & 0xFF000000) >> 24)
+			r := byte((Screen[y*SCREEN_WIDTH+x] & 0x00FF0000) >> 16)
+			g := byte((Screen[y*SCREEN_WIDTH+x] & 0x0000FF00) >> 8)
+			b := byte(Screen[y*SCREEN_WIDTH+x] & 0x000000FF)
+			pixels[offset] = b
+			pixels[offset+1] = g
+			pixels[offset+2] = r
+			pixels[offset+3] = a
+		}
+	}
+
+	// Unlock the texture
+	e.texture.Unlock()
+
+	// Clear the renderer and copy the texture to it
+	e.renderer.Clear()
+	e.renderer.Copy(e.texture, nil, nil)
+	e.renderer.Present()
+	// 60 FPS
+	sdl.Delay(30)
+	//e.cpu.Memory.Display.Screen[0] = 1 << 16
+}
@@ -0,0 +1,11 @@
+//go:build nosdl
+
+package emulator
+
+import "errors"
+
+type sdlWindow struct{}
+
+func (e *Emulator) startWindow() error {
+	return errors.New("built without SDL")
+}
@@ -0,0 +1,142 @@
+// Package fdt writes flattened device tree blobs.
+// See https://devicetree-specification.readthedocs.io/en/stable/flattened-format.html
+package fdt
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const FDT_MAGIC = 0xd00dfeed
+const FDT_VERSION = 17
+const FDT_LAST_COMP_VERSION = 16
+
+const FDT_BEGIN_NODE = 0x1
+const FDT_END_NODE = 0x2
+const FDT_PROP = 0x3
+const FDT_END = 0x9
+
+const headerSize = 40
+
+// Builder writes nodes and properties in the order they appear in the tree
+type Builder struct {
+	structs bytes.Buffer
+	strings bytes.Buffer
+	// offsets of property names already in the strings block
+	names map[string]uint32
+	depth int
+}
+
+func NewBuilder() *Builder {
+	return &Builder{names: make(map[string]uint32)}
+}
+
+func (b *Builder) u32(v uint32) {
+	_ = binary.Write(&b.structs, binary.BigEndian, v)
+}
+
+// Tokens are aligned to 4 bytes
+func (b *Builder) pad() {
+	for b.structs.Len()%4 != 0 {
+		b.structs.WriteByte(0)
+	}
+}
+
+func (b *Builder) BeginNode(name string) {
+	b.u32(FDT_BEGIN_NODE)
+	b.structs.WriteString(name)
+	b.structs.WriteByte(0)
+	b.pad()
+	b.depth++
+}
+
+func (b *Builder) EndNode() {
+	b.u32(FDT_END_NODE)
+	b.depth--
+}
+
+func (b *Builder) nameOffset(name string) uint32 {
+	if off, ok := b.names[name]; ok {
+		return off
+	}
+	off := uint32(b.strings.Len())
+	b.strings.WriteString(name)
+	b.strings.WriteByte(0)
+	b.names[name] = off
+	return off
+}
+
+func (b *Builder) Property(name string, value []byte) {
+	b.u32(FDT_PROP)
+	b.u32(uint32(len(value)))
+	b.u32(b.nameOffset(name))
+	b.structs.Write(value)
+	b.pad()
+}
+
+// PropertyEmpty writes a boolean property like interrupt-controller
+func (b *Builder) PropertyEmpty(name string) {
+	b.Property(name, nil)
+}
+
+func (b *Builder) PropertyU32(name string, values ...uint32) {
+	value := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(value[4*i:], v)
+	}
+	b.Property(name, value)
+}
+
+// PropertyU64 writes values as pairs of cells, for #address-cells and #size-cells of 2
+func (b *Builder) PropertyU64(name string, values ...uint64) {
+	value := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint64(value[8*i:], v)
+	}
+	b.Property(name, value)
+}
+
+// PropertyString writes a string list, a single string is a list of one
+func (b *Builder) PropertyString(name string, values ...string) {
+	var value []byte
+	for _, v := range values {
+		value = append(value, v...)
+		value = append(value, 0)
+	}
+	b.Property(name, value)
+}
+
+// Finish closes the tree and returns the blob. All nodes must be ended before.
+func (b *Builder) Finish(bootCpu uint32) []byte {
+	if b.depth != 0 {
+		panic("fdt: unbalanced nodes")
+	}
+	b.u32(FDT_END)
+
+	// Empty memory reservation block is just the terminating entry
+	rsvmap := make([]byte, 16)
+	offRsvmap := uint32(headerSize)
+	offStruct := offRsvmap + uint32(len(rsvmap))
+	offStrings := offStruct + uint32(b.structs.Len())
+	total := offStrings + uint32(b.strings.Len())
+
+	var out bytes.Buffer
+	for _, v := range []uint32{
+		FDT_MAGIC,
+		total,
+		offStruct,
+		offStrings,
+		offRsvmap,
+		FDT_VERSION,
+		FDT_LAST_COMP_VERSION,
+		bootCpu,
+		uint32(b.strings.Len()),
+		uint32(b.structs.Len()),
+	} {
+		_ = binary.Write(&out, binary.BigEndian, v)
+	}
+	out.Write(rsvmap)
+	out.Write(b.structs.Bytes())
+	out.Write(b.strings.Bytes())
+	return out.Bytes()
+}
@@ -0,0 +1,35 @@
+package fdt
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestFinishHeader(t *testing.T) {
+	b := NewBuilder()
+	b.BeginNode("")
+	b.PropertyU32("#address-cells", 2)
+	b.BeginNode("cpus")
+	b.PropertyU32("#address-cells", 1)
+	b.EndNode()
+	b.EndNode()
+	blob := b.Finish(0)
+
+	header := func(i int) uint32 {
+		return binary.BigEndian.Uint32(blob[4*i:])
+	}
+	if header(0) != FDT_MAGIC {
+		t.Errorf("Expected magic %x, Got %x", FDT_MAGIC, header(0))
+	}
+	if header(1) != uint32(len(blob)) {
+		t.Errorf("Expected totalsize %d, Got %d", len(blob), header(1))
+	}
+	// Same property name is stored once
+	if header(8) != uint32(len("#address-cells")+1) {
+		t.Errorf("Expected strings size %d, Got %d", len("#address-cells")+1, header(8))
+	}
+	offStruct, sizeStruct := header(2), header(9)
+	if last := binary.BigEndian.Uint32(blob[offStruct+sizeStruct-4:]); last != FDT_END {
+		t.Errorf("Expected struct block to end with FDT_END, Got %x", last)
+	}
+}
@@ -0,0 +1,244 @@
+package instructions
+
+import "errors"
+
+// PCM audio output. The guest points the device at a ring buffer in RAM and starts it, the device plays it
+// round and round at the sample rate and raises its interrupt every period played, so the guest can fill the
+// period it left. There is no write pointer, what isn't filled in time is played again. Periods played in the
+// same tick raise one interrupt, AUDIO_POSITION tells how far the device got.
+// It is clocked by mtime, so recorded and replayed runs play the same samples.
+const VIRT_AUDIO = 0x103000
+const VIRT_AUDIO_SIZE = 0x1000
+const AUDIO_IRQ = 13
+
+const AUDIO_CTRL = 0x00
+const AUDIO_STATUS = 0x04
+const AUDIO_RATE = 0x08
+const AUDIO_FORMAT = 0x0c
+const AUDIO_CHANNELS = 0x10
+const AUDIO_BUFFER = 0x14
+const AUDIO_BUFFER_SIZE = 0x18
+const AUDIO_PERIOD_SIZE = 0x1c
+
+// Offset in the ring of the next byte played, read only
+const AUDIO_POSITION = 0x20
+
+const AUDIO_CTRL_RUN = 1 << 0
+const AUDIO_CTRL_IRQ = 1 << 1
+
+// Set when a period was played, cleared by writing it back
+const AUDIO_STATUS_PERIOD = 1 << 0
+
+// Samples are unsigned 8 bit or signed 16 bit little endian, channels interleaved
+const AUDIO_FORMAT_U8 = 0
+const AUDIO_FORMAT_S16LE = 1
+
+const AUDIO_RATE_MIN = 4000
+const AUDIO_RATE_MAX = 48000
+const AUDIO_RATE_DEFAULT = 22050
+
+// mtime counts milliseconds
+const AUDIO_MTIME_FREQUENCY = 1000
+
+type Audio struct {
+	Plic *Plic
+	// The ring is read from RAM
+	Memory     *Memory
+	Ctrl       uint32
+	Status     uint32
+	Rate       uint32
+	Format     uint32
+	Channels   uint32
+	Buffer     uint32
+	BufferSize uint32
+	PeriodSize uint32
+	Position   uint32
+	// mtime the frames are counted from, and frames played since. Started is false till the next tick.
+	Start   uint64
+	Played  uint64
+	Started bool
+	// Gets the frames played, 16 bit samples with the channels interleaved
+	Output func(rate uint32, channels uint32, samples []int16)
+}
+
+func NewAudio(plic *Plic) *Audio {
+	return &Audio{Plic: plic, Rate: AUDIO_RATE_DEFAULT, Format: AUDIO_FORMAT_S16LE, Channels: 2}
+}
+
+func (a *Audio) Read(addr uint32) uint32 {
+	switch addr - VIRT_AUDIO {
+	case AUDIO_CTRL:
+		return a.Ctrl
+	case AUDIO_STATUS:
+		return a.Status
+	case AUDIO_RATE:
+		return a.Rate
+	case AUDIO_FORMAT:
+		return a.Format
+	case AUDIO_CHANNELS:
+		return a.Channels
+	case AUDIO_BUFFER:
+		return a.Buffer
+	case AUDIO_BUFFER_SIZE:
+		return a.BufferSize
+	case AUDIO_PERIOD_SIZE:
+		return a.PeriodSize
+	case AUDIO_POSITION:
+		return a.Position
+	}
+	return 0
+}
+
+func (a *Audio) Write(v uint32, addr uint32) error {
+	if addr < VIRT_AUDIO || addr >= VIRT_AUDIO+VIRT_AUDIO_SIZE {
+		return errors.New("Invalid address for audio")
+	}
+	// The clock starts again from the next tick when playing starts or the format or ring changes
+	restart := true
+	switch addr - VIRT_AUDIO {
+	case AUDIO_CTRL:
+		restart = v&AUDIO_CTRL_RUN != 0 && a.Ctrl&AUDIO_CTRL_RUN == 0
+		if restart {
+			a.Position = 0
+		}
+		a.Ctrl = v & (AUDIO_CTRL_RUN | AUDIO_CTRL_IRQ)
+	case AUDIO_STATUS:
+		a.Status &^= v
+		restart = false
+	case AUDIO_RATE:
+		a.Rate = min(max(v, AUDIO_RATE_MIN), AUDIO_RATE_MAX)
+	case AUDIO_FORMAT:
+		if v == AUDIO_FORMAT_U8 || v == AUDIO_FORMAT_S16LE {
+			a.Format = v
+		}
+	case AUDIO_CHANNELS:
+		if v == 1 || v == 2 {
+			a.Channels = v
+		}
+	case AUDIO_BUFFER:
+		a.Buffer = v
+	case AUDIO_BUFFER_SIZE:
+		a.BufferSize = v
+	case AUDIO_PERIOD_SIZE:
+		a.PeriodSize = v
+	default:
+		restart = false
+	}
+	if restart {
+		a.Started = false
+		a.Position -= a.Position % a.frameBytes()
+		if a.Position >= a.ringSize() {
+			a.Position = 0
+		}
+	}
+	a.updateIrq()
+	return nil
+}
+
+func (a *Audio) frameBytes() uint32 {
+	if a.Format == AUDIO_FORMAT_U8 {
+		return a.Channels
+	}
+	return 2 * a.Channels
+}
+
+// ringSize is the buffer size in whole frames
+func (a *Audio) ringSize() uint32 {
+	return a.BufferSize - a.BufferSize%a.frameBytes()
+}
+
+// Tick plays the frames due at mtime and drives the interrupt line
+func (a *Audio) Tick(mtime uint64) {
+	if a.Ctrl&AUDIO_CTRL_RUN == 0 || a.ringSize() == 0 {
+		return
+	}
+	if !a.Started || mtime < a.Start {
+		a.Start, a.Played, a.Started = mtime, 0, true
+		return
+	}
+	due := (mtime - a.Start) * uint64(a.Rate) / AUDIO_MTIME_FREQUENCY
+	if due <= a.Played {
+		return
+	}
+	// A guest which stopped for longer than the ring hears one ring of it
+	frames := min(due-a.Played, uint64(a.ringSize()/a.frameBytes()))
+	a.Played = due
+	a.play(frames)
+	a.updateIrq()
+}
+
+func (a *Audio) play(frames uint64) {
+	samples := make([]int16, 0, frames*uint64(a.Channels))
+	for i := uint64(0); i < frames; i++ {
+		for c := uint32(0); c < a.Channels; c++ {
+			addr := a.Buffer + a.Position
+			if a.Format == AUDIO_FORMAT_U8 {
+				samples = append(samples, int16(int(a.Memory.PeekByte(addr))-128)<<8)
+				a.Position++
+			} else {
+				samples = append(samples, int16(uint16(a.Memory.PeekByte(addr))|uint16(a.Memory.PeekByte(addr+1))<<8))
+				a.Position += 2
+			}
+		}
+		if a.PeriodSize > 0 && a.Position%a.PeriodSize == 0 {
+			a.Status |= AUDIO_STATUS_PERIOD
+		}
+		if a.Position >= a.ringSize() {
+			a.Position = 0
+		}
+	}
+	if a.Output != nil {
+		a.Output(a.Rate, a.Channels, samples)
+	}
+}
+
+func (a *Audio) updateIrq() {
+	if a.Plic != nil {
+		a.Plic.SetLevel(AUDIO_IRQ, a.Ctrl&AUDIO_CTRL_IRQ != 0 && a.Status&AUDIO_STATUS_PERIOD != 0)
+	}
+}
+
+// AudioState is the registers and the place in the ring, for snapshots. The clock starts again after a restore.
+type AudioState struct {
+	Ctrl       uint32
+	Status     uint32
+	Rate       uint32
+	Format     uint32
+	Channels   uint32
+	Buffer     uint32
+	BufferSize uint32
+	PeriodSize uint32
+	Position   uint32
+}
+
+func (a *Audio) State() AudioState {
+	return AudioState{
+		Ctrl:       a.Ctrl,
+		Status:     a.Status,
+		Rate:       a.Rate,
+		Format:     a.Format,
+		Channels:   a.Channels,
+		Buffer:     a.Buffer,
+		BufferSize: a.BufferSize,
+		PeriodSize: a.PeriodSize,
+		Position:   a.Position,
+	}
+}
+
+func (a *Audio) SetState(s AudioState) {
+	a.Ctrl = s.Ctrl
+	a.Status = s.Status
+	a.Rate = s.Rate
+	a.Format = s.Format
+	a.Channels = s.Channels
+	a.Buffer = s.Buffer
+	a.BufferSize = s.BufferSize
+	a.PeriodSize = s.PeriodSize
+	a.Position = s.Position
+	// Snapshots from before the device had none
+	if a.Rate == 0 {
+		a.Rate, a.Format, a.Channels = AUDIO_RATE_DEFAULT, AUDIO_FORMAT_S16LE, 2
+	}
+	a.Started = false
+	a.updateIrq()
+}
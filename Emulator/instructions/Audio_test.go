@@ -0,0 +1,84 @@
+package instructions
+
+import "testing"
+
+func newTestAudio() (*Memory, *Cpu) {
+	plic, cpu := newTestPlic()
+	_ = plic.Write(1, PLIC_PRIORITY+4*AUDIO_IRQ)
+	_ = plic.Write(1<<AUDIO_IRQ, PLIC_INT_ENABLE)
+	m := &Memory{Map: make(map[uint32]byte), Plic: plic, Audio: NewAudio(plic)}
+	m.Audio.Memory = m
+	return m, cpu
+}
+
+func TestAudioRing(t *testing.T) {
+	m, cpu := newTestAudio()
+	var played []int16
+	m.Audio.Output = func(rate uint32, channels uint32, samples []int16) {
+		if rate != 8000 || channels != 1 {
+			t.Errorf("Expected 8000 Hz mono, Got %d Hz %d channels", rate, channels)
+		}
+		played = append(played, samples...)
+	}
+	// 16 frames of 16 bit mono, the sample is the frame number
+	for i := uint32(0); i < 16; i++ {
+		m.WriteWord(i, 0x80000000+2*i)
+	}
+	for _, reg := range [][2]uint32{
+		{AUDIO_RATE, 8000}, {AUDIO_CHANNELS, 1}, {AUDIO_BUFFER, 0x80000000}, {AUDIO_BUFFER_SIZE, 32}, {AUDIO_PERIOD_SIZE, 16},
+		{AUDIO_CTRL, AUDIO_CTRL_RUN | AUDIO_CTRL_IRQ},
+	} {
+		m.WriteWord(reg[1], VIRT_AUDIO+reg[0])
+	}
+
+	// 8 frames a millisecond
+	m.Audio.Tick(100)
+	m.Audio.Tick(101)
+	if len(played) != 8 || played[7] != 7 {
+		t.Errorf("Expected frames 0 to 7, Got %v", played)
+	}
+	if got := m.ReadWord(VIRT_AUDIO + AUDIO_POSITION); got != 16 {
+		t.Errorf("Expected position 16, Got %d", got)
+	}
+	if cpu.CSR.Registers[MIP]&(1<<11) == 0 {
+		t.Errorf("Expected MEIP after a period")
+	}
+
+	m.WriteWord(AUDIO_STATUS_PERIOD, VIRT_AUDIO+AUDIO_STATUS)
+	if m.ReadWord(VIRT_AUDIO+AUDIO_STATUS) != 0 {
+		t.Errorf("Expected the period status to clear")
+	}
+	// Round the ring and back to frame 0
+	m.Audio.Tick(103)
+	if len(played) != 24 || played[16] != 0 {
+		t.Errorf("Expected the ring to wrap, Got %v", played)
+	}
+}
+
+func TestAudioFormat(t *testing.T) {
+	m, _ := newTestAudio()
+	var played []int16
+	m.Audio.Output = func(rate uint32, channels uint32, samples []int16) {
+		played = append(played, samples...)
+	}
+	m.LoadBytes([]byte{0x80, 0xff, 0x00, 0x80}, 0x80000000)
+	m.WriteWord(AUDIO_FORMAT_U8, VIRT_AUDIO+AUDIO_FORMAT)
+	m.WriteWord(1, VIRT_AUDIO+AUDIO_CHANNELS)
+	m.WriteWord(AUDIO_RATE_MAX+1, VIRT_AUDIO+AUDIO_RATE)
+	if got := m.ReadWord(VIRT_AUDIO + AUDIO_RATE); got != AUDIO_RATE_MAX {
+		t.Errorf("Expected the rate to be limited to %d, Got %d", AUDIO_RATE_MAX, got)
+	}
+	m.WriteWord(4000, VIRT_AUDIO+AUDIO_RATE)
+	m.WriteWord(0x80000000, VIRT_AUDIO+AUDIO_BUFFER)
+	m.WriteWord(4, VIRT_AUDIO+AUDIO_BUFFER_SIZE)
+	m.WriteWord(AUDIO_CTRL_RUN, VIRT_AUDIO+AUDIO_CTRL)
+
+	m.Audio.Tick(0)
+	m.Audio.Tick(1)
+	want := []int16{0, 127 << 8, -128 << 8, 0}
+	for i := range want {
+		if i >= len(played) || played[i] != want[i] {
+			t.Fatalf("Expected %v, Got %v", want, played)
+		}
+	}
+}
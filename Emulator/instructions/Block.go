@@ -0,0 +1,125 @@
+package instructions
+
+// Straight-line code is translated into blocks, which run one instruction after another without going
+// back to the run loop. A block ends with an instruction that may not go on to the next one: a branch, a
+// jump, an instruction that changes CSRs or traps, or fence.i. Blocks stay in their page, so a store only
+// has to look at the blocks of the page it writes to.
+
+// Instructions in a block at most, so interrupts don't wait too long
+const BLOCK_MAX = 64
+
+type Block struct {
+	PC    uint32
+	Insts []*Decoded
+	// Cleared when code of the block was written, a running block stops after the store
+	valid bool
+	// Blocks which ran after this one, so the next block is mostly found without a lookup
+	links [2]*Block
+	// links slot replaced next
+	victim int
+}
+
+// ends tells if the block ends after the instruction
+func ends(d *Decoded) bool {
+	switch d.Op {
+	case OP_BEQ, OP_BNE, OP_BLT, OP_BGE, OP_BLTU, OP_BGEU, OP_JAL, OP_JALR,
+		OP_ECALL, OP_EBREAK, OP_SRET, OP_MRET, OP_WFI, OP_SFENCE_VMA, OP_FENCE_I,
+		OP_CSRRW, OP_CSRRS, OP_CSRRC, OP_CSRRWI, OP_CSRRSI, OP_CSRRCI:
+		return true
+	}
+	return false
+}
+
+// Block returns the block starting at pc, translating it the first time. It returns nil when the
+// instruction at pc has to run on its own: pc is not aligned, or there is no valid instruction at it.
+func (m *Memory) Block(pc uint32) *Block {
+	if b := m.blocks[pc]; b != nil {
+		return b
+	}
+	if pc%4 != 0 {
+		return nil
+	}
+	b := &Block{PC: pc, valid: true}
+	for addr := pc; len(b.Insts) < BLOCK_MAX; addr += 4 {
+		d, ok := m.translate(addr)
+		if !ok {
+			break
+		}
+		b.Insts = append(b.Insts, d)
+		if ends(d) || (addr+4)%CODE_PAGE_SIZE == 0 {
+			break
+		}
+	}
+	if len(b.Insts) == 0 {
+		return nil
+	}
+	if m.blocks == nil {
+		m.blocks = make(map[uint32]*Block)
+	}
+	m.blocks[pc] = b
+	page := m.code[pc/CODE_PAGE_SIZE]
+	page.blocks = append(page.blocks, b)
+	return b
+}
+
+// translate fetches an instruction for a block. Code after the instruction which ends the run may be
+// data, it is not an error until it runs.
+func (m *Memory) translate(addr uint32) (d *Decoded, ok bool) {
+	// Reading the UART takes the byte received, other devices may have side effects too
+	if (addr >= VIRT_UART0 && addr < VIRT_UART0+0x100) || m.mmioAt(addr) != nil {
+		return nil, false
+	}
+	defer func() {
+		if recover() != nil {
+			d, ok = nil, false
+		}
+	}()
+	d = m.Fetch(addr)
+	return d, d.Inst != nil
+}
+
+// Next returns the block at pc, following the links of b, which ran before
+func (m *Memory) Next(b *Block, pc uint32) *Block {
+	for _, l := range b.links {
+		if l != nil && l.PC == pc && l.valid {
+			return l
+		}
+	}
+	next := m.Block(pc)
+	if next != nil && b.valid {
+		b.links[b.victim] = next
+		b.victim = (b.victim + 1) % len(b.links)
+	}
+	return next
+}
+
+// dropBlocks invalidates the blocks with the instruction at location and returns the ones left
+func (m *Memory) dropBlocks(blocks []*Block, location uint32) []*Block {
+	kept := blocks[:0]
+	for _, b := range blocks {
+		if location >= b.PC && location < b.PC+4*uint32(len(b.Insts)) {
+			b.valid = false
+			delete(m.blocks, b.PC)
+			continue
+		}
+		kept = append(kept, b)
+	}
+	clear(blocks[len(kept):])
+	return kept
+}
+
+// RunBlock executes the instructions of b till one goes somewhere else than the next one. It stops
+// early when the block was written or the guest asked for power off. It returns the last instruction
+// executed.
+func (c *Cpu) RunBlock(b *Block) *Decoded {
+	m := c.Memory
+	var d *Decoded
+	for _, d = range b.Insts {
+		next := c.PC + 4
+		c.Exec(d)
+		if c.PC != next || !b.valid || (m.Syscon != nil && m.Syscon.Requested) {
+			break
+		}
+	}
+	return d
+}
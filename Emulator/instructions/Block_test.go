@@ -0,0 +1,159 @@
+package instructions
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Calls a function 10 times, patches it to return 2 instead of 1 and calls it 10 times again.
+// Then it patches the instruction right after the store, in the same block.
+var selfModifying = []uint32{
+	0x00000493, // li s1, 0
+	0x00a00413, // li s0, 10
+	0x050000ef, // loop: jal ra, patched
+	0x00a90933, // add s2, s2, a0
+	0xfff40413, // addi s0, s0, -1
+	0xfe041ae3, // bnez s0, loop
+	0x02049263, // bnez s1, inside
+	0x00100493, // li s1, 1
+	0x00000297, // la t0, patched
+	0x03828293,
+	0x00200337, // li t1, 0x00200513
+	0x51330313,
+	0x0062a023, // sw t1, 0(t0)
+	0x00a00413, // li s0, 10
+	0xfd1ff06f, // j loop
+	0x00000297, // inside: la t0, next
+	0x01428293,
+	0x00500337, // li t1, 0x00500593
+	0x59330313,
+	0x0062a023, // sw t1, 0(t0)
+	0x00300593, // next: li a1, 3
+	0x0000006f, // done: j done
+	0x00100513, // patched: li a0, 1
+	0x00008067, // ret
+}
+
+const selfModifyingDone = 0x80000054
+
+func newTestCpu(program []uint32) *Cpu {
+	b := make([]byte, 4*len(program))
+	for i, w := range program {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+	m := &Memory{Map: make(map[uint32]byte)}
+	_ = m.LoadBytes(b, 0x80000000)
+	cpu := &Cpu{PC: 0x80000000, Memory: m, CSR: &CSR{Registers: make([]uint32, 4096)}, CurrentMode: 3}
+	m.SetCpu(cpu)
+	return cpu
+}
+
+func TestBlocksMatchInterpreter(t *testing.T) {
+	translated := newTestCpu(selfModifying)
+	var b *Block
+	for translated.PC != selfModifyingDone && translated.Instret < 1000 {
+		if b == nil {
+			b = translated.Memory.Block(translated.PC)
+		} else {
+			b = translated.Memory.Next(b, translated.PC)
+		}
+		translated.RunBlock(b)
+	}
+
+	// Blocks only stop between blocks, the interpreter runs as many instructions
+	interpreted := newTestCpu(selfModifying)
+	for interpreted.Instret < translated.Instret {
+		_ = interpreted.Exec(interpreted.Memory.Fetch(interpreted.PC))
+	}
+
+	if got := interpreted.Registers[18]; got != 30 {
+		t.Errorf("Expected s2 30 from the patched function, Got %d", got)
+	}
+	if got := interpreted.Registers[11]; got != 5 {
+		t.Errorf("Expected a1 5 from the patched instruction, Got %d", got)
+	}
+	if translated.Registers != interpreted.Registers || translated.PC != interpreted.PC {
+		t.Errorf("Expected blocks to end like the interpreter\nGot  %v at %x\nWant %v at %x",
+			translated.Registers, translated.PC, interpreted.Registers, interpreted.PC)
+	}
+}
+
+func TestBlockEnds(t *testing.T) {
+	cpu := newTestCpu(selfModifying)
+	m := cpu.Memory
+	// Up to the jal
+	if b := m.Block(0x80000000); len(b.Insts) != 3 {
+		t.Errorf("Expected the block to end at the jal, Got %d instructions", len(b.Insts))
+	}
+	// The store drops the block with the instruction it writes, the other one is kept
+	first, inside := m.Block(0x80000000), m.Block(0x8000003c)
+	m.WriteWord(0x00700593, 0x80000050)
+	if inside.valid || m.Block(0x8000003c) == inside {
+		t.Errorf("Expected the written block to be dropped")
+	}
+	if !first.valid || m.Block(0x80000000) != first {
+		t.Errorf("Expected the other block to stay")
+	}
+	if m.Block(0x80000002) != nil {
+		t.Errorf("Expected no block at an unaligned pc")
+	}
+}
+
+// Stack traffic and arithmetic, forever
+var benchLoop = []uint32{
+	0xff010113, // loop: addi sp, sp, -16
+	0x00812023, // sw s0, 0(sp)
+	0x00012503, // lw a0, 0(sp)
+	0x008545b3, // xor a1, a0, s0
+	0x00351613, // slli a2, a0, 3
+	0x00b606b3, // add a3, a2, a1
+	0x01010113, // addi sp, sp, 16
+	0xfff40413, // addi s0, s0, -1
+	0xfe0410e3, // bnez s0, loop
+	0xfddff06f, // j loop
+}
+
+func reportMIPS(b *testing.B, cpu *Cpu) {
+	b.ReportMetric(float64(cpu.Instret)/b.Elapsed().Seconds()/1e6, "MIPS")
+}
+
+func BenchmarkPredecode(b *testing.B) {
+	insts := make([]Inst, len(benchLoop))
+	for i, w := range benchLoop {
+		insts[i] = DecodeBytes([4]byte{byte(w), byte(w >> 8), byte(w >> 16), byte(w >> 24)})
+	}
+	for i := 0; i < b.N; i++ {
+		_ = Predecode(insts[i%len(insts)])
+	}
+}
+
+// One instruction at a time, decoded every time like before the decode cache
+func BenchmarkExecInst(b *testing.B) {
+	cpu := newTestCpu(benchLoop)
+	m := cpu.Memory
+	for i := 0; i < b.N; i++ {
+		pc := cpu.PC
+		_ = cpu.ExecInst(DecodeBytes([4]byte{m.ReadByte(pc), m.ReadByte(pc + 1), m.ReadByte(pc + 2), m.ReadByte(pc + 3)}))
+	}
+	reportMIPS(b, cpu)
+}
+
+// One instruction at a time from the decode cache, like the run loop with -interpret
+func BenchmarkInterpreter(b *testing.B) {
+	cpu := newTestCpu(benchLoop)
+	for i := 0; i < b.N; i++ {
+		_ = cpu.Exec(cpu.Memory.Fetch(cpu.PC))
+	}
+	reportMIPS(b, cpu)
+}
+
+// Translated blocks, b.N counts blocks and not instructions
+func BenchmarkBlocks(b *testing.B) {
+	cpu := newTestCpu(benchLoop)
+	block := cpu.Memory.Block(cpu.PC)
+	for i := 0; i < b.N; i++ {
+		cpu.RunBlock(block)
+		block = cpu.Memory.Next(block, cpu.PC)
+	}
+	reportMIPS(b, cpu)
+}
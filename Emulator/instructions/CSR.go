@@ -86,6 +86,62 @@ const MCYCLEH uint32 = 0xCB80
 // machine memory protection
 // TODO
 
+// CSRNames maps CSR numbers to their names in assembly
+var CSRNames = map[uint32]string{
+	USTATUS:    "ustatus",
+	UIE:        "uie",
+	UTVEC:      "utvec",
+	USCRATCH:   "uscratch",
+	UEPC:       "uepc",
+	UCAUSE:     "ucause",
+	UTVAL:      "utval",
+	UIP:        "uip",
+	CYCLE:      "cycle",
+	TIME:       "time",
+	INSTRET:    "instret",
+	CYCLEH:     "cycleh",
+	TIMEH:      "timeh",
+	SSTATUS:    "sstatus",
+	SEDELEG:    "sedeleg",
+	SIDELEG:    "sideleg",
+	SIE:        "sie",
+	STVEC:      "stvec",
+	SCOUNTEREN: "scounteren",
+	SENVCFG:    "senvcfg",
+	SSCRATCH:   "sscratch",
+	SEPC:       "sepc",
+	SCAUSE:     "scause",
+	STVAL:      "stval",
+	SIP:        "sip",
+	SRW:        "satp",
+	MVENDORID:  "mvendorid",
+	MARCHID:    "marchid",
+	MIMPID:     "mimpid",
+	MHARTID:    "mhartid",
+	MCONFPTR:   "mconfigptr",
+	MSTATUS:    "mstatus",
+	MISA:       "misa",
+	MEDELEG:    "medeleg",
+	MIDELEG:    "mideleg",
+	MIE:        "mie",
+	MTVEC:      "mtvec",
+	MCOUNTEREN: "mcounteren",
+	MSTATUSH:   "mstatush",
+	MSCRATCH:   "mscratch",
+	MEPC:       "mepc",
+	MCAUSE:     "mcause",
+	MTVAL:      "mtval",
+	MIP:        "mip",
+	MTINST:     "mtinst",
+	MTVAL2:     "mtval2",
+	MENVCFG:    "menvcfg",
+	MENVCFGH:   "menvcfgh",
+	MSECCFG:    "mseccfg",
+	MSECCFGH:   "mseccfgh",
+	MCYCLE:     "mcycle",
+	MINSTRET:   "minstret",
+}
+
 type CSR struct {
 	Registers []uint32
 }
@@ -222,14 +278,28 @@ func (csr *CSR) GetValue(csrReg uint32, currentExecutionMode uint32, cpu *Cpu) u
 		return 0
 	case csrReg == MIMPID:
 		return 0
-	case csrReg == MHARTID:
-		return 0 // Single core system
+	case csrReg == MHARTID && cpu != nil:
+		return cpu.HartID
+	// sie and sip are views of mie and mip, restricted to what is delegated
+	case csrReg == SIE:
+		return csr.Registers[MIE] & csr.Registers[MIDELEG]
+	case csrReg == SIP:
+		return csr.Registers[MIP] & csr.Registers[MIDELEG]
+	case csrReg == TIME && cpu != nil && cpu.Memory != nil:
+		return uint32(cpu.Memory.Clint.Mtime)
+	case csrReg == TIMEH && cpu != nil && cpu.Memory != nil:
+		return uint32(cpu.Memory.Clint.Mtime >> 32)
 	}
 	// TODO see if we can use masked registers here. WARL (Write any values, reads legal values)
 	return csr.Registers[csrReg]
 }
 
 func (csr *CSR) isCSRValid(reg uint32) bool {
+	return IsCSRValid(reg)
+}
+
+// IsCSRValid tells if the CSR is implemented
+func IsCSRValid(reg uint32) bool {
 	r := reg
 	v := []uint32{USTATUS, UIE, UTVEC, USCRATCH, UEPC, UCAUSE, UTVAL, UIP, CYCLE, TIME, INSTRET, CYCLEH, TIMEH,
 		SSTATUS, SEDELEG, SIDELEG, SIE, STVEC, SCOUNTEREN, SSCRATCH, SEPC, SCAUSE, STVAL, SIP, SRW,
@@ -268,10 +338,32 @@ func (csr *CSR) SetValue(csrReg uint32, value uint32, currentExecutionMode uint3
 	// we should also check if reg is write
 	// We should also update correspnding M/S/U registers after masking
 	// TODO
+	switch csrReg {
+	case SIE:
+		mask := csr.Registers[MIDELEG]
+		csr.Registers[MIE] = csr.Registers[MIE]&^mask | value&mask
+		return
+	// Only software interrupt pending bit is writable from S-mode
+	case SIP:
+		mask := csr.Registers[MIDELEG] & MIP_SSIP
+		csr.Registers[MIP] = csr.Registers[MIP]&^mask | value&mask
+		return
+	// Software writes its own SEIP, the PLIC adds its line back
+	case MIP:
+		csr.Registers[MIP] = value
+		if cpu != nil {
+			cpu.SoftwareSEIP = value&MIP_SEIP != 0
+			if cpu.Memory != nil && cpu.Memory.Plic != nil {
+				cpu.Memory.Plic.update()
+			}
+		}
+		return
+	}
 	csr.Registers[csrReg] = value
 }
 
 func (csr *CSR) handleExceptions(mode uint32, exception uint32, cpu *Cpu) {
+	cpu.countTrap(exception)
 	// Save pc to mepc / corresponding
 	// move PC to interrupt / exception handler after checking mdeleg and meip / corresponding registers
 	// mtvec has different address based on modes see page 24, https://people.eecs.berkeley.edu/~krste/papers/riscv-priv-spec-1.7.pdf
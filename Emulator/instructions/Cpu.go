@@ -6,66 +6,92 @@ import (
 	"sync"
 )
 
+// ABI names of the integer registers
+var RegisterNames = [32]string{
+	"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+	"s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+	"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+	"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+}
+
 type Cpu struct {
 	PC             uint32
 	Registers      [32]uint32
 	Memory         *Memory
 	CSR            *CSR
 	AtomicReserved bool
+	// Word reserved by lr.w, sc.w only succeeds on it
+	Reservation uint32
+	// Read from mhartid
+	HartID uint32
+	// Set while the hart doesn't run, like a secondary hart the SBI didn't start yet
+	Stopped bool
+	// Set by wfi, cleared once an interrupt the hart enables is pending
+	Waiting bool
+	// mip.SEIP as written by software, the PLIC's S-mode line is ORed in on top
+	SoftwareSEIP bool
 	// 3 for machine, 1 for supervisor, 2 for hypervisor, 0 for user
 	CurrentMode uint32
 	Mutex       sync.Mutex
+	// Built-in SBI firmware, nil when the guest brings its own
+	Sbi *Sbi
+	// Called for every load and store done by an instruction, with the value loaded or stored
+	MemoryHook func(addr uint32, size uint32, value uint32, write bool)
+	// Number of instructions executed
+	Instret uint64
+}
+
+func (c *Cpu) access(addr uint32, size uint32, value uint32, write bool) {
+	if c.MemoryHook != nil {
+		c.MemoryHook(addr, size, value, write)
+	}
+}
+
+func (c *Cpu) loadByte(addr uint32) byte {
+	v := c.Memory.ReadByte(addr)
+	c.access(addr, 1, uint32(v), false)
+	return v
+}
+
+func (c *Cpu) loadWord(addr uint32) uint32 {
+	v := c.Memory.ReadWord(addr)
+	c.access(addr, 4, v, false)
+	return v
+}
+
+func (c *Cpu) storeWord(v uint32, addr uint32) {
+	c.Memory.WriteWord(v, addr)
+	c.access(addr, 4, v, true)
+}
+
+// Idle tells if the hart still waits in wfi. An interrupt enabled in mie ends the wait even when interrupts
+// are disabled in mstatus, the hart then goes on after the wfi.
+func (c *Cpu) Idle() bool {
+	c.wake()
+	return c.Waiting
+}
+
+// wake ends wfi when an interrupt the hart enables is pending, the devices and the SBI call it when they raise one
+func (c *Cpu) wake() {
+	if c.CSR.Registers[MIP]&c.CSR.Registers[MIE] != 0 {
+		c.Waiting = false
+	}
 }
 
 func (c *Cpu) ExecInst(i Inst) error {
+	return c.Exec(Predecode(i))
+}
+
+// Exec runs an instruction decoded with Predecode or Memory.Fetch
+func (c *Cpu) Exec(d *Decoded) error {
 	// Always reset register 0 to 0, to be sure
 	c.Registers[0] = 0
-	switch i.(type) {
-	case RI:
-		ins := i.(RI)
-		executeR(ins, c)
-	case II:
-		ins := i.(II)
-		executeI(ins, c)
-	case SI:
-		ins := i.(SI)
-		executeS(ins, c)
-	case BI:
-		ins := i.(BI)
-		executeB(ins, c)
-	case JI:
-		ins := i.(JI)
-		executeJ(ins, c)
-	case UI:
-		ins := i.(UI)
-		executeU(ins, c)
-	case FI:
-		ins := i.(FI)
-		executeF(ins, c)
-	}
+	d.exec(d, c)
+	c.Instret++
 	return nil
 }
 
 func (cpu *Cpu) HandleInterrupts(inst string) error {
-	//if inst == "wfi" && cpu.CSR.Registers[MIP] == 0 {
-	//	for {
-	//		if cpu.Memory.Uart.DataExistsToRead() && cpu.CSR.Registers[MIP] > 0 {
-	//			// trigger a plic interrupt
-	//			cpu.Memory.Plic.TriggerInterrupt(10, cpu)
-	//			break
-	//		}
-	//	}
-	// }
-	//csr := cpu.CSR
-	//mode := cpu.CurrentMode
-	//// set mcause & scause register
-	//switch mode {
-	//case 1:
-	//	csr.Registers[SCAUSE] = csr.Registers[SCAUSE] | 1<<31 | 1 // supervisor software interrupt
-	//default:
-	//	csr.Registers[MCAUSE] = csr.Registers[MCAUSE] | 1<<31 | 3 // machine software interrupt
-	//}
-	//return nil
 	// Implement only direct mode now
 
 	// Handle interrupts
@@ -78,8 +104,14 @@ func (cpu *Cpu) HandleInterrupts(inst string) error {
 	if cpu.CSR.Registers[MIE] == 0 {
 		return nil
 	}
-	status := ToMStatusReg(cpu.CSR.GetValue(MSTATUS, cpu.CurrentMode, cpu))
-	if status.mie > 0 && cpu.CSR.Registers[MIP] > 0 {
+	if cpu.handleSupervisorInterrupts() {
+		return nil
+	}
+	// Not a guest access, so no privilege check
+	status := ToMStatusReg(cpu.CSR.Registers[MSTATUS])
+	// The CLINT bits only interrupt when enabled, they stay pending while a hart runs with them masked
+	pending := cpu.CSR.Registers[MIP] &^ ((MIP_MSIP | MIP_MTIP) &^ cpu.CSR.Registers[MIE])
+	if status.mie > 0 && pending > 0 {
 		csr := cpu.CSR
 		mode := cpu.CurrentMode
 
@@ -88,6 +120,7 @@ func (cpu *Cpu) HandleInterrupts(inst string) error {
 		// This should be checked first
 		if midelegReg&uint32(1<<3) == 1 {
 			// go to supervisor trap
+			cpu.countTrap(1 << 31)
 			csr.Registers[SEPC] = cpu.PC
 			sstatus := ToMStatusReg(cpu.CSR.GetValue(SSTATUS, cpu.CurrentMode, cpu))
 			sstatus.spp = mode
@@ -101,6 +134,7 @@ func (cpu *Cpu) HandleInterrupts(inst string) error {
 			cpu.CSR.Registers[MIP] = 0
 		} else {
 			// run machine trap
+			cpu.countTrap(1 << 31)
 			csr.Registers[MEPC] = cpu.PC
 			mstatus := ToMStatusReg(cpu.CSR.GetValue(MSTATUS, cpu.CurrentMode, cpu))
 			mstatus.mpp = mode
@@ -115,10 +149,14 @@ func (cpu *Cpu) HandleInterrupts(inst string) error {
 			// Otherwise, mcause is never written by the implementation, though it may be explicitly written by software.
 			// The Interrupt bit in the mcause register is set if the trap was caused by an interrupt.
 
-			// This is a machine external interrupt, we set mcause to interrupt
-			// TODO checks for other interrupts too
-			if csr.Registers[MIP]&(1<<11) > 0 {
+			// Priority order is MEI, MSI, MTI
+			switch {
+			case pending&(1<<11) > 0:
 				csr.Registers[MCAUSE] = 1<<31 | uint32(11)
+			case pending&MIP_MSIP > 0:
+				csr.Registers[MCAUSE] = 1<<31 | uint32(3)
+			case pending&MIP_MTIP > 0:
+				csr.Registers[MCAUSE] = 1<<31 | uint32(7)
 			}
 
 			csr.Registers[MSTATUS] = FromMStatusReg(mstatus)
@@ -135,306 +173,395 @@ func (cpu *Cpu) HandleInterrupts(inst string) error {
 	return nil
 }
 
-func executeF(inst FI, c *Cpu) {
+// Interrupts delegated through mideleg are taken in S-mode, when running below S-mode or
+// in S-mode with sstatus.sie set.
+func (cpu *Cpu) handleSupervisorInterrupts() bool {
+	csr := cpu.CSR
+	pending := csr.Registers[MIP] & csr.Registers[MIE] & csr.Registers[MIDELEG]
+	if pending == 0 || cpu.CurrentMode > 1 {
+		return false
+	}
+	sstatus := ToMStatusReg(csr.Registers[SSTATUS])
+	if cpu.CurrentMode == 1 && sstatus.sie == 0 {
+		return false
+	}
+	// Priority order is SEI, SSI, STI
+	cause := uint32(9)
+	switch {
+	case pending&MIP_SEIP > 0:
+		cause = 9
+	case pending&MIP_SSIP > 0:
+		cause = 1
+	case pending&MIP_STIP > 0:
+		cause = 5
+	}
+	cpu.trapToSupervisor(1<<31|cause, 0)
+	return true
+}
+
+// Takes a trap into S-mode, cause has the interrupt bit set for interrupts
+func (cpu *Cpu) trapToSupervisor(cause uint32, tval uint32) {
+	cpu.countTrap(cause)
+	csr := cpu.CSR
+	csr.Registers[SEPC] = cpu.PC
+	csr.Registers[SCAUSE] = cause
+	csr.Registers[STVAL] = tval
+	sstatus := ToMStatusReg(csr.Registers[SSTATUS])
+	sstatus.spp = cpu.CurrentMode
+	sstatus.spie = sstatus.sie
+	sstatus.sie = 0
+	csr.Registers[SSTATUS] = FromMStatusReg(sstatus)
+	stvec := ToMtvecReg(csr.Registers[STVEC])
+	cpu.PC = stvec.base
+	// Vectored mode only applies to interrupts
+	if stvec.mode == 1 && cause&(1<<31) > 0 {
+		cpu.PC += 4 * (cause &^ (1 << 31))
+	}
+	cpu.CurrentMode = 1
+}
+
+// Takes a trap into M-mode, cause has the interrupt bit set for interrupts
+func (cpu *Cpu) trapToMachine(cause uint32, tval uint32) {
+	cpu.countTrap(cause)
+	csr := cpu.CSR
+	csr.Registers[MEPC] = cpu.PC
+	csr.Registers[MCAUSE] = cause
+	csr.Registers[MTVAL] = tval
+	mstatus := ToMStatusReg(csr.Registers[MSTATUS])
+	mstatus.mpp = cpu.CurrentMode
+	mstatus.mpie = mstatus.mie
+	mstatus.mie = 0
+	csr.Registers[MSTATUS] = FromMStatusReg(mstatus)
+	mtvec := ToMtvecReg(csr.Registers[MTVEC])
+	cpu.PC = mtvec.base
+	// Vectored mode only applies to interrupts
+	if mtvec.mode == 1 && cause&(1<<31) > 0 {
+		cpu.PC += 4 * (cause &^ (1 << 31))
+	}
+	cpu.CurrentMode = 3
+}
+
+func executeF(d *Decoded, c *Cpu) {
 	// Order memory/instruction access. We ignore them now.
-	switch inst.Operation() {
-	case "fence":
+	switch d.Op {
+	case OP_FENCE:
 		c.PC += 4
-	case "fence.i":
+	// Code may have been written, decode it again
+	case OP_FENCE_I:
+		c.Memory.FlushCode()
 		c.PC += 4
 	}
 }
 
-func executeR(inst RI, c *Cpu) {
-	switch inst.Operation() {
-	case "add":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] + c.Registers[inst.RS2]
+func executeR(d *Decoded, c *Cpu) {
+	switch d.Op {
+	case OP_ADD:
+		c.Registers[d.RD] = c.Registers[d.RS1] + c.Registers[d.RS2]
 		c.PC += 4
 
-	case "sub":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] - c.Registers[inst.RS2]
+	case OP_SUB:
+		c.Registers[d.RD] = c.Registers[d.RS1] - c.Registers[d.RS2]
 		c.PC += 4
 
-	case "xor":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] ^ c.Registers[inst.RS2]
+	case OP_XOR:
+		c.Registers[d.RD] = c.Registers[d.RS1] ^ c.Registers[d.RS2]
 		c.PC += 4
 
-	case "or":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] | c.Registers[inst.RS2]
+	case OP_OR:
+		c.Registers[d.RD] = c.Registers[d.RS1] | c.Registers[d.RS2]
 		c.PC += 4
 
-	case "and":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] & c.Registers[inst.RS2]
+	case OP_AND:
+		c.Registers[d.RD] = c.Registers[d.RS1] & c.Registers[d.RS2]
 		c.PC += 4
 
-	case "sll":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] << (c.Registers[inst.RS2] & 0x1F)
+	case OP_SLL:
+		c.Registers[d.RD] = c.Registers[d.RS1] << (c.Registers[d.RS2] & 0x1F)
 		c.PC += 4
 
-	case "srl":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] >> (c.Registers[inst.RS2] & 0x1F)
+	case OP_SRL:
+		c.Registers[d.RD] = c.Registers[d.RS1] >> (c.Registers[d.RS2] & 0x1F)
 		c.PC += 4
 
 	// Arithmetic Left shift RS1 by lower 5 bits of RS2
-	case "sra":
-		c.Registers[inst.RD] = uint32(int32(c.Registers[inst.RS1]) >> byte(c.Registers[inst.RS2]&0x1F))
+	case OP_SRA:
+		c.Registers[d.RD] = uint32(int32(c.Registers[d.RS1]) >> byte(c.Registers[d.RS2]&0x1F))
 		c.PC += 4
 
 	// Signed compare
-	case "slt":
-		if int32(c.Registers[inst.RS1]) < int32(c.Registers[inst.RS2]) {
-			c.Registers[inst.RD] = 1
+	case OP_SLT:
+		if int32(c.Registers[d.RS1]) < int32(c.Registers[d.RS2]) {
+			c.Registers[d.RD] = 1
 		} else {
-			c.Registers[inst.RD] = 0
+			c.Registers[d.RD] = 0
 		}
 		c.PC += 4
 
 	// Unsigned compare
-	case "sltu":
-		if c.Registers[inst.RS1] < c.Registers[inst.RS2] {
-			c.Registers[inst.RD] = 1
+	case OP_SLTU:
+		if c.Registers[d.RS1] < c.Registers[d.RS2] {
+			c.Registers[d.RD] = 1
 		} else {
-			c.Registers[inst.RD] = 0
+			c.Registers[d.RD] = 0
 		}
 		c.PC += 4
 	// Atomic Instructions
-	case "lr.w":
-		c.Registers[inst.RD] = c.Memory.ReadWord(c.Registers[inst.RS1])
+	case OP_LR_W:
+		c.Registers[d.RD] = c.loadWord(c.Registers[d.RS1])
 		c.AtomicReserved = true
+		c.Reservation = c.Registers[d.RS1]
 		c.PC += 4
-	case "sc.w":
-		if c.AtomicReserved {
-			c.Memory.WriteWord(c.Registers[inst.RS2], c.Registers[inst.RS1])
-			c.Registers[inst.RD] = 0
+	case OP_SC_W:
+		if c.AtomicReserved && c.Reservation == c.Registers[d.RS1] {
+			c.storeWord(c.Registers[d.RS2], c.Registers[d.RS1])
+			c.Registers[d.RD] = 0
 		} else {
-			c.Registers[inst.RD] = 1
+			c.Registers[d.RD] = 1
 		}
 		c.AtomicReserved = false
 		c.PC += 4
-	case "amoswap.w":
-		c.Registers[inst.RD] = c.Memory.ReadWord(c.Registers[inst.RS1])
-		c.Memory.WriteWord(c.Registers[inst.RS2], c.Registers[inst.RS1])
+	case OP_AMOSWAP_W:
+		c.Registers[d.RD] = c.loadWord(c.Registers[d.RS1])
+		c.storeWord(c.Registers[d.RS2], c.Registers[d.RS1])
 		c.PC += 4
-	case "amoadd.w":
-		c.Registers[inst.RD] = c.Memory.ReadWord(c.Registers[inst.RS1])
-		c.Memory.WriteWord(c.Registers[inst.RS2]+c.Registers[inst.RD], c.Registers[inst.RS1])
+	case OP_AMOADD_W:
+		c.Registers[d.RD] = c.loadWord(c.Registers[d.RS1])
+		c.storeWord(c.Registers[d.RS2]+c.Registers[d.RD], c.Registers[d.RS1])
 		c.PC += 4
-	case "amoand.w":
-		c.Registers[inst.RD] = c.Memory.ReadWord(c.Registers[inst.RS1])
-		c.Memory.WriteWord(c.Registers[inst.RS2]&c.Registers[inst.RD], c.Registers[inst.RS1])
+	case OP_AMOAND_W:
+		c.Registers[d.RD] = c.loadWord(c.Registers[d.RS1])
+		c.storeWord(c.Registers[d.RS2]&c.Registers[d.RD], c.Registers[d.RS1])
 		c.PC += 4
-	case "amoor.w":
-		c.Registers[inst.RD] = c.Memory.ReadWord(c.Registers[inst.RS1])
-		c.Memory.WriteWord(c.Registers[inst.RS2]|c.Registers[inst.RD], c.Registers[inst.RS1])
+	case OP_AMOOR_W:
+		c.Registers[d.RD] = c.loadWord(c.Registers[d.RS1])
+		c.storeWord(c.Registers[d.RS2]|c.Registers[d.RD], c.Registers[d.RS1])
 		c.PC += 4
-	case "amoxor.w":
-		c.Registers[inst.RD] = c.Memory.ReadWord(c.Registers[inst.RS1])
-		c.Memory.WriteWord(c.Registers[inst.RS2]^c.Registers[inst.RD], c.Registers[inst.RS1])
+	case OP_AMOXOR_W:
+		c.Registers[d.RD] = c.loadWord(c.Registers[d.RS1])
+		c.storeWord(c.Registers[d.RS2]^c.Registers[d.RD], c.Registers[d.RS1])
 		c.PC += 4
-	case "amomax.w":
-		c.Registers[inst.RD] = c.Memory.ReadWord(c.Registers[inst.RS1])
-		c.Memory.WriteWord(uint32(max(int32(c.Registers[inst.RS2]), int32(c.Registers[inst.RD]))), c.Registers[inst.RS1])
+	case OP_AMOMAX_W:
+		c.Registers[d.RD] = c.loadWord(c.Registers[d.RS1])
+		c.storeWord(uint32(max(int32(c.Registers[d.RS2]), int32(c.Registers[d.RD]))), c.Registers[d.RS1])
 		c.PC += 4
-	case "amomin.w":
-		c.Registers[inst.RD] = c.Memory.ReadWord(c.Registers[inst.RS1])
-		c.Memory.WriteWord(uint32(min(int32(c.Registers[inst.RS2]), int32(c.Registers[inst.RD]))), c.Registers[inst.RS1])
+	case OP_AMOMIN_W:
+		c.Registers[d.RD] = c.loadWord(c.Registers[d.RS1])
+		c.storeWord(uint32(min(int32(c.Registers[d.RS2]), int32(c.Registers[d.RD]))), c.Registers[d.RS1])
 		c.PC += 4
-	case "amomaxu.w":
-		c.Registers[inst.RD] = c.Memory.ReadWord(c.Registers[inst.RS1])
-		c.Memory.WriteWord(max(c.Registers[inst.RS2], c.Registers[inst.RD]), c.Registers[inst.RS1])
+	case OP_AMOMAXU_W:
+		c.Registers[d.RD] = c.loadWord(c.Registers[d.RS1])
+		c.storeWord(max(c.Registers[d.RS2], c.Registers[d.RD]), c.Registers[d.RS1])
 		c.PC += 4
-	case "amominu.w":
-		c.Registers[inst.RD] = c.Memory.ReadWord(c.Registers[inst.RS1])
-		c.Memory.WriteWord(min(c.Registers[inst.RS2], c.Registers[inst.RD]), c.Registers[inst.RS1])
+	case OP_AMOMINU_W:
+		c.Registers[d.RD] = c.loadWord(c.Registers[d.RS1])
+		c.storeWord(min(c.Registers[d.RS2], c.Registers[d.RD]), c.Registers[d.RS1])
 		c.PC += 4
 		// Multiply Instructions
-	case "mul":
-		c.Registers[inst.RD] = uint32(int32(c.Registers[inst.RS1]) * int32(c.Registers[inst.RS2]))
+	case OP_MUL:
+		c.Registers[d.RD] = uint32(int32(c.Registers[d.RS1]) * int32(c.Registers[d.RS2]))
 		c.PC += 4
-	case "mulh":
-		c.Registers[inst.RD] = uint32(int64(int32(c.Registers[inst.RS1])) * int64(int32(c.Registers[inst.RS2])) >> 32)
+	case OP_MULH:
+		c.Registers[d.RD] = uint32(int64(int32(c.Registers[d.RS1])) * int64(int32(c.Registers[d.RS2])) >> 32)
 		c.PC += 4
-	case "mulhsu":
+	case OP_MULHSU:
 		// RS2 is unsigned and RS1 is signed
-		c.Registers[inst.RD] = uint32(uint64(int32(c.Registers[inst.RS1])) * uint64(c.Registers[inst.RS2]) >> 32)
+		c.Registers[d.RD] = uint32(uint64(int32(c.Registers[d.RS1])) * uint64(c.Registers[d.RS2]) >> 32)
 		c.PC += 4
-	case "mulhu":
-		c.Registers[inst.RD] = uint32(uint64(c.Registers[inst.RS1]) * uint64(c.Registers[inst.RS2]) >> 32)
+	case OP_MULHU:
+		c.Registers[d.RD] = uint32(uint64(c.Registers[d.RS1]) * uint64(c.Registers[d.RS2]) >> 32)
 		c.PC += 4
-	case "div":
-		c.Registers[inst.RD] = uint32(int32(c.Registers[inst.RS1]) / int32(c.Registers[inst.RS2]))
+	case OP_DIV:
+		c.Registers[d.RD] = uint32(int32(c.Registers[d.RS1]) / int32(c.Registers[d.RS2]))
 		c.PC += 4
-	case "divu":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] / c.Registers[inst.RS2]
+	case OP_DIVU:
+		c.Registers[d.RD] = c.Registers[d.RS1] / c.Registers[d.RS2]
 		c.PC += 4
-	case "rem":
-		c.Registers[inst.RD] = uint32(int32(c.Registers[inst.RS1]) % int32(c.Registers[inst.RS2]))
+	case OP_REM:
+		c.Registers[d.RD] = uint32(int32(c.Registers[d.RS1]) % int32(c.Registers[d.RS2]))
 		c.PC += 4
-	case "remu":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] % c.Registers[inst.RS2]
+	case OP_REMU:
+		c.Registers[d.RD] = c.Registers[d.RS1] % c.Registers[d.RS2]
 		c.PC += 4
 	}
 }
 
-func executeI(inst II, c *Cpu) {
-	switch inst.Operation() {
-	case "addi":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] + uint32(int32(uint32(inst.IIM)<<20)>>20)
+func executeI(d *Decoded, c *Cpu) {
+	switch d.Op {
+	case OP_ADDI:
+		c.Registers[d.RD] = c.Registers[d.RS1] + d.Imm
 		c.PC += 4
 
-	case "xori":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] ^ uint32(int16(inst.IIM<<4)>>4)
+	case OP_XORI:
+		c.Registers[d.RD] = c.Registers[d.RS1] ^ d.Imm
 		c.PC += 4
 
-	case "ori":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] | uint32(int16(inst.IIM<<4)>>4)
+	case OP_ORI:
+		c.Registers[d.RD] = c.Registers[d.RS1] | d.Imm
 		c.PC += 4
 
-	case "andi":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] & uint32(int32(uint32(inst.IIM)<<20)>>20)
+	case OP_ANDI:
+		c.Registers[d.RD] = c.Registers[d.RS1] & d.Imm
 		c.PC += 4
 
 	// Shifts should use only last 6 bits
-	case "slli":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] << (uint32(inst.IIM) & 0x1F)
+	case OP_SLLI:
+		c.Registers[d.RD] = c.Registers[d.RS1] << (d.Imm & 0x1F)
 		c.PC += 4
 
-	case "srli":
-		c.Registers[inst.RD] = c.Registers[inst.RS1] >> (uint32(inst.IIM) & 0x1F)
+	case OP_SRLI:
+		c.Registers[d.RD] = c.Registers[d.RS1] >> (d.Imm & 0x1F)
 		c.PC += 4
 
 	// Arithmetic Shift, Golang does arithmetic shifts(msb-ext) for signed and logical for unsigned(zero-ext)
-	case "srai":
+	case OP_SRAI:
 		// We need bottom 5 bits only
-		c.Registers[inst.RD] = uint32(int32(c.Registers[inst.RS1]) >> ((inst.IIM << 11) >> 11))
+		c.Registers[d.RD] = uint32(int32(c.Registers[d.RS1]) >> (d.Imm & 0x1F))
 		c.PC += 4
 
-	case "slti":
+	case OP_SLTI:
 		// Signed value
-		if int32(c.Registers[inst.RS1]) < int32(int16(inst.IIM<<4)>>4) {
-			c.Registers[inst.RD] = 1
+		if int32(c.Registers[d.RS1]) < int32(d.Imm) {
+			c.Registers[d.RD] = 1
 		} else {
-			c.Registers[inst.RD] = 0
+			c.Registers[d.RD] = 0
 		}
 		c.PC += 4
 
-	case "sltiu":
-		if c.Registers[inst.RS1] < uint32(int16(inst.IIM<<4)>>4) {
-			c.Registers[inst.RD] = 1
+	case OP_SLTIU:
+		if c.Registers[d.RS1] < d.Imm {
+			c.Registers[d.RD] = 1
 		} else {
-			c.Registers[inst.RD] = 0
+			c.Registers[d.RD] = 0
 		}
 		c.PC += 4
 
 	// All Load ones are signed offsets
-	case "lb":
-		rdi := int32(c.Registers[inst.RS1]) + int32(int16(inst.IIM<<4)>>4)
-		c.Registers[inst.RD] = uint32(int8(c.Memory.ReadByte(uint32(rdi))))
+	case OP_LB:
+		rdi := int32(c.Registers[d.RS1]) + int32(d.Imm)
+		c.Registers[d.RD] = uint32(int8(c.loadByte(uint32(rdi))))
 		c.PC += 4
 
 	// All Load ones are signed offsets
-	case "lh":
-		rdi := int32(c.Registers[inst.RS1]) + int32(int16(inst.IIM<<4)>>4)
-		c.Registers[inst.RD] = uint32(int16(uint16(c.Memory.ReadByte(uint32(rdi))) | (uint16(c.Memory.ReadByte(uint32(rdi+1))) << 8)))
+	case OP_LH:
+		rdi := int32(c.Registers[d.RS1]) + int32(d.Imm)
+		c.Registers[d.RD] = uint32(int16(uint16(c.Memory.ReadByte(uint32(rdi))) | (uint16(c.Memory.ReadByte(uint32(rdi+1))) << 8)))
+		c.access(uint32(rdi), 2, c.Registers[d.RD]&0xFFFF, false)
 		c.PC += 4
 
 	// All Load ones are signed offsets
-	case "lw":
-		rdi := int32(c.Registers[inst.RS1]) + int32(int16(inst.IIM<<4)>>4)
-		c.Registers[inst.RD] = c.Memory.ReadWord(uint32(rdi))
+	case OP_LW:
+		rdi := int32(c.Registers[d.RS1]) + int32(d.Imm)
+		c.Registers[d.RD] = c.loadWord(uint32(rdi))
 		c.PC += 4
 
 	// All Load ones are signed offsets
-	case "lbu":
-		rdi := c.Registers[inst.RS1] + uint32(int16(inst.IIM<<4)>>4)
-		c.Registers[inst.RD] = uint32(c.Memory.ReadByte(rdi))
+	case OP_LBU:
+		rdi := c.Registers[d.RS1] + d.Imm
+		c.Registers[d.RD] = uint32(c.loadByte(rdi))
 		c.PC += 4
 
 	// All Load ones are signed offsets
-	case "lhu":
-		rdi := c.Registers[inst.RS1] + uint32(int16(inst.IIM<<4)>>4)
+	case OP_LHU:
+		rdi := c.Registers[d.RS1] + d.Imm
 		k1 := uint32(c.Memory.ReadByte(rdi))
 		k2 := (uint32(c.Memory.ReadByte(rdi+1)) << 8)
 		k := k1 | k2
-		c.Registers[inst.RD] = k
+		c.access(rdi, 2, k, false)
+		c.Registers[d.RD] = k
 		c.PC += 4
 
-	case "jalr":
+	case OP_JALR:
 		// This is required because RS1 and RD can be same register
-		oldV := c.Registers[inst.RS1]
-		c.Registers[inst.RD] = c.PC + 4
-		c.PC = oldV + uint32(int16(inst.IIM<<4)>>4)
-
-	case "ecall":
-		if os.Getenv("MODE") == "test" || true {
-			if c.Registers[10] == 42 || c.Registers[10] == 0 {
-				fmt.Fprintln(os.Stdout, fmt.Sprintf("Test Succeeded"))
-			} else {
-				fmt.Fprintln(os.Stdout, fmt.Sprintf("Ecall: testId: %d, Failed", c.Registers[3]))
+		oldV := c.Registers[d.RS1]
+		c.Registers[d.RD] = c.PC + 4
+		c.PC = oldV + d.Imm
+
+	case OP_ECALL:
+		if c.Sbi != nil {
+			switch c.CurrentMode {
+			case 1:
+				// Environment call from S-mode, taken by the firmware
+				c.countTrap(9)
+				c.Sbi.Ecall(c)
+				c.PC += 4
+			// Environment call from U-mode is delegated to the kernel
+			case 0:
+				c.trapToSupervisor(8, 0)
+			// Environment call from M-mode goes to the guest's own M-mode handler
+			default:
+				c.trapToMachine(11, 0)
 			}
-			os.Exit(0)
+			return
+		}
+		// Bare metal tests end with an ecall, a0 is 0 or 42 on success and gp holds the failed test.
+		// The run loop stops like on a power off, failures exit with the riscv-tests code gp<<1|1.
+		c.Memory.Syscon.Requested = true
+		if c.Registers[10] == 42 || c.Registers[10] == 0 {
+			fmt.Fprintln(os.Stdout, "Test Succeeded")
+			c.Memory.Syscon.ExitCode = 0
+		} else {
+			fmt.Fprintf(os.Stdout, "Ecall: testId: %d, Failed\n", c.Registers[3])
+			c.Memory.Syscon.ExitCode = int(c.Registers[3]<<1 | 1)
 		}
-		// If not in test mode Switch context to OS
-		c.PC += 4
 
-	case "ebreak":
+	case OP_EBREAK:
 		// Switch access to Debugger
 		c.PC += 4
 
-	case "csrrw":
+	case OP_CSRRW:
 		// Ignore reading values / registers twice
-		xs := c.Registers[inst.RS1]
-		c.Registers[inst.RD] = c.CSR.GetValue(uint32(inst.IIM), c.CurrentMode, c)
-		c.CSR.SetValue(uint32(inst.IIM), xs, c.CurrentMode, c)
+		xs := c.Registers[d.RS1]
+		c.Registers[d.RD] = c.CSR.GetValue(d.Imm, c.CurrentMode, c)
+		c.CSR.SetValue(d.Imm, xs, c.CurrentMode, c)
 		c.PC += 4
 
 	// For all i or immediate instructions for csr RD is a 5 bit field
-	case "csrrwi":
-		c.Registers[inst.RD] = c.CSR.GetValue(uint32(inst.IIM), c.CurrentMode, c)
-		c.CSR.SetValue(uint32(inst.IIM), uint32(inst.RS1), c.CurrentMode, c)
+	case OP_CSRRWI:
+		c.Registers[d.RD] = c.CSR.GetValue(d.Imm, c.CurrentMode, c)
+		c.CSR.SetValue(d.Imm, uint32(d.RS1), c.CurrentMode, c)
 		c.PC += 4
 
-	case "csrrs":
+	case OP_CSRRS:
 		// We need more checks here to see if we can indeed modify the registers based on privilege level
 		// at which processor is working
-		kk := c.CSR.GetValue(uint32(inst.IIM), c.CurrentMode, c)
-		csrExisting := c.CSR.GetValue(uint32(inst.IIM), c.CurrentMode, c)
-		csrBitmask := c.Registers[inst.RS1]
-		c.CSR.SetValue(uint32(inst.IIM), csrBitmask|csrExisting, c.CurrentMode, c)
-		c.Registers[inst.RD] = kk
+		kk := c.CSR.GetValue(d.Imm, c.CurrentMode, c)
+		csrExisting := c.CSR.GetValue(d.Imm, c.CurrentMode, c)
+		csrBitmask := c.Registers[d.RS1]
+		c.CSR.SetValue(d.Imm, csrBitmask|csrExisting, c.CurrentMode, c)
+		c.Registers[d.RD] = kk
 		c.PC += 4
 
-	case "csrrsi":
+	case OP_CSRRSI:
 		// We need more checks here to see if we can indeed modify the registers based on privilege level
 		// at which processor is working
-		kk := c.CSR.GetValue(uint32(inst.IIM), c.CurrentMode, c)
+		kk := c.CSR.GetValue(d.Imm, c.CurrentMode, c)
 		// RS1 has the immediate values
-		csrExisting := c.CSR.GetValue(uint32(inst.IIM), c.CurrentMode, c)
-		csrBitmask := uint32(inst.RS1)
-		c.CSR.SetValue(uint32(inst.IIM), csrBitmask|csrExisting, c.CurrentMode, c)
-		c.Registers[inst.RD] = kk
+		csrExisting := c.CSR.GetValue(d.Imm, c.CurrentMode, c)
+		csrBitmask := uint32(d.RS1)
+		c.CSR.SetValue(d.Imm, csrBitmask|csrExisting, c.CurrentMode, c)
+		c.Registers[d.RD] = kk
 		c.PC += 4
 
-	case "csrrc":
+	case OP_CSRRC:
 		// We need more checks here to see if we can indeed modify the registers based on privilege level
 		// at which processor is working
-		kk := c.CSR.GetValue(uint32(inst.IIM), c.CurrentMode, c)
-		csrExisting := c.CSR.GetValue(uint32(inst.IIM), c.CurrentMode, c)
-		csrBitmask := c.Registers[inst.RS1]
-		c.CSR.SetValue(uint32(inst.IIM), csrExisting & ^csrBitmask, c.CurrentMode, c)
-		c.Registers[inst.RD] = kk
+		kk := c.CSR.GetValue(d.Imm, c.CurrentMode, c)
+		csrExisting := c.CSR.GetValue(d.Imm, c.CurrentMode, c)
+		csrBitmask := c.Registers[d.RS1]
+		c.CSR.SetValue(d.Imm, csrExisting & ^csrBitmask, c.CurrentMode, c)
+		c.Registers[d.RD] = kk
 		c.PC += 4
 
-	case "csrrci":
+	case OP_CSRRCI:
 		// We need more checks here to see if we can indeed modify the registers based on privilege level
 		// at which processor is working
-		kk := c.CSR.GetValue(uint32(inst.IIM), c.CurrentMode, c)
-		csrExisting := c.CSR.GetValue(uint32(inst.IIM), c.CurrentMode, c)
-		csrBitmask := uint32(inst.RS1)
-		c.CSR.SetValue(uint32(inst.IIM), csrExisting & ^csrBitmask, c.CurrentMode, c)
-		c.Registers[inst.RD] = kk
+		kk := c.CSR.GetValue(d.Imm, c.CurrentMode, c)
+		csrExisting := c.CSR.GetValue(d.Imm, c.CurrentMode, c)
+		csrBitmask := uint32(d.RS1)
+		c.CSR.SetValue(d.Imm, csrExisting & ^csrBitmask, c.CurrentMode, c)
+		c.Registers[d.RD] = kk
 		c.PC += 4
-	case "sret":
+	case OP_SRET:
 		statusReg := ToMStatusReg(c.CSR.GetValue(SSTATUS, c.CurrentMode, c))
 		statusReg.sie = statusReg.spie
 		// restore mode of processor
@@ -445,7 +572,7 @@ func executeI(inst II, c *Cpu) {
 		c.CSR.Registers[SSTATUS] = FromMStatusReg(statusReg)
 		// change return PC
 		c.PC = c.CSR.Registers[SEPC]
-	case "mret":
+	case OP_MRET:
 		statusReg := ToMStatusReg(c.CSR.GetValue(MSTATUS, c.CurrentMode, c))
 		statusRegTmp := statusReg
 		statusReg.mie = statusReg.mpie
@@ -464,103 +591,97 @@ func executeI(inst II, c *Cpu) {
 		(fmt.Sprintf("after tmp %x, mstatus %x, from csr:%x from mstatus: %x", FromMStatusReg(statusRegTmp), c.CSR.Registers[MSTATUS], c.CSR.GetValue(MSTATUS, c.CurrentMode, c), tmp))
 		// change return PC
 		c.PC = c.CSR.Registers[MEPC]
-	case "sfence.vma":
+	case OP_SFENCE_VMA:
 		// nop operation
 		c.PC += 4
-	case "wfi":
-		// Wait until interrupt comes
-		// Check for interrupts from PLIC in a loop here
-		for {
-			if c.Memory.Uart.DataExistsToRead() && c.CSR.Registers[MIE] > 0 {
-				// trigger a plic interrupt
-				c.Memory.Plic.TriggerInterrupt(10, c)
-				c.PC += 4
-				break
-			}
-		}
-		// If nothing then simply wait
+	case OP_WFI:
+		// Only a hint, the run loop lets the hart wait till an interrupt it enables is pending
+		c.Waiting = true
+		c.PC += 4
 	default:
 		panic("running instruction failed")
 	}
 }
 
-func executeS(inst SI, c *Cpu) {
-	switch inst.Operation() {
+func executeS(d *Decoded, c *Cpu) {
+	switch d.Op {
 	// All Store ones are signed offsets
-	case "sb":
-		c.Memory.WriteByte(byte(c.Registers[int(inst.RS2)]&uint32(0xFF)), c.Registers[int(inst.RS1)]+uint32(int16(inst.SIM<<4)>>4))
+	case OP_SB:
+		c.Memory.WriteByte(byte(c.Registers[d.RS2]&uint32(0xFF)), c.Registers[d.RS1]+d.Imm)
+		c.access(c.Registers[d.RS1]+d.Imm, 1, c.Registers[d.RS2]&0xFF, true)
 		c.PC += 4
 
 	// All Store ones are signed offsets
-	case "sh":
-		c.Memory.WriteByte(byte(c.Registers[int(inst.RS2)]&uint32(0xFF)), c.Registers[int(inst.RS1)]+uint32(int16(inst.SIM<<4)>>4))
-		c.Memory.WriteByte(byte((c.Registers[int(inst.RS2)]&uint32(0xFF00))>>8), c.Registers[int(inst.RS1)]+uint32(int16(inst.SIM<<4)>>4)+1)
+	case OP_SH:
+		c.Memory.WriteByte(byte(c.Registers[d.RS2]&uint32(0xFF)), c.Registers[d.RS1]+d.Imm)
+		c.Memory.WriteByte(byte((c.Registers[d.RS2]&uint32(0xFF00))>>8), c.Registers[d.RS1]+d.Imm+1)
+		c.access(c.Registers[d.RS1]+d.Imm, 2, c.Registers[d.RS2]&0xFFFF, true)
 		c.PC += 4
 
-	case "sw":
-		location := c.Registers[int(inst.RS1)] + uint32(int16(inst.SIM<<4)>>4)
-		c.Memory.WriteWord(c.Registers[int(inst.RS2)], location)
+	case OP_SW:
+		location := c.Registers[d.RS1] + d.Imm
+		c.storeWord(c.Registers[d.RS2], location)
 		c.PC += 4
 	}
 }
 
-func executeB(inst BI, c *Cpu) {
-	switch inst.Operation() {
-	case "beq":
-		if c.Registers[inst.RS1] == c.Registers[inst.RS2] {
-			c.PC += uint32(int16(inst.BIM<<4) >> 4)
+func executeB(d *Decoded, c *Cpu) {
+	switch d.Op {
+	case OP_BEQ:
+		if c.Registers[d.RS1] == c.Registers[d.RS2] {
+			c.PC += d.Imm
 		} else {
 			c.PC += 4
 		}
-	case "bne":
-		if c.Registers[inst.RS1] != c.Registers[inst.RS2] {
-			c.PC += uint32(int16(inst.BIM<<4) >> 4)
+	case OP_BNE:
+		if c.Registers[d.RS1] != c.Registers[d.RS2] {
+			c.PC += d.Imm
 		} else {
 			c.PC += 4
 		}
-	case "blt":
-		if int32(c.Registers[inst.RS1]) < int32(c.Registers[inst.RS2]) {
-			c.PC = c.PC + uint32(int16(inst.BIM<<4)>>4)
+	case OP_BLT:
+		if int32(c.Registers[d.RS1]) < int32(c.Registers[d.RS2]) {
+			c.PC = c.PC + d.Imm
 		} else {
 			c.PC += 4
 		}
-	case "bge":
-		if int32(c.Registers[inst.RS1]) >= int32(c.Registers[inst.RS2]) {
-			c.PC = c.PC + uint32(int16(inst.BIM<<4)>>4)
+	case OP_BGE:
+		if int32(c.Registers[d.RS1]) >= int32(c.Registers[d.RS2]) {
+			c.PC = c.PC + d.Imm
 		} else {
 			c.PC += 4
 		}
-	case "bltu":
-		if c.Registers[inst.RS1] < c.Registers[inst.RS2] {
-			c.PC = c.PC + uint32(int16(inst.BIM<<4)>>4)
+	case OP_BLTU:
+		if c.Registers[d.RS1] < c.Registers[d.RS2] {
+			c.PC = c.PC + d.Imm
 		} else {
 			c.PC += 4
 		}
-	case "bgeu":
-		if c.Registers[inst.RS1] >= c.Registers[inst.RS2] {
-			c.PC = c.PC + uint32(int16(inst.BIM<<4)>>4)
+	case OP_BGEU:
+		if c.Registers[d.RS1] >= c.Registers[d.RS2] {
+			c.PC = c.PC + d.Imm
 		} else {
 			c.PC += 4
 		}
 	}
 }
 
-func executeJ(inst JI, c *Cpu) {
-	switch inst.Operation() {
-	case "jal":
-		c.Registers[inst.RD] = c.PC + 4
-		c.PC += uint32(int32(inst.JIM<<12) >> 12)
+func executeJ(d *Decoded, c *Cpu) {
+	switch d.Op {
+	case OP_JAL:
+		c.Registers[d.RD] = c.PC + 4
+		c.PC += d.Imm
 	}
 }
 
 // Immediate value not sign extended, all others are sign extended
-func executeU(inst UI, c *Cpu) {
-	switch inst.Operation() {
-	case "lui":
-		c.Registers[inst.RD] = inst.UIM1 << 12
+func executeU(d *Decoded, c *Cpu) {
+	switch d.Op {
+	case OP_LUI:
+		c.Registers[d.RD] = d.Imm
 		c.PC += 4
-	case "auipc":
-		c.Registers[inst.RD] = c.PC + uint32(int32(inst.UIM1<<12))
+	case OP_AUIPC:
+		c.Registers[d.RD] = c.PC + d.Imm
 		c.PC += 4
 	}
 }
@@ -0,0 +1,119 @@
+package instructions
+
+// Decoded is an instruction decoded once to be executed many times. The operands are taken out of the
+// instruction and the immediate is sign extended the way the operation uses it.
+type Decoded struct {
+	Inst Inst
+	// Operation of Inst
+	Name string
+	Op   Op
+	Word uint32
+	RD   byte
+	RS1  byte
+	RS2  byte
+	// CSR number for CSR instructions
+	Imm uint32
+	// executeR, executeI, ... for the format of Inst
+	exec func(d *Decoded, c *Cpu)
+}
+
+// Predecode decodes the operation and operands of an instruction, it panics on unknown operations
+// like Operation does
+func Predecode(i Inst) *Decoded {
+	name := i.Operation()
+	d := &Decoded{Inst: i, Name: name, Op: opByName[name]}
+	switch i := i.(type) {
+	case RI:
+		d.RD, d.RS1, d.RS2 = i.RD, i.RS1, i.RS2
+		d.exec = executeR
+	case II:
+		d.RD, d.RS1 = i.RD, i.RS1
+		d.Imm = uint32(int32(uint32(i.IIM)<<20) >> 20)
+		if d.Op >= OP_CSRRW && d.Op <= OP_CSRRCI {
+			d.Imm = uint32(i.IIM)
+		}
+		d.exec = executeI
+	case SI:
+		d.RS1, d.RS2 = i.RS1, i.RS2
+		d.Imm = uint32(int16(i.SIM<<4) >> 4)
+		d.exec = executeS
+	case BI:
+		d.RS1, d.RS2 = i.RS1, i.RS2
+		d.Imm = uint32(int16(i.BIM<<4) >> 4)
+		d.exec = executeB
+	case JI:
+		d.RD = i.RD
+		d.Imm = uint32(int32(i.JIM<<12) >> 12)
+		d.exec = executeJ
+	case UI:
+		d.RD = i.RD
+		d.Imm = i.UIM1 << 12
+		d.exec = executeU
+	case FI:
+		d.RD, d.RS1 = i.RD, i.RS1
+		d.exec = executeF
+	}
+	return d
+}
+
+// Decoded instructions are kept per page of code, a store only drops the instruction it overwrites
+const CODE_PAGE_SIZE = 4096
+
+type codePage struct {
+	insts [CODE_PAGE_SIZE / 4]*Decoded
+	// Blocks starting in the page, they end in it too
+	blocks []*Block
+}
+
+// Fetch returns the instruction at pc, decoded when it runs for the first time. A zero word is returned
+// without Inst, it is no instruction.
+func (m *Memory) Fetch(pc uint32) *Decoded {
+	if pc%4 != 0 {
+		return m.decode(pc)
+	}
+	if m.code == nil {
+		m.code = make(map[uint32]*codePage)
+	}
+	page := m.code[pc/CODE_PAGE_SIZE]
+	if page == nil {
+		page = new(codePage)
+		m.code[pc/CODE_PAGE_SIZE] = page
+	}
+	slot := pc % CODE_PAGE_SIZE / 4
+	if page.insts[slot] == nil {
+		page.insts[slot] = m.decode(pc)
+	}
+	return page.insts[slot]
+}
+
+func (m *Memory) decode(pc uint32) *Decoded {
+	b := [4]byte{m.ReadByte(pc), m.ReadByte(pc + 1), m.ReadByte(pc + 2), m.ReadByte(pc + 3)}
+	word := TransformLittleToBig(b)
+	if word == 0 {
+		return &Decoded{}
+	}
+	d := Predecode(DecodeBytes(b))
+	d.Word = word
+	return d
+}
+
+// invalidate drops the decoded instruction a byte written at location belongs to, and the blocks with it
+func (m *Memory) invalidate(location uint32) {
+	page := m.code[location/CODE_PAGE_SIZE]
+	if page == nil {
+		return
+	}
+	page.insts[location%CODE_PAGE_SIZE/4] = nil
+	if len(page.blocks) > 0 {
+		page.blocks = m.dropBlocks(page.blocks, location)
+	}
+}
+
+// FlushCode drops all decoded instructions and blocks
+func (m *Memory) FlushCode() {
+	for _, b := range m.blocks {
+		b.valid = false
+	}
+	m.code = nil
+	m.blocks = nil
+}
@@ -0,0 +1,63 @@
+package instructions
+
+import "testing"
+
+func TestPredecodeImmediates(t *testing.T) {
+	tests := []struct {
+		inst uint32
+		op   Op
+		imm  uint32
+	}{
+		// addi a0, a0, -1
+		{0xFFF50513, OP_ADDI, 0xFFFFFFFF},
+		// csrrs a0, mstatus, zero
+		{0x30002573, OP_CSRRS, MSTATUS},
+		// sw a0, -4(sp)
+		{0xFEA12E23, OP_SW, 0xFFFFFFFC},
+		// jal ra, -8
+		{0xFF9FF0EF, OP_JAL, 0xFFFFFFF8},
+		// lui a0, 0x80000
+		{0x80000537, OP_LUI, 0x80000000},
+	}
+	for _, test := range tests {
+		b := [4]byte{byte(test.inst), byte(test.inst >> 8), byte(test.inst >> 16), byte(test.inst >> 24)}
+		d := Predecode(DecodeBytes(b))
+		if d.Op != test.op || d.Imm != test.imm {
+			t.Errorf("%08x: Expected %s %x, Got %s %x", test.inst, test.op, test.imm, d.Op, d.Imm)
+		}
+		if d.Name != test.op.String() {
+			t.Errorf("%08x: Expected name %s, Got %s", test.inst, test.op, d.Name)
+		}
+	}
+}
+
+func TestFetchInvalidation(t *testing.T) {
+	m := &Memory{Map: make(map[uint32]byte)}
+	// addi a0, zero, 1 followed by addi a0, zero, 2
+	_ = m.LoadBytes([]byte{0x13, 0x05, 0x10, 0x00, 0x13, 0x05, 0x20, 0x00}, 0x80000000)
+
+	first := m.Fetch(0x80000000)
+	if first.Imm != 1 || m.Fetch(0x80000000) != first {
+		t.Fatalf("Expected the decoded instruction to be cached")
+	}
+	second := m.Fetch(0x80000004)
+
+	// addi a0, zero, 3
+	m.WriteWord(0x00300513, 0x80000000)
+	if d := m.Fetch(0x80000000); d.Imm != 3 {
+		t.Errorf("Expected the store to drop the instruction, Got imm %d", d.Imm)
+	}
+	if m.Fetch(0x80000004) != second {
+		t.Errorf("Expected the next instruction to stay cached")
+	}
+
+	// Written behind the back of the cache, like a DMA would
+	m.Map[0x80000006] = 0x40
+	if d := m.Fetch(0x80000004); d.Imm != 2 {
+		t.Errorf("Expected the stale instruction before the flush, Got imm %d", d.Imm)
+	}
+	m.FlushCode()
+	if d := m.Fetch(0x80000004); d.Imm != 4 {
+		t.Errorf("Expected imm 4 after the flush, Got %d", d.Imm)
+	}
+}
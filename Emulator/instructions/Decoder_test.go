@@ -190,3 +190,17 @@ func TestDecoderInstructions(t *testing.T) {
 
 	}
 }
+
+func BenchmarkDecodeBytes(b *testing.B) {
+	words := [][4]byte{
+		{0x13, 0x01, 0x01, 0xff}, // addi sp, sp, -16
+		{0x23, 0x20, 0x81, 0x00}, // sw s0, 0(sp)
+		{0x03, 0x25, 0x01, 0x00}, // lw a0, 0(sp)
+		{0xb3, 0x45, 0x85, 0x00}, // xor a1, a0, s0
+		{0xe3, 0x10, 0x04, 0xfe}, // bnez s0, -32
+		{0x6f, 0xf0, 0xdf, 0xfd}, // j -36
+	}
+	for i := 0; i < b.N; i++ {
+		_ = DecodeBytes(words[i%len(words)]).Operation()
+	}
+}
@@ -0,0 +1,206 @@
+package instructions
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Goldfish events device, a keyboard and pointer Linux drives with goldfish_events
+// (compatible "google,goldfish-events-keypad"). QEMU virt has none, it sits after the RTC.
+// Each event is read as three words from EVENTS_READ: type, code and value, like a Linux input_event.
+// The interrupt line stays high as long as events are waiting.
+const VIRT_EVENTS = 0x102000
+const VIRT_EVENTS_SIZE = 0x1000
+const EVENTS_IRQ = 12
+
+// Reads return the next event word, writes select the page read through EVENTS_DATA
+const EVENTS_READ = 0x00
+const EVENTS_SET_PAGE = 0x00
+const EVENTS_LEN = 0x04
+const EVENTS_DATA = 0x08
+
+// Pages describing the device: its name, the bitmaps of the event types and codes it sends, and the
+// min, max, fuzz and flat words of its absolute axes
+const EVENTS_PAGE_NAME = 0x00000
+const EVENTS_PAGE_EVBITS = 0x10000
+const EVENTS_PAGE_ABSDATA = 0x20000 | EV_ABS
+
+const EVENTS_NAME = "kutemu-events"
+
+// Linux input event types and codes
+const EV_SYN = 0x00
+const EV_KEY = 0x01
+const EV_ABS = 0x03
+const ABS_X = 0x00
+const ABS_Y = 0x01
+const BTN_LEFT = 0x110
+const BTN_RIGHT = 0x111
+const BTN_MIDDLE = 0x112
+
+// Keycodes 1 to 255 are keys of a keyboard, the buttons come after
+const EVENTS_KEY_MAX = 0xff
+
+type InputEvent struct {
+	Type  uint32
+	Code  uint32
+	Value uint32
+}
+
+type GoldfishEvents struct {
+	Plic *Plic
+	// Range of the pointer axes, the size of the display
+	Width  uint32
+	Height uint32
+	// Events are sent by the host from any goroutine, the guest reads them from the run loop
+	mutex   sync.Mutex
+	queue   []InputEvent
+	waiting atomic.Bool
+	// Word of the first event the next read returns
+	field int
+	page  uint32
+}
+
+func NewGoldfishEvents(plic *Plic, width uint32, height uint32) *GoldfishEvents {
+	return &GoldfishEvents{Plic: plic, Width: width, Height: height}
+}
+
+// Send queues an event for the guest
+func (g *GoldfishEvents) Send(typ uint32, code uint32, value uint32) {
+	g.mutex.Lock()
+	g.queue = append(g.queue, InputEvent{Type: typ, Code: code, Value: value})
+	g.waiting.Store(true)
+	g.mutex.Unlock()
+}
+
+// Pending tells if the guest has events to read
+func (g *GoldfishEvents) Pending() bool {
+	return g.waiting.Load()
+}
+
+// Tick drives the interrupt line
+func (g *GoldfishEvents) Tick() {
+	if g.Plic != nil {
+		g.Plic.SetLevel(EVENTS_IRQ, g.waiting.Load())
+	}
+}
+
+func (g *GoldfishEvents) Read(addr uint32) uint32 {
+	switch offset := addr - VIRT_EVENTS; {
+	case offset == EVENTS_READ:
+		return g.next()
+	case offset == EVENTS_LEN:
+		return uint32(len(g.pageData()))
+	case offset >= EVENTS_DATA:
+		data := g.pageData()
+		var v uint32
+		for i := uint32(0); i < 4; i++ {
+			if n := offset - EVENTS_DATA + i; n < uint32(len(data)) {
+				v |= uint32(data[n]) << (8 * i)
+			}
+		}
+		return v
+	}
+	return 0
+}
+
+// PageByte reads the page, the names and bitmaps are read a byte at a time. The registers are only read as words.
+func (g *GoldfishEvents) PageByte(addr uint32) byte {
+	data := g.pageData()
+	if n := addr - VIRT_EVENTS - EVENTS_DATA; addr-VIRT_EVENTS >= EVENTS_DATA && n < uint32(len(data)) {
+		return data[n]
+	}
+	return 0
+}
+
+func (g *GoldfishEvents) Write(v uint32, addr uint32) error {
+	if addr < VIRT_EVENTS || addr >= VIRT_EVENTS+VIRT_EVENTS_SIZE {
+		return errors.New("Invalid address for events")
+	}
+	if addr-VIRT_EVENTS == EVENTS_SET_PAGE {
+		g.page = v
+	}
+	return nil
+}
+
+// next returns the next word of the first event, an empty queue reads as zeros
+func (g *GoldfishEvents) next() uint32 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(g.queue) == 0 {
+		return 0
+	}
+	event := g.queue[0]
+	v := [3]uint32{event.Type, event.Code, event.Value}[g.field]
+	g.field++
+	if g.field == 3 {
+		g.field = 0
+		g.queue = g.queue[1:]
+		g.waiting.Store(len(g.queue) > 0)
+		// Lowered right away, a completion before the next tick would raise it again
+		g.Tick()
+	}
+	return v
+}
+
+func (g *GoldfishEvents) pageData() []byte {
+	switch g.page {
+	case EVENTS_PAGE_NAME:
+		return []byte(EVENTS_NAME)
+	case EVENTS_PAGE_EVBITS | EV_SYN:
+		return bitmap(EV_SYN, EV_KEY, EV_ABS)
+	case EVENTS_PAGE_EVBITS | EV_KEY:
+		keys := []uint32{BTN_LEFT, BTN_RIGHT, BTN_MIDDLE}
+		for key := uint32(1); key <= EVENTS_KEY_MAX; key++ {
+			keys = append(keys, key)
+		}
+		return bitmap(keys...)
+	case EVENTS_PAGE_EVBITS | EV_ABS:
+		return bitmap(ABS_X, ABS_Y)
+	case EVENTS_PAGE_ABSDATA:
+		data := make([]byte, 0, 32)
+		for _, max := range []uint32{g.Width - 1, g.Height - 1} {
+			for _, v := range []uint32{0, max, 0, 0} {
+				data = append(data, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+			}
+		}
+		return data
+	}
+	return nil
+}
+
+// EventsState is the events the guest didn't read yet and the page it selected, for snapshots
+type EventsState struct {
+	Queue []InputEvent
+	Field int
+	Page  uint32
+}
+
+func (g *GoldfishEvents) State() EventsState {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return EventsState{Queue: slices.Clone(g.queue), Field: g.field, Page: g.page}
+}
+
+func (g *GoldfishEvents) SetState(s EventsState) {
+	g.mutex.Lock()
+	g.queue = slices.Clone(s.Queue)
+	g.field = s.Field
+	g.page = s.Page
+	g.waiting.Store(len(g.queue) > 0)
+	g.mutex.Unlock()
+	g.Tick()
+}
+
+// bitmap sets the bits, as many bytes as the highest bit needs
+func bitmap(bits ...uint32) []byte {
+	var b []byte
+	for _, bit := range bits {
+		for uint32(len(b)) <= bit/8 {
+			b = append(b, 0)
+		}
+		b[bit/8] |= 1 << (bit % 8)
+	}
+	return b
+}
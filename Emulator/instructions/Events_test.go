@@ -0,0 +1,80 @@
+package instructions
+
+import "testing"
+
+func TestEventsQueue(t *testing.T) {
+	plic, cpu := newTestPlic()
+	_ = plic.Write(1, PLIC_PRIORITY+4*EVENTS_IRQ)
+	_ = plic.Write(1<<EVENTS_IRQ, PLIC_INT_ENABLE)
+	m := &Memory{Map: make(map[uint32]byte), Plic: plic, Events: NewGoldfishEvents(plic, 320, 200)}
+
+	m.Events.Send(EV_KEY, 30, 1)
+	m.Events.Tick()
+	if cpu.CSR.Registers[MIP]&(1<<11) == 0 {
+		t.Errorf("Expected MEIP while an event is waiting")
+	}
+	for _, want := range []uint32{EV_KEY, 30, 1, 0} {
+		if got := m.ReadWord(VIRT_EVENTS + EVENTS_READ); got != want {
+			t.Errorf("Expected event word %d, Got %d", want, got)
+		}
+	}
+	if plic.Read(PLIC_CLAIM) != EVENTS_IRQ {
+		t.Errorf("Expected the events interrupt to be claimed")
+	}
+	_ = plic.Write(EVENTS_IRQ, PLIC_CLAIM)
+	m.Events.Tick()
+	if cpu.CSR.Registers[MIP]&(1<<11) > 0 {
+		t.Errorf("Expected MEIP to clear once the events were read")
+	}
+}
+
+func TestEventsPages(t *testing.T) {
+	m := &Memory{Map: make(map[uint32]byte), Events: NewGoldfishEvents(nil, 320, 200)}
+
+	m.WriteWord(EVENTS_PAGE_NAME, VIRT_EVENTS+EVENTS_SET_PAGE)
+	name := make([]byte, m.ReadWord(VIRT_EVENTS+EVENTS_LEN))
+	for i := range name {
+		name[i] = m.ReadByte(VIRT_EVENTS + EVENTS_DATA + uint32(i))
+	}
+	if string(name) != EVENTS_NAME {
+		t.Errorf("Expected name %q, Got %q", EVENTS_NAME, name)
+	}
+
+	m.WriteWord(EVENTS_PAGE_EVBITS|EV_KEY, VIRT_EVENTS+EVENTS_SET_PAGE)
+	if got := m.ReadByte(VIRT_EVENTS + EVENTS_DATA + BTN_LEFT/8); got&(1<<(BTN_LEFT%8)) == 0 {
+		t.Errorf("Expected BTN_LEFT in the key bits, Got %02x", got)
+	}
+
+	// min, max, fuzz and flat of ABS_X then ABS_Y
+	m.WriteWord(EVENTS_PAGE_ABSDATA, VIRT_EVENTS+EVENTS_SET_PAGE)
+	if got := m.ReadWord(VIRT_EVENTS + EVENTS_LEN); got != 32 {
+		t.Errorf("Expected 32 bytes of axes, Got %d", got)
+	}
+	if got := m.ReadWord(VIRT_EVENTS + EVENTS_DATA + 20); got != 199 {
+		t.Errorf("Expected ABS_Y max 199, Got %d", got)
+	}
+}
+
+func TestEventsState(t *testing.T) {
+	m := &Memory{Map: make(map[uint32]byte), Events: NewGoldfishEvents(nil, 320, 200)}
+	m.Events.Send(EV_KEY, 30, 1)
+	m.Events.Send(EV_KEY, 30, 0)
+	m.ReadWord(VIRT_EVENTS + EVENTS_READ)
+	m.WriteWord(EVENTS_PAGE_ABSDATA, VIRT_EVENTS+EVENTS_SET_PAGE)
+	s := m.Events.State()
+
+	restored := &Memory{Map: make(map[uint32]byte), Events: NewGoldfishEvents(nil, 320, 200)}
+	restored.Events.SetState(s)
+	if !restored.Events.Pending() || restored.ReadWord(VIRT_EVENTS+EVENTS_LEN) != 32 {
+		t.Errorf("Expected the queue and the page to be restored")
+	}
+	// The first event was half read
+	for _, want := range []uint32{30, 1, EV_KEY, 30, 0} {
+		if got := restored.ReadWord(VIRT_EVENTS + EVENTS_READ); got != want {
+			t.Errorf("Expected event word %d, Got %d", want, got)
+		}
+	}
+	if restored.Events.Pending() || !m.Events.Pending() {
+		t.Errorf("Expected the restored queue to be a copy")
+	}
+}
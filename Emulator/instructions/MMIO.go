@@ -0,0 +1,37 @@
+package instructions
+
+// MMIO is a region of device registers served by callbacks, for devices which live outside the emulator
+type MMIO struct {
+	Base uint32
+	Size uint32
+	// Called with the offset in the region and the access size in bytes, 1, 2 or 4
+	Read  func(offset uint32, size uint32) uint32
+	Write func(offset uint32, size uint32, value uint32)
+}
+
+func (r *MMIO) contains(location uint32) bool {
+	return location-r.Base < r.Size
+}
+
+// mmioAt returns the callback region location belongs to, if any
+func (m *Memory) mmioAt(location uint32) *MMIO {
+	for _, r := range m.MMIO {
+		if r.contains(location) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (m *Memory) readMMIO(r *MMIO, location uint32, size uint32) uint32 {
+	if r.Read == nil {
+		return 0
+	}
+	return r.Read(location-r.Base, size)
+}
+
+func (m *Memory) writeMMIO(r *MMIO, location uint32, size uint32, value uint32) {
+	if r.Write != nil {
+		r.Write(location-r.Base, size, value)
+	}
+}
@@ -5,27 +5,64 @@ const VIRT_DISPLAY = 0x1D385000
 const VIRT_DISPLAY_SIZE = 320 * 200
 
 type Memory struct {
-	Map     map[uint32]byte
-	Uart    *UART
-	Plic    *Plic
-	Cpu     *Cpu
+	Map  map[uint32]byte
+	Uart *UART
+	Plic *Plic
+	Cpu  *Cpu
+	// All harts sharing the memory, indexed by hart ID. Cpu is the first one.
+	Harts   []*Cpu
 	Clint   *Clint
 	Display *Display
+	Syscon  *Syscon
+	Rtc     *GoldfishRTC
+	Events  *GoldfishEvents
+	Audio   *Audio
+	// Decoded instructions by page number
+	code map[uint32]*codePage
+	// Translated blocks by start address
+	blocks map[uint32]*Block
+	// Counts device accesses when set
+	Stats *Stats
+	// Regions served by callbacks, they come before the memory and the built-in devices
+	MMIO []*MMIO
+	// Pages of STATE_PAGE_SIZE written to, by page address. Nil when nobody keeps track.
+	Dirty map[uint32]bool
 }
 
 // Hack
 func (m *Memory) SetCpu(cpu *Cpu) {
-	m.Cpu = cpu
+	m.SetHarts([]*Cpu{cpu})
+}
+
+// SetHarts connects the harts to the memory and to the interrupt lines of the devices
+func (m *Memory) SetHarts(harts []*Cpu) {
+	m.Cpu = harts[0]
+	m.Harts = harts
+	if m.Plic != nil {
+		m.Plic.Harts = harts
+	}
+	if m.Clint != nil {
+		m.Clint.Harts = harts
+	}
 }
 
 func (m *Memory) LoadBytes(b []byte, location uint32) error {
 	for i, bb := range b {
 		m.Map[location+uint32(i)] = bb
+		m.markDirty(location + uint32(i))
 	}
+	m.FlushCode()
 	return nil
 }
 
 func (m *Memory) WriteByte(b byte, location uint32) {
+	if m.startMMIO(location) {
+		defer m.stopMMIO()
+	}
+	if r := m.mmioAt(location); r != nil {
+		m.writeMMIO(r, location, 1, uint32(b))
+		return
+	}
 	if location >= VIRT_UART0 && location < VIRT_UART0+0x100 {
 		_ = m.Uart.Write(b, location-VIRT_UART0)
 		return
@@ -35,9 +72,33 @@ func (m *Memory) WriteByte(b byte, location uint32) {
 	}
 
 	m.Map[location] = b
+	m.markDirty(location)
+	m.invalidate(location)
+	if len(m.Harts) > 1 {
+		m.breakReservations(location)
+	}
+}
+
+func (m *Memory) markDirty(location uint32) {
+	if m.Dirty != nil {
+		m.Dirty[location&^(STATE_PAGE_SIZE-1)] = true
+	}
+}
+
+// breakReservations makes sc.w fail on the harts which reserved the word written to
+func (m *Memory) breakReservations(location uint32) {
+	for _, hart := range m.Harts {
+		if hart.AtomicReserved && hart.Reservation == location&^3 {
+			hart.AtomicReserved = false
+		}
+	}
 }
 
 func (m *Memory) WriteHalf(h uint16, location uint32) {
+	if r := m.mmioAt(location); r != nil {
+		m.writeMMIO(r, location, 2, uint32(h))
+		return
+	}
 	m.WriteByte(byte(h&uint16(0xFF)), location)
 	m.WriteByte(byte((h&uint16(0xFF00))>>8), location+1)
 	if location >= VIRT_DISPLAY && location < VIRT_DISPLAY+VIRT_DISPLAY_SIZE {
@@ -46,21 +107,44 @@ func (m *Memory) WriteHalf(h uint16, location uint32) {
 }
 
 func (m *Memory) WriteWord(w uint32, location uint32) {
-	if location >= PLIC_PRIORITY && location <= PLIC_INT_ENABLE+0x100 {
-		_ = m.Plic.Write(w, location, m.Cpu)
+	if m.startMMIO(location) {
+		defer m.stopMMIO()
+	}
+	if r := m.mmioAt(location); r != nil {
+		m.writeMMIO(r, location, 4, w)
 		return
 	}
-	if location >= PLIC_THRESHOLD && location <= PLIC_THRESHOLD+0x100 {
-		_ = m.Plic.Write(w, location, m.Cpu)
+	if location >= PLIC_BASE && location < PLIC_BASE+PLIC_SIZE {
+		_ = m.Plic.Write(w, location)
 		return
 	}
 
 	if location >= BASE_CLINT && location <= CLINT_END {
-		_ = m.Clint.Write(w, location, m.Cpu)
+		_ = m.Clint.Write(w, location)
 		return
 	}
 
-	if location >= VIRT_DISPLAY && location < VIRT_DISPLAY+VIRT_DISPLAY_SIZE {
+	if location >= VIRT_TEST && location < VIRT_TEST+VIRT_TEST_SIZE {
+		_ = m.Syscon.Write(w, location)
+		return
+	}
+
+	if location >= VIRT_RTC && location < VIRT_RTC+VIRT_RTC_SIZE {
+		_ = m.Rtc.Write(w, location)
+		return
+	}
+
+	if location >= VIRT_EVENTS && location < VIRT_EVENTS+VIRT_EVENTS_SIZE {
+		_ = m.Events.Write(w, location)
+		return
+	}
+
+	if location >= VIRT_AUDIO && location < VIRT_AUDIO+VIRT_AUDIO_SIZE {
+		_ = m.Audio.Write(w, location)
+		return
+	}
+
+	if location >= VIRT_DISPLAY && location <= VIRT_DISPLAY_CTRL {
 		_ = m.Display.Write(w, location)
 		return
 	}
@@ -73,22 +157,52 @@ func (m *Memory) WriteWord(w uint32, location uint32) {
 }
 
 func (m *Memory) ReadByte(location uint32) byte {
+	if m.startMMIO(location) {
+		defer m.stopMMIO()
+	}
+	if r := m.mmioAt(location); r != nil {
+		return byte(m.readMMIO(r, location, 1))
+	}
 	if location >= VIRT_UART0 && location <= VIRT_UART0+0x16 {
 		b, _ := m.Uart.Read(location - VIRT_UART0)
 		return b
 	}
+	if location >= VIRT_EVENTS && location < VIRT_EVENTS+VIRT_EVENTS_SIZE {
+		return m.Events.PageByte(location)
+	}
+	return m.Map[location]
+}
+
+// PeekByte reads RAM without touching any device, for debuggers and other tools
+func (m *Memory) PeekByte(location uint32) byte {
 	return m.Map[location]
 }
 
+// PokeByte writes RAM without touching any device, for debuggers and other tools
+func (m *Memory) PokeByte(b byte, location uint32) {
+	m.Map[location] = b
+	m.markDirty(location)
+	m.invalidate(location)
+	if len(m.Harts) > 1 {
+		m.breakReservations(location)
+	}
+}
+
 func (m *Memory) ReadHalf(location uint32) uint16 {
+	if r := m.mmioAt(location); r != nil {
+		return uint16(m.readMMIO(r, location, 2))
+	}
 	return uint16(m.ReadByte(location)) | (uint16(m.ReadByte(location+1)) << 8)
 }
 
 func (m *Memory) ReadWord(location uint32) uint32 {
-	if location >= PLIC_PRIORITY && location <= PLIC_INT_ENABLE+0x100 {
-		return m.Plic.Read(location)
+	if m.startMMIO(location) {
+		defer m.stopMMIO()
+	}
+	if r := m.mmioAt(location); r != nil {
+		return m.readMMIO(r, location, 4)
 	}
-	if location >= PLIC_THRESHOLD && location <= PLIC_THRESHOLD+0x100 {
+	if location >= PLIC_BASE && location < PLIC_BASE+PLIC_SIZE {
 		return m.Plic.Read(location)
 	}
 
@@ -96,12 +210,25 @@ func (m *Memory) ReadWord(location uint32) uint32 {
 		return m.Display.Screen[location-VIRT_DISPLAY]
 	}
 
-	if location >= BASE_CLINT && location == 0x200BFFC {
-		return uint32(((m.Clint.Mtime << 32) >> 32) & 0xFFFFFFFF)
+	// Write only device
+	if location >= VIRT_TEST && location < VIRT_TEST+VIRT_TEST_SIZE {
+		return 0
+	}
+
+	if location >= VIRT_RTC && location < VIRT_RTC+VIRT_RTC_SIZE {
+		return m.Rtc.Read(location)
+	}
+
+	if location >= VIRT_EVENTS && location < VIRT_EVENTS+VIRT_EVENTS_SIZE {
+		return m.Events.Read(location)
 	}
 
-	if location >= BASE_CLINT && location == 0x200BFF8 {
-		return uint32((m.Clint.Mtime >> 32) & 0xFFFFFFFF)
+	if location >= VIRT_AUDIO && location < VIRT_AUDIO+VIRT_AUDIO_SIZE {
+		return m.Audio.Read(location)
+	}
+
+	if location >= BASE_CLINT && location <= CLINT_END {
+		return m.Clint.Read(location)
 	}
 
 	return uint32(int32(uint32(m.ReadByte(location)) |
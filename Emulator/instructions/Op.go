@@ -0,0 +1,177 @@
+package instructions
+
+// Op is the operation of an instruction as a number, so it can be switched on without comparing strings
+type Op uint8
+
+const (
+	OP_UNKNOWN Op = iota
+	// Integer register-register and M extension
+	OP_ADD
+	OP_SUB
+	OP_XOR
+	OP_OR
+	OP_AND
+	OP_SLL
+	OP_SRL
+	OP_SRA
+	OP_SLT
+	OP_SLTU
+	OP_MUL
+	OP_MULH
+	OP_MULHSU
+	OP_MULHU
+	OP_DIV
+	OP_DIVU
+	OP_REM
+	OP_REMU
+	// A extension
+	OP_LR_W
+	OP_SC_W
+	OP_AMOSWAP_W
+	OP_AMOADD_W
+	OP_AMOAND_W
+	OP_AMOOR_W
+	OP_AMOXOR_W
+	OP_AMOMAX_W
+	OP_AMOMIN_W
+	OP_AMOMAXU_W
+	OP_AMOMINU_W
+	// Register-immediate, loads, jalr, system and Zicsr
+	OP_ADDI
+	OP_XORI
+	OP_ORI
+	OP_ANDI
+	OP_SLLI
+	OP_SRLI
+	OP_SRAI
+	OP_SLTI
+	OP_SLTIU
+	OP_LB
+	OP_LH
+	OP_LW
+	OP_LBU
+	OP_LHU
+	OP_JALR
+	OP_ECALL
+	OP_EBREAK
+	OP_CSRRW
+	OP_CSRRS
+	OP_CSRRC
+	OP_CSRRWI
+	OP_CSRRSI
+	OP_CSRRCI
+	OP_SRET
+	OP_MRET
+	OP_WFI
+	OP_SFENCE_VMA
+	// Stores
+	OP_SB
+	OP_SH
+	OP_SW
+	// Branches
+	OP_BEQ
+	OP_BNE
+	OP_BLT
+	OP_BGE
+	OP_BLTU
+	OP_BGEU
+	// Jumps
+	OP_JAL
+	// Upper immediates
+	OP_LUI
+	OP_AUIPC
+	// Fences
+	OP_FENCE
+	OP_FENCE_I
+)
+
+// Names of the operations, the same Operation returns
+var opNames = [...]string{
+	OP_ADD:        "add",
+	OP_SUB:        "sub",
+	OP_XOR:        "xor",
+	OP_OR:         "or",
+	OP_AND:        "and",
+	OP_SLL:        "sll",
+	OP_SRL:        "srl",
+	OP_SRA:        "sra",
+	OP_SLT:        "slt",
+	OP_SLTU:       "sltu",
+	OP_MUL:        "mul",
+	OP_MULH:       "mulh",
+	OP_MULHSU:     "mulhsu",
+	OP_MULHU:      "mulhu",
+	OP_DIV:        "div",
+	OP_DIVU:       "divu",
+	OP_REM:        "rem",
+	OP_REMU:       "remu",
+	OP_LR_W:       "lr.w",
+	OP_SC_W:       "sc.w",
+	OP_AMOSWAP_W:  "amoswap.w",
+	OP_AMOADD_W:   "amoadd.w",
+	OP_AMOAND_W:   "amoand.w",
+	OP_AMOOR_W:    "amoor.w",
+	OP_AMOXOR_W:   "amoxor.w",
+	OP_AMOMAX_W:   "amomax.w",
+	OP_AMOMIN_W:   "amomin.w",
+	OP_AMOMAXU_W:  "amomaxu.w",
+	OP_AMOMINU_W:  "amominu.w",
+	OP_ADDI:       "addi",
+	OP_XORI:       "xori",
+	OP_ORI:        "ori",
+	OP_ANDI:       "andi",
+	OP_SLLI:       "slli",
+	OP_SRLI:       "srli",
+	OP_SRAI:       "srai",
+	OP_SLTI:       "slti",
+	OP_SLTIU:      "sltiu",
+	OP_LB:         "lb",
+	OP_LH:         "lh",
+	OP_LW:         "lw",
+	OP_LBU:        "lbu",
+	OP_LHU:        "lhu",
+	OP_JALR:       "jalr",
+	OP_ECALL:      "ecall",
+	OP_EBREAK:     "ebreak",
+	OP_CSRRW:      "csrrw",
+	OP_CSRRS:      "csrrs",
+	OP_CSRRC:      "csrrc",
+	OP_CSRRWI:     "csrrwi",
+	OP_CSRRSI:     "csrrsi",
+	OP_CSRRCI:     "csrrci",
+	OP_SRET:       "sret",
+	OP_MRET:       "mret",
+	OP_WFI:        "wfi",
+	OP_SFENCE_VMA: "sfence.vma",
+	OP_SB:         "sb",
+	OP_SH:         "sh",
+	OP_SW:         "sw",
+	OP_BEQ:        "beq",
+	OP_BNE:        "bne",
+	OP_BLT:        "blt",
+	OP_BGE:        "bge",
+	OP_BLTU:       "bltu",
+	OP_BGEU:       "bgeu",
+	OP_JAL:        "jal",
+	OP_LUI:        "lui",
+	OP_AUIPC:      "auipc",
+	OP_FENCE:      "fence",
+	OP_FENCE_I:    "fence.i",
+}
+
+var opByName = func() map[string]Op {
+	m := make(map[string]Op, len(opNames))
+	for op, name := range opNames {
+		if name != "" {
+			m[name] = Op(op)
+		}
+	}
+	return m
+}()
+
+func (o Op) String() string {
+	if int(o) < len(opNames) && opNames[o] != "" {
+		return opNames[o]
+	}
+	return "unknown"
+}
@@ -1,5 +1,11 @@
 package instructions
 
+import (
+	"errors"
+	"math/bits"
+	"slices"
+)
+
 // https://five-embeddev.com/riscv-priv-isa-manual/Priv-v1.12/plic.html
 // PLIC treats each interrupt target as independent. The targets are the harts.
 // A hart can have local interrupt sources like software interrupts or timer interrupts which don't pass through PLIC.
@@ -13,12 +19,12 @@ package instructions
 // ID 0 means no interrupts. Smaller interrupt ID takes precedence over larger values when priorities of interrupts
 // are same.
 
-// All interrupt priorities can be hardwired to 1 for us.
+// Each source has a priority, 0 means the source never interrupts.
 
 // Each interrupt target has a vector of interrupt enable bits, one per interrupt source.
-// Can be hardwired to 0 or 1. We can do a 1.
+// Bit 0 is hardwired to 0 as source 0 does not exist.
 
-// interrupt priority thresholds can be wired to 0.
+// Each target has a priority threshold, only interrupts with priority above it are notified.
 
 // Interrupt notifications generated by the PLIC appear
 //in the  meip/seip/ueip bits of the mip/sip/ uip registers for M/S/U modes, respectively.
@@ -47,87 +53,292 @@ package instructions
 //has processed the interrupt, it sends an interrupt completion message to the gateway to allow a new interrupt
 //request.
 
+// Memory map follows the SiFive PLIC used by QEMU virt.
+// Context 2*h is the M-mode context of hart h, context 2*h+1 is its S-mode context.
+const PLIC_BASE uint32 = 0x0c00_0000
+const PLIC_SIZE uint32 = 0x0400_0000
 const PLIC_PRIORITY uint32 = 0x0c00_0000
 const PLIC_PENDING uint32 = 0x0c00_1000
 const PLIC_INT_ENABLE uint32 = 0x0c00_2000
 const PLIC_THRESHOLD uint32 = 0x0c20_0000
 const PLIC_CLAIM uint32 = 0x0c20_0004
 
-// Assume we just have one source interrupt, UART
-type Plic struct {
-	Priority uint32
-	// When an interrupt from source is set, the corresponding bit is set there
-	Pending   []uint32
-	Enable    uint32
+const PLIC_ENABLE_STRIDE uint32 = 0x80
+const PLIC_CONTEXT_STRIDE uint32 = 0x1000
+
+// Source 0 is reserved, so 1023 sources at most
+const PLIC_MAX_SOURCES uint32 = 1023
+const PLIC_MAX_CONTEXTS uint32 = 15872
+
+// SiFive PLICs implement 3 bits of priority
+const PLIC_PRIORITY_MASK uint32 = 0x7
+
+type PlicContext struct {
+	// One bit per source
+	Enable    []uint32
 	Threshold uint32
-	Claim     uint32
-	Complete  uint32
 }
 
-type InterruptSource struct {
-	Pending bool
+type Plic struct {
+	NumSources uint32
+	// Priority of each source, 0 means never interrupt
+	Priority []uint32
+	// When an interrupt from source is set, the corresponding bit is set there
+	Pending []uint32
+	// Sources which were claimed and are waiting for a completion. The gateway doesn't forward them till then.
+	Claimed []uint32
+	// Current level of the interrupt lines, used to re-trigger level interrupts on completion
+	Level    []uint32
+	Contexts []PlicContext
+	// Harts whose MEIP/SEIP bits are driven by the contexts
+	Harts []*Cpu
 }
 
-func (plic *Plic) Write(v uint32, addr uint32, cpu *Cpu) error {
-	if addr == PLIC_PRIORITY {
-		plic.Priority = v
+func NewPlic(numSources uint32, numContexts uint32) *Plic {
+	if numSources > PLIC_MAX_SOURCES {
+		numSources = PLIC_MAX_SOURCES
 	}
-
-	// Doesn't do anything as of now
-	if addr == PLIC_INT_ENABLE {
-		plic.Enable = v
+	if numContexts > PLIC_MAX_CONTEXTS {
+		numContexts = PLIC_MAX_CONTEXTS
+	}
+	words := (numSources + 1 + 31) / 32
+	contexts := make([]PlicContext, numContexts)
+	for i := range contexts {
+		contexts[i].Enable = make([]uint32, words)
 	}
+	return &Plic{
+		NumSources: numSources,
+		Priority:   make([]uint32, numSources+1),
+		Pending:    make([]uint32, words),
+		Claimed:    make([]uint32, words),
+		Level:      make([]uint32, words),
+		Contexts:   contexts,
+	}
+}
 
-	if addr == PLIC_THRESHOLD {
-		plic.Threshold = v
+func getBit(bits []uint32, id uint32) bool {
+	return bits[id/32]&(1<<(id%32)) > 0
+}
+
+func setBit(bits []uint32, id uint32, v bool) {
+	if v {
+		bits[id/32] |= 1 << (id % 32)
+	} else {
+		bits[id/32] &^= 1 << (id % 32)
 	}
+}
 
-	// interrupt is completed here
-	if addr == PLIC_CLAIM {
-		if len(plic.Pending) > 0 && plic.Pending[0] == v {
-			plic.Pending = plic.Pending[1:]
-			// Set MIP to 0 here, as there is no pending interrupt now.
-			// TODO: This is not completely correct, but should do for now
-			cpu.CSR.Registers[MIP] = 0
-			mstatus := ToMStatusReg(cpu.CSR.GetValue(MSTATUS, cpu.CurrentMode, cpu))
-			mstatus.mie = 1
-			cpu.CSR.Registers[MSTATUS] = FromMStatusReg(mstatus)
+func (plic *Plic) validSource(id uint32) bool {
+	return id > 0 && id <= plic.NumSources
+}
+
+func (plic *Plic) Write(v uint32, addr uint32) error {
+	offset := addr - PLIC_BASE
+	switch {
+	case addr >= PLIC_PRIORITY && addr < PLIC_PENDING:
+		id := offset / 4
+		if plic.validSource(id) {
+			plic.Priority[id] = v & PLIC_PRIORITY_MASK
+		}
+
+	// Pending bits are read only
+	case addr >= PLIC_PENDING && addr < PLIC_INT_ENABLE:
+
+	case addr >= PLIC_INT_ENABLE && addr < PLIC_THRESHOLD:
+		ctx := (addr - PLIC_INT_ENABLE) / PLIC_ENABLE_STRIDE
+		word := ((addr - PLIC_INT_ENABLE) % PLIC_ENABLE_STRIDE) / 4
+		if ctx >= uint32(len(plic.Contexts)) || word >= uint32(len(plic.Pending)) {
+			return nil
+		}
+		// Source 0 doesn't exist, so it can't be enabled
+		if word == 0 {
+			v = v &^ 1
+		}
+		plic.Contexts[ctx].Enable[word] = v
+
+	case addr >= PLIC_THRESHOLD && addr < PLIC_BASE+PLIC_SIZE:
+		ctx := (addr - PLIC_THRESHOLD) / PLIC_CONTEXT_STRIDE
+		reg := (addr - PLIC_THRESHOLD) % PLIC_CONTEXT_STRIDE
+		if ctx >= uint32(len(plic.Contexts)) {
+			return nil
+		}
+		switch reg {
+		case 0:
+			plic.Contexts[ctx].Threshold = v & PLIC_PRIORITY_MASK
+		// interrupt is completed here
+		case 4:
+			plic.complete(ctx, v)
 		}
+
+	default:
+		return errors.New("Invalid address for plic")
 	}
 
+	plic.update()
 	return nil
 }
 
 func (plic *Plic) Read(addr uint32) uint32 {
-	if addr == PLIC_CLAIM {
-		if len(plic.Pending) == 0 {
+	offset := addr - PLIC_BASE
+	switch {
+	case addr >= PLIC_PRIORITY && addr < PLIC_PENDING:
+		id := offset / 4
+		if plic.validSource(id) {
+			return plic.Priority[id]
+		}
+
+	case addr >= PLIC_PENDING && addr < PLIC_INT_ENABLE:
+		word := (addr - PLIC_PENDING) / 4
+		if word < uint32(len(plic.Pending)) {
+			return plic.Pending[word]
+		}
+
+	case addr >= PLIC_INT_ENABLE && addr < PLIC_THRESHOLD:
+		ctx := (addr - PLIC_INT_ENABLE) / PLIC_ENABLE_STRIDE
+		word := ((addr - PLIC_INT_ENABLE) % PLIC_ENABLE_STRIDE) / 4
+		if ctx < uint32(len(plic.Contexts)) && word < uint32(len(plic.Pending)) {
+			return plic.Contexts[ctx].Enable[word]
+		}
+
+	case addr >= PLIC_THRESHOLD && addr < PLIC_BASE+PLIC_SIZE:
+		ctx := (addr - PLIC_THRESHOLD) / PLIC_CONTEXT_STRIDE
+		reg := (addr - PLIC_THRESHOLD) % PLIC_CONTEXT_STRIDE
+		if ctx >= uint32(len(plic.Contexts)) {
 			return 0
 		}
-		return plic.Pending[0]
+		switch reg {
+		case 0:
+			return plic.Contexts[ctx].Threshold
+		case 4:
+			return plic.claim(ctx)
+		}
 	}
 
-	if addr == PLIC_PENDING {
-		if len(plic.Pending) > 0 {
-			return plic.Pending[0]
+	// Reserved registers read as zero
+	return 0
+}
+
+// Highest priority pending and enabled interrupt for a context above its threshold, 0 if there is none.
+// On same priority the smaller ID wins.
+func (plic *Plic) best(ctx uint32) uint32 {
+	context := plic.Contexts[ctx]
+	bestId := uint32(0)
+	bestPriority := context.Threshold
+	for word := range plic.Pending {
+		candidates := plic.Pending[word] & context.Enable[word]
+		for candidates != 0 {
+			bit := uint32(bits.TrailingZeros32(candidates))
+			candidates &^= 1 << bit
+			id := uint32(word)*32 + bit
+			if plic.Priority[id] > bestPriority {
+				bestId = id
+				bestPriority = plic.Priority[id]
+			}
 		}
 	}
+	return bestId
+}
 
-	if addr == PLIC_INT_ENABLE {
-		return plic.Enable
+func (plic *Plic) claim(ctx uint32) uint32 {
+	id := plic.best(ctx)
+	if id == 0 {
+		return 0
 	}
+	setBit(plic.Pending, id, false)
+	setBit(plic.Claimed, id, true)
+	plic.update()
+	return id
+}
 
-	panic("This shouldn't happen")
+func (plic *Plic) complete(ctx uint32, id uint32) {
+	// Completion for a source not enabled for the context is ignored
+	if !plic.validSource(id) || !getBit(plic.Contexts[ctx].Enable, id) {
+		return
+	}
+	setBit(plic.Claimed, id, false)
+	// Level triggered device is still asserting, so the gateway forwards it again
+	if getBit(plic.Level, id) {
+		setBit(plic.Pending, id, true)
+	}
 }
 
-func (plic *Plic) TriggerInterrupt(id uint32, cpu *Cpu) {
-	if len(plic.Pending) > 0 {
+// SetLevel is used by level triggered devices to drive their interrupt line.
+func (plic *Plic) SetLevel(id uint32, level bool) {
+	if !plic.validSource(id) {
 		return
 	}
-	if cpu.CSR.Registers[MIP] > 0 {
+	setBit(plic.Level, id, level)
+	if level && !getBit(plic.Claimed, id) {
+		setBit(plic.Pending, id, true)
+	}
+	plic.update()
+}
+
+// TriggerInterrupt is used by edge triggered devices. It is dropped if the previous one is not completed yet.
+func (plic *Plic) TriggerInterrupt(id uint32) {
+	if !plic.validSource(id) || getBit(plic.Claimed, id) {
 		return
 	}
-	plic.Pending = append(plic.Pending, id)
-	// also set flag of hart
-	// 11 is external machine interrupt pending
-	cpu.CSR.Registers[MIP] = cpu.CSR.Registers[MIP] | 1<<11
+	setBit(plic.Pending, id, true)
+	plic.update()
+}
+
+// Interrupt notifications appear in meip/seip bits of mip of the hart owning the context. SEIP stays set
+// while software has it set.
+func (plic *Plic) update() {
+	for ctx := range plic.Contexts {
+		hart := ctx / 2
+		if hart >= len(plic.Harts) || plic.Harts[hart] == nil {
+			continue
+		}
+		mip := &plic.Harts[hart].CSR.Registers[MIP]
+		bit := uint32(1 << 11)
+		software := false
+		if ctx%2 == 1 {
+			bit = MIP_SEIP
+			software = plic.Harts[hart].SoftwareSEIP
+		}
+		if plic.best(uint32(ctx)) != 0 || software {
+			*mip |= bit
+			plic.Harts[hart].wake()
+		} else {
+			*mip &^= bit
+		}
+	}
+}
+
+// PlicState is the state of the sources and contexts, for snapshots
+type PlicState struct {
+	Priority []uint32
+	Pending  []uint32
+	Claimed  []uint32
+	Level    []uint32
+	Contexts []PlicContext
+}
+
+func (plic *Plic) State() PlicState {
+	s := PlicState{
+		Priority: slices.Clone(plic.Priority),
+		Pending:  slices.Clone(plic.Pending),
+		Claimed:  slices.Clone(plic.Claimed),
+		Level:    slices.Clone(plic.Level),
+	}
+	for _, c := range plic.Contexts {
+		s.Contexts = append(s.Contexts, PlicContext{Enable: slices.Clone(c.Enable), Threshold: c.Threshold})
+	}
+	return s
+}
+
+func (plic *Plic) SetState(s PlicState) {
+	copy(plic.Priority, s.Priority)
+	copy(plic.Pending, s.Pending)
+	copy(plic.Claimed, s.Claimed)
+	copy(plic.Level, s.Level)
+	for n := range plic.Contexts {
+		if n < len(s.Contexts) {
+			copy(plic.Contexts[n].Enable, s.Contexts[n].Enable)
+			plic.Contexts[n].Threshold = s.Contexts[n].Threshold
+		}
+	}
+	plic.update()
 }
@@ -0,0 +1,115 @@
+package instructions
+
+import "testing"
+
+func newTestPlic() (*Plic, *Cpu) {
+	cpu := &Cpu{CSR: &CSR{Registers: make([]uint32, 4096)}}
+	plic := NewPlic(PLIC_MAX_SOURCES, 2)
+	plic.Harts = []*Cpu{cpu}
+	return plic, cpu
+}
+
+func TestPlicClaimOrder(t *testing.T) {
+	plic, cpu := newTestPlic()
+	_ = plic.Write(1, PLIC_PRIORITY+4*10)
+	_ = plic.Write(3, PLIC_PRIORITY+4*40)
+	_ = plic.Write(3, PLIC_PRIORITY+4*41)
+	_ = plic.Write(1<<10, PLIC_INT_ENABLE)
+	_ = plic.Write(1<<8|1<<9, PLIC_INT_ENABLE+4)
+
+	plic.TriggerInterrupt(10)
+	plic.TriggerInterrupt(41)
+	plic.TriggerInterrupt(40)
+	if cpu.CSR.Registers[MIP]&(1<<11) == 0 {
+		t.Errorf("Expected MEIP to be set")
+	}
+	if cpu.CSR.Registers[MIP]&(1<<9) > 0 {
+		t.Errorf("Expected SEIP to be clear")
+	}
+
+	// Highest priority first, smaller ID wins on same priority
+	for _, want := range []uint32{40, 41, 10, 0} {
+		if got := plic.Read(PLIC_CLAIM); got != want {
+			t.Errorf("Expected claim %d, Got %d", want, got)
+		}
+	}
+	if cpu.CSR.Registers[MIP]&(1<<11) > 0 {
+		t.Errorf("Expected MEIP to be clear after all claims")
+	}
+}
+
+func TestPlicThreshold(t *testing.T) {
+	plic, cpu := newTestPlic()
+	_ = plic.Write(2, PLIC_PRIORITY+4*UART0_IRQ)
+	// S-mode context of hart 0
+	_ = plic.Write(1<<UART0_IRQ, PLIC_INT_ENABLE+PLIC_ENABLE_STRIDE)
+	_ = plic.Write(2, PLIC_THRESHOLD+PLIC_CONTEXT_STRIDE)
+
+	plic.SetLevel(UART0_IRQ, true)
+	if cpu.CSR.Registers[MIP]&(1<<9) > 0 {
+		t.Errorf("Expected SEIP to be masked by threshold")
+	}
+	_ = plic.Write(1, PLIC_THRESHOLD+PLIC_CONTEXT_STRIDE)
+	if cpu.CSR.Registers[MIP]&(1<<9) == 0 {
+		t.Errorf("Expected SEIP to be set")
+	}
+	if cpu.CSR.Registers[MIP]&(1<<11) > 0 {
+		t.Errorf("Expected MEIP to be clear")
+	}
+}
+
+func TestPlicLevelCompletion(t *testing.T) {
+	plic, cpu := newTestPlic()
+	_ = plic.Write(1, PLIC_PRIORITY+4*UART0_IRQ)
+	_ = plic.Write(1<<UART0_IRQ, PLIC_INT_ENABLE)
+
+	plic.SetLevel(UART0_IRQ, true)
+	if got := plic.Read(PLIC_CLAIM); got != UART0_IRQ {
+		t.Fatalf("Expected claim %d, Got %d", UART0_IRQ, got)
+	}
+	// No new request is forwarded before completion
+	plic.SetLevel(UART0_IRQ, true)
+	if plic.Read(PLIC_PENDING) != 0 {
+		t.Errorf("Expected nothing pending while claimed")
+	}
+	// Still asserted on completion, so it is pending again
+	_ = plic.Write(UART0_IRQ, PLIC_CLAIM)
+	if plic.Read(PLIC_PENDING) != 1<<UART0_IRQ {
+		t.Errorf("Expected source to be pending again, Got %x", plic.Read(PLIC_PENDING))
+	}
+	if cpu.CSR.Registers[MIP]&(1<<11) == 0 {
+		t.Errorf("Expected MEIP to be set")
+	}
+	_ = plic.Read(PLIC_CLAIM)
+	plic.SetLevel(UART0_IRQ, false)
+	_ = plic.Write(UART0_IRQ, PLIC_CLAIM)
+	if plic.Read(PLIC_PENDING) != 0 || cpu.CSR.Registers[MIP] != 0 {
+		t.Errorf("Expected no interrupt after line went low")
+	}
+}
+
+func TestPlicSoftwareSEIP(t *testing.T) {
+	plic, cpu := newTestPlic()
+	_ = plic.Write(1, PLIC_PRIORITY+4*UART0_IRQ)
+	_ = plic.Write(1<<UART0_IRQ, PLIC_INT_ENABLE+PLIC_ENABLE_STRIDE)
+	cpu.CSR.SetValue(MIP, MIP_SEIP, 3, cpu)
+
+	// The PLIC doesn't clear what software set
+	_ = plic.Write(0, PLIC_THRESHOLD+PLIC_CONTEXT_STRIDE)
+	if cpu.CSR.Registers[MIP]&MIP_SEIP == 0 {
+		t.Errorf("Expected SEIP to stay set by software")
+	}
+	cpu.CSR.SetValue(MIP, 0, 3, cpu)
+	plic.update()
+	if cpu.CSR.Registers[MIP]&MIP_SEIP > 0 {
+		t.Errorf("Expected SEIP to be clear")
+	}
+
+	// Software clearing SEIP leaves the PLIC line
+	plic.SetLevel(UART0_IRQ, true)
+	cpu.CSR.SetValue(MIP, 0, 3, cpu)
+	plic.update()
+	if cpu.CSR.Registers[MIP]&MIP_SEIP == 0 {
+		t.Errorf("Expected SEIP from the PLIC")
+	}
+}
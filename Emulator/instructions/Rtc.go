@@ -0,0 +1,168 @@
+package instructions
+
+import (
+	"errors"
+	"time"
+)
+
+// Goldfish RTC, as used by Linux rtc-goldfish. Same address and interrupt as QEMU virt.
+// Time is in nanoseconds since the unix epoch.
+const VIRT_RTC = 0x101000
+const VIRT_RTC_SIZE = 0x1000
+const RTC_IRQ = 11
+
+const RTC_TIME_LOW = 0x00
+const RTC_TIME_HIGH = 0x04
+const RTC_ALARM_LOW = 0x08
+const RTC_ALARM_HIGH = 0x0c
+const RTC_IRQ_ENABLED = 0x10
+const RTC_CLEAR_ALARM = 0x14
+const RTC_ALARM_STATUS = 0x18
+const RTC_CLEAR_INTERRUPT = 0x1c
+
+type GoldfishRTC struct {
+	Plic *Plic
+	// Guest time is Start plus the host time passed since Boot, plus whatever guest adjusted with Offset
+	Start  time.Time
+	Boot   time.Time
+	Offset int64
+	// Host time source, replaced to make guest time deterministic
+	Clock func() time.Time
+	// Reading TIME_LOW latches the upper half, so both reads see the same time
+	TimeHigh uint32
+	// ALARM_HIGH is written first, alarm is set on write to ALARM_LOW
+	AlarmHigh    uint32
+	Alarm        uint64
+	AlarmRunning bool
+	IrqEnabled   bool
+	IrqPending   bool
+}
+
+// NewGoldfishRTC creates a RTC starting at start, or at the host time if start is zero
+func NewGoldfishRTC(start time.Time, plic *Plic) *GoldfishRTC {
+	now := time.Now()
+	if start.IsZero() {
+		start = now
+	}
+	return &GoldfishRTC{
+		Plic:  plic,
+		Start: start,
+		Boot:  now,
+		Clock: time.Now,
+	}
+}
+
+// SetClock changes the host time source. Guest time starts again from Start.
+func (r *GoldfishRTC) SetClock(clock func() time.Time) {
+	r.Clock = clock
+	r.Boot = clock()
+}
+
+func (r *GoldfishRTC) Now() uint64 {
+	return uint64(r.Start.UnixNano() + int64(r.Clock().Sub(r.Boot)) + r.Offset)
+}
+
+func (r *GoldfishRTC) Read(addr uint32) uint32 {
+	switch addr - VIRT_RTC {
+	case RTC_TIME_LOW:
+		now := r.Now()
+		r.TimeHigh = uint32(now >> 32)
+		return uint32(now)
+	case RTC_TIME_HIGH:
+		return r.TimeHigh
+	case RTC_ALARM_LOW:
+		return uint32(r.Alarm)
+	case RTC_ALARM_HIGH:
+		return uint32(r.Alarm >> 32)
+	case RTC_IRQ_ENABLED:
+		if r.IrqEnabled {
+			return 1
+		}
+	case RTC_ALARM_STATUS:
+		if r.AlarmRunning {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (r *GoldfishRTC) Write(v uint32, addr uint32) error {
+	if addr < VIRT_RTC || addr >= VIRT_RTC+VIRT_RTC_SIZE {
+		return errors.New("Invalid address for rtc")
+	}
+	switch addr - VIRT_RTC {
+	case RTC_TIME_LOW:
+		// Guest sets the time, TIME_HIGH is written before
+		r.Offset += int64(uint64(r.TimeHigh)<<32|uint64(v)) - int64(r.Now())
+	case RTC_TIME_HIGH:
+		r.TimeHigh = v
+	case RTC_ALARM_LOW:
+		r.Alarm = uint64(r.AlarmHigh)<<32 | uint64(v)
+		r.AlarmRunning = true
+		r.Tick()
+	case RTC_ALARM_HIGH:
+		r.AlarmHigh = v
+	case RTC_IRQ_ENABLED:
+		r.IrqEnabled = v&1 > 0
+	case RTC_CLEAR_ALARM:
+		r.AlarmRunning = false
+	case RTC_CLEAR_INTERRUPT:
+		r.IrqPending = false
+	}
+	r.updateIrq()
+	return nil
+}
+
+// Tick fires the alarm once its time has passed
+func (r *GoldfishRTC) Tick() {
+	if !r.AlarmRunning || r.Now() < r.Alarm {
+		return
+	}
+	r.AlarmRunning = false
+	r.IrqPending = true
+	r.updateIrq()
+}
+
+func (r *GoldfishRTC) updateIrq() {
+	if r.Plic != nil {
+		r.Plic.SetLevel(RTC_IRQ, r.IrqPending && r.IrqEnabled)
+	}
+}
+
+// RTCState is the guest time and alarm, for snapshots
+type RTCState struct {
+	// Guest time when the snapshot was taken
+	Time         uint64
+	TimeHigh     uint32
+	AlarmHigh    uint32
+	Alarm        uint64
+	AlarmRunning bool
+	IrqEnabled   bool
+	IrqPending   bool
+}
+
+func (r *GoldfishRTC) State() RTCState {
+	return RTCState{
+		Time:         r.Now(),
+		TimeHigh:     r.TimeHigh,
+		AlarmHigh:    r.AlarmHigh,
+		Alarm:        r.Alarm,
+		AlarmRunning: r.AlarmRunning,
+		IrqEnabled:   r.IrqEnabled,
+		IrqPending:   r.IrqPending,
+	}
+}
+
+// SetState continues guest time from the snapshot
+func (r *GoldfishRTC) SetState(s RTCState) {
+	r.Start = time.Unix(0, int64(s.Time))
+	r.Boot = r.Clock()
+	r.Offset = 0
+	r.TimeHigh = s.TimeHigh
+	r.AlarmHigh = s.AlarmHigh
+	r.Alarm = s.Alarm
+	r.AlarmRunning = s.AlarmRunning
+	r.IrqEnabled = s.IrqEnabled
+	r.IrqPending = s.IrqPending
+	r.updateIrq()
+}
@@ -0,0 +1,107 @@
+package instructions
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestRtc runs the RTC on a clock the test moves, starting at 0x1_0000_0000 - 10 ns
+func newTestRtc() (*GoldfishRTC, *time.Time, *Cpu) {
+	plic, cpu := newTestPlic()
+	_ = plic.Write(1, PLIC_PRIORITY+4*RTC_IRQ)
+	_ = plic.Write(1<<RTC_IRQ, PLIC_INT_ENABLE)
+	now := time.Unix(1700000000, 0)
+	rtc := NewGoldfishRTC(time.Unix(0, 0x1_0000_0000-10), plic)
+	rtc.SetClock(func() time.Time { return now })
+	return rtc, &now, cpu
+}
+
+func TestRtcTimeLatch(t *testing.T) {
+	rtc, now, _ := newTestRtc()
+	low := rtc.Read(VIRT_RTC + RTC_TIME_LOW)
+	// TIME_HIGH is the one latched by TIME_LOW, even after the low word wrapped
+	*now = now.Add(20)
+	high := rtc.Read(VIRT_RTC + RTC_TIME_HIGH)
+	if low != 0xfffffff6 || high != 0 {
+		t.Errorf("Expected 0x0_fffffff6, Got %x_%08x", high, low)
+	}
+	low = rtc.Read(VIRT_RTC + RTC_TIME_LOW)
+	if high = rtc.Read(VIRT_RTC + RTC_TIME_HIGH); high != 1 || low != 10 {
+		t.Errorf("Expected 0x1_0000000a, Got %x_%08x", high, low)
+	}
+
+	// The guest sets the time high half first
+	_ = rtc.Write(2, VIRT_RTC+RTC_TIME_HIGH)
+	_ = rtc.Write(5, VIRT_RTC+RTC_TIME_LOW)
+	if got := rtc.Now(); got != 0x2_0000_0005 {
+		t.Errorf("Expected the time 0x2_00000005, Got %x", got)
+	}
+}
+
+func TestRtcAlarm(t *testing.T) {
+	rtc, now, cpu := newTestRtc()
+	_ = rtc.Write(1, VIRT_RTC+RTC_IRQ_ENABLED)
+	_ = rtc.Write(1, VIRT_RTC+RTC_ALARM_HIGH)
+	_ = rtc.Write(100, VIRT_RTC+RTC_ALARM_LOW)
+	if rtc.Read(VIRT_RTC+RTC_ALARM_STATUS) != 1 || rtc.Read(VIRT_RTC+RTC_ALARM_HIGH) != 1 {
+		t.Errorf("Expected the alarm to run at 0x1_00000064")
+	}
+	rtc.Tick()
+	if cpu.CSR.Registers[MIP]&(1<<11) > 0 {
+		t.Errorf("Expected no interrupt before the alarm")
+	}
+	*now = now.Add(110)
+	rtc.Tick()
+	if cpu.CSR.Registers[MIP]&(1<<11) == 0 || rtc.Read(VIRT_RTC+RTC_ALARM_STATUS) != 0 {
+		t.Errorf("Expected the alarm to fire once")
+	}
+	// The handler claims it, clears it and completes it, the line is low by then
+	if id := rtc.Plic.Read(PLIC_CLAIM); id != RTC_IRQ {
+		t.Errorf("Expected to claim the rtc interrupt, Got %d", id)
+	}
+	_ = rtc.Write(1, VIRT_RTC+RTC_CLEAR_INTERRUPT)
+	_ = rtc.Plic.Write(RTC_IRQ, PLIC_CLAIM)
+	if cpu.CSR.Registers[MIP]&(1<<11) > 0 || rtc.IrqPending {
+		t.Errorf("Expected the interrupt to clear")
+	}
+
+	// An alarm in the past fires right away, a cleared one never
+	_ = rtc.Write(0, VIRT_RTC+RTC_ALARM_LOW)
+	if !rtc.IrqPending {
+		t.Errorf("Expected an alarm in the past to fire")
+	}
+	_ = rtc.Write(1, VIRT_RTC+RTC_CLEAR_INTERRUPT)
+	_ = rtc.Write(2, VIRT_RTC+RTC_ALARM_HIGH)
+	_ = rtc.Write(0, VIRT_RTC+RTC_ALARM_LOW)
+	_ = rtc.Write(1, VIRT_RTC+RTC_CLEAR_ALARM)
+	*now = now.Add(0x2_0000_0000)
+	rtc.Tick()
+	if rtc.IrqPending {
+		t.Errorf("Expected a cleared alarm not to fire")
+	}
+	if rtc.Write(0, VIRT_RTC+VIRT_RTC_SIZE) == nil {
+		t.Errorf("Expected a write past the registers to fail")
+	}
+}
+
+func TestRtcState(t *testing.T) {
+	rtc, now, _ := newTestRtc()
+	_ = rtc.Write(1, VIRT_RTC+RTC_IRQ_ENABLED)
+	_ = rtc.Write(1, VIRT_RTC+RTC_ALARM_HIGH)
+	_ = rtc.Write(100, VIRT_RTC+RTC_ALARM_LOW)
+	s := rtc.State()
+
+	restored, later, cpu := newTestRtc()
+	*later = later.Add(time.Hour)
+	restored.SetState(s)
+	if restored.Now() != rtc.Now() || restored.State() != s {
+		t.Errorf("Expected the time and alarm to continue from the snapshot, Got %+v", restored.State())
+	}
+	// Guest time goes on from there with the host clock
+	*later = later.Add(200)
+	*now = now.Add(200)
+	restored.Tick()
+	if restored.Now() != rtc.Now() || cpu.CSR.Registers[MIP]&(1<<11) == 0 {
+		t.Errorf("Expected the restored alarm to fire at the same guest time")
+	}
+}
@@ -0,0 +1,361 @@
+package instructions
+
+// Built-in SBI firmware, so S-mode kernels can run without OpenSBI.
+// See https://github.com/riscv-non-isa/riscv-sbi-doc
+// ecalls from S-mode land here, with a7 as extension ID, a6 as function ID and a0-a5 as arguments.
+// Result goes back in a0 (error) and a1 (value).
+
+// Extension IDs
+const SBI_EXT_BASE = 0x10
+const SBI_EXT_TIME = 0x54494D45
+const SBI_EXT_IPI = 0x735049
+const SBI_EXT_RFENCE = 0x52464E43
+const SBI_EXT_HSM = 0x48534D
+const SBI_EXT_SRST = 0x53525354
+
+// Legacy extensions, the function is selected by extension ID alone
+const SBI_LEGACY_SET_TIMER = 0x00
+const SBI_LEGACY_CONSOLE_PUTCHAR = 0x01
+const SBI_LEGACY_CONSOLE_GETCHAR = 0x02
+const SBI_LEGACY_CLEAR_IPI = 0x03
+const SBI_LEGACY_SEND_IPI = 0x04
+const SBI_LEGACY_REMOTE_FENCE_I = 0x05
+const SBI_LEGACY_REMOTE_SFENCE_VMA = 0x06
+const SBI_LEGACY_REMOTE_SFENCE_VMA_ASID = 0x07
+const SBI_LEGACY_SHUTDOWN = 0x08
+
+// Error codes
+const SBI_SUCCESS = 0
+const SBI_ERR_FAILED = -1
+const SBI_ERR_NOT_SUPPORTED = -2
+const SBI_ERR_INVALID_PARAM = -3
+const SBI_ERR_INVALID_ADDRESS = -5
+const SBI_ERR_ALREADY_AVAILABLE = -6
+
+// SBI v2.0
+const SBI_SPEC_VERSION = 2 << 24
+
+// Not a registered implementation ID, only used to tell KUTEmu apart from real firmwares
+const SBI_IMPL_ID = 0x4B55
+const SBI_IMPL_VERSION = 1
+
+// HSM hart states
+const SBI_HSM_STARTED = 0
+const SBI_HSM_STOPPED = 1
+
+// Suspend types below this one are retentive
+const SBI_HSM_SUSPEND_NON_RETENTIVE = 0x80000000
+
+// SRST reset types and reasons
+const SBI_SRST_SHUTDOWN = 0
+const SBI_SRST_COLD_REBOOT = 1
+const SBI_SRST_WARM_REBOOT = 2
+const SBI_SRST_REASON_FAILURE = 1
+
+// Supervisor interrupt bits of mip
+const MIP_SSIP = 1 << 1
+const MIP_STIP = 1 << 5
+const MIP_SEIP = 1 << 9
+
+type Sbi struct {
+	// Harts managed by the firmware, indexed by hart ID
+	Harts []*Cpu
+}
+
+// NewSbi sets up the machine state the firmware would leave behind before jumping to the kernel. The
+// kernel starts on the first hart, the others wait for hart_start.
+func NewSbi(harts []*Cpu) *Sbi {
+	for _, cpu := range harts {
+		csr := cpu.CSR
+		// Supervisor interrupts and the usual exceptions are handled by the kernel directly
+		csr.Registers[MIDELEG] = MIP_SSIP | MIP_STIP | MIP_SEIP
+		csr.Registers[MEDELEG] = 1<<0 | 1<<3 | 1<<8 | 1<<12 | 1<<13 | 1<<15
+		csr.Registers[MIE] = MIP_SSIP | MIP_STIP | MIP_SEIP
+		// No timer till kernel asks for one
+		cpu.Memory.Clint.Mtimecmp[cpu.HartID] = ^uint64(0)
+		cpu.Stopped = cpu.HartID != 0
+	}
+	return &Sbi{Harts: harts}
+}
+
+// Tick raises the supervisor timer interrupt once the programmed time is reached
+func (s *Sbi) Tick() {
+	for _, hart := range s.Harts {
+		clint := hart.Memory.Clint
+		if clint.Mtime >= clint.Mtimecmp[hart.HartID] {
+			hart.CSR.Registers[MIP] |= MIP_STIP
+			hart.wake()
+		}
+	}
+}
+
+// Ecall handles a call from S-mode. PC is not changed.
+func (s *Sbi) Ecall(c *Cpu) {
+	ext := c.Registers[17]
+	fid := c.Registers[16]
+	a0 := c.Registers[10]
+	a1 := c.Registers[11]
+	a2 := c.Registers[12]
+
+	if ext <= SBI_LEGACY_SHUTDOWN {
+		c.Registers[10] = uint32(s.legacy(c, ext, a0, a1))
+		return
+	}
+
+	err, value := int32(SBI_ERR_NOT_SUPPORTED), uint32(0)
+	switch ext {
+	case SBI_EXT_BASE:
+		err, value = s.base(fid, a0)
+	case SBI_EXT_TIME:
+		if fid == 0 {
+			err = s.setTimer(c, uint64(a1)<<32|uint64(a0))
+		}
+	case SBI_EXT_IPI:
+		if fid == 0 {
+			err = s.sendIpi(a0, a1)
+		}
+	case SBI_EXT_RFENCE:
+		// There is no TLB, only the decoded code of remote_fence_i has to go
+		if fid <= 6 {
+			err = s.checkHartMask(a0, a1)
+		}
+		if fid == 0 && err == SBI_SUCCESS {
+			c.Memory.FlushCode()
+		}
+	case SBI_EXT_HSM:
+		err, value = s.hsm(c, fid, a0, a1, a2)
+	case SBI_EXT_SRST:
+		if fid == 0 {
+			err = s.reset(c, a0, a1)
+		}
+	}
+	c.Registers[10] = uint32(err)
+	c.Registers[11] = value
+}
+
+func (s *Sbi) base(fid uint32, a0 uint32) (int32, uint32) {
+	switch fid {
+	case 0:
+		return SBI_SUCCESS, SBI_SPEC_VERSION
+	case 1:
+		return SBI_SUCCESS, SBI_IMPL_ID
+	case 2:
+		return SBI_SUCCESS, SBI_IMPL_VERSION
+	case 3:
+		switch a0 {
+		case SBI_EXT_BASE, SBI_EXT_TIME, SBI_EXT_IPI, SBI_EXT_RFENCE, SBI_EXT_HSM, SBI_EXT_SRST:
+			return SBI_SUCCESS, 1
+		}
+		if a0 <= SBI_LEGACY_SHUTDOWN {
+			return SBI_SUCCESS, 1
+		}
+		return SBI_SUCCESS, 0
+	// mvendorid, marchid and mimpid are all 0
+	case 4, 5, 6:
+		return SBI_SUCCESS, 0
+	}
+	return SBI_ERR_NOT_SUPPORTED, 0
+}
+
+func (s *Sbi) setTimer(c *Cpu, t uint64) int32 {
+	c.Memory.Clint.Mtimecmp[c.HartID] = t
+	c.CSR.Registers[MIP] &^= MIP_STIP
+	return SBI_SUCCESS
+}
+
+// A hart mask base of all ones means every hart
+func (s *Sbi) forHarts(mask uint32, base uint32, f func(hart *Cpu)) int32 {
+	if base == ^uint32(0) {
+		for _, hart := range s.Harts {
+			f(hart)
+		}
+		return SBI_SUCCESS
+	}
+	for i := uint32(0); i < 32; i++ {
+		if mask&(1<<i) == 0 {
+			continue
+		}
+		if base+i >= uint32(len(s.Harts)) {
+			return SBI_ERR_INVALID_PARAM
+		}
+	}
+	for i := uint32(0); i < 32; i++ {
+		if mask&(1<<i) > 0 {
+			f(s.Harts[base+i])
+		}
+	}
+	return SBI_SUCCESS
+}
+
+func (s *Sbi) checkHartMask(mask uint32, base uint32) int32 {
+	return s.forHarts(mask, base, func(hart *Cpu) {})
+}
+
+func (s *Sbi) sendIpi(mask uint32, base uint32) int32 {
+	return s.forHarts(mask, base, func(hart *Cpu) {
+		hart.CSR.Registers[MIP] |= MIP_SSIP
+		hart.wake()
+	})
+}
+
+func (s *Sbi) hsm(c *Cpu, fid uint32, a0 uint32, a1 uint32, a2 uint32) (int32, uint32) {
+	switch fid {
+	// hart_start, the hart enters S-mode at start with a0 = hartid and a1 = opaque
+	case 0:
+		hartId, start, opaque := a0, a1, a2
+		if hartId >= uint32(len(s.Harts)) {
+			return SBI_ERR_INVALID_PARAM, 0
+		}
+		hart := s.Harts[hartId]
+		if !hart.Stopped {
+			return SBI_ERR_ALREADY_AVAILABLE, 0
+		}
+		hart.PC = start
+		hart.CurrentMode = 1
+		hart.Registers[10] = hartId
+		hart.Registers[11] = opaque
+		hart.CSR.Registers[SRW] = 0
+		sstatus := ToMStatusReg(hart.CSR.Registers[SSTATUS])
+		sstatus.sie = 0
+		hart.CSR.Registers[SSTATUS] = FromMStatusReg(sstatus)
+		hart.Stopped = false
+		hart.Waiting = false
+		return SBI_SUCCESS, 0
+	// hart_stop, there must always be a running hart
+	case 1:
+		for _, hart := range s.Harts {
+			if hart != c && !hart.Stopped {
+				c.Stopped = true
+				return SBI_SUCCESS, 0
+			}
+		}
+		return SBI_ERR_FAILED, 0
+	// hart_get_status
+	case 2:
+		hartId := a0
+		if hartId >= uint32(len(s.Harts)) {
+			return SBI_ERR_INVALID_PARAM, 0
+		}
+		if s.Harts[hartId].Stopped {
+			return SBI_SUCCESS, SBI_HSM_STOPPED
+		}
+		return SBI_SUCCESS, SBI_HSM_STARTED
+	// hart_suspend with a0 = suspend type, a retentive suspend waits like wfi and returns
+	case 3:
+		suspendType := a0
+		if suspendType == 0 {
+			c.Waiting = true
+			return SBI_SUCCESS, 0
+		}
+		if suspendType < SBI_HSM_SUSPEND_NON_RETENTIVE {
+			return SBI_ERR_INVALID_PARAM, 0
+		}
+		return SBI_ERR_NOT_SUPPORTED, 0
+	}
+	return SBI_ERR_NOT_SUPPORTED, 0
+}
+
+func (s *Sbi) reset(c *Cpu, resetType uint32, reason uint32) int32 {
+	switch resetType {
+	case SBI_SRST_SHUTDOWN:
+		if reason == SBI_SRST_REASON_FAILURE {
+			_ = c.Memory.Syscon.Write(FINISHER_FAIL|1<<16, VIRT_TEST)
+		} else {
+			_ = c.Memory.Syscon.Write(FINISHER_PASS, VIRT_TEST)
+		}
+	case SBI_SRST_COLD_REBOOT, SBI_SRST_WARM_REBOOT:
+		_ = c.Memory.Syscon.Write(FINISHER_RESET, VIRT_TEST)
+	default:
+		return SBI_ERR_INVALID_PARAM
+	}
+	return SBI_SUCCESS
+}
+
+func (s *Sbi) legacy(c *Cpu, ext uint32, a0 uint32, a1 uint32) int32 {
+	switch ext {
+	case SBI_LEGACY_SET_TIMER:
+		return s.setTimer(c, uint64(a1)<<32|uint64(a0))
+	case SBI_LEGACY_CONSOLE_PUTCHAR:
+		c.Memory.Uart.Transmit(byte(a0))
+		return SBI_SUCCESS
+	case SBI_LEGACY_CONSOLE_GETCHAR:
+		b, ok := c.Memory.Uart.Receive()
+		if !ok {
+			return -1
+		}
+		return int32(b)
+	case SBI_LEGACY_CLEAR_IPI:
+		c.CSR.Registers[MIP] &^= MIP_SSIP
+		return SBI_SUCCESS
+	// Legacy calls pass a pointer to the hart mask, or 0 for all harts
+	case SBI_LEGACY_SEND_IPI:
+		mask, base, ok := s.legacyHartMask(c, a0)
+		if !ok {
+			return SBI_ERR_INVALID_ADDRESS
+		}
+		return s.sendIpi(mask, base)
+	case SBI_LEGACY_REMOTE_FENCE_I, SBI_LEGACY_REMOTE_SFENCE_VMA, SBI_LEGACY_REMOTE_SFENCE_VMA_ASID:
+		mask, base, ok := s.legacyHartMask(c, a0)
+		if !ok {
+			return SBI_ERR_INVALID_ADDRESS
+		}
+		err := s.checkHartMask(mask, base)
+		if ext == SBI_LEGACY_REMOTE_FENCE_I && err == SBI_SUCCESS {
+			c.Memory.FlushCode()
+		}
+		return err
+	case SBI_LEGACY_SHUTDOWN:
+		_ = c.Memory.Syscon.Write(FINISHER_PASS, VIRT_TEST)
+		return SBI_SUCCESS
+	}
+	return SBI_ERR_NOT_SUPPORTED
+}
+
+// legacyHartMask reads the mask the kernel points to with a virtual address, false when it isn't mapped
+func (s *Sbi) legacyHartMask(c *Cpu, addr uint32) (uint32, uint32, bool) {
+	if addr == 0 {
+		return 0, ^uint32(0), true
+	}
+	paddr, ok := translateSv32(c, addr)
+	if !ok {
+		return 0, 0, false
+	}
+	return peekWord(c.Memory, paddr), 0, true
+}
+
+// translateSv32 walks the page tables satp points to, like the MMU would for a S-mode load
+func translateSv32(c *Cpu, vaddr uint32) (uint32, bool) {
+	satp := c.CSR.Registers[SRW]
+	// Bare
+	if satp>>31 == 0 {
+		return vaddr, true
+	}
+	table := (satp & 0x3fffff) << 12
+	for level := 1; level >= 0; level-- {
+		pte := peekWord(c.Memory, table+(vaddr>>(12+10*level)&0x3ff)*4)
+		// Not valid, or writable without being readable
+		if pte&1 == 0 || pte&0x6 == 0x4 {
+			return 0, false
+		}
+		ppn := pte >> 10
+		// Neither readable nor executable, a pointer to the next level
+		if pte&0xa == 0 {
+			table = ppn << 12
+			continue
+		}
+		if level == 1 {
+			// A megapage must be aligned to 4 MiB
+			if ppn&0x3ff != 0 {
+				return 0, false
+			}
+			return ppn<<12 | vaddr&0x3fffff, true
+		}
+		return ppn<<12 | vaddr&0xfff, true
+	}
+	return 0, false
+}
+
+// peekWord reads RAM without touching any device
+func peekWord(m *Memory, addr uint32) uint32 {
+	return uint32(m.PeekByte(addr)) | uint32(m.PeekByte(addr+1))<<8 | uint32(m.PeekByte(addr+2))<<16 | uint32(m.PeekByte(addr+3))<<24
+}
@@ -0,0 +1,155 @@
+package instructions
+
+import "testing"
+
+func newTestSbi(n int) (*Sbi, []*Cpu) {
+	harts := newTestHarts(n)
+	harts[0].Memory.Syscon = &Syscon{}
+	return NewSbi(harts), harts
+}
+
+// ecall makes a SBI call from c and returns a0 and a1
+func ecall(s *Sbi, c *Cpu, ext uint32, fid uint32, args ...uint32) (int32, uint32) {
+	c.Registers[17] = ext
+	c.Registers[16] = fid
+	for i, arg := range args {
+		c.Registers[10+i] = arg
+	}
+	s.Ecall(c)
+	return int32(c.Registers[10]), c.Registers[11]
+}
+
+func TestSbiBase(t *testing.T) {
+	s, harts := newTestSbi(1)
+	if err, v := ecall(s, harts[0], SBI_EXT_BASE, 0); err != SBI_SUCCESS || v != SBI_SPEC_VERSION {
+		t.Errorf("Expected spec version %x, Got %d %x", SBI_SPEC_VERSION, err, v)
+	}
+	for _, ext := range []uint32{SBI_EXT_TIME, SBI_EXT_IPI, SBI_EXT_RFENCE, SBI_EXT_HSM, SBI_EXT_SRST, SBI_LEGACY_SHUTDOWN} {
+		if err, v := ecall(s, harts[0], SBI_EXT_BASE, 3, ext); err != SBI_SUCCESS || v != 1 {
+			t.Errorf("Expected extension %x to be available, Got %d %d", ext, err, v)
+		}
+	}
+	if _, v := ecall(s, harts[0], SBI_EXT_BASE, 3, 0x12345678); v != 0 {
+		t.Errorf("Expected an unknown extension to be unavailable")
+	}
+	if err, _ := ecall(s, harts[0], 0x12345678, 0); err != SBI_ERR_NOT_SUPPORTED {
+		t.Errorf("Expected SBI_ERR_NOT_SUPPORTED for an unknown extension, Got %d", err)
+	}
+}
+
+func TestSbiSetTimer(t *testing.T) {
+	s, harts := newTestSbi(2)
+	c := harts[1]
+	c.Memory.Clint.Mtime = 0x1_0000_0000
+	ecall(s, c, SBI_EXT_TIME, 0, 0x10, 1)
+	s.Tick()
+	if c.CSR.Registers[MIP]&MIP_STIP > 0 {
+		t.Errorf("Expected no STIP before the time")
+	}
+	c.Memory.Clint.Mtime = 0x1_0000_0010
+	s.Tick()
+	if c.CSR.Registers[MIP]&MIP_STIP == 0 || harts[0].CSR.Registers[MIP]&MIP_STIP > 0 {
+		t.Errorf("Expected STIP on hart 1 only")
+	}
+	// A new time clears it
+	ecall(s, c, SBI_EXT_TIME, 0, 0x20, 1)
+	if c.CSR.Registers[MIP]&MIP_STIP > 0 {
+		t.Errorf("Expected set_timer to clear STIP")
+	}
+}
+
+func TestSbiHsm(t *testing.T) {
+	s, harts := newTestSbi(2)
+	if _, v := ecall(s, harts[0], SBI_EXT_HSM, 2, 1); v != SBI_HSM_STOPPED {
+		t.Errorf("Expected hart 1 to be stopped, Got %d", v)
+	}
+	if err, _ := ecall(s, harts[0], SBI_EXT_HSM, 0, 1, 0x80400000, 0x1234); err != SBI_SUCCESS {
+		t.Errorf("Expected hart_start to succeed, Got %d", err)
+	}
+	h := harts[1]
+	if h.Stopped || h.PC != 0x80400000 || h.CurrentMode != 1 || h.Registers[10] != 1 || h.Registers[11] != 0x1234 {
+		t.Errorf("Expected hart 1 in S-mode at 80400000 with a0 = 1 and a1 = 1234, Got pc %x mode %d a0 %x a1 %x", h.PC, h.CurrentMode, h.Registers[10], h.Registers[11])
+	}
+	if _, v := ecall(s, harts[0], SBI_EXT_HSM, 2, 1); v != SBI_HSM_STARTED {
+		t.Errorf("Expected hart 1 to be started, Got %d", v)
+	}
+	if err, _ := ecall(s, harts[0], SBI_EXT_HSM, 0, 1, 0x80400000, 0); err != SBI_ERR_ALREADY_AVAILABLE {
+		t.Errorf("Expected SBI_ERR_ALREADY_AVAILABLE, Got %d", err)
+	}
+	if err, _ := ecall(s, harts[0], SBI_EXT_HSM, 2, 2); err != SBI_ERR_INVALID_PARAM {
+		t.Errorf("Expected SBI_ERR_INVALID_PARAM for hart 2, Got %d", err)
+	}
+
+	// a0 is the suspend type, not a hart
+	if err, _ := ecall(s, h, SBI_EXT_HSM, 3, 0); err != SBI_SUCCESS || !h.Waiting {
+		t.Errorf("Expected a retentive suspend to wait like wfi, Got %d", err)
+	}
+	if err, _ := ecall(s, h, SBI_EXT_HSM, 3, 1); err != SBI_ERR_INVALID_PARAM {
+		t.Errorf("Expected SBI_ERR_INVALID_PARAM for a reserved suspend type, Got %d", err)
+	}
+}
+
+func TestSbiReset(t *testing.T) {
+	for _, test := range []struct {
+		resetType uint32
+		reason    uint32
+		reset     bool
+		code      int
+	}{
+		{SBI_SRST_SHUTDOWN, 0, false, 0},
+		{SBI_SRST_SHUTDOWN, SBI_SRST_REASON_FAILURE, false, 3},
+		{SBI_SRST_COLD_REBOOT, 0, true, 0},
+		{SBI_SRST_WARM_REBOOT, 0, true, 0},
+	} {
+		s, harts := newTestSbi(1)
+		syscon := harts[0].Memory.Syscon
+		if err, _ := ecall(s, harts[0], SBI_EXT_SRST, 0, test.resetType, test.reason); err != SBI_SUCCESS {
+			t.Errorf("Expected reset type %d to succeed, Got %d", test.resetType, err)
+		}
+		if !syscon.Requested || syscon.Reset != test.reset || syscon.ExitCode != test.code {
+			t.Errorf("Expected reset type %d reason %d to request reset %v with code %d, Got %+v", test.resetType, test.reason, test.reset, test.code, *syscon)
+		}
+	}
+	s, harts := newTestSbi(1)
+	if err, _ := ecall(s, harts[0], SBI_EXT_SRST, 0, 5, 0); err != SBI_ERR_INVALID_PARAM || harts[0].Memory.Syscon.Requested {
+		t.Errorf("Expected an unknown reset type to be refused, Got %d", err)
+	}
+}
+
+func TestSbiLegacyIpi(t *testing.T) {
+	s, harts := newTestSbi(2)
+	m := harts[0].Memory
+	// The mask is at virtual 0x1000, mapped by a 4 KiB page to 0x80003000
+	harts[0].CSR.Registers[SRW] = 1<<31 | 0x80001
+	m.WriteWord(0x80002000>>12<<10|1, 0x80001000)
+	m.WriteWord(0x80003000>>12<<10|0x7, 0x80002000+4)
+	m.WriteWord(1<<1, 0x80003000)
+	if ret, _ := ecall(s, harts[0], SBI_LEGACY_SEND_IPI, 0, 0x1000); ret != SBI_SUCCESS {
+		t.Errorf("Expected the IPI to be sent, Got %d", ret)
+	}
+	if harts[1].CSR.Registers[MIP]&MIP_SSIP == 0 || harts[0].CSR.Registers[MIP]&MIP_SSIP > 0 {
+		t.Errorf("Expected SSIP on hart 1 only")
+	}
+	if ret, _ := ecall(s, harts[0], SBI_LEGACY_SEND_IPI, 0, 0x400000); ret != SBI_ERR_INVALID_ADDRESS {
+		t.Errorf("Expected SBI_ERR_INVALID_ADDRESS for an unmapped mask, Got %d", ret)
+	}
+}
+
+func TestSbiMachineEcall(t *testing.T) {
+	s, harts := newTestSbi(1)
+	cpu := harts[0]
+	cpu.Sbi = s
+	cpu.PC = 0x80000000
+	cpu.CSR.Registers[MTVEC] = 0x80000100
+	cpu.Memory.WriteWord(0x00000073, cpu.PC) // ecall
+	_ = cpu.Exec(cpu.Memory.Fetch(cpu.PC))
+	if cpu.PC != 0x80000100 || cpu.CurrentMode != 3 {
+		t.Fatalf("Expected the M-mode handler, Got pc %x in mode %d", cpu.PC, cpu.CurrentMode)
+	}
+	if cpu.CSR.Registers[MCAUSE] != 11 || cpu.CSR.Registers[MEPC] != 0x80000000 {
+		t.Errorf("Expected mcause 11 and mepc 80000000, Got %d and %x", cpu.CSR.Registers[MCAUSE], cpu.CSR.Registers[MEPC])
+	}
+	if ToMStatusReg(cpu.CSR.Registers[MSTATUS]).mpp != 3 {
+		t.Errorf("Expected mpp 3")
+	}
+}
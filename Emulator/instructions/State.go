@@ -0,0 +1,153 @@
+package instructions
+
+import "maps"
+
+// RAM is saved in pages, pages with only zeros are left out
+const STATE_PAGE_SIZE = 4096
+
+// MachineState is everything needed to resume the machine where it was. The first hart is kept in the
+// machine state itself, the others in Harts.
+type MachineState struct {
+	HartState
+	Harts []HartState
+	// Keyed by page address
+	Pages   map[uint32][]byte
+	Uart    UARTState
+	Plic    PlicState
+	Clint   ClintState
+	Display map[uint32]uint32
+	Rtc     RTCState
+	Audio   AudioState
+	Events  EventsState
+	Syscon  SysconState
+}
+
+// HartState is what a hart keeps besides the memory and devices
+type HartState struct {
+	PC             uint32
+	Registers      [32]uint32
+	CurrentMode    uint32
+	AtomicReserved bool
+	Reservation    uint32
+	Stopped        bool
+	Waiting        bool
+	SoftwareSEIP   bool
+	Instret        uint64
+	CSR            []uint32
+}
+
+func (c *Cpu) saveHart() HartState {
+	return HartState{
+		PC:             c.PC,
+		Registers:      c.Registers,
+		CurrentMode:    c.CurrentMode,
+		AtomicReserved: c.AtomicReserved,
+		Reservation:    c.Reservation,
+		Stopped:        c.Stopped,
+		Waiting:        c.Waiting,
+		SoftwareSEIP:   c.SoftwareSEIP,
+		Instret:        c.Instret,
+		CSR:            append([]uint32(nil), c.CSR.Registers...),
+	}
+}
+
+func (c *Cpu) restoreHart(s HartState) {
+	c.PC = s.PC
+	c.Registers = s.Registers
+	c.CurrentMode = s.CurrentMode
+	c.AtomicReserved = s.AtomicReserved
+	c.Reservation = s.Reservation
+	c.Stopped = s.Stopped
+	c.Waiting = s.Waiting
+	c.SoftwareSEIP = s.SoftwareSEIP
+	c.Instret = s.Instret
+	copy(c.CSR.Registers, s.CSR)
+}
+
+// Save copies the state of all harts and devices, c is the first hart
+func (c *Cpu) Save() *MachineState {
+	m := c.Memory
+	s := c.saveDevices()
+	for addr, b := range m.Map {
+		if b == 0 {
+			continue
+		}
+		base := addr &^ (STATE_PAGE_SIZE - 1)
+		page, ok := s.Pages[base]
+		if !ok {
+			page = make([]byte, STATE_PAGE_SIZE)
+			s.Pages[base] = page
+		}
+		page[addr-base] = b
+	}
+	return s
+}
+
+// SaveDirty is Save with only the pages in Memory.Dirty, pages with only zeros included
+func (c *Cpu) SaveDirty() *MachineState {
+	m := c.Memory
+	s := c.saveDevices()
+	for base := range m.Dirty {
+		page := make([]byte, STATE_PAGE_SIZE)
+		for n := range page {
+			page[n] = m.Map[base+uint32(n)]
+		}
+		s.Pages[base] = page
+	}
+	return s
+}
+
+// saveDevices copies everything but the memory
+func (c *Cpu) saveDevices() *MachineState {
+	m := c.Memory
+	s := &MachineState{
+		HartState: c.saveHart(),
+		Pages:     make(map[uint32][]byte),
+		Uart:      m.Uart.State(),
+		Plic:      m.Plic.State(),
+		Clint:     m.Clint.State(),
+		Rtc:       m.Rtc.State(),
+		Audio:     m.Audio.State(),
+		Events:    m.Events.State(),
+		Syscon:    m.Syscon.State(),
+	}
+	for i := 1; i < len(m.Harts); i++ {
+		s.Harts = append(s.Harts, m.Harts[i].saveHart())
+	}
+	m.Display.Mutex.Lock()
+	s.Display = maps.Clone(m.Display.Screen)
+	m.Display.Mutex.Unlock()
+	return s
+}
+
+// Restore puts the harts and devices back in a saved state, c is the first hart
+func (c *Cpu) Restore(s *MachineState) {
+	m := c.Memory
+	c.restoreHart(s.HartState)
+	for i, hart := range s.Harts {
+		m.Harts[i+1].restoreHart(hart)
+	}
+	m.Map = make(map[uint32]byte)
+	m.FlushCode()
+	for base, page := range s.Pages {
+		for n, b := range page {
+			if b != 0 {
+				m.Map[base+uint32(n)] = b
+			}
+		}
+	}
+	m.Uart.SetState(s.Uart)
+	m.Syscon.SetState(s.Syscon)
+	m.Clint.SetState(s.Clint)
+	m.Display.Mutex.Lock()
+	m.Display.Screen = maps.Clone(s.Display)
+	if m.Display.Screen == nil {
+		m.Display.Screen = make(map[uint32]uint32)
+	}
+	m.Display.Mutex.Unlock()
+	// They drive interrupt lines, so they go after the CSRs
+	m.Plic.SetState(s.Plic)
+	m.Rtc.SetState(s.Rtc)
+	m.Audio.SetState(s.Audio)
+	m.Events.SetState(s.Events)
+}
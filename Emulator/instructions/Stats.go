@@ -0,0 +1,63 @@
+package instructions
+
+import "time"
+
+// Stats counts what the machine spends its time on besides instructions, for benchmarks. It is only
+// kept when Memory.Stats is set.
+type Stats struct {
+	// Device register accesses and the time they took
+	MMIO     uint64
+	MMIOTime time.Duration
+	// Exceptions and interrupts taken. Calls to the built-in SBI count as exceptions, they would trap
+	// into M-mode firmware.
+	Traps      uint64
+	Interrupts uint64
+	// Set while an access is timed, devices accessing memory themselves are part of it
+	busy  bool
+	began time.Time
+}
+
+// Device registers, everything else is memory
+func isDevice(location uint32) bool {
+	switch {
+	case location >= VIRT_UART0 && location < VIRT_UART0+0x100,
+		location >= PLIC_BASE && location < PLIC_BASE+PLIC_SIZE,
+		location >= BASE_CLINT && location <= CLINT_END,
+		location >= VIRT_TEST && location < VIRT_TEST+VIRT_TEST_SIZE,
+		location >= VIRT_RTC && location < VIRT_RTC+VIRT_RTC_SIZE,
+		location >= VIRT_EVENTS && location < VIRT_EVENTS+VIRT_EVENTS_SIZE,
+		location >= VIRT_AUDIO && location < VIRT_AUDIO+VIRT_AUDIO_SIZE,
+		location >= VIRT_DISPLAY && location < VIRT_DISPLAY_CTRL+4:
+		return true
+	}
+	return false
+}
+
+// startMMIO starts timing an access to location if it goes to a device. It returns false when there is
+// nothing to stop.
+func (m *Memory) startMMIO(location uint32) bool {
+	s := m.Stats
+	if s == nil || s.busy || !(isDevice(location) || m.mmioAt(location) != nil) {
+		return false
+	}
+	s.busy = true
+	s.began = time.Now()
+	return true
+}
+
+func (m *Memory) stopMMIO() {
+	s := m.Stats
+	s.MMIO++
+	s.MMIOTime += time.Since(s.began)
+	s.busy = false
+}
+
+func (c *Cpu) countTrap(cause uint32) {
+	if s := c.Memory.Stats; s != nil {
+		if cause&(1<<31) > 0 {
+			s.Interrupts++
+		} else {
+			s.Traps++
+		}
+	}
+}
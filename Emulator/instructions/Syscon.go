@@ -0,0 +1,58 @@
+package instructions
+
+import "errors"
+
+// SiFive test device, used by guests to power off or reboot the machine.
+// Linux drives it through syscon-poweroff and syscon-reboot. Same layout as QEMU virt.
+const VIRT_TEST = 0x100000
+const VIRT_TEST_SIZE = 0x1000
+
+// Lower 16 bits of the written value select the action, upper 16 bits are the fail code
+const FINISHER_FAIL = 0x3333
+const FINISHER_PASS = 0x5555
+const FINISHER_RESET = 0x7777
+
+type Syscon struct {
+	// Set once the guest asked for power off or reset
+	Requested bool
+	Reset     bool
+	ExitCode  int
+}
+
+func (s *Syscon) Write(v uint32, addr uint32) error {
+	if addr != VIRT_TEST {
+		return errors.New("Invalid address for syscon")
+	}
+	code := int(v >> 16)
+	switch v & 0xFFFF {
+	case FINISHER_FAIL:
+		// Same as QEMU, so a fail never looks like a pass
+		s.Requested = true
+		s.ExitCode = code<<1 | 1
+	case FINISHER_PASS:
+		s.Requested = true
+		s.ExitCode = 0
+	case FINISHER_RESET:
+		s.Requested = true
+		s.Reset = true
+	}
+	return nil
+}
+
+// SysconState is a power off or reset the machine didn't act on yet, for snapshots. The run loop acts on it
+// right after the instruction, a library user can still save before stepping again.
+type SysconState struct {
+	Requested bool
+	Reset     bool
+	ExitCode  int
+}
+
+func (s *Syscon) State() SysconState {
+	return SysconState{Requested: s.Requested, Reset: s.Reset, ExitCode: s.ExitCode}
+}
+
+func (s *Syscon) SetState(state SysconState) {
+	s.Requested = state.Requested
+	s.Reset = state.Reset
+	s.ExitCode = state.ExitCode
+}
@@ -0,0 +1,42 @@
+package instructions
+
+import "testing"
+
+func TestSyscon(t *testing.T) {
+	for _, test := range []struct {
+		v         uint32
+		requested bool
+		reset     bool
+		code      int
+	}{
+		{FINISHER_PASS, true, false, 0},
+		{0x2a<<16 | FINISHER_FAIL, true, false, 0x2a<<1 | 1},
+		// A fail without a code still isn't a pass
+		{FINISHER_FAIL, true, false, 1},
+		{FINISHER_RESET, true, true, 0},
+		{0x1234, false, false, 0},
+	} {
+		m := &Memory{Map: make(map[uint32]byte), Syscon: &Syscon{}}
+		m.WriteWord(test.v, VIRT_TEST)
+		s := m.Syscon
+		if s.Requested != test.requested || s.Reset != test.reset || s.ExitCode != test.code {
+			t.Errorf("Expected %x to request %v reset %v with code %d, Got %+v", test.v, test.requested, test.reset, test.code, *s)
+		}
+	}
+}
+
+func TestSysconBadOffset(t *testing.T) {
+	s := &Syscon{}
+	if err := s.Write(FINISHER_PASS, VIRT_TEST+4); err == nil || s.Requested {
+		t.Errorf("Expected a write past the finisher register to fail")
+	}
+}
+
+func TestSysconState(t *testing.T) {
+	s := &Syscon{}
+	state := SysconState{Requested: true, ExitCode: 5}
+	s.SetState(state)
+	if s.State() != state {
+		t.Errorf("Expected state %+v, Got %+v", state, s.State())
+	}
+}
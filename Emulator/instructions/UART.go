@@ -22,9 +22,16 @@ const SCR = 7
 
 const DLAB_FLAG = 1 << 7
 
+// PLIC source of UART0 on QEMU virt
+const UART0_IRQ = 10
+
 type UART struct {
 	registerRT [8]byte
 	registerDL [3]byte
+	// Polled for a received byte whenever the receive buffer is empty
+	Input func() (byte, bool)
+	// Called with every transmitted byte
+	Output func(b byte)
 }
 
 func (u *UART) getDLabFlag() byte {
@@ -39,13 +46,42 @@ func NewUART() *UART {
 		// We are ready to transmit and receive
 		registerRT: [8]byte{0, 0, 0, 0, 0, 32, 0, 0},
 		registerDL: [3]byte{0, 0, 0},
+		Input:      StdinInput,
+		Output:     StdoutOutput,
+	}
+}
+
+// StdinInput reads a byte from stdin without blocking
+func StdinInput() (byte, bool) {
+	unix.SetNonblock(int(os.Stdin.Fd()), true)
+	defer unix.SetNonblock(int(os.Stdin.Fd()), false)
+
+	// Create a buffer to read into
+	buf := make([]byte, 1)
+	// Try to read one byte
+	_, err := os.Stdin.Read(buf)
+	return buf[0], err == nil
+}
+
+// StdoutOutput writes a byte to stdout
+func StdoutOutput(b byte) {
+	fmt.Printf("%c", b)
+}
+
+// poll fills the receive buffer from Input if it is empty
+func (u *UART) poll() {
+	if u.registerRT[LSR]&0x1 == 0 {
+		if b, ok := u.Input(); ok {
+			u.registerRT[RBR] = b
+			u.registerRT[LSR] |= 0x1
+		}
 	}
 }
 
 func (u *UART) Write(b byte, location uint32) error {
 	// This is receive mode. This is receive because we receive it and write to stdout
 	if location == THR && u.getDLabFlag() == 0 {
-		fmt.Printf("%c", b)
+		u.Transmit(b)
 		// show you can write more data
 		// we write to the register, so the register can be completely used by read buffer
 		u.registerRT[5] = u.registerRT[5] | 1<<5
@@ -64,42 +100,30 @@ func (u *UART) Write(b byte, location uint32) error {
 }
 
 func (u *UART) DataExistsToRead() bool {
-	if u.registerRT[LSR]&0x1 > 0 {
-		return true
-	}
-	if u.registerRT[LSR]&0x1 == 0 {
-		// read only if there is no data in receive buffer
-		unix.SetNonblock(int(os.Stdin.Fd()), true)
-		defer unix.SetNonblock(int(os.Stdin.Fd()), false)
-
-		// Create a buffer to read into
-		buf := make([]byte, 1)
-		// Try to read one byte
-		_, err := os.Stdin.Read(buf)
-		if err == nil {
-			u.registerRT[RBR] = buf[0]
-			u.registerRT[LSR] |= 0x1
-			return true
-		}
+	// read only if there is no data in receive buffer
+	u.poll()
+	return u.registerRT[LSR]&0x1 > 0
+}
+
+// Transmit sends a byte out of the UART
+func (u *UART) Transmit(b byte) {
+	u.Output(b)
+}
+
+// Receive returns the next byte from the UART, if there is one
+func (u *UART) Receive() (byte, bool) {
+	if !u.DataExistsToRead() {
+		return 0, false
 	}
-	return false
+	b, _ := u.Read(RBR)
+	return b, true
 }
 
 // TODO
 func (u *UART) Read(location uint32) (byte, error) {
 	if location == LSR && u.registerRT[LSR]&0x1 == 0 {
 		// read only if there is no data in receive buffer
-		unix.SetNonblock(int(os.Stdin.Fd()), true)
-		defer unix.SetNonblock(int(os.Stdin.Fd()), false)
-
-		// Create a buffer to read into
-		buf := make([]byte, 1)
-		// Try to read one byte
-		_, err := os.Stdin.Read(buf)
-		if err == nil {
-			u.registerRT[RBR] = buf[0]
-			u.registerRT[LSR] |= 0x1
-		}
+		u.poll()
 		return u.registerRT[LSR], nil
 	}
 
@@ -117,3 +141,18 @@ func (u *UART) Read(location uint32) (byte, error) {
 
 	return u.registerRT[location], nil
 }
+
+// UARTState is the register file of the UART, for snapshots
+type UARTState struct {
+	RT [8]byte
+	DL [3]byte
+}
+
+func (u *UART) State() UARTState {
+	return UARTState{RT: u.registerRT, DL: u.registerDL}
+}
+
+func (u *UART) SetState(s UARTState) {
+	u.registerRT = s.RT
+	u.registerDL = s.DL
+}
@@ -7,63 +7,115 @@ const CLINT_END = 0x200BFFF
 const MTIMECMP_OFFSET = 0x4000
 const MTIME_OFFSET = 0xBFF8
 
+// Machine software and timer interrupt bits of mip
+const MIP_MSIP = 1 << 3
+const MIP_MTIP = 1 << 7
+
+// Every hart has a msip word at 4 * hart ID and a 64 bit mtimecmp at MTIMECMP_OFFSET + 8 * hart ID,
+// mtime is shared
 type Clint struct {
-	Msip     uint32
-	Mtimecmp uint64
+	Msip     []uint32
+	Mtimecmp []uint64
 	Mtime    uint64
+	// Harts whose MSIP and MTIP bits are driven by the registers, indexed by hart ID
+	Harts []*Cpu
 }
 
-func (c *Clint) Write(v uint32, addr uint32, cpu *Cpu) error {
+// NewClint has no timer interrupt pending till a hart programs its mtimecmp
+func NewClint(harts int) *Clint {
+	c := &Clint{Msip: make([]uint32, harts), Mtimecmp: make([]uint64, harts)}
+	for i := range c.Mtimecmp {
+		c.Mtimecmp[i] = ^uint64(0)
+	}
+	return c
+}
+
+func (c *Clint) Write(v uint32, addr uint32) error {
 	if addr > CLINT_END || addr < BASE_CLINT {
 		return errors.New("Invalid address for clint")
 	}
+	offset := addr - BASE_CLINT
 
-	if addr == BASE_CLINT {
-		c.Msip = v
-		// trigger MSIP (Software interrupt)
-		// set MSIP (3) of MIP
-		// We assume software interrupt
-		c.TriggerInterrupt(3, cpu)
+	switch {
+	case offset < 4*uint32(len(c.Msip)):
+		// Only bit 0 is writable, it is the MSIP bit of the hart
+		hart := offset / 4
+		c.Msip[hart] = v & 1
+		c.setPending(hart, MIP_MSIP, v&1 > 0)
+	case offset >= MTIMECMP_OFFSET && offset < MTIMECMP_OFFSET+8*uint32(len(c.Mtimecmp)):
+		hart := (offset - MTIMECMP_OFFSET) / 8
+		c.Mtimecmp[hart] = setHalf(c.Mtimecmp[hart], v, offset%8 == 4)
+		c.setPending(hart, MIP_MTIP, c.Mtime >= c.Mtimecmp[hart])
+	case offset == MTIME_OFFSET || offset == MTIME_OFFSET+4:
+		c.Mtime = setHalf(c.Mtime, v, offset == MTIME_OFFSET+4)
 	}
+	return nil
+}
 
-	if addr == BASE_CLINT+MTIMECMP_OFFSET {
-		// so clear everything except top 32 bits
-		c.Mtimecmp = (c.Mtimecmp & uint64(0xFFFFFFFF<<32)) | uint64(v)
-		// lower part of mtimecmp register
+func (c *Clint) Read(addr uint32) uint32 {
+	offset := addr - BASE_CLINT
+	switch {
+	case offset < 4*uint32(len(c.Msip)):
+		return c.Msip[offset/4]
+	case offset >= MTIMECMP_OFFSET && offset < MTIMECMP_OFFSET+8*uint32(len(c.Mtimecmp)):
+		return getHalf(c.Mtimecmp[(offset-MTIMECMP_OFFSET)/8], offset%8 == 4)
+	case offset == MTIME_OFFSET || offset == MTIME_OFFSET+4:
+		return getHalf(c.Mtime, offset == MTIME_OFFSET+4)
 	}
+	return 0
+}
 
-	if addr == BASE_CLINT+MTIME_OFFSET+4 {
-		// upper part of mtimecmp
-		// so clear everything except bottom 32 bits
-		c.Mtimecmp = (c.Mtimecmp & uint64(0xFFFFFFFF)) | uint64(v)<<32
+// Tick raises the machine timer interrupt of the harts whose mtimecmp is reached
+func (c *Clint) Tick() {
+	for hart := range c.Harts {
+		c.setPending(uint32(hart), MIP_MTIP, c.Mtime >= c.Mtimecmp[hart])
 	}
+}
 
-	if addr == BASE_CLINT+MTIME_OFFSET {
-		// so clear everything except top 32 bits
-		c.Mtime = (c.Mtime & uint64(0xFFFFFFFF<<32)) | uint64(v)
-		// lower part of mtimecmp register
+func (c *Clint) setPending(hart uint32, bit uint32, v bool) {
+	if int(hart) >= len(c.Harts) || c.Harts[hart] == nil {
+		return
 	}
-
-	if addr == BASE_CLINT+MTIMECMP_OFFSET+4 {
-		// upper part of mtimecmp
-		// so clear everything except bottom 32 bits
-		c.Mtime = (c.Mtime & uint64(0xFFFFFFFF)) | uint64(v)<<32
+	mip := &c.Harts[hart].CSR.Registers[MIP]
+	if v {
+		*mip |= bit
+		c.Harts[hart].wake()
+	} else {
+		*mip &^= bit
 	}
+}
 
-	return nil
+func setHalf(r uint64, v uint32, high bool) uint64 {
+	if high {
+		return r&0xFFFFFFFF | uint64(v)<<32
+	}
+	return r&^0xFFFFFFFF | uint64(v)
 }
 
-func (c *Clint) TriggerTimerInterrupt(cpu *Cpu) {
-	if cpu.CSR.Registers[MIP] > 0 {
-		return
+func getHalf(r uint64, high bool) uint32 {
+	if high {
+		return uint32(r >> 32)
 	}
-	// set mtip bit on position 7
-	cpu.CSR.Registers[MIP] = cpu.CSR.Registers[MIP] | 1<<7
+	return uint32(r)
 }
 
-func (c *Clint) TriggerInterrupt(id uint32, cpu *Cpu) {
-	if cpu.CSR.Registers[MIP] > 0 {
-		return
+// ClintState is the state of the registers, for snapshots
+type ClintState struct {
+	Msip     []uint32
+	Mtimecmp []uint64
+	Mtime    uint64
+}
+
+func (c *Clint) State() ClintState {
+	return ClintState{
+		Msip:     append([]uint32(nil), c.Msip...),
+		Mtimecmp: append([]uint64(nil), c.Mtimecmp...),
+		Mtime:    c.Mtime,
 	}
-	cpu.CSR.Registers[MIP] = cpu.CSR.Registers[MIP] | 1<<id
+}
+
+func (c *Clint) SetState(s ClintState) {
+	copy(c.Msip, s.Msip)
+	copy(c.Mtimecmp, s.Mtimecmp)
+	c.Mtime = s.Mtime
 }
@@ -0,0 +1,102 @@
+package instructions
+
+import "testing"
+
+func newTestHarts(n int) []*Cpu {
+	m := &Memory{Map: make(map[uint32]byte), Clint: NewClint(n), Plic: NewPlic(PLIC_MAX_SOURCES, 2*uint32(n))}
+	harts := make([]*Cpu, n)
+	for i := range harts {
+		harts[i] = &Cpu{Memory: m, CSR: &CSR{Registers: make([]uint32, 4096)}, HartID: uint32(i), CurrentMode: 3}
+	}
+	m.SetHarts(harts)
+	return harts
+}
+
+func TestClintPerHart(t *testing.T) {
+	harts := newTestHarts(2)
+	m := harts[0].Memory
+
+	m.WriteWord(1, BASE_CLINT+4)
+	if harts[1].CSR.Registers[MIP]&MIP_MSIP == 0 || harts[0].CSR.Registers[MIP]&MIP_MSIP > 0 {
+		t.Errorf("Expected only hart 1 to get the software interrupt")
+	}
+	m.WriteWord(0, BASE_CLINT+4)
+	if harts[1].CSR.Registers[MIP]&MIP_MSIP > 0 {
+		t.Errorf("Expected the software interrupt to be cleared")
+	}
+
+	m.Clint.Mtime = 0x1_0000_0010
+	m.WriteWord(0x20, BASE_CLINT+MTIMECMP_OFFSET+8)
+	m.WriteWord(1, BASE_CLINT+MTIMECMP_OFFSET+12)
+	if got := m.Clint.Mtimecmp[1]; got != 0x1_0000_0020 {
+		t.Errorf("Expected mtimecmp of hart 1 0x100000020, Got %x", got)
+	}
+	if got := m.ReadWord(BASE_CLINT + MTIME_OFFSET + 4); got != 1 {
+		t.Errorf("Expected high half of mtime 1, Got %x", got)
+	}
+	m.Clint.Mtime = 0x1_0000_0020
+	m.Clint.Tick()
+	if harts[1].CSR.Registers[MIP]&MIP_MTIP == 0 || harts[0].CSR.Registers[MIP]&MIP_MTIP > 0 {
+		t.Errorf("Expected only hart 1 to get the timer interrupt")
+	}
+}
+
+func TestReservationBrokenByOtherHart(t *testing.T) {
+	harts := newTestHarts(2)
+	m := harts[0].Memory
+	lr := &Decoded{Op: OP_LR_W, RD: 5, RS1: 10, exec: executeR}
+	sc := &Decoded{Op: OP_SC_W, RD: 6, RS1: 10, RS2: 11, exec: executeR}
+	harts[0].Registers[10] = 0x80001000
+	harts[0].Registers[11] = 7
+
+	_ = harts[0].Exec(lr)
+	m.WriteWord(3, 0x80001004)
+	_ = harts[0].Exec(sc)
+	if harts[0].Registers[6] != 0 {
+		t.Errorf("Expected sc.w to succeed after a store to another word")
+	}
+
+	_ = harts[0].Exec(lr)
+	harts[1].Registers[10], harts[1].Registers[11] = 0x80001000, 7
+	_ = harts[1].Exec(&Decoded{Op: OP_AMOADD_W, RD: 5, RS1: 10, RS2: 11, exec: executeR})
+	_ = harts[0].Exec(sc)
+	if harts[0].Registers[6] != 1 {
+		t.Errorf("Expected sc.w to fail after another hart wrote the word")
+	}
+	if got := m.ReadWord(0x80001000); got != 14 {
+		t.Errorf("Expected the failed sc.w to leave 14, Got %d", got)
+	}
+}
+
+func TestSbiHartStart(t *testing.T) {
+	harts := newTestHarts(2)
+	sbi := NewSbi(harts)
+	if !harts[1].Stopped {
+		t.Errorf("Expected hart 1 to wait for hart_start")
+	}
+	ecall := func(c *Cpu, fid uint32, args ...uint32) (int32, uint32) {
+		c.Registers[17], c.Registers[16] = SBI_EXT_HSM, fid
+		copy(c.Registers[10:], args)
+		sbi.Ecall(c)
+		return int32(c.Registers[10]), c.Registers[11]
+	}
+
+	if err, _ := ecall(harts[0], 1); err != SBI_ERR_FAILED {
+		t.Errorf("Expected the last running hart not to stop, Got %d", err)
+	}
+	if err, _ := ecall(harts[0], 0, 1, 0x80400000, 0x1234); err != SBI_SUCCESS {
+		t.Errorf("Expected hart_start to succeed, Got %d", err)
+	}
+	if h := harts[1]; h.Stopped || h.PC != 0x80400000 || h.Registers[10] != 1 || h.Registers[11] != 0x1234 || h.CurrentMode != 1 {
+		t.Errorf("Expected hart 1 to start in S-mode at 0x80400000 with a0 1 and a1 0x1234")
+	}
+	if err, _ := ecall(harts[0], 0, 1, 0x80400000, 0); err != SBI_ERR_ALREADY_AVAILABLE {
+		t.Errorf("Expected hart_start of a running hart to fail, Got %d", err)
+	}
+	if err, _ := ecall(harts[1], 1); err != SBI_SUCCESS || !harts[1].Stopped {
+		t.Errorf("Expected hart 1 to stop")
+	}
+	if _, status := ecall(harts[0], 2, 1); status != SBI_HSM_STOPPED {
+		t.Errorf("Expected hart 1 to be stopped, Got %d", status)
+	}
+}
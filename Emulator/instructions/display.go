@@ -4,12 +4,24 @@ import (
 	"sync"
 )
 
+// Register after the pixels, guests write DISPLAY_CTRL_SCREENSHOT to it to have the screen saved
+const VIRT_DISPLAY_CTRL = VIRT_DISPLAY + VIRT_DISPLAY_SIZE
+const DISPLAY_CTRL_SCREENSHOT = 1
+
 type Display struct {
 	Screen map[uint32]uint32
 	Mutex  sync.Mutex
+	// Set by the guest through VIRT_DISPLAY_CTRL, cleared once the screenshot is taken
+	ScreenshotRequested bool
 }
 
 func (d *Display) Write(v uint32, add uint32) error {
+	if add == VIRT_DISPLAY_CTRL {
+		if v == DISPLAY_CTRL_SCREENSHOT {
+			d.ScreenshotRequested = true
+		}
+		return nil
+	}
 	d.Mutex.Lock()
 	addr := add - VIRT_DISPLAY
 	d.Screen[addr] = v
@@ -1,8 +1,187 @@
 package main
 
-import "riscv/emulator"
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"riscv/emulator"
+	"strconv"
+	"strings"
+	"time"
+)
 
 func main() {
-	emu := emulator.NewEmulator()
-	emu.Run()
+	if len(os.Args) > 1 && os.Args[1] == "disasm" {
+		os.Exit(disasmMain(os.Args[2:]))
+	}
+
+	image := flag.String("image", "", "Flat binary to run, defaults to $OBJ_PATH")
+	sbi := flag.Bool("sbi", false, "Use the built-in SBI firmware and boot the image in S-mode")
+	memory := flag.Uint("memory", 0, "DRAM size in MiB, defaults to 128")
+	harts := flag.Int("harts", 1, "Number of harts, they take turns running a quantum of instructions")
+	bootargs := flag.String("bootargs", "", "Kernel command line put in the device tree")
+	dumpDTB := flag.String("dump-dtb", "", "Write the generated device tree blob to this file")
+	gdb := flag.String("gdb", "", "Serve gdb on a localhost TCP port like :1234, or a unix socket like unix:/tmp/gdb")
+	gdbWait := flag.Bool("gdb-wait", false, "Wait for gdb before running the first instruction")
+	monitor := flag.String("monitor", "", "Serve the monitor console on a localhost TCP port like :4444, or a unix socket like unix:/tmp/monitor")
+	rtcStart := flag.String("rtc-start", "", "Start the RTC at this RFC3339 time instead of the host time")
+	trace := flag.String("trace", "", "Write a spike --log-commits style trace to this file, - for stdout")
+	tracePC := flag.String("trace-pc", "", "Only trace PCs in the hex range start:end")
+	traceModes := flag.String("trace-modes", "", "Only trace these privilege modes, like m,s,u")
+	traceStart := flag.Uint64("trace-start", 0, "Skip this many instructions before tracing")
+	traceCount := flag.Uint64("trace-count", 0, "Stop tracing after this many instructions, 0 means no limit")
+	traceDisasm := flag.Bool("trace-disasm", true, "Write the disassembly line before each commit line")
+	lockstep := flag.String("lockstep", "", "Compare every instruction with this spike or qemu execlog commit log")
+	lockstepContext := flag.Int("lockstep-context", 0, "Instructions shown before a difference, defaults to 10")
+	snapshot := flag.String("snapshot", "", "File snapshots are saved to with F5 or -snapshot-pc and restored from with F9")
+	snapshotPC := flag.String("snapshot-pc", "", "Save a snapshot the first time the guest reaches this hex PC")
+	restore := flag.String("restore", "", "Resume from this snapshot instead of booting the image")
+	record := flag.String("record", "", "Record time and UART input to this file, to reproduce the run with -replay")
+	replay := flag.String("replay", "", "Replay a run recorded with -record")
+	profile := flag.String("profile", "", "Write a pprof profile of the guest to this file, for go tool pprof")
+	profileFolded := flag.String("profile-folded", "", "Write folded stacks of the guest to this file, for flame graphs")
+	profileTop := flag.Int("profile-top", 0, "Print the guest functions with the most instructions when the run ends, 0 means no report")
+	profileELF := flag.String("profile-elf", "", "ELF file of the image, its symbols name the functions in profiles")
+	profileInterval := flag.Uint64("profile-interval", 0, "Count every this many instructions instead of every instruction")
+	bench := flag.Bool("bench", false, "Report instructions per second, time spent in devices and traps taken when the run ends")
+	benchCount := flag.Uint64("bench-count", 0, "Stop the benchmark after this many instructions, 0 means run till the guest stops")
+	interpret := flag.Bool("interpret", false, "Run one instruction at a time instead of translating basic blocks, slower but checks interrupts after every instruction")
+	coverage := flag.String("coverage", "", "Write an lcov tracefile of the guest code executed to this file")
+	coverageELF := flag.String("coverage-elf", "", "ELF file of the image with debug info, maps the code to source lines for -coverage")
+	audio := flag.String("audio", "", "Write what the audio device plays to this WAV file")
+	mute := flag.Bool("mute", false, "Don't play the audio device on the speakers, it is never played with -headless")
+	reverse := flag.Bool("reverse", false, "Keep checkpoints so gdb can reverse-step and reverse-continue")
+	reverseInterval := flag.Uint64("reverse-interval", 0, "Instructions between checkpoints, defaults to 1000000")
+	headless := flag.Bool("headless", false, "Run without the SDL window")
+	web := flag.String("web", "", "Serve the browser frontend with the display, a UART console and controls on a localhost TCP port like :8080")
+	terminal := flag.Bool("terminal", false, "Draw the display in the terminal with the UART console on a status line, use with -headless")
+	terminalFPS := flag.Int("terminal-fps", 0, "Times a second the terminal is redrawn, defaults to 10")
+	vnc := flag.String("vnc", "", "Serve the display, keyboard and pointer over VNC on a localhost TCP port like :5900, or a unix socket like unix:/tmp/vnc")
+	screenshot := flag.String("screenshot", "", "File screenshots are written to, %d is replaced with the instruction count, defaults to kutemu-%d.png")
+	screenshotAt := flag.String("screenshot-at", "", "Take screenshots when these comma separated instruction counts are reached")
+	video := flag.String("video", "", "Write frames of the display to this .y4m or .avi file, or to PNG files when it has a %d for the frame number")
+	videoInterval := flag.Uint64("video-interval", 0, "Instructions between two video frames, defaults to 1000000")
+	videoFPS := flag.Int("video-fps", 0, "Frame rate written in the video header, defaults to 30")
+	flag.Parse()
+
+	config := emulator.Config{
+		Image:           *image,
+		SBI:             *sbi,
+		MemorySize:      uint32(*memory) * 1024 * 1024,
+		Harts:           *harts,
+		Bootargs:        *bootargs,
+		DumpDTB:         *dumpDTB,
+		Gdb:             *gdb,
+		GdbWait:         *gdbWait,
+		Monitor:         *monitor,
+		Trace:           *trace,
+		TraceDisasm:     *traceDisasm,
+		Lockstep:        *lockstep,
+		LockstepContext: *lockstepContext,
+		Snapshot:        *snapshot,
+		Restore:         *restore,
+		Record:          *record,
+		Replay:          *replay,
+		Profile:         *profile,
+		ProfileFolded:   *profileFolded,
+		ProfileTop:      *profileTop,
+		ProfileSymbols:  *profileELF,
+		ProfileInterval: *profileInterval,
+		Bench:           *bench || *benchCount > 0,
+		BenchCount:      *benchCount,
+		Interpret:       *interpret,
+		Coverage:        *coverage,
+		CoverageELF:     *coverageELF,
+		Headless:        *headless,
+		Vnc:             *vnc,
+		Terminal:        *terminal,
+		TerminalFPS:     *terminalFPS,
+		Web:             *web,
+		Screenshot:      *screenshot,
+		Video:           *video,
+		VideoInterval:   *videoInterval,
+		VideoFPS:        *videoFPS,
+		Audio:           *audio,
+		Mute:            *mute,
+		Reverse:         *reverse,
+		ReverseInterval: *reverseInterval,
+	}
+	config.TraceFilter.Start = *traceStart
+	config.TraceFilter.Count = *traceCount
+	if *tracePC != "" {
+		var start, end uint32
+		if _, err := fmt.Sscanf(*tracePC, "%x:%x", &start, &end); err != nil {
+			log.Fatalf("Invalid -trace-pc: %s\n", err)
+		}
+		config.TraceFilter.StartPC = start
+		config.TraceFilter.EndPC = end
+	}
+	if config.Record != "" && config.Replay != "" {
+		log.Fatalf("-record and -replay can't be used together\n")
+	}
+	if config.Restore != "" && (config.Record != "" || config.Replay != "") {
+		log.Fatalf("-restore can't be used with -record or -replay\n")
+	}
+	if config.Coverage != "" && config.CoverageELF == "" {
+		log.Fatalf("-coverage needs -coverage-elf\n")
+	}
+	if config.Harts < 1 || config.Harts > 32 {
+		log.Fatalf("-harts must be between 1 and 32\n")
+	}
+	// They follow a single instruction stream
+	if config.Harts > 1 && (config.Gdb != "" || config.Lockstep != "" || config.Record != "" || config.Replay != "" || config.Reverse) {
+		log.Fatalf("-gdb, -lockstep, -record, -replay and -reverse need a single hart\n")
+	}
+	if config.Reverse && config.Gdb == "" {
+		log.Fatalf("-reverse needs -gdb\n")
+	}
+	// Both are written as the run goes and can't follow it back
+	if config.Reverse && (config.Record != "" || config.Lockstep != "") {
+		log.Fatalf("-reverse can't be used with -record or -lockstep\n")
+	}
+	if *snapshotPC != "" {
+		if _, err := fmt.Sscanf(*snapshotPC, "%x", &config.SnapshotPC); err != nil {
+			log.Fatalf("Invalid -snapshot-pc: %s\n", err)
+		}
+	}
+	for _, mode := range strings.Split(*traceModes, ",") {
+		switch mode {
+		case "":
+		case "u":
+			config.TraceFilter.Modes |= 1 << 0
+		case "s":
+			config.TraceFilter.Modes |= 1 << 1
+		case "m":
+			config.TraceFilter.Modes |= 1 << 3
+		default:
+			log.Fatalf("Invalid -trace-modes: unknown mode %q\n", mode)
+		}
+	}
+	for _, at := range strings.Split(*screenshotAt, ",") {
+		if at == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(at, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid -screenshot-at: %s\n", err)
+		}
+		config.ScreenshotAt = append(config.ScreenshotAt, n)
+	}
+	if config.VideoFPS < 0 {
+		log.Fatalf("-video-fps can't be negative\n")
+	}
+	if config.TerminalFPS < 0 {
+		log.Fatalf("-terminal-fps can't be negative\n")
+	}
+	if *rtcStart != "" {
+		t, err := time.Parse(time.RFC3339, *rtcStart)
+		if err != nil {
+			log.Fatalf("Invalid -rtc-start: %s\n", err)
+		}
+		config.RTCStart = t
+	}
+
+	emu := emulator.NewEmulator(config)
+	os.Exit(emu.Run())
 }